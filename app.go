@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/backup"
+	"github.com/blreynolds4/photopi-api/catalog"
+	"github.com/blreynolds4/photopi-api/certs"
+	"github.com/blreynolds4/photopi-api/config"
+	"github.com/blreynolds4/photopi-api/events"
+	"github.com/blreynolds4/photopi-api/frames"
+	"github.com/blreynolds4/photopi-api/framesync"
+	"github.com/blreynolds4/photopi-api/idempotency"
+	"github.com/blreynolds4/photopi-api/ingest"
+	"github.com/blreynolds4/photopi-api/invites"
+	"github.com/blreynolds4/photopi-api/mailbox"
+	"github.com/blreynolds4/photopi-api/naming"
+	"github.com/blreynolds4/photopi-api/player"
+	"github.com/blreynolds4/photopi-api/ratelimit"
+	"github.com/blreynolds4/photopi-api/schedule"
+	"github.com/blreynolds4/photopi-api/stager"
+	"github.com/blreynolds4/photopi-api/tus"
+	"github.com/blreynolds4/photopi-api/users"
+	"github.com/blreynolds4/photopi-api/webhooks"
+	"github.com/unrolled/render"
+)
+
+// settings are what the service is configured with
+type settings struct {
+	env         string // LOCAL, DEV, STG, PRD
+	bind        string // address to listen on, all of them when empty
+	port        string // server traffic on this port
+	version     string // path to VERSION file
+	tagName     string // tag files are uploaded in
+	photosPath  string // get the location to save files
+	uiPath      string // get the location of the ui app
+	framePath   string // get the location of the web player
+	showPath    string
+	dataPath    string // service state such as webhooks
+	archivePath string // photos rotated out of the slideshow
+	stateFile   string // blank/wake state for the display process
+	nowFile     string // photo on screen for external viewers
+	capacity    stager.Capacity
+	inbox       ingest.InboxOptions
+	limits      ingest.Limits
+	downloads   ingest.DownloadOptions
+	mail        mailbox.Options
+	auth        authSettings
+	nameFormat  string // how photos are named from the date they were taken
+	backup      backup.Options
+	frames      []frames.Config // frames besides the default one
+	tls         tlsSettings
+	web         webSettings
+}
+
+// settingsFromConfig turns the checked config into what the service
+// starts with
+func settingsFromConfig(c config.Config) (settings, error) {
+	s := settings{
+		env:         c.Server.Env,
+		bind:        c.Server.Bind,
+		port:        strconv.Itoa(c.Server.Port),
+		version:     c.Server.VersionFile,
+		tagName:     c.Server.UploadTag,
+		photosPath:  c.Paths.Photos,
+		uiPath:      c.Paths.UI,
+		framePath:   c.Paths.Frame,
+		showPath:    c.Paths.Show,
+		dataPath:    c.Paths.Data,
+		archivePath: c.Paths.Archive,
+		stateFile:   c.Paths.DisplayState,
+		nowFile:     c.Paths.PlaybackState,
+		nameFormat:  c.Naming.Format,
+		backup:      backup.Options{Queue: c.Backup.Queue, Targets: c.Backup.Targets},
+		frames:      c.Frames,
+	}
+	if s.stateFile == "" {
+		s.stateFile = filepath.Join(s.dataPath, "display-state.json")
+	}
+	if s.nowFile == "" {
+		s.nowFile = filepath.Join(s.dataPath, "now-playing.json")
+	}
+
+	// slideshow capacity of the default frame, unset means unlimited
+	s.capacity = stager.Capacity{
+		MaxCount:    c.Stager.MaxCount,
+		MaxBytes:    c.Stager.MaxMB * 1024 * 1024,
+		Policy:      c.Stager.Policy,
+		KeepPinned:  c.Stager.KeepPinned,
+		ArchiveDir:  s.archivePath,
+		EvictionLog: filepath.Join(s.dataPath, "evictions.jsonl"),
+	}
+
+	// photos dropped in a watched folder are added like uploads
+	s.inbox = ingest.InboxOptions{Dir: c.Inbox.Path, KeepDir: c.Inbox.KeepPath, Interval: c.Inbox.Interval}
+
+	s.limits = ingest.DefaultLimits
+	s.limits.MaxPhotoBytes = c.Uploads.MaxPhotoMB * 1024 * 1024
+	s.limits.MaxArchiveBytes = c.Uploads.MaxArchiveMB * 1024 * 1024
+	s.limits.MaxEntries = c.Uploads.MaxArchivePhotos
+	s.downloads = ingest.DefaultDownloadOptions
+	s.downloads.Timeout = c.Uploads.ImportTimeout
+	s.downloads.AllowPrivate = c.Uploads.ImportAllowPrivate
+
+	// photos can be emailed to the frame too
+	s.mail = mailbox.Options{
+		Addr:       c.Mail.Addr,
+		Domain:     c.Mail.Domain,
+		Recipients: c.Mail.Recipients,
+		Senders:    c.Mail.Senders,
+		MaxBytes:   c.Mail.MaxMB * 1024 * 1024,
+		Timeout:    DEFAULT_SMTP_TIMEOUT,
+	}
+
+	// the route budgets given replace the defaults for those routes
+	given, err := ratelimit.ParseBudgets(c.Server.RateLimits)
+	if err != nil {
+		return s, fmt.Errorf("server.rate_limits: %s", err.Error())
+	}
+	s.auth = authSettings{required: c.Server.AuthRequired, limits: defaultRateLimits.Merge(given)}
+
+	// HTTPS is optional, a self-signed certificate is kept with the data
+	s.tls = tlsSettings{
+		redirect: c.Server.TLS.Redirect,
+		certs: certs.Options{
+			CertFile: c.Server.TLS.Cert,
+			KeyFile:  c.Server.TLS.Key,
+			Dir:      filepath.Join(s.dataPath, "tls"),
+			Hosts:    c.Server.TLS.Hosts,
+		},
+	}
+	if c.Server.TLS.Port != 0 {
+		s.tls.port = strconv.Itoa(c.Server.TLS.Port)
+	}
+	if len(s.tls.certs.Hosts) == 0 {
+		s.tls.certs.Hosts = []string{"localhost", "127.0.0.1", "::1"}
+		if hostname, err := os.Hostname(); err == nil && hostname != "" && hostname != "localhost" {
+			s.tls.certs.Hosts = append([]string{hostname, hostname + ".local"}, s.tls.certs.Hosts...)
+		}
+	}
+
+	// browsers are only let in from the right hosts and pages
+	s.web = webSettings{
+		allowedHosts:          c.Server.Web.AllowedHosts,
+		corsOrigins:           c.Server.Web.CORSOrigins,
+		contentSecurityPolicy: c.Server.Web.ContentSecurityPolicy,
+		frameOptions:          strings.ToUpper(c.Server.Web.FrameOptions),
+	}
+	proxies, err := c.Server.Web.Proxies()
+	if err != nil {
+		return s, fmt.Errorf("server.web.trusted_proxies: %s", err.Error())
+	}
+	s.web.trustedProxies = proxies
+	for _, method := range c.Server.Web.CORSMethods {
+		s.web.corsMethods = append(s.web.corsMethods, strings.ToUpper(method))
+	}
+	if s.env == local && len(s.web.corsOrigins) == 0 {
+		s.web.corsOrigins = []string{DEFAULT_UI_DEV_ORIGIN}
+	}
+	return s, nil
+}
+
+// startApp creates the directories and starts the services the handlers
+// use, the returned func stops them
+func startApp(s settings) (AppContext, func()) {
+	// create the photo, slideshow, data and archive paths if needed
+	for _, dir := range []struct{ name, path string }{
+		{"phtoto", s.photosPath},
+		{"slideshow", s.showPath},
+		{"data", s.dataPath},
+		{"archive", s.archivePath},
+	} {
+		if _, err := os.Stat(dir.path); os.IsNotExist(err) {
+			err := os.Mkdir(dir.path, 0744)
+			if err != nil {
+				fmt.Println("Unable to create", dir.name, "path ", dir.path)
+				os.Exit(1)
+			}
+		}
+	}
+
+	// create the event bus the pipeline reports through
+	bus := events.NewEventBus(DEFAULT_EVENT_BUFFER)
+
+	// catalog every photo in the slideshow and archive as it is staged
+	photos, err := catalog.NewJSONCatalog(filepath.Join(s.dataPath, "catalog.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// play the slideshow, frames and remote controls follow it
+	play, err := player.NewPlayer(filepath.Join(s.dataPath, "player.json"), s.nowFile,
+		filepath.Join(s.dataPath, "shown.json"), s.showPath, photos, bus)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// favourites are pinned in the slideshow and hidden photos kept out of it
+	// the least shown policy goes by what the player has shown
+	capacity := s.capacity
+	capacity.Pins = catalog.Flags{Catalog: photos}
+	capacity.Hidden = catalog.Flags{Catalog: photos}
+	capacity.History = play
+
+	// the default frame shows SHOW_PATH, any others are configured in the
+	// config file or frames.json, each frame stages its own photos and builds its slideshow from its own
+	// playlists
+	defaultFrame, err := frames.Start(frames.Config{Name: frames.Default, ShowDir: s.showPath, ArchiveDir: s.archivePath},
+		capacity, filepath.Join(s.dataPath, "selection.json"), photos, bus)
+	if err != nil {
+		log.Fatal(err)
+	}
+	configs, err := frames.Load(filepath.Join(s.dataPath, "frames.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	configs = append(append([]frames.Config{}, s.frames...), configs...)
+	if err := frames.Check(configs); err != nil {
+		log.Fatal(err)
+	}
+	others, err := frames.StartConfigured(configs, s.dataPath, capacity, photos, bus)
+	if err != nil {
+		log.Fatal(err)
+	}
+	allFrames := frames.NewFrames(photos, bus, defaultFrame, others...)
+	selector := defaultFrame.Selector
+
+	// create backup, it copies each photo to the backup targets and stages
+	// it in its frames
+	saver := backup.NewBackup(allFrames, s.backup, bus)
+	namer := naming.NewImageNamer(s.nameFormat)
+	indexer := catalog.NewIndexer(photos, bus, namer, allFrames.Dirs()...)
+
+	// uploads and the inbox share the naming, backup and staging pipeline
+	pipeline := ingest.NewPipeline(s.photosPath, namer, allFrames, photos, saver, bus)
+
+	// resumable uploads wait in PHOTOS_PATH until they are complete
+	uploads, err := tus.NewStore(filepath.Join(s.photosPath, ".tus"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// retried uploads get their original response for a day
+	replays, err := idempotency.NewStore(filepath.Join(s.dataPath, "idempotency.json"), 24*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// switch playlists and blank the display on a schedule
+	scheduler, err := schedule.NewScheduler(filepath.Join(s.dataPath, "schedule.json"), s.stateFile, selector, bus)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// who can sign in, uploads are attributed to them
+	accounts, err := users.NewStore(filepath.Join(s.dataPath, "users.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(accounts.List()) == 0 {
+		if s.auth.required {
+			fmt.Println("No one can sign in yet, add an admin with: photopi-api user add -admin <name>")
+		} else {
+			fmt.Println("No one has an account yet, anyone who can reach the server can add photos and change settings until an admin is added with: photopi-api user add -admin <name>")
+		}
+	}
+	// guests can add photos with an invite link instead
+	guests, err := invites.NewStore(filepath.Join(s.dataPath, "invites.json"), filepath.Join(s.dataPath, "invites.key"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// deliver pipeline events to webhook subscribers
+	hooks, err := webhooks.NewWebhooks(filepath.Join(s.dataPath, "webhooks.json"), bus, webhooks.DefaultOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// initialse application context
+	ctx := AppContext{
+		Render:       render.New(),
+		Env:          s.env,
+		Port:         s.port,
+		TagName:      s.tagName,
+		PhotoPath:    s.photosPath,
+		UIPath:       s.uiPath,
+		FramePath:    s.framePath,
+		ShowPath:     s.showPath,
+		DataPath:     s.dataPath,
+		Capacity:     capacity,
+		Stager:       allFrames,
+		Frames:       allFrames,
+		Hashes:       framesync.NewHashCache(),
+		PhotoSave:    saver,
+		Ingest:       pipeline,
+		Limits:       s.limits,
+		Uploads:      uploads,
+		Idempotency:  replays,
+		Downloader:   ingest.NewDownloader(s.downloads, s.limits),
+		Users:        accounts,
+		Invites:      guests,
+		AuthRequired: s.auth.required,
+		RateLimits:   s.auth.limits,
+		Events:       bus,
+		Webhooks:     hooks,
+		Catalog:      photos,
+		Selector:     selector,
+		Schedule:     scheduler,
+		Player:       play,
+	}
+
+	stop := func() {
+		play.Stop()
+		fmt.Println("Player stopped")
+		scheduler.Stop()
+		fmt.Println("Scheduler stopped")
+		// photos being backed up are staged before the frames stop
+		saver.Stop()
+		fmt.Println("Saver stopped")
+		allFrames.Stop()
+		fmt.Println("Frames stopped")
+		indexer.Stop()
+		fmt.Println("Indexer stopped")
+		hooks.Stop()
+		fmt.Println("Webhooks stopped")
+	}
+	return ctx, stop
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/invites"
+	"github.com/blreynolds4/photopi-api/users"
+	"github.com/urfave/negroni"
+)
+
+// the cookie a signed in browser sends and how long it lasts
+const sessionCookie = "photopi_session"
+const sessionLifetime = 30 * 24 * time.Hour
+
+// identity is who made a request, kept in the request's context, cookie
+// is true when the browser sent it on its own
+type identity struct {
+	user   users.User
+	token  users.Token
+	cookie bool
+}
+
+type identityKey struct{}
+
+// authenticate works out who is making each request from a bearer token or
+// the session cookie, a bad token is turned down but a stale cookie is
+// only ignored so the browser can sign in again
+func authenticate(ctx AppContext) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		if ctx.Users == nil {
+			next(w, req)
+			return
+		}
+
+		if header := req.Header.Get("Authorization"); header != "" {
+			secret := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+			user, token, err := ctx.Users.Authenticate(secret)
+			if !strings.HasPrefix(header, "Bearer ") || err != nil {
+				unauthorized(w, ctx, "Authorization must be a valid Bearer token")
+				return
+			}
+			next(w, withIdentity(req, identity{user: user, token: token}))
+			return
+		}
+
+		if cookie, err := req.Cookie(sessionCookie); err == nil {
+			if user, token, err := ctx.Users.Authenticate(cookie.Value); err == nil {
+				req = withIdentity(req, identity{user: user, token: token, cookie: true})
+			}
+		}
+		next(w, req)
+	}
+}
+
+func withIdentity(req *http.Request, id identity) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), identityKey{}, id))
+}
+
+// currentUser is the signed in user making the request
+func currentUser(req *http.Request) (users.User, bool) {
+	id, ok := req.Context().Value(identityKey{}).(identity)
+	return id.user, ok
+}
+
+// the header scripts send an invite link's token in
+const inviteHeader = "X-Invite-Token"
+
+type inviteKey struct{}
+
+// currentInvite is the invite a guest is adding photos with
+func currentInvite(req *http.Request) (invites.Invite, bool) {
+	invite, ok := req.Context().Value(inviteKey{}).(invites.Invite)
+	return invite, ok
+}
+
+// memberOrGuest also lets guests run fn with the invite link's token in
+// inviteHeader, or the invite query parameter for forms, it is checked
+// before anything is read
+func memberOrGuest(fn HandlerFunc) HandlerFunc {
+	signedIn := member(fn)
+	return func(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+		token := req.Header.Get(inviteHeader)
+		if token == "" {
+			token = req.URL.Query().Get("invite")
+		}
+		if token == "" || ctx.Invites == nil {
+			signedIn(w, req, ctx)
+			return
+		}
+		invite, err := ctx.Invites.Check(token)
+		if err != nil {
+			ctx.Render.JSON(w, http.StatusForbidden, Status{Status: "error", Message: err.Error()})
+			return
+		}
+		fn(w, req.WithContext(context.WithValue(req.Context(), inviteKey{}, invite)), ctx)
+	}
+}
+
+// member lets signed in users run fn, until someone has an account anyone
+// can unless AUTH_REQUIRED is on
+func member(fn HandlerFunc) HandlerFunc {
+	return requireRole(users.Member, false, fn)
+}
+
+// admin lets only admins run fn, until someone has an account anyone can
+// unless AUTH_REQUIRED is on
+func admin(fn HandlerFunc) HandlerFunc {
+	return requireRole(users.Admin, false, fn)
+}
+
+// account is for a user's own account, it always needs someone signed in
+func account(fn HandlerFunc) HandlerFunc {
+	return requireRole(users.Member, true, fn)
+}
+
+// accountAdmin manages other users, it always needs an admin signed in
+func accountAdmin(fn HandlerFunc) HandlerFunc {
+	return requireRole(users.Admin, true, fn)
+}
+
+func requireRole(role string, always bool, fn HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+		if !always && !signInRequired(ctx) {
+			fn(w, req, ctx)
+			return
+		}
+		user, ok := currentUser(req)
+		if !ok {
+			unauthorized(w, ctx, "Sign in or send a token to do this")
+			return
+		}
+		if !user.Can(role) {
+			ctx.Render.JSON(w, http.StatusForbidden, Status{Status: "error", Message: fmt.Sprintf("Only %ss can do this", role)})
+			return
+		}
+		fn(w, req, ctx)
+	}
+}
+
+// signInRequired is true with AUTH_REQUIRED on or once anyone has an
+// account, until then a new install stays open so it can be set up
+func signInRequired(ctx AppContext) bool {
+	return ctx.AuthRequired || (ctx.Users != nil && len(ctx.Users.List()) > 0)
+}
+
+func unauthorized(w http.ResponseWriter, ctx AppContext, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="photopi"`)
+	ctx.Render.JSON(w, http.StatusUnauthorized, Status{Status: "error", Message: message})
+}
+
+// uploaderFor is who photos in the request are attributed to, the signed
+// in user or else whoever the client says it is
+func uploaderFor(req *http.Request, given string) string {
+	if user, ok := currentUser(req); ok {
+		return user.Name
+	}
+	return strings.TrimSpace(given)
+}
@@ -2,7 +2,13 @@ package backup
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 
+	"github.com/blreynolds4/photopi-api/events"
 	"github.com/blreynolds4/photopi-api/stager"
 )
 
@@ -14,24 +20,51 @@ type PhotoBackup interface {
 	Stop()
 }
 
+// Target is somewhere every photo is copied to, such as a USB drive or a
+// mounted share
+type Target struct {
+	Name string `yaml:"name"`
+	Dir  string `yaml:"dir"`
+}
+
+// Options say how many photos can wait to be backed up and where they go
+type Options struct {
+	Queue   int
+	Targets []Target
+}
+
 type awsBackup struct {
 	stager   stager.PhotoStager
+	targets  []Target
 	saveChan chan string
+	events   events.Publisher
+	working  sync.WaitGroup
 }
 
-func NewAWSBackup(stager stager.PhotoStager, bufferSize int) PhotoBackup {
+func NewAWSBackup(stager stager.PhotoStager, bufferSize int, publisher events.Publisher) PhotoBackup {
+	return NewBackup(stager, Options{Queue: bufferSize}, publisher)
+}
+
+// NewBackup copies each photo to the targets before staging it, a target
+// that fails doesn't stop the photo being staged
+func NewBackup(stager stager.PhotoStager, options Options, publisher events.Publisher) PhotoBackup {
 	saver := awsBackup{
 		stager:   stager,
-		saveChan: make(chan string, bufferSize),
+		targets:  options.Targets,
+		saveChan: make(chan string, options.Queue),
+		events:   publisher,
 	}
 
+	saver.working.Add(1)
 	go func() {
-		for {
-			// more will be true if the
-			source, more := <-saver.saveChan
-			if more {
-				go saver.backupAndStage(source)
-			}
+		defer saver.working.Done()
+		// the loop ends once Stop closes the channel and it is empty
+		for source := range saver.saveChan {
+			saver.working.Add(1)
+			go func(source string) {
+				defer saver.working.Done()
+				saver.backupAndStage(source)
+			}(source)
 		}
 	}()
 
@@ -41,6 +74,13 @@ func NewAWSBackup(stager stager.PhotoStager, bufferSize int) PhotoBackup {
 func (a *awsBackup) backupAndStage(source string) {
 	// save the photo to aws
 	a.awsBackup((source))
+	for _, target := range a.targets {
+		if err := copyTo(source, target.Dir); err != nil {
+			fmt.Println("Unable to back up", source, "to", target.Name, "because", err.Error())
+			a.events.Publish(events.PhotoFailed, filepath.Base(source), map[string]string{"stage": "backup", "target": target.Name, "error": err.Error()})
+		}
+	}
+	a.events.Publish(events.PhotoBackedUp, filepath.Base(source), nil)
 
 	// add the photo to staging
 	a.stager.StagePhoto(source)
@@ -57,6 +97,45 @@ func (a *awsBackup) BackupPhoto(source string) error {
 	return nil
 }
 
+// Stop waits for the photos already handed over to be backed up and staged
 func (a *awsBackup) Stop() {
 	close(a.saveChan)
+	a.working.Wait()
+}
+
+// copyTo copies the photo into dir unless it is already there, it is
+// written under a temporary name first so a partial copy is never kept
+func copyTo(source, dir string) error {
+	destination := filepath.Join(dir, filepath.Base(source))
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if existing, err := os.Stat(destination); err == nil && existing.Size() == info.Size() {
+		return nil
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(dir, ".backup-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Chmod(0644)
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Rename(out.Name(), destination)
 }
@@ -0,0 +1,62 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/blreynolds4/photopi-api/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stagedPhotos struct {
+	lock   sync.Mutex
+	staged []string
+}
+
+func (s *stagedPhotos) StagePhoto(source string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.staged = append(s.staged, filepath.Base(source))
+	return nil
+}
+func (s *stagedPhotos) Sync(names []string, reason string) error { return nil }
+func (s *stagedPhotos) Unstage(name, reason string) error        { return nil }
+func (s *stagedPhotos) Restore(name string) error                { return nil }
+func (s *stagedPhotos) Stop()                                    {}
+
+type recorded struct {
+	lock  sync.Mutex
+	types []string
+}
+
+func (r *recorded) Publish(eventType, photo string, data interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.types = append(r.types, eventType)
+}
+
+func TestPhotosAreCopiedToEachTargetAndStaged(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "a.jpg")
+	require.Nil(t, ioutil.WriteFile(source, []byte("photo"), 0644))
+	usb := t.TempDir()
+	missing := filepath.Join(t.TempDir(), "unplugged")
+
+	staged := &stagedPhotos{}
+	bus := &recorded{}
+	saver := NewBackup(staged, Options{Queue: 2, Targets: []Target{{Name: "usb", Dir: usb}, {Name: "nas", Dir: missing}}}, bus)
+	require.Nil(t, saver.BackupPhoto(source))
+	saver.Stop()
+
+	data, err := ioutil.ReadFile(filepath.Join(usb, "a.jpg"))
+	require.Nil(t, err)
+	assert.Equal(t, "photo", string(data))
+	_, err = os.Stat(missing)
+	assert.True(t, os.IsNotExist(err))
+	// a target that isn't there doesn't keep the photo out of the slideshow
+	assert.Equal(t, []string{"a.jpg"}, staged.staged)
+	assert.Equal(t, []string{events.PhotoFailed, events.PhotoBackedUp}, bus.types)
+}
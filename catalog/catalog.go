@@ -0,0 +1,492 @@
+package catalog
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/naming"
+)
+
+// ErrNotFound is returned when the catalog has no photo with the name
+var ErrNotFound = errors.New("photo not found")
+
+// ErrAlbumNotFound is returned when the catalog has no album with the id
+var ErrAlbumNotFound = errors.New("album not found")
+
+// Photo is what the catalog knows about a single photo
+type Photo struct {
+	Name      string    `json:"name"`
+	Taken     time.Time `json:"taken"`
+	Added     time.Time `json:"added"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Caption   string    `json:"caption,omitempty"`
+	Uploader  string    `json:"uploader,omitempty"`
+	Favourite bool      `json:"favourite"`
+	Hidden    bool      `json:"hidden"`
+	Albums    []string  `json:"albums,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	Frames    []string  `json:"frames,omitempty"`
+}
+
+// Album groups photos, photos refer to albums by id
+type Album struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Created     time.Time `json:"created"`
+}
+
+// InAlbum is true when the photo belongs to album
+func (p Photo) InAlbum(album string) bool {
+	for _, a := range p.Albums {
+		if a == album {
+			return true
+		}
+	}
+	return false
+}
+
+// ForFrame is true when the photo was routed to frame, or to no frame in
+// particular which means every frame
+func (p Photo) ForFrame(frame string) bool {
+	if len(p.Frames) == 0 {
+		return true
+	}
+	for _, f := range p.Frames {
+		if f == frame {
+			return true
+		}
+	}
+	return false
+}
+
+// HasTag is true when the photo is tagged with tag, ignoring case
+func (p Photo) HasTag(tag string) bool {
+	for _, t := range p.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Flags answers the stager's questions about favourites and hidden photos
+// from the catalog, photos it doesn't know about are neither
+type Flags struct {
+	Catalog Catalog
+}
+
+// Pinned is true for favourites, they are never rotated out
+func (f Flags) Pinned(name string) bool {
+	p, err := f.Catalog.Get(name)
+	return err == nil && p.Favourite
+}
+
+// Hidden is true for photos that are kept but never shown
+func (f Flags) Hidden(name string) bool {
+	p, err := f.Catalog.Get(name)
+	return err == nil && p.Hidden
+}
+
+// Catalog stores photo metadata by photo file name and the albums
+// photos can be grouped into
+type Catalog interface {
+	Get(name string) (Photo, error)
+	Put(photo Photo) error
+	Update(name string, change func(*Photo) error) (Photo, error)
+	Rename(from, to string) error
+	Delete(name string) error
+	List() []Photo
+	Batch(change func() error) error
+
+	Albums() []Album
+	GetAlbum(id string) (Album, error)
+	FindAlbum(idOrName string) (Album, error)
+	AddAlbum(album Album) (Album, error)
+	UpdateAlbum(id string, change func(*Album) error) (Album, error)
+	DeleteAlbum(id string) error
+}
+
+// catalogFile is how the catalog is saved
+type catalogFile struct {
+	Photos []Photo `json:"photos"`
+	Albums []Album `json:"albums"`
+}
+
+type jsonCatalog struct {
+	lock     sync.Mutex
+	file     string
+	photos   map[string]Photo
+	albums   map[string]Album
+	batching int
+	dirty    bool
+}
+
+// NewJSONCatalog loads the catalog kept in file, creating it on first save
+func NewJSONCatalog(file string) (Catalog, error) {
+	c := jsonCatalog{
+		file:   file,
+		photos: make(map[string]Photo),
+		albums: make(map[string]Album),
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return &c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	saved := catalogFile{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		// catalogs from before albums are a plain list of photos
+		if err := json.Unmarshal(data, &saved.Photos); err != nil {
+			return nil, fmt.Errorf("reading catalog %s: %s", file, err.Error())
+		}
+	}
+	for _, p := range saved.Photos {
+		c.photos[p.Name] = p
+	}
+	for _, a := range saved.Albums {
+		c.albums[a.ID] = a
+	}
+	return &c, nil
+}
+
+func (c *jsonCatalog) Get(name string) (Photo, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	p, ok := c.photos[name]
+	if !ok {
+		return p, ErrNotFound
+	}
+	return p, nil
+}
+
+func (c *jsonCatalog) Put(photo Photo) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.photos[photo.Name] = photo
+	return c.save()
+}
+
+// Update applies change to the named photo and saves it, nothing is saved
+// if change returns an error
+func (c *jsonCatalog) Update(name string, change func(*Photo) error) (Photo, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	p, ok := c.photos[name]
+	if !ok {
+		return p, ErrNotFound
+	}
+	if err := change(&p); err != nil {
+		return c.photos[name], err
+	}
+	p.Name = name
+	c.photos[name] = p
+	return p, c.save()
+}
+
+func (c *jsonCatalog) Rename(from, to string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	p, ok := c.photos[from]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(c.photos, from)
+	p.Name = to
+	c.photos[to] = p
+	return c.save()
+}
+
+func (c *jsonCatalog) Delete(name string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.photos[name]; !ok {
+		return ErrNotFound
+	}
+	delete(c.photos, name)
+	return c.save()
+}
+
+// List returns every photo ordered by when it was taken
+func (c *jsonCatalog) List() []Photo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	result := make([]Photo, 0, len(c.photos))
+	for _, p := range c.photos {
+		result = append(result, p)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Taken.Equal(result[j].Taken) {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].Taken.Before(result[j].Taken)
+	})
+	return result
+}
+
+func (c *jsonCatalog) Albums() []Album {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	result := make([]Album, 0, len(c.albums))
+	for _, a := range c.albums {
+		result = append(result, a)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return strings.ToLower(result[i].Name) < strings.ToLower(result[j].Name)
+	})
+	return result
+}
+
+func (c *jsonCatalog) GetAlbum(id string) (Album, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	a, ok := c.albums[id]
+	if !ok {
+		return a, ErrAlbumNotFound
+	}
+	return a, nil
+}
+
+// FindAlbum looks an album up by id and then by name, ignoring case
+func (c *jsonCatalog) FindAlbum(idOrName string) (Album, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if a, ok := c.albums[idOrName]; ok {
+		return a, nil
+	}
+	for _, a := range c.albums {
+		if strings.EqualFold(a.Name, idOrName) {
+			return a, nil
+		}
+	}
+	return Album{}, ErrAlbumNotFound
+}
+
+// AddAlbum creates an album with a new id, album names must be unique
+func (c *jsonCatalog) AddAlbum(album Album) (Album, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.checkAlbumName("", album.Name); err != nil {
+		return album, err
+	}
+	album.ID = newID()
+	album.Created = time.Now()
+	c.albums[album.ID] = album
+	return album, c.save()
+}
+
+func (c *jsonCatalog) UpdateAlbum(id string, change func(*Album) error) (Album, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	a, ok := c.albums[id]
+	if !ok {
+		return a, ErrAlbumNotFound
+	}
+	if err := change(&a); err != nil {
+		return c.albums[id], err
+	}
+	if err := c.checkAlbumName(id, a.Name); err != nil {
+		return c.albums[id], err
+	}
+	a.ID = id
+	c.albums[id] = a
+	return a, c.save()
+}
+
+// DeleteAlbum removes the album and takes its photos out of it, the
+// photos themselves are kept
+func (c *jsonCatalog) DeleteAlbum(id string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.albums[id]; !ok {
+		return ErrAlbumNotFound
+	}
+	delete(c.albums, id)
+
+	for name, p := range c.photos {
+		if p.InAlbum(id) {
+			albums := []string{}
+			for _, a := range p.Albums {
+				if a != id {
+					albums = append(albums, a)
+				}
+			}
+			p.Albums = albums
+			c.photos[name] = p
+		}
+	}
+	return c.save()
+}
+
+// Batch runs change holding back every save until it returns and then
+// saves once, so adding a whole library doesn't rewrite the catalog for
+// each photo, changes made meanwhile by anyone else are held back too
+func (c *jsonCatalog) Batch(change func() error) error {
+	c.lock.Lock()
+	c.batching = c.batching + 1
+	c.lock.Unlock()
+
+	err := change()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.batching = c.batching - 1
+	if c.batching > 0 || !c.dirty {
+		return err
+	}
+	c.dirty = false
+	if saveErr := c.save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// checkAlbumName makes sure no other album has the name, the lock must be held
+func (c *jsonCatalog) checkAlbumName(id, name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("albums need a name")
+	}
+	for _, a := range c.albums {
+		if a.ID != id && strings.EqualFold(a.Name, name) {
+			return fmt.Errorf("there is already an album called %s", a.Name)
+		}
+	}
+	return nil
+}
+
+// save writes the catalog out, or marks it to be written when a batch
+// ends, the lock must be held
+func (c *jsonCatalog) save() error {
+	if c.batching > 0 {
+		c.dirty = true
+		return nil
+	}
+
+	saved := catalogFile{
+		Photos: make([]Photo, 0, len(c.photos)),
+		Albums: make([]Album, 0, len(c.albums)),
+	}
+	for _, p := range c.photos {
+		saved.Photos = append(saved.Photos, p)
+	}
+	sort.Slice(saved.Photos, func(i, j int) bool {
+		return saved.Photos[i].Name < saved.Photos[j].Name
+	})
+	for _, a := range c.albums {
+		saved.Albums = append(saved.Albums, a)
+	}
+	sort.Slice(saved.Albums, func(i, j int) bool {
+		return saved.Albums[i].Created.Before(saved.Albums[j].Created)
+	})
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write then rename so a crash never leaves half a catalog
+	tmp := c.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.file)
+}
+
+// PhotoFromFile builds the catalog entry for a photo on disk, the time it
+// was taken comes from the name namer gave it and its hash finds copies of it
+func PhotoFromFile(file string, namer naming.ImageNamer) (Photo, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return Photo{}, err
+	}
+
+	sum, err := HashFile(file)
+	if err != nil {
+		return Photo{}, err
+	}
+
+	name := filepath.Base(file)
+	return Photo{
+		Name:   name,
+		Taken:  TakenFromName(namer, name, info.ModTime()),
+		Added:  info.ModTime(),
+		Size:   info.Size(),
+		SHA256: sum,
+	}, nil
+}
+
+// NormalizeTags trims tags and drops blanks and duplicates, keeping the
+// first spelling of each
+func NormalizeTags(tags []string) []string {
+	result := []string{}
+	seen := make(map[string]bool)
+	for _, t := range tags {
+		t = strings.TrimSpace(t)
+		key := strings.ToLower(t)
+		if t == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, t)
+	}
+	return result
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// TakenFromName reads the time at the start of a photo name in namer's
+// format, names namer didn't make use fallback
+func TakenFromName(namer naming.ImageNamer, name string, fallback time.Time) time.Time {
+	if t, ok := namer.TimeOf(name); ok {
+		return t
+	}
+	return fallback
+}
+
+// HashFile returns the hex sha256 of a file's contents
+func HashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,111 @@
+package catalog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/naming"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAlbumsArePersistedWithPhotos(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "catalog.json")
+	c, err := NewJSONCatalog(file)
+	require.Nil(t, err)
+
+	xmas, err := c.AddAlbum(Album{Name: "Christmas 2024"})
+	require.Nil(t, err)
+	_, err = c.AddAlbum(Album{Name: "christmas 2024"})
+	assert.NotNil(t, err, "album names are unique ignoring case")
+
+	require.Nil(t, c.Put(Photo{Name: "a.jpg", Albums: []string{xmas.ID}, Tags: []string{"Kids"}}))
+
+	reloaded, err := NewJSONCatalog(file)
+	require.Nil(t, err)
+	found, err := reloaded.FindAlbum("CHRISTMAS 2024")
+	require.Nil(t, err)
+	assert.Equal(t, xmas.ID, found.ID)
+
+	photo, err := reloaded.Get("a.jpg")
+	require.Nil(t, err)
+	assert.True(t, photo.InAlbum(xmas.ID))
+	assert.True(t, photo.HasTag("kids"))
+
+	// deleting the album keeps the photo
+	require.Nil(t, reloaded.DeleteAlbum(xmas.ID))
+	photo, err = reloaded.Get("a.jpg")
+	require.Nil(t, err)
+	assert.Empty(t, photo.Albums)
+	assert.Equal(t, ErrAlbumNotFound, reloaded.DeleteAlbum(xmas.ID))
+}
+
+func TestBatchSavesOnce(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "catalog.json")
+	c, err := NewJSONCatalog(file)
+	require.Nil(t, err)
+
+	err = c.Batch(func() error {
+		for _, name := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+			require.Nil(t, c.Put(Photo{Name: name}))
+		}
+		_, err := c.Update("b.jpg", func(p *Photo) error {
+			p.Favourite = true
+			return nil
+		})
+		require.Nil(t, err)
+
+		// nothing is written until the batch ends
+		_, statErr := os.Stat(file)
+		assert.True(t, os.IsNotExist(statErr))
+		return nil
+	})
+	require.Nil(t, err)
+
+	reloaded, err := NewJSONCatalog(file)
+	require.Nil(t, err)
+	assert.Len(t, reloaded.List(), 3)
+	photo, err := reloaded.Get("b.jpg")
+	require.Nil(t, err)
+	assert.True(t, photo.Favourite)
+}
+
+func TestLoadsCatalogWithoutAlbums(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "catalog.json")
+	require.Nil(t, ioutil.WriteFile(file, []byte(`[{"name":"old.jpg","size":10}]`), 0644))
+
+	c, err := NewJSONCatalog(file)
+	require.Nil(t, err)
+	photo, err := c.Get("old.jpg")
+	require.Nil(t, err)
+	assert.Equal(t, int64(10), photo.Size)
+	assert.Empty(t, c.Albums())
+}
+
+func TestTakenFromName(t *testing.T) {
+	fallback := time.Now()
+	namer := naming.NewExifImageNamer()
+	taken := TakenFromName(namer, "2005-12-31-09-08-07_2.jpg", fallback)
+	assert.Equal(t, time.Date(2005, time.December, 31, 9, 8, 7, 0, time.Local), taken)
+	assert.Equal(t, fallback, TakenFromName(namer, "IMG_0001.jpg", fallback))
+}
+
+func TestTakenFromNameInTheConfiguredFormat(t *testing.T) {
+	fallback := time.Now()
+	namer := naming.NewImageNamer("20060102_150405")
+	taken := TakenFromName(namer, "20051231_090807.jpg", fallback)
+	assert.Equal(t, time.Date(2005, time.December, 31, 9, 8, 7, 0, time.Local), taken)
+	assert.Equal(t, fallback, TakenFromName(namer, "2005-12-31-09-08-07.jpg", fallback))
+
+	// a format without the time of day gives midnight
+	namer = naming.NewImageNamer("2006-01-02")
+	taken = TakenFromName(namer, "2005-12-31_3.jpg", fallback)
+	assert.Equal(t, time.Date(2005, time.December, 31, 0, 0, 0, 0, time.Local), taken)
+}
+
+func TestNormalizeTags(t *testing.T) {
+	assert.Equal(t, []string{"Kids", "beach"}, NormalizeTags([]string{" Kids", "", "kids", "beach "}))
+}
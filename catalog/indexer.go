@@ -0,0 +1,171 @@
+package catalog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/blreynolds4/photopi-api/events"
+	"github.com/blreynolds4/photopi-api/naming"
+)
+
+// Indexer keeps the catalog in step with the photos the pipeline stages
+type Indexer interface {
+	Stop()
+}
+
+// renamed is event data from a stager that moved a photo under a new name
+type renamed interface {
+	RenamedFrom() string
+}
+
+type eventIndexer struct {
+	catalog Catalog
+	namer   naming.ImageNamer
+	dirs    []string
+	done    chan bool
+}
+
+// NewIndexer adds any photos in dirs the catalog doesn't know about, hashes
+// those cataloged without one and then catalogs each photo as the stager
+// publishes it, reading when each was taken from the name namer gave it
+func NewIndexer(catalog Catalog, bus events.EventBus, namer naming.ImageNamer, dirs ...string) Indexer {
+	indexer := eventIndexer{
+		catalog: catalog,
+		namer:   namer,
+		dirs:    dirs,
+		done:    make(chan bool),
+	}
+
+	// subscribe before scanning so nothing staged meanwhile is missed
+	sub := bus.Subscribe(0)
+	indexer.scan()
+
+	go func() {
+		defer func() {
+			sub.Close()
+		}()
+		for {
+			select {
+			case <-indexer.done:
+				return
+			case e, more := <-sub.Events():
+				if !more {
+					// fell behind, catch up from the directories instead
+					sub = bus.Subscribe(0)
+					indexer.scan()
+					continue
+				}
+				switch e.Type {
+				case events.PhotoStaged:
+					indexer.staged(e)
+				case events.PhotoArchived:
+					indexer.archived(e)
+				}
+			}
+		}
+	}()
+
+	return &indexer
+}
+
+// scan catalogs the photos in the directories in one batch
+func (i *eventIndexer) scan() {
+	err := i.catalog.Batch(func() error {
+		i.scanDirs()
+		return nil
+	})
+	if err != nil {
+		fmt.Println("Unable to save the catalog because", err.Error())
+	}
+}
+
+func (i *eventIndexer) scanDirs() {
+	for _, dir := range i.dirs {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			fmt.Println("Unable to index", dir, "because", err.Error())
+			continue
+		}
+
+		for _, info := range infos {
+			if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+				continue
+			}
+			file := filepath.Join(dir, info.Name())
+			if photo, err := i.catalog.Get(info.Name()); err == nil {
+				if photo.SHA256 == "" {
+					i.hash(file)
+				}
+				continue
+			}
+			i.add(file)
+		}
+	}
+}
+
+func (i *eventIndexer) staged(e events.Event) {
+	// the stager renames photos that collide, carry over what was
+	// recorded under the name it was uploaded with
+	if data, ok := e.Data.(map[string]string); ok {
+		source := data["source"]
+		if source != "" && source != e.Photo {
+			if err := i.catalog.Rename(source, e.Photo); err == nil {
+				return
+			}
+		}
+	}
+
+	if _, err := i.catalog.Get(e.Photo); err == nil {
+		return
+	}
+	for _, dir := range i.dirs {
+		file := filepath.Join(dir, e.Photo)
+		if _, err := os.Stat(file); err == nil {
+			i.add(file)
+			return
+		}
+	}
+}
+
+// archived carries the catalog entry over when a photo had to be renamed
+// as it was archived
+func (i *eventIndexer) archived(e events.Event) {
+	r, ok := e.Data.(renamed)
+	if !ok || r.RenamedFrom() == "" {
+		return
+	}
+	if err := i.catalog.Rename(r.RenamedFrom(), e.Photo); err != nil {
+		fmt.Println("Unable to catalog", r.RenamedFrom(), "as", e.Photo, "because", err.Error())
+	}
+}
+
+func (i *eventIndexer) add(file string) {
+	photo, err := PhotoFromFile(file, i.namer)
+	if err == nil {
+		err = i.catalog.Put(photo)
+	}
+	if err != nil {
+		fmt.Println("Unable to catalog", file, "because", err.Error())
+	}
+}
+
+// hash records the hash of a photo cataloged before hashes were recorded
+func (i *eventIndexer) hash(file string) {
+	sum, err := HashFile(file)
+	if err == nil {
+		_, err = i.catalog.Update(filepath.Base(file), func(p *Photo) error {
+			p.SHA256 = sum
+			return nil
+		})
+	}
+	if err != nil {
+		fmt.Println("Unable to hash", file, "because", err.Error())
+	}
+}
+
+func (i *eventIndexer) Stop() {
+	close(i.done)
+}
@@ -0,0 +1,166 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// how long a generated certificate lasts and how close to expiring it can
+// get before a new one is made
+const (
+	lifetime = 825 * 24 * time.Hour
+	renewal  = 30 * 24 * time.Hour
+)
+
+// names of the generated certificate and key in Dir
+const (
+	certName = "selfsigned.crt"
+	keyName  = "selfsigned.key"
+)
+
+// Options say where the server's certificate comes from, CertFile and
+// KeyFile when they are given, otherwise a self-signed certificate for
+// Hosts kept in Dir
+type Options struct {
+	CertFile string
+	KeyFile  string
+	Dir      string
+	Hosts    []string
+}
+
+// Files returns the certificate and key to serve with, a self-signed
+// certificate is made when there isn't one yet, it is about to expire or it
+// doesn't cover all the hosts
+func Files(options Options) (string, string, error) {
+	if options.CertFile != "" || options.KeyFile != "" {
+		if options.CertFile == "" || options.KeyFile == "" {
+			return "", "", errors.New("a certificate and its key are both needed")
+		}
+		return options.CertFile, options.KeyFile, nil
+	}
+	if len(options.Hosts) == 0 {
+		return "", "", errors.New("a self-signed certificate needs at least one host")
+	}
+
+	certFile := filepath.Join(options.Dir, certName)
+	keyFile := filepath.Join(options.Dir, keyName)
+	if cert, err := readCert(certFile); err == nil && covers(cert, options.Hosts, time.Now()) {
+		if _, err := os.Stat(keyFile); err == nil {
+			return certFile, keyFile, nil
+		}
+	}
+
+	fmt.Println("Making a self-signed certificate for", strings.Join(options.Hosts, ", "))
+	if err := os.MkdirAll(options.Dir, 0700); err != nil {
+		return "", "", err
+	}
+	certPEM, keyPEM, err := selfSigned(options.Hosts, time.Now())
+	if err != nil {
+		return "", "", err
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return "", "", err
+	}
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// Pool trusts the certificates in a PEM file, such as a hub's self-signed
+// certificate, as well as the system's
+func Pool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", file)
+	}
+	return pool, nil
+}
+
+// covers is true when the certificate is good for a while yet and names
+// every host
+func covers(cert *x509.Certificate, hosts []string, now time.Time) bool {
+	if now.Add(renewal).After(cert.NotAfter) {
+		return false
+	}
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func readCert(file string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate in %s", file)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// selfSigned makes a certificate that can also be trusted as its own
+// authority, which is what clients that import it expect
+func selfSigned(hosts []string, now time.Time) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0], Organization: []string{"photopi"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(lifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
@@ -0,0 +1,66 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfSignedCertificatesAreKeptUntilTheyNeedChanging(t *testing.T) {
+	dir := t.TempDir()
+	options := Options{Dir: dir, Hosts: []string{"photopi.local", "127.0.0.1"}}
+
+	certFile, keyFile, err := Files(options)
+	require.Nil(t, err)
+	_, err = tls.LoadX509KeyPair(certFile, keyFile)
+	require.Nil(t, err)
+	first, err := ioutil.ReadFile(certFile)
+	require.Nil(t, err)
+
+	// a client that trusts the file trusts the server
+	pool, err := Pool(certFile)
+	require.Nil(t, err)
+	cert, err := readCert(certFile)
+	require.Nil(t, err)
+	_, err = cert.Verify(x509.VerifyOptions{Roots: pool, DNSName: "photopi.local"})
+	assert.Nil(t, err)
+	assert.Nil(t, cert.VerifyHostname("127.0.0.1"))
+
+	// the same certificate is used on the next start
+	_, _, err = Files(options)
+	require.Nil(t, err)
+	again, _ := ioutil.ReadFile(certFile)
+	assert.Equal(t, first, again)
+
+	// and a new one made for a new host or when it is about to expire
+	options.Hosts = append(options.Hosts, "frame.example.com")
+	_, _, err = Files(options)
+	require.Nil(t, err)
+	changed, _ := ioutil.ReadFile(certFile)
+	assert.NotEqual(t, first, changed)
+	cert, err = readCert(certFile)
+	require.Nil(t, err)
+	assert.Nil(t, cert.VerifyHostname("frame.example.com"))
+	assert.True(t, covers(cert, options.Hosts, time.Now()))
+	assert.False(t, covers(cert, options.Hosts, cert.NotAfter.Add(-24*time.Hour)))
+}
+
+func TestGivenCertificatesAreUsedAsTheyAre(t *testing.T) {
+	certFile, keyFile, err := Files(Options{CertFile: "server.crt", KeyFile: "server.key", Hosts: []string{"ignored"}})
+	require.Nil(t, err)
+	assert.Equal(t, "server.crt", certFile)
+	assert.Equal(t, "server.key", keyFile)
+
+	_, _, err = Files(Options{CertFile: "server.crt"})
+	assert.Error(t, err)
+	_, _, err = Files(Options{Dir: t.TempDir()})
+	assert.Error(t, err)
+	_, err = Pool(filepath.Join(t.TempDir(), "missing.crt"))
+	assert.Error(t, err)
+}
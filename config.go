@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/blreynolds4/photopi-api/config"
+	"gopkg.in/yaml.v3"
+)
+
+// DEFAULT_CONFIG_FILE is read when it exists and CONFIG doesn't name another
+const DEFAULT_CONFIG_FILE string = "./photopi.yaml"
+
+// configFile is the file named by CONFIG, or the default one when it is
+// there, an empty name means no file and only the environment is used
+func configFile() string {
+	if file := os.Getenv("CONFIG"); file != "" {
+		return file
+	}
+	if _, err := os.Stat(DEFAULT_CONFIG_FILE); err == nil {
+		return DEFAULT_CONFIG_FILE
+	}
+	return ""
+}
+
+// loadConfig reads the config file and environment and checks the result
+func loadConfig(file string) (config.Config, error) {
+	c, err := config.Load(file, os.LookupEnv)
+	if err != nil {
+		return c, err
+	}
+	return c, c.Validate()
+}
+
+// mustLoadConfig is the checked config for the server, its commands and
+// the frame client, it stops with every problem found when there are any
+func mustLoadConfig() config.Config {
+	file := configFile()
+	c, err := loadConfig(file)
+	if err != nil {
+		if file != "" {
+			log.Fatalf("%s is not valid:\n%s", file, err.Error())
+		}
+		log.Fatalf("the configuration is not valid:\n%s", err.Error())
+	}
+	return c
+}
+
+// loadSettings is what the server and its commands run with
+func loadSettings() settings {
+	s, err := settingsFromConfig(mustLoadConfig())
+	if err != nil {
+		log.Fatalf("the configuration is not valid:\n%s", err.Error())
+	}
+	return s
+}
+
+const configUsage = `Usage: photopi-api config check [file]
+
+  check [file]    check the config file, CONFIG or ./photopi.yaml by default,
+                  with the environment over it and print what the server
+                  and frame client would run with
+`
+
+// runConfig checks a config file before the server is started with it
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "check" || len(args) > 2 {
+		fmt.Fprint(os.Stderr, configUsage)
+		os.Exit(2)
+	}
+
+	file := configFile()
+	if len(args) == 2 {
+		file = args[1]
+	}
+	name := file
+	if name == "" {
+		name = "The environment"
+	}
+
+	c, err := loadConfig(file)
+	if err != nil {
+		fmt.Println(name, "is not valid:")
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	if c.Server.Env == local {
+		fmt.Println("Warning: server.env is LOCAL, it answers any host")
+		if len(c.Server.Web.CORSOrigins) == 0 {
+			fmt.Println("Warning: with server.env LOCAL pages from", DEFAULT_UI_DEV_ORIGIN, "can use the API")
+		}
+		if c.Server.Bind == "" {
+			fmt.Println("Warning: with server.env LOCAL and no server.bind only this machine can reach the server")
+		}
+	}
+	if c.Client.Hub != "" && c.Client.Token == "" {
+		fmt.Println("Warning: client.hub is set without client.token, the hub turns the frame client away once anyone has an account there")
+	}
+	if c.Client.Token != "" {
+		// the token is a password, don't print it
+		c.Client.Token = "(set)"
+	}
+	fmt.Println(name, "is valid, the server would run with:")
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		fmt.Println("Unable to show the config because", err.Error())
+		os.Exit(1)
+	}
+	encoder.Close()
+}
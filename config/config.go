@@ -0,0 +1,393 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/backup"
+	"github.com/blreynolds4/photopi-api/frames"
+	"github.com/blreynolds4/photopi-api/ingest"
+	"github.com/blreynolds4/photopi-api/naming"
+	"github.com/blreynolds4/photopi-api/ratelimit"
+	"github.com/blreynolds4/photopi-api/stager"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is how the service is set up, the defaults are read over by a
+// YAML file and then by the environment variables named in the env tags
+type Config struct {
+	Server  Server          `yaml:"server"`
+	Paths   Paths           `yaml:"paths"`
+	Naming  Naming          `yaml:"naming"`
+	Uploads Uploads         `yaml:"uploads"`
+	Inbox   Inbox           `yaml:"inbox"`
+	Mail    Mail            `yaml:"mail"`
+	Backup  Backup          `yaml:"backup"`
+	Stager  Stager          `yaml:"stager"`
+	Frames  []frames.Config `yaml:"frames"`
+	Client  Client          `yaml:"client"`
+}
+
+// Server is how the API is served, Env LOCAL only listens on localhost
+// unless Bind says where to listen, and answers any host
+type Server struct {
+	Env          string `yaml:"env" env:"ENV"`
+	Bind         string `yaml:"bind" env:"BIND"`
+	Port         int    `yaml:"port" env:"PORT"`
+	VersionFile  string `yaml:"version_file" env:"VERSION"`
+	UploadTag    string `yaml:"upload_tag" env:"UPLOAD_TAG"`
+	AuthRequired bool   `yaml:"auth_required" env:"AUTH_REQUIRED"`
+	RateLimits   string `yaml:"rate_limits" env:"RATE_LIMITS"`
+	TLS          TLS    `yaml:"tls"`
+	Web          Web    `yaml:"web"`
+}
+
+// TLS turns on HTTPS on Port, with Cert and Key or else a self-signed
+// certificate for Hosts
+type TLS struct {
+	Port     int      `yaml:"port" env:"TLS_PORT"`
+	Cert     string   `yaml:"cert" env:"TLS_CERT"`
+	Key      string   `yaml:"key" env:"TLS_KEY"`
+	Hosts    []string `yaml:"hosts" env:"TLS_HOSTS"`
+	Redirect bool     `yaml:"redirect" env:"TLS_REDIRECT"`
+}
+
+// Web says which hosts and pages browsers can use the service from
+type Web struct {
+	AllowedHosts          []string `yaml:"allowed_hosts" env:"ALLOWED_HOSTS"`
+	CORSOrigins           []string `yaml:"cors_origins" env:"CORS_ORIGINS"`
+	CORSMethods           []string `yaml:"cors_methods" env:"CORS_METHODS"`
+	ContentSecurityPolicy string   `yaml:"content_security_policy" env:"CONTENT_SECURITY_POLICY"`
+	FrameOptions          string   `yaml:"frame_options" env:"FRAME_OPTIONS"`
+	TrustedProxies        []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+}
+
+// Proxies are the trusted proxies' networks, an address on its own is a
+// network of one
+func (w Web) Proxies() ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, proxy := range w.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("%s is not an address or network", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not an address or network", proxy)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Paths are where photos and state are kept, the state files default to
+// the data directory
+type Paths struct {
+	Photos        string `yaml:"photos" env:"PHOTOS_PATH"`
+	UI            string `yaml:"ui" env:"UI_PATH"`
+	Frame         string `yaml:"frame" env:"FRAME_PATH"`
+	Show          string `yaml:"show" env:"SHOW_PATH"`
+	Data          string `yaml:"data" env:"DATA_PATH"`
+	Archive       string `yaml:"archive" env:"ARCHIVE_PATH"`
+	DisplayState  string `yaml:"display_state" env:"DISPLAY_STATE_FILE"`
+	PlaybackState string `yaml:"playback_state" env:"PLAYBACK_STATE_FILE"`
+}
+
+// Naming is how photos are named, Format is a Go time layout for the date
+// they were taken
+type Naming struct {
+	Format string `yaml:"format" env:"NAMING_FORMAT"`
+}
+
+// Uploads limits what can be added and how photos are fetched by URL
+type Uploads struct {
+	MaxPhotoMB         int64         `yaml:"max_photo_mb" env:"MAX_PHOTO_MB"`
+	MaxArchiveMB       int64         `yaml:"max_archive_mb" env:"MAX_ARCHIVE_MB"`
+	MaxArchivePhotos   int           `yaml:"max_archive_photos" env:"MAX_ARCHIVE_PHOTOS"`
+	ImportTimeout      time.Duration `yaml:"import_timeout" env:"IMPORT_TIMEOUT"`
+	ImportAllowPrivate bool          `yaml:"import_allow_private" env:"IMPORT_ALLOW_PRIVATE"`
+}
+
+// Inbox is a watched folder, it is off without a Path
+type Inbox struct {
+	Path     string        `yaml:"path" env:"INBOX_PATH"`
+	KeepPath string        `yaml:"keep_path" env:"INBOX_KEEP_PATH"`
+	Interval time.Duration `yaml:"interval" env:"INBOX_INTERVAL"`
+}
+
+// Mail is the SMTP server photos can be emailed to, it is off without an
+// Addr
+type Mail struct {
+	Addr       string   `yaml:"addr" env:"SMTP_ADDR"`
+	Domain     string   `yaml:"domain" env:"SMTP_DOMAIN"`
+	Recipients []string `yaml:"recipients" env:"SMTP_RECIPIENTS"`
+	Senders    []string `yaml:"senders" env:"SMTP_SENDERS"`
+	MaxMB      int64    `yaml:"max_mb" env:"SMTP_MAX_MB"`
+}
+
+// Backup is how many photos can wait to be backed up and where copies go
+type Backup struct {
+	Queue   int             `yaml:"queue" env:"BACKUP_QUEUE"`
+	Targets []backup.Target `yaml:"targets"`
+}
+
+// Stager limits the default frame's slideshow, other frames have their own
+type Stager struct {
+	MaxCount   int    `yaml:"max_count" env:"SHOW_MAX_COUNT"`
+	MaxMB      int64  `yaml:"max_mb" env:"SHOW_MAX_MB"`
+	Policy     string `yaml:"policy" env:"ROTATION_POLICY"`
+	KeepPinned bool   `yaml:"keep_pinned" env:"ROTATION_KEEP_PINNED"`
+}
+
+// Client is how photopi-api frame-client syncs a frame from a hub into
+// paths.show, Token is an API token from the hub, made with photopi-api
+// user token, and Cert is the hub's certificate when it is self-signed
+type Client struct {
+	Hub      string        `yaml:"hub" env:"HUB_URL"`
+	Frame    string        `yaml:"frame" env:"FRAME_NAME"`
+	Token    string        `yaml:"token" env:"HUB_TOKEN"`
+	Cert     string        `yaml:"cert" env:"HUB_CERT"`
+	Interval time.Duration `yaml:"interval" env:"SYNC_INTERVAL"`
+}
+
+// FileEnv is the env when a config file doesn't give one
+const FileEnv = "DEV"
+
+// Default is the setup with nothing configured
+func Default() Config {
+	return Config{
+		Server: Server{
+			Env:         "LOCAL",
+			Port:        8080,
+			VersionFile: "VERSION",
+			UploadTag:   "uploadImages",
+			Web: Web{
+				CORSMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"},
+				ContentSecurityPolicy: "default-src 'self'; img-src 'self' data: blob:; style-src 'self' 'unsafe-inline'; " +
+					"frame-ancestors 'self'; base-uri 'self'; form-action 'self'",
+				FrameOptions: "SAMEORIGIN",
+			},
+		},
+		Paths: Paths{
+			Photos:  "./piphotos",
+			UI:      "./ui/build",
+			Frame:   "./frame",
+			Show:    "./slideshow",
+			Data:    "./data",
+			Archive: "./archive",
+		},
+		Naming: Naming{Format: naming.DefaultFormat},
+		Uploads: Uploads{
+			MaxPhotoMB:       ingest.DefaultLimits.MaxPhotoBytes / (1024 * 1024),
+			MaxArchiveMB:     ingest.DefaultLimits.MaxArchiveBytes / (1024 * 1024),
+			MaxArchivePhotos: ingest.DefaultLimits.MaxEntries,
+			ImportTimeout:    ingest.DefaultDownloadOptions.Timeout,
+		},
+		Inbox:  Inbox{Interval: 10 * time.Second},
+		Mail:   Mail{MaxMB: 25},
+		Backup: Backup{Queue: 25},
+		Stager: Stager{KeepPinned: true},
+		Client: Client{Frame: frames.Default, Interval: 5 * time.Minute},
+	}
+}
+
+// Load reads file over the defaults, when it is given, and then the
+// environment, lookup is how variables are found, usually os.LookupEnv
+// keys the file doesn't know about are an error so typos aren't missed
+// a file is for a server others use, so with one the env isn't LOCAL
+// unless it says so
+func Load(file string, lookup func(string) (string, bool)) (Config, error) {
+	c := Default()
+	if file != "" {
+		c.Server.Env = FileEnv
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return c, err
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&c); err != nil && err != io.EOF {
+			return c, fmt.Errorf("%s: %s", file, err.Error())
+		}
+	}
+
+	problems := []string{}
+	applyEnv(reflect.ValueOf(&c).Elem(), lookup, &problems)
+	if len(problems) > 0 {
+		return c, errors.New(strings.Join(problems, "\n"))
+	}
+	return c, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// applyEnv sets each field with an env tag from its variable when that is
+// set, lists are comma separated
+func applyEnv(v reflect.Value, lookup func(string) (string, bool), problems *[]string) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		name := v.Type().Field(i).Tag.Get("env")
+		if name == "" {
+			if field.Kind() == reflect.Struct {
+				applyEnv(field, lookup, problems)
+			}
+			continue
+		}
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case field.Type() == durationType:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				*problems = append(*problems, fmt.Sprintf("%s must be a duration like 30s, not %s", name, value))
+				continue
+			}
+			field.SetInt(int64(d))
+		case field.Kind() == reflect.String:
+			field.SetString(value)
+		case field.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				*problems = append(*problems, fmt.Sprintf("%s must be true or false, not %s", name, value))
+				continue
+			}
+			field.SetBool(b)
+		case field.Kind() == reflect.Int || field.Kind() == reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				*problems = append(*problems, fmt.Sprintf("%s must be a number, not %s", name, value))
+				continue
+			}
+			field.SetInt(n)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+			list := []string{}
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+		}
+	}
+}
+
+// Validate checks everything and lists all the problems found, not just
+// the first
+func (c Config) Validate() error {
+	problems := []string{}
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	s := c.Server
+	check(s.Env != "", "server.env can't be empty")
+	check(s.Bind == "" || net.ParseIP(s.Bind) != nil || s.Bind == "localhost", "server.bind must be an address or localhost, not %s", s.Bind)
+	check(validPort(s.Port), "server.port must be between 1 and 65535, not %d", s.Port)
+	check(s.UploadTag != "", "server.upload_tag can't be empty")
+	if _, err := ratelimit.ParseBudgets(s.RateLimits); err != nil {
+		problems = append(problems, "server.rate_limits: "+err.Error())
+	}
+	if s.TLS.Port != 0 {
+		check(validPort(s.TLS.Port), "server.tls.port must be between 1 and 65535, not %d", s.TLS.Port)
+		check(s.TLS.Port != s.Port, "server.tls.port must be different to server.port")
+	}
+	check((s.TLS.Cert == "") == (s.TLS.Key == ""), "server.tls.cert and server.tls.key must be set together")
+	check(!s.TLS.Redirect || s.TLS.Port != 0, "server.tls.redirect needs server.tls.port")
+	for _, origin := range s.Web.CORSOrigins {
+		u, err := url.Parse(origin)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && strings.TrimSuffix(u.Path, "/") == "",
+			"server.web.cors_origins must be origins like http://localhost:8081, not %s", origin)
+	}
+	check(len(s.Web.CORSMethods) > 0, "server.web.cors_methods can't be empty")
+	frameOptions := strings.ToUpper(s.Web.FrameOptions)
+	check(frameOptions == "DENY" || frameOptions == "SAMEORIGIN", "server.web.frame_options must be DENY or SAMEORIGIN, not %s", s.Web.FrameOptions)
+	if _, err := s.Web.Proxies(); err != nil {
+		check(false, "server.web.trusted_proxies must be addresses or networks, %s", err.Error())
+	}
+
+	for _, path := range []struct{ name, value string }{
+		{"photos", c.Paths.Photos},
+		{"ui", c.Paths.UI},
+		{"frame", c.Paths.Frame},
+		{"show", c.Paths.Show},
+		{"data", c.Paths.Data},
+		{"archive", c.Paths.Archive},
+	} {
+		check(path.value != "", "paths.%s can't be empty", path.name)
+	}
+
+	if err := naming.ValidFormat(c.Naming.Format); err != nil {
+		problems = append(problems, "naming.format: "+err.Error())
+	}
+
+	check(c.Uploads.MaxPhotoMB > 0, "uploads.max_photo_mb must be more than 0")
+	check(c.Uploads.MaxArchiveMB > 0, "uploads.max_archive_mb must be more than 0")
+	check(c.Uploads.MaxArchivePhotos > 0, "uploads.max_archive_photos must be more than 0")
+	check(c.Uploads.ImportTimeout >= time.Second, "uploads.import_timeout must be at least a second, not %s", c.Uploads.ImportTimeout)
+
+	check(c.Inbox.Path == "" || c.Inbox.Interval >= time.Second, "inbox.interval must be at least a second, not %s", c.Inbox.Interval)
+	check(c.Inbox.KeepPath == "" || c.Inbox.Path != "", "inbox.keep_path needs inbox.path")
+	inbox := ingest.InboxOptions{Dir: c.Inbox.Path, KeepDir: c.Inbox.KeepPath}
+	check(!inbox.KeepsInside(), "inbox.keep_path can't be inbox.path or inside it, kept photos would be added again")
+
+	check(c.Mail.Addr == "" || len(c.Mail.Senders) > 0, "mail.senders must list who may email photos when mail.addr is set")
+	check(c.Mail.MaxMB > 0, "mail.max_mb must be more than 0")
+
+	check(c.Backup.Queue > 0, "backup.queue must be more than 0")
+	targets := make(map[string]bool)
+	for i, target := range c.Backup.Targets {
+		check(target.Name != "", "backup.targets[%d] needs a name", i)
+		check(target.Dir != "", "backup.targets[%d] needs a dir", i)
+		check(!targets[target.Name], "backup target %s is defined twice", target.Name)
+		targets[target.Name] = true
+	}
+
+	check(c.Stager.MaxCount >= 0, "stager.max_count can't be negative")
+	check(c.Stager.MaxMB >= 0, "stager.max_mb can't be negative")
+	check(stager.ValidPolicy(c.Stager.Policy), "stager.policy must be %s, %s or %s, not %s",
+		stager.OldestFirst, stager.LeastRecentlyShown, stager.RandomEviction, c.Stager.Policy)
+
+	if err := frames.Check(c.Frames); err != nil {
+		problems = append(problems, "frames: "+err.Error())
+	}
+
+	if c.Client.Hub != "" {
+		u, err := url.Parse(c.Client.Hub)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"client.hub must be a URL like https://photopi.local:8443, not %s", c.Client.Hub)
+	}
+	check(c.Client.Frame != "", "client.frame can't be empty")
+	check(c.Client.Interval >= time.Second, "client.interval must be at least a second, not %s", c.Client.Interval)
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
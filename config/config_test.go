@@ -0,0 +1,146 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/backup"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, text string) string {
+	file := filepath.Join(t.TempDir(), "photopi.yaml")
+	require.Nil(t, ioutil.WriteFile(file, []byte(text), 0644))
+	return file
+}
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+}
+
+func TestTheDefaultsAreValid(t *testing.T) {
+	c, err := Load("", env(nil))
+	require.Nil(t, err)
+	assert.Nil(t, c.Validate())
+	assert.Equal(t, Default(), c)
+
+	// an empty file changes nothing but the env, a file isn't LOCAL
+	c, err = Load(writeConfig(t, ""), env(nil))
+	require.Nil(t, err)
+	defaults := Default()
+	defaults.Server.Env = FileEnv
+	assert.Equal(t, defaults, c)
+	c, err = Load(writeConfig(t, "server:\n  env: LOCAL\n"), env(nil))
+	require.Nil(t, err)
+	assert.Equal(t, "LOCAL", c.Server.Env)
+}
+
+func TestTheEnvironmentOverridesTheFile(t *testing.T) {
+	file := writeConfig(t, `
+server:
+  env: dev
+  port: 8000
+  tls:
+    port: 8443
+    hosts: [photopi.local]
+paths:
+  photos: /home/pi/NewPictures
+  show: /home/pi/Pictures
+inbox:
+  path: /home/pi/Inbox
+  interval: 1m
+backup:
+  targets:
+    - name: usb
+      dir: /media/usb/photos
+stager:
+  policy: least-shown
+frames:
+  - name: kitchen
+    show_dir: /srv/kitchen
+    max_count: 200
+client:
+  hub: https://photopi.local:8443
+  frame: kitchen
+`)
+	c, err := Load(file, env(map[string]string{"PORT": "8080", "TLS_HOSTS": "photopi.local, 192.168.1.20", "ROTATION_KEEP_PINNED": "false",
+		"HUB_TOKEN": "secret", "SYNC_INTERVAL": "30s"}))
+	require.Nil(t, err)
+	require.Nil(t, c.Validate())
+
+	assert.Equal(t, "dev", c.Server.Env)
+	assert.Equal(t, 8080, c.Server.Port)
+	assert.Equal(t, []string{"photopi.local", "192.168.1.20"}, c.Server.TLS.Hosts)
+	assert.Equal(t, "/home/pi/NewPictures", c.Paths.Photos)
+	assert.Equal(t, "./data", c.Paths.Data)
+	assert.Equal(t, time.Minute, c.Inbox.Interval)
+	assert.Equal(t, []backup.Target{{Name: "usb", Dir: "/media/usb/photos"}}, c.Backup.Targets)
+	assert.Equal(t, "least-shown", c.Stager.Policy)
+	assert.False(t, c.Stager.KeepPinned)
+	require.Len(t, c.Frames, 1)
+	assert.Equal(t, "/srv/kitchen", c.Frames[0].ShowDir)
+	assert.Equal(t, 200, c.Frames[0].MaxCount)
+	assert.Equal(t, Client{Hub: "https://photopi.local:8443", Frame: "kitchen", Token: "secret", Interval: 30 * time.Second}, c.Client)
+}
+
+func TestMistakesAreExplained(t *testing.T) {
+	_, err := Load(writeConfig(t, "server:\n  prot: 8080\n"), env(nil))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 2: field prot not found")
+
+	_, err = Load("", env(map[string]string{"PORT": "eighty", "AUTH_REQUIRED": "maybe"}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "PORT must be a number, not eighty")
+	assert.Contains(t, err.Error(), "AUTH_REQUIRED must be true or false, not maybe")
+
+	c, err := Load(writeConfig(t, `
+server:
+  port: 70000
+  bind: photopi.local
+  rate_limits: "AddPhotos=lots"
+  tls:
+    cert: server.crt
+  web:
+    trusted_proxies: [10.0.0.1, 10.0.0.0/33]
+naming:
+  format: 2006/01/02
+inbox:
+  path: /home/pi/Inbox
+  keep_path: /home/pi/Inbox/kept
+mail:
+  addr: ":2525"
+stager:
+  policy: newest
+frames:
+  - name: Kitchen
+    show_dir: /srv/kitchen
+client:
+  hub: photopi.local
+  interval: 10ms
+`), env(nil))
+	require.Nil(t, err)
+	err = c.Validate()
+	require.Error(t, err)
+	for _, problem := range []string{
+		"server.port must be between 1 and 65535, not 70000",
+		"server.bind must be an address or localhost, not photopi.local",
+		"server.rate_limits: rate \"lots\" for AddPhotos",
+		"server.tls.cert and server.tls.key must be set together",
+		"server.web.trusted_proxies must be addresses or networks, 10.0.0.0/33",
+		"naming.format",
+		"inbox.keep_path can't be inbox.path or inside it",
+		"mail.senders must list who may email photos",
+		"stager.policy must be oldest, least-shown or random, not newest",
+		"frames: frame name \"Kitchen\"",
+		"client.hub must be a URL like https://photopi.local:8443, not photopi.local",
+		"client.interval must be at least a second, not 10ms",
+	} {
+		assert.Contains(t, err.Error(), problem)
+	}
+}
@@ -0,0 +1,175 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// event types published by the photo pipeline and slideshow
+const (
+	PhotoReceived    = "photo.received"
+	PhotoBackedUp    = "photo.backedup"
+	PhotoStaged      = "photo.staged"
+	PhotoTrashed     = "photo.trashed"
+	PhotoArchived    = "photo.archived"
+	PhotoFailed      = "photo.failed"
+	SlideshowChanged = "slideshow.changed"
+	DisplayChanged   = "display.changed"
+	PlayerChanged    = "player.changed"
+	PlaybackChanged  = "playback.changed"
+	// StreamReset tells a resuming client events it missed are gone and
+	// it has to reload its state
+	StreamReset = "stream.reset"
+)
+
+// subscriberBuffer is how many events a subscriber can fall behind
+// before it gets dropped and has to resume with its last event id
+const subscriberBuffer = 64
+
+// Event is a single typed notification about a photo or the slideshow
+type Event struct {
+	ID    uint64      `json:"id"`
+	Type  string      `json:"type"`
+	Photo string      `json:"photo,omitempty"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// Publisher is anything that can announce an event
+type Publisher interface {
+	Publish(eventType, photo string, data interface{})
+}
+
+// Subscription is a live feed of events from an EventBus
+// Replay holds the buffered events newer than the id the
+// subscription was started from, or a single StreamReset when some of
+// them have already fallen out of the buffer
+type Subscription interface {
+	Replay() []Event
+	Events() <-chan Event
+	Close()
+}
+
+// EventBus fans published events out to subscribers and keeps
+// the most recent ones in a ring buffer so clients can resume
+type EventBus interface {
+	Publisher
+	Subscribe(lastID uint64) Subscription
+}
+
+type ringBus struct {
+	lock   sync.Mutex
+	ring   []Event
+	next   int
+	count  int
+	lastID uint64
+	subs   map[*subscription]bool
+}
+
+// NewEventBus creates an event bus that remembers the last bufferSize events
+func NewEventBus(bufferSize int) EventBus {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+
+	return &ringBus{
+		ring: make([]Event, bufferSize),
+		subs: make(map[*subscription]bool),
+	}
+}
+
+func (b *ringBus) Publish(eventType, photo string, data interface{}) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.lastID = b.lastID + 1
+	e := Event{
+		ID:    b.lastID,
+		Type:  eventType,
+		Photo: photo,
+		Time:  time.Now(),
+		Data:  data,
+	}
+
+	b.ring[b.next] = e
+	b.next = (b.next + 1) % len(b.ring)
+	if b.count < len(b.ring) {
+		b.count = b.count + 1
+	}
+
+	for sub := range b.subs {
+		select {
+		case sub.events <- e:
+		default:
+			// the subscriber isn't keeping up, drop it so it
+			// reconnects and resumes from the ring buffer
+			delete(b.subs, sub)
+			close(sub.events)
+		}
+	}
+}
+
+func (b *ringBus) Subscribe(lastID uint64) Subscription {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	sub := &subscription{
+		bus:    b,
+		events: make(chan Event, subscriberBuffer),
+	}
+
+	// replay anything buffered after the last event the client saw, a zero
+	// id means a new client that only wants events from now on
+	start := (b.next - b.count + len(b.ring)) % len(b.ring)
+	if lastID > 0 && b.missed(lastID, start) {
+		// the ids don't line up, the oldest buffered event isn't the next
+		// one or the bus restarted since, so a replay would have a gap
+		sub.replay = []Event{{ID: b.lastID, Type: StreamReset, Time: time.Now()}}
+	} else if lastID > 0 {
+		for i := 0; i < b.count; i++ {
+			e := b.ring[(start+i)%len(b.ring)]
+			if e.ID > lastID {
+				sub.replay = append(sub.replay, e)
+			}
+		}
+	}
+
+	b.subs[sub] = true
+	return sub
+}
+
+// missed is true when events after lastID aren't all in the buffer
+func (b *ringBus) missed(lastID uint64, start int) bool {
+	if lastID > b.lastID {
+		return true
+	}
+	return b.count > 0 && b.ring[start].ID > lastID+1
+}
+
+func (b *ringBus) unsubscribe(sub *subscription) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.subs[sub] {
+		delete(b.subs, sub)
+		close(sub.events)
+	}
+}
+
+type subscription struct {
+	bus    *ringBus
+	replay []Event
+	events chan Event
+}
+
+func (s *subscription) Replay() []Event {
+	return s.replay
+}
+
+func (s *subscription) Events() <-chan Event {
+	return s.events
+}
+
+func (s *subscription) Close() {
+	s.bus.unsubscribe(s)
+}
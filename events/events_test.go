@@ -0,0 +1,86 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribeReceivesNewEvents(t *testing.T) {
+	bus := NewEventBus(4)
+	sub := bus.Subscribe(0)
+	defer sub.Close()
+
+	bus.Publish(PhotoReceived, "a.jpg", nil)
+
+	assert.Empty(t, sub.Replay())
+	e := <-sub.Events()
+	assert.Equal(t, uint64(1), e.ID)
+	assert.Equal(t, PhotoReceived, e.Type)
+	assert.Equal(t, "a.jpg", e.Photo)
+}
+
+func TestResumeReplaysFromRingBuffer(t *testing.T) {
+	bus := NewEventBus(3)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		bus.Publish(PhotoStaged, name, nil)
+	}
+
+	// only the last three events are kept
+	sub := bus.Subscribe(2)
+	defer sub.Close()
+	replay := sub.Replay()
+	require.Equal(t, 3, len(replay))
+	assert.Equal(t, uint64(3), replay[0].ID)
+	assert.Equal(t, uint64(5), replay[2].ID)
+
+	// resuming inside the buffer replays only what was missed
+	resumed := bus.Subscribe(4)
+	defer resumed.Close()
+	require.Equal(t, 1, len(resumed.Replay()))
+	assert.Equal(t, "e", resumed.Replay()[0].Photo)
+}
+
+func TestResumePastTheBufferIsReset(t *testing.T) {
+	bus := NewEventBus(3)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		bus.Publish(PhotoStaged, name, nil)
+	}
+
+	// event 2 has fallen out of the buffer
+	sub := bus.Subscribe(1)
+	defer sub.Close()
+	require.Equal(t, 1, len(sub.Replay()))
+	assert.Equal(t, StreamReset, sub.Replay()[0].Type)
+	assert.Equal(t, uint64(5), sub.Replay()[0].ID)
+
+	// an id from before a restart is newer than anything on the bus
+	restarted := bus.Subscribe(40)
+	defer restarted.Close()
+	require.Equal(t, 1, len(restarted.Replay()))
+	assert.Equal(t, StreamReset, restarted.Replay()[0].Type)
+
+	// a client that saw everything has nothing to replay
+	current := bus.Subscribe(5)
+	defer current.Close()
+	assert.Empty(t, current.Replay())
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	bus := NewEventBus(1)
+	sub := bus.Subscribe(0)
+
+	for i := 0; i <= subscriberBuffer; i++ {
+		bus.Publish(PhotoReceived, "x", nil)
+	}
+
+	count := 0
+	for range sub.Events() {
+		count = count + 1
+	}
+	assert.Equal(t, subscriberBuffer, count)
+
+	// closing after being dropped is safe
+	sub.Close()
+}
@@ -0,0 +1,125 @@
+// PhotoPi web player, shows the photo the server is playing full screen and
+// follows playback, player settings and the display over /events
+(function () {
+  'use strict';
+
+  var settings = null;
+  var current = null;
+
+  var stage = document.getElementById('stage');
+  var front = document.getElementById('front');
+  var back = document.getElementById('back');
+  var clock = document.getElementById('clock');
+  var caption = document.getElementById('caption');
+  var empty = document.getElementById('empty');
+  var blank = document.getElementById('blank');
+
+  function getJSON(url) {
+    return fetch(url, { cache: 'no-store' }).then(function (res) {
+      if (!res.ok) {
+        throw new Error(url + ' returned ' + res.status);
+      }
+      return res.json();
+    });
+  }
+
+  function describe(now) {
+    var parts = [];
+    if (now.caption) {
+      parts.push(now.caption);
+    }
+    var taken = new Date(now.taken);
+    if (!isNaN(taken.getTime()) && taken.getFullYear() > 1970) {
+      parts.push(taken.toLocaleDateString(undefined, { year: 'numeric', month: 'long', day: 'numeric' }));
+    }
+    if (now.uploader) {
+      parts.push('from ' + now.uploader);
+    }
+    return parts.join(' · ');
+  }
+
+  // show what the server says is playing, pausing and resuming don't
+  // change the photo so only a new photo is swapped in
+  function play(now) {
+    empty.classList.toggle('hidden', now.name !== '');
+    if (now.name === '') {
+      current = null;
+      front.classList.remove('showing');
+      caption.textContent = '';
+      return;
+    }
+    if (current && current.name === now.name && current.since === now.since) {
+      return;
+    }
+    current = now;
+
+    var img = back;
+    // park the hidden image back at the start without animating it
+    img.style.transition = 'none';
+    img.classList.remove('leaving');
+    void img.offsetWidth;
+    img.style.transition = '';
+    img.onload = function () {
+      back = front;
+      front = img;
+      back.classList.remove('showing');
+      back.classList.add('leaving');
+      front.classList.remove('leaving');
+      front.classList.add('showing');
+      caption.textContent = describe(now);
+    };
+    img.src = now.url;
+  }
+
+  function applySettings() {
+    stage.className = { fade: 'fade', slide: 'slide-in' }[settings.transition] || '';
+    stage.classList.toggle('fit-cover', settings.fit === 'cover');
+    clock.classList.toggle('hidden', !settings.clock);
+    caption.classList.toggle('hidden', !settings.captions);
+  }
+
+  function tick() {
+    clock.textContent = new Date().toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+  }
+
+  function load() {
+    return Promise.all([getJSON('/player'), getJSON('/slideshow/now'), getJSON('/display')])
+      .then(function (results) {
+        settings = results[0];
+        applySettings();
+        play(results[1]);
+        blank.classList.toggle('hidden', !results[2].blank);
+      });
+  }
+
+  // follow live changes, EventSource reconnects and resumes on its own
+  function listen() {
+    var source = new EventSource('/events?types=playback.changed,player.changed,display.changed');
+    source.addEventListener('playback.changed', function (e) {
+      play(JSON.parse(e.data).data);
+    });
+    source.addEventListener('player.changed', function (e) {
+      settings = JSON.parse(e.data).data;
+      applySettings();
+    });
+    source.addEventListener('display.changed', function (e) {
+      blank.classList.toggle('hidden', !JSON.parse(e.data).data.blank);
+    });
+    // catch up when the server no longer has everything missed while
+    // disconnected
+    source.addEventListener('stream.reset', function () {
+      load().catch(function (err) { console.error(err); });
+    });
+  }
+
+  tick();
+  setInterval(tick, 1000);
+
+  load()
+    .then(listen)
+    .catch(function (err) {
+      console.error(err);
+      // try again from the start if the server isn't up yet
+      setTimeout(function () { location.reload(); }, 10000);
+    });
+})();
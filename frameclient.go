@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/certs"
+	"github.com/blreynolds4/photopi-api/framesync"
+)
+
+// runFrameClient keeps paths.show in step with a frame on the hub that
+// client.hub in the config names
+func runFrameClient() {
+	c := mustLoadConfig()
+	if c.Client.Hub == "" {
+		log.Fatal("client.hub (HUB_URL) is needed to run as a frame client")
+	}
+	if c.Client.Token == "" {
+		fmt.Println("client.token (HUB_TOKEN) isn't set, the hub will turn the frame away once anyone has an account there")
+	}
+
+	options := framesync.Options{
+		Hub:      c.Client.Hub,
+		Frame:    c.Client.Frame,
+		ShowDir:  c.Paths.Show,
+		Token:    c.Client.Token,
+		Interval: c.Client.Interval,
+		Timeout:  time.Minute,
+	}
+	if c.Client.Cert != "" {
+		pool, err := certs.Pool(c.Client.Cert)
+		if err != nil {
+			log.Fatalf("client.cert must be a PEM certificate: %s", err.Error())
+		}
+		options.RootCAs = pool
+	}
+
+	if err := os.MkdirAll(options.ShowDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("===> Syncing frame " + options.Frame + " from " + options.Hub + " into " + options.ShowDir)
+	client := framesync.NewClient(options)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	client.Stop()
+	fmt.Println("Frame client stopped")
+}
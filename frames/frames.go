@@ -0,0 +1,373 @@
+package frames
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/blreynolds4/photopi-api/catalog"
+	"github.com/blreynolds4/photopi-api/events"
+	"github.com/blreynolds4/photopi-api/selection"
+	"github.com/blreynolds4/photopi-api/stager"
+)
+
+// Default is the frame showing SHOW_PATH, it always exists
+const Default = "default"
+
+// ErrNotFound is returned when there is no frame with the name
+var ErrNotFound = errors.New("frame not found")
+
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Config describes a frame, its show directory can be shown here or synced
+// to a frame client somewhere else, the capacity fields work like
+// SHOW_MAX_COUNT, SHOW_MAX_MB, ROTATION_POLICY and ROTATION_KEEP_PINNED
+type Config struct {
+	Name       string `json:"name" yaml:"name"`
+	ShowDir    string `json:"showDir" yaml:"show_dir"`
+	ArchiveDir string `json:"archiveDir,omitempty" yaml:"archive_dir,omitempty"`
+	MaxCount   int    `json:"maxCount,omitempty" yaml:"max_count,omitempty"`
+	MaxMB      int64  `json:"maxMB,omitempty" yaml:"max_mb,omitempty"`
+	Policy     string `json:"policy,omitempty" yaml:"policy,omitempty"`
+	KeepPinned *bool  `json:"keepPinned,omitempty" yaml:"keep_pinned,omitempty"`
+}
+
+// Validate checks a configured frame
+func (c Config) Validate() error {
+	if !validName.MatchString(c.Name) {
+		return fmt.Errorf("frame name %q must be lower case letters, numbers and dashes", c.Name)
+	}
+	if c.Name == Default {
+		return fmt.Errorf("frame name %s is reserved for SHOW_PATH", Default)
+	}
+	if c.ShowDir == "" {
+		return fmt.Errorf("frame %s needs a show directory", c.Name)
+	}
+	if c.MaxCount < 0 || c.MaxMB < 0 {
+		return fmt.Errorf("frame %s limits can't be negative", c.Name)
+	}
+	if !stager.ValidPolicy(c.Policy) {
+		return fmt.Errorf("frame %s has unknown policy %s", c.Name, c.Policy)
+	}
+	return nil
+}
+
+// Frame is a slideshow with its own directory, selection and capacity
+type Frame struct {
+	Config
+	Capacity stager.Capacity
+	Stager   stager.PhotoStager
+	Selector selection.Selector
+}
+
+// Load reads the frames configured in file, a missing file means there is
+// only the default frame
+func Load(file string) ([]Config, error) {
+	configs := []Config{}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return configs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("reading frames %s: %s", file, err.Error())
+	}
+	if err := Check(configs); err != nil {
+		return nil, fmt.Errorf("frames %s: %s", file, err.Error())
+	}
+	return configs, nil
+}
+
+// Check validates each frame and that no two have the same name
+func Check(configs []Config) error {
+	names := make(map[string]bool)
+	for _, c := range configs {
+		if err := c.Validate(); err != nil {
+			return err
+		}
+		if names[c.Name] {
+			return fmt.Errorf("frame %s is defined twice", c.Name)
+		}
+		names[c.Name] = true
+	}
+	return nil
+}
+
+// Start creates the frame's stager and selector, the selection is kept in
+// selectionFile and the frame only selects photos routed to it
+func Start(config Config, capacity stager.Capacity, selectionFile string, cat catalog.Catalog, bus events.Publisher) (*Frame, error) {
+	capacity.ArchiveDir = config.ArchiveDir
+	for _, dir := range []string{config.ShowDir, config.ArchiveDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	frame := Frame{
+		Config:   config,
+		Capacity: capacity,
+		Stager:   stager.NewDirectoryStager(config.ShowDir, 25, framePublisher{config.Name, bus}, capacity),
+	}
+
+	selector, err := selection.NewSelector(selectionFile, frameCatalog{cat, config.Name}, frame.Stager)
+	if err != nil {
+		frame.Stager.Stop()
+		return nil, err
+	}
+	frame.Selector = selector
+	return &frame, nil
+}
+
+// StartConfigured starts each configured frame keeping its archive,
+// eviction log and selection under dataDir/frames/<name>, shared supplies
+// the favourites, hidden photos and play history every frame honours
+func StartConfigured(configs []Config, dataDir string, shared stager.Capacity, cat catalog.Catalog, bus events.Publisher) ([]*Frame, error) {
+	started := []*Frame{}
+	for _, c := range configs {
+		dir := filepath.Join(dataDir, "frames", c.Name)
+		if c.ArchiveDir == "" {
+			c.ArchiveDir = filepath.Join(dir, "archive")
+		}
+
+		capacity := stager.Capacity{
+			MaxCount:    c.MaxCount,
+			MaxBytes:    c.MaxMB * 1024 * 1024,
+			Policy:      c.Policy,
+			KeepPinned:  c.KeepPinned == nil || *c.KeepPinned,
+			EvictionLog: filepath.Join(dir, "evictions.jsonl"),
+			Pins:        shared.Pins,
+			Hidden:      shared.Hidden,
+			History:     shared.History,
+		}
+
+		frame, err := Start(c, capacity, filepath.Join(dir, "selection.json"), cat, bus)
+		if err != nil {
+			for _, f := range started {
+				f.stop()
+			}
+			return nil, fmt.Errorf("starting frame %s: %s", c.Name, err.Error())
+		}
+		started = append(started, frame)
+	}
+	return started, nil
+}
+
+func (f *Frame) stop() {
+	f.Selector.Stop()
+	f.Stager.Stop()
+}
+
+// frameCatalog is the catalog as a frame's selection sees it, photos routed
+// to other frames are left out
+type frameCatalog struct {
+	catalog.Catalog
+	frame string
+}
+
+func (c frameCatalog) List() []catalog.Photo {
+	result := []catalog.Photo{}
+	for _, p := range c.Catalog.List() {
+		if p.ForFrame(c.frame) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// framePublisher adds the frame's name to the events its stager publishes
+type framePublisher struct {
+	frame  string
+	events events.Publisher
+}
+
+func (f framePublisher) Publish(eventType, photo string, data interface{}) {
+	if values, ok := data.(map[string]string); ok {
+		withFrame := map[string]string{"frame": f.frame}
+		for k, v := range values {
+			withFrame[k] = v
+		}
+		data = withFrame
+	}
+	f.events.Publish(eventType, photo, data)
+}
+
+// Frames holds every frame, as a stager it routes each photo to the frames
+// the catalog says it is for and applies other changes to all of them
+type Frames interface {
+	stager.PhotoStager
+	Default() *Frame
+	Get(name string) (*Frame, error)
+	List() []*Frame
+	Dirs() []string
+	Trash(name string) error
+}
+
+type frameSet struct {
+	catalog catalog.Catalog
+	frames  []*Frame
+	events  events.Publisher
+}
+
+// NewFrames routes photos between the default frame and the others
+func NewFrames(cat catalog.Catalog, bus events.Publisher, defaultFrame *Frame, others ...*Frame) Frames {
+	all := append([]*Frame{defaultFrame}, others...)
+	sort.SliceStable(all[1:], func(i, j int) bool {
+		return all[i+1].Name < all[j+1].Name
+	})
+	return &frameSet{
+		catalog: cat,
+		frames:  all,
+		events:  bus,
+	}
+}
+
+func (s *frameSet) Default() *Frame {
+	return s.frames[0]
+}
+
+func (s *frameSet) Get(name string) (*Frame, error) {
+	for _, f := range s.frames {
+		if f.Name == name {
+			return f, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *frameSet) List() []*Frame {
+	return append([]*Frame{}, s.frames...)
+}
+
+// Dirs are every frame's show and archive directories
+func (s *frameSet) Dirs() []string {
+	dirs := []string{}
+	for _, f := range s.frames {
+		dirs = append(dirs, f.ShowDir, f.ArchiveDir)
+	}
+	return dirs
+}
+
+// targets are the frames a photo is routed to, every frame when it
+// doesn't say
+func (s *frameSet) targets(name string) []*Frame {
+	photo, err := s.catalog.Get(name)
+	if err != nil {
+		return s.frames
+	}
+	result := []*Frame{}
+	for _, f := range s.frames {
+		if photo.ForFrame(f.Name) {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+// StagePhoto copies the photo for all but the last of its frames and moves
+// the original into the last one
+func (s *frameSet) StagePhoto(source string) error {
+	name := filepath.Base(source)
+	targets := s.targets(name)
+	if len(targets) == 0 {
+		fmt.Println("No frames for", name, "leaving it in", filepath.Dir(source))
+		return nil
+	}
+
+	for _, f := range targets[:len(targets)-1] {
+		// copies wait next to the upload so staging them is a rename
+		copy := filepath.Join(filepath.Dir(source), ".frames", f.Name, name)
+		if err := copyFile(source, copy); err != nil {
+			fmt.Println("Unable to copy", name, "for frame", f.Name, "because", err.Error())
+			s.events.Publish(events.PhotoFailed, name, map[string]string{
+				"stage": "stage",
+				"frame": f.Name,
+				"error": err.Error(),
+			})
+			continue
+		}
+		f.Stager.StagePhoto(copy)
+	}
+	return targets[len(targets)-1].Stager.StagePhoto(source)
+}
+
+// Sync makes every frame hold the named photos
+func (s *frameSet) Sync(names []string, reason string) error {
+	for _, f := range s.frames {
+		if err := f.Stager.Sync(names, reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unstage takes the photo out of every frame
+func (s *frameSet) Unstage(name, reason string) error {
+	for _, f := range s.frames {
+		if err := f.Stager.Unstage(name, reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore puts the photo back in the frames it is routed to and that have
+// it archived
+func (s *frameSet) Restore(name string) error {
+	var err error
+	for _, f := range s.targets(name) {
+		if _, statErr := os.Stat(filepath.Join(f.ArchiveDir, name)); statErr != nil {
+			continue
+		}
+		if restoreErr := f.Stager.Restore(name); restoreErr != nil {
+			err = restoreErr
+		}
+	}
+	return err
+}
+
+// Trash deletes a catalogued photo from every frame's slideshow and
+// archive and from the catalog, backups keep their copy
+func (s *frameSet) Trash(name string) error {
+	if _, err := s.catalog.Get(name); err != nil {
+		return ErrNotFound
+	}
+	for _, f := range s.frames {
+		if err := f.Stager.Unstage(name, "trashed"); err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(f.ArchiveDir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := s.catalog.Delete(name); err != nil {
+		return err
+	}
+	fmt.Println("Trashed", name)
+	s.events.Publish(events.PhotoTrashed, name, nil)
+	return nil
+}
+
+// Stop stops every frame's selection and then its staging
+func (s *frameSet) Stop() {
+	for _, f := range s.frames {
+		f.stop()
+	}
+}
+
+func copyFile(source, destination string) error {
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(source)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(destination, data, 0644)
+}
@@ -0,0 +1,138 @@
+package frames
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/catalog"
+	"github.com/blreynolds4/photopi-api/events"
+	"github.com/blreynolds4/photopi-api/stager"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func exists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
+
+type neverShown struct{}
+
+func (neverShown) LastShown(name string) time.Time {
+	return time.Time{}
+}
+
+func TestPhotosAreRoutedToTheirFrames(t *testing.T) {
+	data := t.TempDir()
+	inbox := t.TempDir()
+	bus := events.NewEventBus(100)
+	cat, err := catalog.NewJSONCatalog(filepath.Join(data, "catalog.json"))
+	require.Nil(t, err)
+
+	home, err := Start(Config{Name: Default, ShowDir: filepath.Join(data, "show"), ArchiveDir: filepath.Join(data, "archive")},
+		stager.Capacity{}, filepath.Join(data, "selection.json"), cat, bus)
+	require.Nil(t, err)
+	others, err := StartConfigured([]Config{
+		{Name: "gran", ShowDir: filepath.Join(data, "gran")},
+		{Name: "aunt", ShowDir: filepath.Join(data, "aunt"), MaxCount: 10},
+	}, data, stager.Capacity{History: neverShown{}}, cat, bus)
+	require.Nil(t, err)
+	all := NewFrames(cat, bus, home, others...)
+	defer all.Stop()
+
+	names := []string{}
+	for _, f := range all.List() {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, []string{Default, "aunt", "gran"}, names)
+	aunt, err := all.Get("aunt")
+	require.Nil(t, err)
+	assert.Equal(t, filepath.Join(data, "frames", "aunt", "archive"), aunt.ArchiveDir)
+	assert.Equal(t, 10, aunt.Capacity.MaxCount)
+	assert.Equal(t, neverShown{}, aunt.Capacity.History)
+	_, err = all.Get("uncle")
+	assert.Equal(t, ErrNotFound, err)
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(inbox, "both.jpg"), []byte("photo"), 0644))
+	require.Nil(t, cat.Put(catalog.Photo{Name: "both.jpg", Frames: []string{Default, "gran"}}))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(inbox, "everyone.jpg"), []byte("photo"), 0644))
+
+	require.Nil(t, all.StagePhoto(filepath.Join(inbox, "both.jpg")))
+	require.Nil(t, all.StagePhoto(filepath.Join(inbox, "everyone.jpg")))
+
+	assert.Eventually(t, func() bool {
+		return exists(filepath.Join(data, "show", "both.jpg")) &&
+			exists(filepath.Join(data, "gran", "both.jpg")) &&
+			exists(filepath.Join(data, "show", "everyone.jpg")) &&
+			exists(filepath.Join(data, "gran", "everyone.jpg")) &&
+			exists(filepath.Join(data, "aunt", "everyone.jpg"))
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, exists(filepath.Join(data, "aunt", "both.jpg")))
+	assert.False(t, exists(filepath.Join(inbox, "both.jpg")))
+
+	// selection for a frame only sees the photos routed to it
+	view := frameCatalog{cat, "aunt"}
+	require.Nil(t, cat.Put(catalog.Photo{Name: "everyone.jpg"}))
+	assert.Equal(t, 1, len(view.List()))
+	assert.Equal(t, 2, len(frameCatalog{cat, "gran"}.List()))
+}
+
+func TestTrashedPhotosLeaveEveryFrame(t *testing.T) {
+	data := t.TempDir()
+	bus := events.NewEventBus(100)
+	cat, err := catalog.NewJSONCatalog(filepath.Join(data, "catalog.json"))
+	require.Nil(t, err)
+	home, err := Start(Config{Name: Default, ShowDir: filepath.Join(data, "show"), ArchiveDir: filepath.Join(data, "archive")},
+		stager.Capacity{}, filepath.Join(data, "selection.json"), cat, bus)
+	require.Nil(t, err)
+	others, err := StartConfigured([]Config{{Name: "gran", ShowDir: filepath.Join(data, "gran")}}, data, stager.Capacity{}, cat, bus)
+	require.Nil(t, err)
+	all := NewFrames(cat, bus, home, others...)
+	defer all.Stop()
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(data, "show", "old.jpg"), []byte("photo"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(data, "frames", "gran", "archive", "old.jpg"), []byte("photo"), 0644))
+	require.Nil(t, cat.Put(catalog.Photo{Name: "old.jpg"}))
+	feed := bus.Subscribe(0)
+	defer feed.Close()
+
+	require.Nil(t, all.Trash("old.jpg"))
+	assert.False(t, exists(filepath.Join(data, "show", "old.jpg")))
+	assert.False(t, exists(filepath.Join(data, "archive", "old.jpg")))
+	assert.False(t, exists(filepath.Join(data, "frames", "gran", "archive", "old.jpg")))
+	_, err = cat.Get("old.jpg")
+	assert.Equal(t, catalog.ErrNotFound, err)
+	assert.Equal(t, ErrNotFound, all.Trash("old.jpg"))
+
+	trashed := false
+	for !trashed {
+		select {
+		case e := <-feed.Events():
+			trashed = e.Type == events.PhotoTrashed && e.Photo == "old.jpg"
+		case <-time.After(time.Second):
+			t.Fatal("no trashed event")
+		}
+	}
+}
+
+func TestLoadValidatesFrames(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "frames.json")
+	configs, err := Load(file)
+	require.Nil(t, err)
+	assert.Empty(t, configs)
+
+	for _, bad := range []string{
+		`[{"name":"Gran","showDir":"/x"}]`,
+		`[{"name":"default","showDir":"/x"}]`,
+		`[{"name":"gran"}]`,
+		`[{"name":"gran","showDir":"/x","policy":"newest"}]`,
+		`[{"name":"gran","showDir":"/x"},{"name":"gran","showDir":"/y"}]`,
+	} {
+		require.Nil(t, ioutil.WriteFile(file, []byte(bad), 0644))
+		_, err := Load(file)
+		assert.NotNil(t, err, bad)
+	}
+}
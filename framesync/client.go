@@ -0,0 +1,334 @@
+package framesync
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/catalog"
+)
+
+// partial downloads are kept here inside the show directory, the dot keeps
+// it out of the slideshow
+const partialDir = ".sync"
+
+// the last manifest applied, kept for viewers that want the hub's order
+const manifestFile = ".manifest.json"
+
+// Options configure a frame client
+// Hub is the base url of the hub instance and Frame the name of the frame
+// on the hub whose photos are copied into ShowDir, RootCAs are trusted as
+// well as the system's for a hub with a self-signed certificate and Token
+// is an API token from the hub sent with every request
+type Options struct {
+	Hub      string
+	Frame    string
+	ShowDir  string
+	Token    string
+	Interval time.Duration
+	Timeout  time.Duration
+	RootCAs  *x509.CertPool
+}
+
+// Result is what a sync changed
+type Result struct {
+	Downloaded int `json:"downloaded"`
+	Deleted    int `json:"deleted"`
+	Unchanged  int `json:"unchanged"`
+	Failed     int `json:"failed"`
+}
+
+// Client keeps a local show directory in step with a frame on a hub
+type Client interface {
+	Sync() (Result, error)
+	Stop()
+}
+
+type hubClient struct {
+	options Options
+	http    *http.Client
+	hashes  *HashCache
+	etag    string
+	// the last manifest applied, kept to try again when some of its photos
+	// didn't arrive, and how long the hub last asked the frame to wait
+	last       Manifest
+	incomplete bool
+	wait       time.Duration
+	done       chan bool
+}
+
+// throttled is returned when the hub turns a request away with 429, after
+// is how long it asked the frame to wait
+type throttled struct {
+	after time.Duration
+}
+
+func (t throttled) Error() string {
+	return fmt.Sprintf("hub asked the frame to wait %s", t.after)
+}
+
+// NewClient syncs once and then every interval until stopped
+func NewClient(options Options) Client {
+	c := newHubClient(options)
+	go c.run()
+	return c
+}
+
+func newHubClient(options Options) *hubClient {
+	client := &http.Client{Timeout: options.Timeout}
+	if options.RootCAs != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: options.RootCAs}
+		client.Transport = transport
+	}
+	return &hubClient{
+		options: options,
+		http:    client,
+		hashes:  NewHashCache(),
+		done:    make(chan bool),
+	}
+}
+
+func (c *hubClient) run() {
+	for {
+		result, err := c.Sync()
+		if err != nil {
+			fmt.Println("Sync with", c.options.Hub, "failed because", err.Error())
+		} else if result.Downloaded > 0 || result.Deleted > 0 || result.Failed > 0 {
+			fmt.Printf("Synced frame %s: %+v\n", c.options.Frame, result)
+		}
+
+		// a hub that asked the frame to wait is tried again once it has,
+		// so photos it held back still arrive before the next interval
+		next := c.options.Interval
+		if c.wait > 0 {
+			next = c.wait
+		}
+		timer := time.NewTimer(next)
+		select {
+		case <-c.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Sync fetches the frame's manifest and brings the show directory in line
+// with it, photos that fail to download are tried again next time and once
+// the hub asks the frame to wait the rest are left until then
+func (c *hubClient) Sync() (Result, error) {
+	result := Result{}
+	c.wait = 0
+
+	manifest, changed, err := c.manifest()
+	if t, ok := err.(throttled); ok {
+		c.wait = t.after
+	}
+	if err != nil || !changed {
+		return result, err
+	}
+
+	if err := os.MkdirAll(filepath.Join(c.options.ShowDir, partialDir), 0755); err != nil {
+		return result, err
+	}
+
+	wanted := make(map[string]bool)
+	for _, entry := range manifest.Photos {
+		if entry.Name != filepath.Base(entry.Name) || strings.HasPrefix(entry.Name, ".") {
+			fmt.Println("Skipping", entry.Name, "from the manifest, it isn't a photo name")
+			continue
+		}
+		wanted[entry.Name] = true
+
+		if c.have(entry) {
+			result.Unchanged++
+			continue
+		}
+		if c.wait > 0 {
+			result.Failed++
+			continue
+		}
+		if err := c.download(entry); err != nil {
+			fmt.Println("Unable to download", entry.Name, "because", err.Error())
+			if t, ok := err.(throttled); ok {
+				c.wait = t.after
+			}
+			result.Failed++
+			continue
+		}
+		result.Downloaded++
+	}
+
+	infos, err := ioutil.ReadDir(c.options.ShowDir)
+	if err != nil {
+		return result, err
+	}
+	for _, info := range infos {
+		if !isPhoto(info) || wanted[info.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.options.ShowDir, info.Name())); err != nil {
+			fmt.Println("Unable to delete", info.Name(), "because", err.Error())
+			continue
+		}
+		result.Deleted++
+	}
+
+	// keep the manifest for viewers, and apply it again next time unless
+	// everything in it arrived
+	if data, err := json.MarshalIndent(manifest, "", "  "); err == nil {
+		ioutil.WriteFile(filepath.Join(c.options.ShowDir, manifestFile), data, 0644)
+	}
+	c.last = manifest
+	c.incomplete = result.Failed > 0
+	return result, nil
+}
+
+// manifest fetches the frame's manifest, changed is false when it is the
+// same as the last one applied and that one is complete
+func (c *hubClient) manifest() (Manifest, bool, error) {
+	manifest := Manifest{}
+	req, err := c.request("manifest")
+	if err != nil {
+		return manifest, false, err
+	}
+	if c.etag != "" {
+		req.Header.Set("If-None-Match", c.etag)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return manifest, false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified {
+		return c.last, c.incomplete, nil
+	}
+	if res.StatusCode == http.StatusTooManyRequests {
+		return manifest, false, throttled{after: c.retryAfter(res)}
+	}
+	if res.StatusCode != http.StatusOK {
+		return manifest, false, fmt.Errorf("hub returned %s for the manifest", res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&manifest); err != nil {
+		return manifest, false, fmt.Errorf("reading manifest: %s", err.Error())
+	}
+	c.etag = res.Header.Get("ETag")
+	return manifest, true, nil
+}
+
+// have is true when the show directory already has the photo
+func (c *hubClient) have(entry Entry) bool {
+	file := filepath.Join(c.options.ShowDir, entry.Name)
+	info, err := os.Stat(file)
+	if err != nil || info.Size() != entry.Size {
+		return false
+	}
+	sum, err := c.hashes.Hash(file, info)
+	return err == nil && sum == entry.SHA256
+}
+
+// download fetches the photo into a partial file, carrying on from what an
+// earlier attempt got, and moves it into place once its hash checks out
+func (c *hubClient) download(entry Entry) error {
+	part := filepath.Join(c.options.ShowDir, partialDir, entry.Name+".part")
+
+	var offset int64
+	if info, err := os.Stat(part); err == nil {
+		offset = info.Size()
+	}
+	if offset > entry.Size {
+		os.Remove(part)
+		offset = 0
+	}
+
+	if offset < entry.Size {
+		req, err := c.request("photos/" + url.PathEscape(entry.Name))
+		if err != nil {
+			return err
+		}
+		if offset > 0 {
+			req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		}
+
+		res, err := c.http.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		flags := os.O_CREATE | os.O_WRONLY
+		switch res.StatusCode {
+		case http.StatusPartialContent:
+			flags = flags | os.O_APPEND
+		case http.StatusOK:
+			// the hub sent the whole photo
+			flags = flags | os.O_TRUNC
+		case http.StatusTooManyRequests:
+			return throttled{after: c.retryAfter(res)}
+		default:
+			return fmt.Errorf("hub returned %s", res.Status)
+		}
+
+		f, err := os.OpenFile(part, flags, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, io.LimitReader(res.Body, entry.Size))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			// what arrived is kept for the next attempt
+			return err
+		}
+	}
+
+	sum, err := catalog.HashFile(part)
+	if err != nil {
+		return err
+	}
+	if sum != entry.SHA256 {
+		os.Remove(part)
+		return fmt.Errorf("hash %s does not match the manifest", sum)
+	}
+	return os.Rename(part, filepath.Join(c.options.ShowDir, entry.Name))
+}
+
+// retryAfter is how long the hub's Retry-After asks the frame to wait, an
+// interval when it doesn't say
+func (c *hubClient) retryAfter(res *http.Response) time.Duration {
+	value := res.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && time.Until(at) > 0 {
+		return time.Until(at)
+	}
+	return c.options.Interval
+}
+
+func (c *hubClient) request(path string) (*http.Request, error) {
+	u := strings.TrimSuffix(c.options.Hub, "/") + "/frames/" + url.PathEscape(c.options.Frame) + "/" + path
+	req, err := http.NewRequest("GET", u, nil)
+	if err == nil && c.options.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.options.Token)
+	}
+	return req, err
+}
+
+func (c *hubClient) Stop() {
+	close(c.done)
+}
@@ -0,0 +1,185 @@
+package framesync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the token a hub's frames sign in with
+const hubToken = "ppt_frame"
+
+// hub serves a frame the way the api does and records the ranges asked for
+type hub struct {
+	lock   sync.Mutex
+	dir    string
+	ranges []string
+	// how many requests for photos are turned away with 429
+	throttle int
+	server   *httptest.Server
+}
+
+func newHub(t *testing.T) *hub {
+	h := &hub{dir: t.TempDir()}
+	cache := NewHashCache()
+	h.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer "+hubToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Path == "/frames/gran/manifest" {
+			manifest, err := BuildManifest("gran", h.dir, cache)
+			require.Nil(t, err)
+			w.Header().Set("ETag", manifest.ETag())
+			if req.Header.Get("If-None-Match") == manifest.ETag() {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			json.NewEncoder(w).Encode(manifest)
+			return
+		}
+		name := strings.TrimPrefix(req.URL.Path, "/frames/gran/photos/")
+		h.lock.Lock()
+		h.ranges = append(h.ranges, req.Header.Get("Range"))
+		turnAway := h.throttle > 0
+		h.throttle--
+		h.lock.Unlock()
+		if turnAway {
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		http.ServeFile(w, req, filepath.Join(h.dir, name))
+	}))
+	t.Cleanup(h.server.Close)
+	return h
+}
+
+func (h *hub) client(show string) *hubClient {
+	return newHubClient(Options{Hub: h.server.URL, Frame: "gran", ShowDir: show, Token: hubToken, Interval: time.Minute, Timeout: time.Second})
+}
+
+func write(t *testing.T, dir, name, content string) {
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+}
+
+func read(t *testing.T, dir, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	require.Nil(t, err)
+	return string(data)
+}
+
+func TestSyncDownloadsChangedAndDeletesRemoved(t *testing.T) {
+	h := newHub(t)
+	show := t.TempDir()
+	write(t, h.dir, "a.jpg", "photo a")
+	write(t, h.dir, "b.jpg", "photo b")
+	write(t, show, "b.jpg", "photo b")
+	write(t, show, "old.jpg", "gone from the hub")
+	c := h.client(show)
+
+	result, err := c.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, Result{Downloaded: 1, Deleted: 1, Unchanged: 1}, result)
+	assert.Equal(t, "photo a", read(t, show, "a.jpg"))
+	_, err = os.Stat(filepath.Join(show, "old.jpg"))
+	assert.True(t, os.IsNotExist(err))
+
+	// nothing changed on the hub, the manifest isn't even applied
+	result, err = c.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, Result{}, result)
+
+	write(t, h.dir, "a.jpg", "photo a, edited")
+	result, err = c.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, 1, result.Downloaded)
+	assert.Equal(t, "photo a, edited", read(t, show, "a.jpg"))
+}
+
+func TestSyncResumesAndChecksHashes(t *testing.T) {
+	h := newHub(t)
+	show := t.TempDir()
+	write(t, h.dir, "big.jpg", "0123456789")
+	require.Nil(t, os.MkdirAll(filepath.Join(show, partialDir), 0755))
+	write(t, filepath.Join(show, partialDir), "big.jpg.part", "01234")
+	c := h.client(show)
+
+	result, err := c.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, 1, result.Downloaded)
+	assert.Equal(t, "0123456789", read(t, show, "big.jpg"))
+	assert.Equal(t, []string{"bytes=5-"}, h.ranges)
+
+	// a partial download that doesn't match is thrown away and fetched again
+	write(t, h.dir, "other.jpg", "abcdefghij")
+	write(t, filepath.Join(show, partialDir), "other.jpg.part", "XYZ")
+	result, err = c.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, 1, result.Failed)
+	_, err = os.Stat(filepath.Join(show, "other.jpg"))
+	assert.True(t, os.IsNotExist(err))
+
+	result, err = c.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, 1, result.Downloaded)
+	assert.Equal(t, "abcdefghij", read(t, show, "other.jpg"))
+}
+
+func TestSyncSignsInToTheHub(t *testing.T) {
+	h := newHub(t)
+	show := t.TempDir()
+	write(t, h.dir, "a.jpg", "photo a")
+
+	c := h.client(show)
+	c.options.Token = ""
+	_, err := c.Sync()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "401")
+
+	c.options.Token = hubToken
+	result, err := c.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, 1, result.Downloaded)
+}
+
+func TestSyncWaitsWhenTheHubAsks(t *testing.T) {
+	h := newHub(t)
+	show := t.TempDir()
+	write(t, h.dir, "a.jpg", "photo a")
+	write(t, h.dir, "b.jpg", "photo b")
+	write(t, h.dir, "c.jpg", "photo c")
+	write(t, show, "c.jpg", "photo c")
+	h.throttle = 1
+	c := h.client(show)
+
+	// the rest aren't asked for once the hub says wait, nor deleted
+	result, err := c.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, Result{Failed: 2, Unchanged: 1}, result)
+	assert.Equal(t, 7*time.Second, c.wait)
+	assert.Len(t, h.ranges, 1)
+	assert.NotEmpty(t, c.etag)
+
+	// the unchanged manifest is applied again for what didn't arrive
+	etag := c.etag
+	result, err = c.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, Result{Downloaded: 2, Unchanged: 1}, result)
+	assert.Equal(t, time.Duration(0), c.wait)
+	assert.Equal(t, etag, c.etag)
+
+	result, err = c.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, Result{}, result)
+}
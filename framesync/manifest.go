@@ -0,0 +1,114 @@
+package framesync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/catalog"
+)
+
+// Entry is a photo a frame should have
+// Order is its place in the slideshow, photos are named by when they were taken
+type Entry struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Order  int    `json:"order"`
+}
+
+// Manifest lists every photo in a frame's show directory
+type Manifest struct {
+	Frame  string  `json:"frame"`
+	Photos []Entry `json:"photos"`
+}
+
+// ETag identifies the manifest's contents so clients can skip unchanged ones
+func (m Manifest) ETag() string {
+	data, _ := json.Marshal(m)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// HashCache remembers photo hashes so they are only worked out again when
+// a file's size or modification time changes
+type HashCache struct {
+	lock   sync.Mutex
+	hashes map[string]cachedHash
+}
+
+type cachedHash struct {
+	size     int64
+	modified time.Time
+	sum      string
+}
+
+// NewHashCache creates an empty cache
+func NewHashCache() *HashCache {
+	return &HashCache{hashes: make(map[string]cachedHash)}
+}
+
+// Hash returns the hex sha256 of file
+func (c *HashCache) Hash(file string, info os.FileInfo) (string, error) {
+	c.lock.Lock()
+	cached, ok := c.hashes[file]
+	c.lock.Unlock()
+	if ok && cached.size == info.Size() && cached.modified.Equal(info.ModTime()) {
+		return cached.sum, nil
+	}
+
+	sum, err := catalog.HashFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	c.lock.Lock()
+	c.hashes[file] = cachedHash{size: info.Size(), modified: info.ModTime(), sum: sum}
+	c.lock.Unlock()
+	return sum, nil
+}
+
+// BuildManifest lists the photos in dir, skipping directories and dot files
+func BuildManifest(frame, dir string, cache *HashCache) (Manifest, error) {
+	manifest := Manifest{Frame: frame, Photos: []Entry{}}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return manifest, err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+
+	for _, info := range infos {
+		if !isPhoto(info) {
+			continue
+		}
+		sum, err := cache.Hash(filepath.Join(dir, info.Name()), info)
+		if os.IsNotExist(err) {
+			// rotated out while listing
+			continue
+		}
+		if err != nil {
+			return manifest, err
+		}
+		manifest.Photos = append(manifest.Photos, Entry{
+			Name:   info.Name(),
+			Size:   info.Size(),
+			SHA256: sum,
+			Order:  len(manifest.Photos),
+		})
+	}
+	return manifest, nil
+}
+
+func isPhoto(info os.FileInfo) bool {
+	return !info.IsDir() && !strings.HasPrefix(info.Name(), ".")
+}
@@ -4,10 +4,13 @@ go 1.15
 
 require (
 	github.com/dsoprea/go-exif v0.0.0-20201216222538-db167117f483
+	github.com/dsoprea/go-logging v0.0.0-20190624164917-c4f10aab7696
 	github.com/gorilla/mux v1.8.0
 	github.com/palantir/stacktrace v0.0.0-20161112013806-78658fd2d177
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/stretchr/testify v1.6.1
 	github.com/unrolled/render v1.0.3
-	github.com/unrolled/secure v1.0.8 // indirect
+	github.com/unrolled/secure v1.17.0
 	github.com/urfave/negroni v1.0.0
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
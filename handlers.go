@@ -1,15 +1,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
-	"time"
+	"strings"
 
-	"github.com/blreynolds4/photopi-api/naming"
+	"github.com/blreynolds4/photopi-api/events"
+	"github.com/blreynolds4/photopi-api/ingest"
+	"github.com/blreynolds4/photopi-api/invites"
 )
 
 // HandlerFunc is a custom implementation of the http.HandlerFunc
@@ -34,18 +38,57 @@ func HealthcheckHandler(w http.ResponseWriter, req *http.Request, ctx AppContext
 }
 
 type postResponse struct {
-	Message string   `json:"message"`
-	Files   []string `json:"files"`
+	Message string               `json:"message"`
+	Files   []string             `json:"files"`
+	Entries []ingest.EntryResult `json:"entries,omitempty"`
 }
 
+// largest value accepted for a plain form field
+const maxFormFieldSize = 4096
+
 // AddPhotosHandler accepts one or more photos to add to the slideshows
+// optional album (id or name), tags and frames (comma separated), caption
+// and uploader form fields apply to every photo in the request, photos go
+// to every frame unless frames says which and keep any caption written into
+// them unless one is given, photos from a signed in user are attributed to
+// them whatever uploader says
+// guests with an invite link send its token in the invite query parameter,
+// their photos go to the invite's album and frames
+// zip and tar files are unpacked and each photo in them added, the entries
+// in the response say what happened to each one
 func AddPhotosHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
 	fmt.Printf("Handling Photos POST request: %+v\n", req)
 	result := postResponse{}
+	album := ""
+	caption := ""
+	uploader := ""
+	tags := []string{}
+	frameNames := []string{}
+	added := []string{}
+
+	// guests stop at what their invite has left, before saving any more
+	invite, guest := currentInvite(req)
+	remaining := -1
+	if guest {
+		remaining = invite.Remaining()
+	}
+	full := func() bool { return remaining >= 0 && len(added) >= remaining }
+	refused := false
 
 	// FormFile returns the first file for the given key in ctx.TagName
 	// it also returns the FileHeader so we can get the Filename,
 	// the Header and the size of the file
+	// the byte budget ran out while reading, nothing is kept so the retry
+	// can send it all again
+	overLimit := func(err error) bool {
+		if !errors.As(err, new(tooFastError)) {
+			return false
+		}
+		ctx.Ingest.Discard(added)
+		w.Header().Del("Location")
+		return overBudget(w, ctx, err)
+	}
+
 	mpReader, err := req.MultipartReader()
 	if err != nil {
 		ctx.Render.Text(w, http.StatusInternalServerError, fmt.Sprintf("Error getting mp reader %s", err.Error()))
@@ -58,6 +101,9 @@ func AddPhotosHandler(w http.ResponseWriter, req *http.Request, ctx AppContext)
 			// no more files to save
 			break
 		}
+		if overLimit(err) {
+			return
+		}
 		if err != nil {
 			ctx.Render.Text(w, http.StatusInternalServerError, fmt.Sprintf("Error reading part %s", err.Error()))
 			return
@@ -66,69 +112,225 @@ func AddPhotosHandler(w http.ResponseWriter, req *http.Request, ctx AppContext)
 		// make sure this part gets closed
 		defer p.Close()
 
+		// the other fields can come before or after the photos, so they are
+		// applied once the whole form has been read
+		if p.FileName() == "" && isOptionField(p.FormName()) {
+			value, err := ioutil.ReadAll(io.LimitReader(p, maxFormFieldSize))
+			if overLimit(err) {
+				return
+			}
+			if err != nil {
+				ctx.Render.Text(w, http.StatusInternalServerError, fmt.Sprintf("Error reading part %s", err.Error()))
+				return
+			}
+			switch p.FormName() {
+			case "album":
+				album = strings.TrimSpace(string(value))
+			case "tags":
+				tags = append(tags, strings.Split(string(value), ",")...)
+			case "frames":
+				frameNames = append(frameNames, strings.Split(string(value), ",")...)
+			case "caption":
+				caption = strings.TrimSpace(string(value))
+			case "uploader":
+				uploader = string(value)
+			}
+			continue
+		}
+
 		// only save images from the expected form field, skip over the rest
 		if p.FormName() == ctx.TagName {
 			// read current photo
 			fmt.Printf("Uploaded File: %+v from form %s\n", p.FileName(), p.FormName())
 			result.Files = append(result.Files, p.FileName())
-			data, err := ioutil.ReadAll(p)
+
+			// the client can send checksums with each file to be sure it
+			// arrived intact, any that doesn't fails the whole request
+			checksums := ingest.Checksums{MD5: p.Header.Get("Content-MD5"), SHA256: p.Header.Get("X-Checksum-SHA256")}
+			checked, err := checksums.Reader(p)
+			if err != nil {
+				ctx.Ingest.Discard(added)
+				w.Header().Del("Location")
+				result.Message = fmt.Sprintf("Photo %s has a bad checksum: %s", p.FileName(), err.Error())
+				ctx.Render.JSON(w, http.StatusBadRequest, result)
+				return
+			}
+
+			// a photo in an archive is added like any other, one that
+			// can't be doesn't stop the rest
+			if ingest.IsArchive(p.FileName()) {
+				entries, err := ingest.ExtractArchive(p.FileName(), checked, ctx.PhotoPath, ctx.Limits, func(name string, data []byte) (string, error) {
+					if full() {
+						refused = true
+						return "", invites.ErrUsedUp
+					}
+					createdPath, err := ctx.Ingest.Save(name, data, "upload")
+					if err != nil {
+						return "", err
+					}
+					added = append(added, createdPath)
+					w.Header().Add("Location", newURL(createdPath, req))
+					return filepath.Base(createdPath), nil
+				})
+				if overLimit(err) {
+					return
+				}
+				if err != nil {
+					entries = append(entries, ingest.EntryResult{Archive: p.FileName(), Error: err.Error()})
+					ctx.Events.Publish(events.PhotoFailed, p.FileName(), map[string]string{"stage": "receive", "error": err.Error()})
+				}
+				result.Entries = append(result.Entries, entries...)
+				if refused {
+					refuseGuest(w, ctx, remaining, added, result)
+					return
+				}
+
+				// the checksum covers the whole archive, not just the photos
+				if _, err := io.Copy(ioutil.Discard, checked); err == nil && checked.Verify() != nil {
+					rejectChecksum(w, ctx, p.FileName(), added, result)
+					return
+				}
+				continue
+			}
+
+			data, err := ingest.ReadPhoto(checked, ctx.Limits)
+			if err == ingest.ErrTooLarge {
+				ctx.Ingest.Discard(added)
+				w.Header().Del("Location")
+				result.Message = fmt.Sprintf("Photo %s is larger than %d MB", p.FileName(), ctx.Limits.MaxPhotoBytes/(1024*1024))
+				ctx.Render.JSON(w, http.StatusRequestEntityTooLarge, result)
+				return
+			}
+			if overLimit(err) {
+				return
+			}
 			if err != nil {
 				result.Message = fmt.Sprintf("Error reading photo %s: %s", p.FileName(), err.Error())
+				ctx.Events.Publish(events.PhotoFailed, p.FileName(), map[string]string{"stage": "receive", "error": err.Error()})
 				ctx.Render.JSON(w, http.StatusInternalServerError, result)
 				return
 			}
+			if err := checked.Verify(); err != nil {
+				rejectChecksum(w, ctx, p.FileName(), added, result)
+				return
+			}
 
-			createdPath, err := addFileToPath(ctx.PhotoPath, p.FileName(), data)
+			if full() {
+				refuseGuest(w, ctx, remaining, added, result)
+				return
+			}
+			createdPath, err := ctx.Ingest.Save(p.FileName(), data, "upload")
 			if err != nil {
 				result.Message = fmt.Sprintf("Error saving photo %s: %s", p.FileName(), err.Error())
 				ctx.Render.JSON(w, http.StatusInternalServerError, result)
 				return
 			}
-
-			// backup and stage the photo
-			ctx.PhotoSave.BackupPhoto(createdPath)
+			added = append(added, createdPath)
 
 			// create a location header for the added file with the unique filename
 			w.Header().Add("Location", newURL(createdPath, req))
 		}
 	}
 
+	// guests' photos go where their invite says
+	if guest {
+		album = invite.Album
+		frameNames = invite.Frames
+		if strings.TrimSpace(uploader) == "" {
+			uploader = "guest"
+		}
+	}
+
+	// nothing is staged until every photo knows its frames
+	routed, err := ctx.Ingest.CheckFrames(frameNames)
+	if err != nil {
+		ctx.Ingest.Discard(added)
+		w.Header().Del("Location")
+		result.Message = fmt.Sprintf("No photos were added: %s", err.Error())
+		ctx.Render.JSON(w, http.StatusBadRequest, result)
+		return
+	}
+
+	// and only as many as it allows, another upload with the same invite
+	// may have used some since
+	if guest {
+		if err := ctx.Invites.Use(invite.ID, len(added)); err != nil {
+			ctx.Ingest.Discard(added)
+			w.Header().Del("Location")
+			result.Message = fmt.Sprintf("No photos were added: %s", err.Error())
+			ctx.Render.JSON(w, http.StatusForbidden, result)
+			return
+		}
+	}
+
+	// backup and stage the photos
+	tagErr := ctx.Ingest.Finish(added, ingest.Options{Album: album, Tags: tags, Frames: routed, Caption: caption, Uploader: uploaderFor(req, uploader)})
+	if tagErr != nil {
+		result.Message = fmt.Sprintf("Photos were saved but not added to album %s: %s", album, tagErr.Error())
+		ctx.Render.JSON(w, http.StatusBadRequest, result)
+		return
+	}
+
 	// all good
 	fmt.Println("Returning success")
 	result.Message = "Successfully uploaded files"
+	for _, entry := range result.Entries {
+		if entry.Error != "" {
+			result.Message = "Uploaded files, some photos in archives could not be added"
+			break
+		}
+	}
 	ctx.Render.JSON(w, http.StatusOK, result)
 }
 
-func addFileToPath(rootDir, filename string, data []byte) (string, error) {
-	// need to create a unique filename for our new file, starting with what we
-	// have and adding numeric extentions until it doesn't exist
-	namer := naming.NewExifImageNamer()
-	exifName, err := namer.NameImage(data)
-	if err != nil {
-		return "", err
+// isOptionField is true for the form fields that say what to do with the
+// photos rather than being one
+func isOptionField(name string) bool {
+	switch name {
+	case "album", "tags", "frames", "caption", "uploader":
+		return true
 	}
+	return false
+}
 
-	if "" == exifName {
-		exifName = useUploadTime()
-	}
+// refuseGuest turns down a guest's upload with more photos than their
+// invite has left, none of them are added
+func refuseGuest(w http.ResponseWriter, ctx AppContext, remaining int, added []string, result postResponse) {
+	ctx.Ingest.Discard(added)
+	w.Header().Del("Location")
+	result.Message = fmt.Sprintf("No photos were added: invite only takes %d more photos", remaining)
+	result.Entries = nil
+	ctx.Render.JSON(w, http.StatusForbidden, result)
+}
 
-	fqFilename := naming.UniqueFileName(rootDir, exifName, filepath.Ext(filename))
+// rejectChecksum turns down an upload with a file that didn't arrive intact,
+// nothing in it is added so the client can send it all again
+func rejectChecksum(w http.ResponseWriter, ctx AppContext, filename string, added []string, result postResponse) {
+	ctx.Ingest.Discard(added)
+	ctx.Events.Publish(events.PhotoFailed, filename, map[string]string{"stage": "receive", "error": ingest.ErrChecksum.Error()})
+	w.Header().Del("Location")
+	result.Message = fmt.Sprintf("Photo %s does not match its checksum", filename)
+	result.Entries = nil
+	ctx.Render.JSON(w, http.StatusBadRequest, result)
+}
 
-	// write the new file
-	err = ioutil.WriteFile(fqFilename, data, 0644)
-	if err != nil {
-		return "", err
-	}
+// newURL is where something created by the request is found, under the
+// request's own path
+func newURL(file string, req *http.Request) string {
+	return urlUnder(req.URL.Path, file, req)
+}
 
-	// return the name we used
-	return fqFilename, nil
+// photoURL is where an added photo is found in the catalog, whichever
+// route added it
+func photoURL(file string, req *http.Request) string {
+	return urlUnder("/photos", file, req)
 }
 
-func newURL(file string, req *http.Request) string {
+func urlUnder(dir string, file string, req *http.Request) string {
 	baseFileame := filepath.Base(file)
-	newUrlPath := filepath.Join(req.URL.Path, baseFileame)
+	newUrlPath := path.Join(dir, baseFileame)
 	newUrl := &url.URL{
-		Scheme: "http",
+		Scheme: requestScheme(req),
 		Host:   req.Host,
 		Path:   newUrlPath,
 	}
@@ -137,7 +339,14 @@ func newURL(file string, req *http.Request) string {
 	return newUrl.String()
 }
 
-func useUploadTime() string {
-	now := time.Now()
-	return now.Format("2006-01-02-15-04-05")
+// requestScheme is how the client reached the server, a trusted proxy in
+// front of it says in X-Forwarded-Proto
+func requestScheme(req *http.Request) string {
+	if forwarded, ok := req.Context().Value(schemeKey{}).(string); ok {
+		return forwarded
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/blreynolds4/photopi-api/catalog"
+	"github.com/gorilla/mux"
+)
+
+type albumRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+}
+
+type albumResponse struct {
+	catalog.Album
+	Photos []string `json:"photos"`
+}
+
+// albumError maps catalog errors to a response
+func albumError(w http.ResponseWriter, ctx AppContext, err error) {
+	status := http.StatusBadRequest
+	if err == catalog.ErrAlbumNotFound {
+		status = http.StatusNotFound
+	}
+	ctx.Render.JSON(w, status, Status{Status: "error", Message: err.Error()})
+}
+
+func withPhotos(ctx AppContext, album catalog.Album) albumResponse {
+	result := albumResponse{Album: album, Photos: []string{}}
+	for _, p := range ctx.Catalog.List() {
+		if p.InAlbum(album.ID) {
+			result.Photos = append(result.Photos, p.Name)
+		}
+	}
+	return result
+}
+
+// ListAlbumsHandler returns every album
+func ListAlbumsHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	ctx.Render.JSON(w, http.StatusOK, ctx.Catalog.Albums())
+}
+
+// AddAlbumHandler creates an album
+func AddAlbumHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	body := albumRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: fmt.Sprintf("Invalid album %s", err.Error())})
+		return
+	}
+
+	album := catalog.Album{}
+	if body.Name != nil {
+		album.Name = *body.Name
+	}
+	if body.Description != nil {
+		album.Description = *body.Description
+	}
+	album, err := ctx.Catalog.AddAlbum(album)
+	if err != nil {
+		albumError(w, ctx, err)
+		return
+	}
+
+	w.Header().Add("Location", newURL(album.ID, req))
+	ctx.Render.JSON(w, http.StatusCreated, withPhotos(ctx, album))
+}
+
+// GetAlbumHandler returns an album and the photos in it
+func GetAlbumHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	album, err := ctx.Catalog.GetAlbum(mux.Vars(req)["id"])
+	if err != nil {
+		albumError(w, ctx, err)
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, withPhotos(ctx, album))
+}
+
+// UpdateAlbumHandler changes an album's name or description
+func UpdateAlbumHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	body := albumRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: fmt.Sprintf("Invalid album %s", err.Error())})
+		return
+	}
+
+	album, err := ctx.Catalog.UpdateAlbum(mux.Vars(req)["id"], func(a *catalog.Album) error {
+		if body.Name != nil {
+			a.Name = *body.Name
+		}
+		if body.Description != nil {
+			a.Description = *body.Description
+		}
+		return nil
+	})
+	if err != nil {
+		albumError(w, ctx, err)
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, withPhotos(ctx, album))
+}
+
+// DeleteAlbumHandler removes an album, its photos are kept
+func DeleteAlbumHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	if err := ctx.Catalog.DeleteAlbum(mux.Vars(req)["id"]); err != nil {
+		albumError(w, ctx, err)
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, Status{Status: "ok", Message: "Album deleted"})
+}
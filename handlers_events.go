@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/events"
+)
+
+// how often a comment is sent to keep idle event streams open
+const eventHeartbeat = 15 * time.Second
+
+// EventsHandler streams pipeline and slideshow events as Server-Sent Events
+// clients resume from the Last-Event-ID header (or lastEventId query param)
+// and can limit the stream with a comma separated types query param, a
+// stream.reset always gets through so a client resuming past the buffer
+// knows to reload
+func EventsHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		ctx.Render.Text(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	lastID := req.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = req.URL.Query().Get("lastEventId")
+	}
+	var resumeFrom uint64
+	if lastID != "" {
+		id, err := strconv.ParseUint(lastID, 10, 64)
+		if err != nil {
+			ctx.Render.Text(w, http.StatusBadRequest, fmt.Sprintf("Invalid Last-Event-ID %s", lastID))
+			return
+		}
+		resumeFrom = id
+	}
+
+	wanted := map[string]bool{}
+	if types := req.URL.Query().Get("types"); types != "" {
+		for _, t := range strings.Split(types, ",") {
+			wanted[strings.TrimSpace(t)] = true
+		}
+	}
+
+	sub := ctx.Events.Subscribe(resumeFrom)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(e events.Event) error {
+		if len(wanted) > 0 && !wanted[e.Type] && e.Type != events.StreamReset {
+			return nil
+		}
+		return writeEvent(w, e)
+	}
+
+	for _, e := range sub.Replay() {
+		if err := send(e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case e, more := <-sub.Events():
+			if !more {
+				// dropped for falling behind, the client reconnects with its last id
+				return
+			}
+			if err := send(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e events.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/blreynolds4/photopi-api/player"
+	"github.com/gorilla/mux"
+)
+
+// SlideshowHandler lists the photos in the slideshow with what the catalog
+// knows about them
+func SlideshowHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	ctx.Render.JSON(w, http.StatusOK, ctx.Player.Slides())
+}
+
+// SlideshowPhotoHandler serves a photo from the slideshow directory
+func SlideshowPhotoHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	name := mux.Vars(req)["name"]
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		ctx.Render.JSON(w, http.StatusNotFound, Status{Status: "error", Message: "photo not found"})
+		return
+	}
+	http.ServeFile(w, req, filepath.Join(ctx.ShowPath, name))
+}
+
+// GetPlayerHandler returns the web player settings
+func GetPlayerHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	ctx.Render.JSON(w, http.StatusOK, ctx.Player.Settings())
+}
+
+// SetPlayerHandler replaces the web player settings, playing frames pick
+// them up straight away
+func SetPlayerHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	settings := player.DefaultSettings
+	if err := json.NewDecoder(req.Body).Decode(&settings); err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: fmt.Sprintf("Invalid player settings %s", err.Error())})
+		return
+	}
+
+	if err := ctx.Player.SetSettings(settings); err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, ctx.Player.Settings())
+}
+
+// NowPlayingHandler returns the photo on screen
+func NowPlayingHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	ctx.Render.JSON(w, http.StatusOK, ctx.Player.Now())
+}
+
+// NextHandler moves the slideshow on to the next photo
+func NextHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	playback(w, ctx, ctx.Player.Next)
+}
+
+// PreviousHandler goes back to the photo shown before
+func PreviousHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	playback(w, ctx, ctx.Player.Previous)
+}
+
+// PauseHandler keeps the photo on screen until resumed
+func PauseHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	playback(w, ctx, ctx.Player.Pause)
+}
+
+// ResumeHandler carries on playing the slideshow
+func ResumeHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	playback(w, ctx, ctx.Player.Resume)
+}
+
+// ShowHandler puts a photo from the slideshow on screen now
+func ShowHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	name := mux.Vars(req)["name"]
+	playback(w, ctx, func() (player.NowPlaying, error) {
+		return ctx.Player.Show(name)
+	})
+}
+
+// playback runs a playback command and returns what is now on screen
+func playback(w http.ResponseWriter, ctx AppContext, command func() (player.NowPlaying, error)) {
+	now, err := command()
+	if err == player.ErrNotInSlideshow {
+		ctx.Render.JSON(w, http.StatusNotFound, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusInternalServerError, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, now)
+}
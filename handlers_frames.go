@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/blreynolds4/photopi-api/frames"
+	"github.com/blreynolds4/photopi-api/framesync"
+	"github.com/gorilla/mux"
+)
+
+// frameResponse is a frame with how many photos it is showing and which
+// playlist builds its slideshow
+type frameResponse struct {
+	frames.Config
+	Photos   int    `json:"photos"`
+	Playlist string `json:"playlist"`
+}
+
+func describeFrame(f *frames.Frame) frameResponse {
+	response := frameResponse{
+		Config:   f.Config,
+		Playlist: f.Selector.Config().Active,
+	}
+	if infos, err := ioutil.ReadDir(f.ShowDir); err == nil {
+		for _, info := range infos {
+			if !info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+				response.Photos++
+			}
+		}
+	}
+	response.MaxCount = f.Capacity.MaxCount
+	response.MaxMB = f.Capacity.MaxBytes / (1024 * 1024)
+	response.Policy = f.Capacity.Policy
+	keep := f.Capacity.KeepPinned
+	response.KeepPinned = &keep
+	return response
+}
+
+// ListFramesHandler returns every frame, the default one first
+func ListFramesHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	result := []frameResponse{}
+	for _, f := range ctx.Frames.List() {
+		result = append(result, describeFrame(f))
+	}
+	ctx.Render.JSON(w, http.StatusOK, result)
+}
+
+// GetFrameHandler returns a frame
+func GetFrameHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	if f, ok := findFrame(w, req, ctx); ok {
+		ctx.Render.JSON(w, http.StatusOK, describeFrame(f))
+	}
+}
+
+// GetFrameSelectionHandler returns a frame's playlists
+func GetFrameSelectionHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	if f, ok := findFrame(w, req, ctx); ok {
+		getSelection(w, ctx, f.Selector)
+	}
+}
+
+// SetFrameSelectionHandler replaces a frame's playlists and rebuilds its slideshow
+func SetFrameSelectionHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	if f, ok := findFrame(w, req, ctx); ok {
+		setSelection(w, req, ctx, f.Selector)
+	}
+}
+
+// ApplyFrameSelectionHandler re-evaluates a frame's active playlist now
+func ApplyFrameSelectionHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	if f, ok := findFrame(w, req, ctx); ok {
+		applySelection(w, ctx, f.Selector)
+	}
+}
+
+// FrameEvictionsHandler returns the photos most recently rotated out of a frame
+func FrameEvictionsHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	if f, ok := findFrame(w, req, ctx); ok {
+		evictions(w, req, ctx, f.Capacity.EvictionLog)
+	}
+}
+
+// FrameManifestHandler lists the photos a frame client should have with
+// their hashes, clients send back the ETag to skip unchanged manifests
+func FrameManifestHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	f, ok := findFrame(w, req, ctx)
+	if !ok {
+		return
+	}
+
+	manifest, err := framesync.BuildManifest(f.Name, f.ShowDir, ctx.Hashes)
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusInternalServerError, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	etag := manifest.ETag()
+	w.Header().Set("ETag", etag)
+	if req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, manifest)
+}
+
+// FramePhotoHandler serves a photo from a frame's show directory, ranges
+// are supported so clients can resume downloads
+func FramePhotoHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	f, ok := findFrame(w, req, ctx)
+	if !ok {
+		return
+	}
+
+	name := mux.Vars(req)["photo"]
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		ctx.Render.JSON(w, http.StatusNotFound, Status{Status: "error", Message: "photo not found"})
+		return
+	}
+	http.ServeFile(w, req, filepath.Join(f.ShowDir, name))
+}
+
+func findFrame(w http.ResponseWriter, req *http.Request, ctx AppContext) (*frames.Frame, bool) {
+	f, err := ctx.Frames.Get(mux.Vars(req)["name"])
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusNotFound, Status{Status: "error", Message: err.Error()})
+		return nil, false
+	}
+	return f, true
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/blreynolds4/photopi-api/idempotency"
+)
+
+// longest Idempotency-Key accepted
+const maxIdempotencyKey = 255
+
+// recorder keeps a copy of the response as it is written
+type recorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.header == nil {
+		r.status = status
+		r.header = r.ResponseWriter.Header().Clone()
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(data []byte) (int, error) {
+	if r.header == nil {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+// idempotent sends the original response to a request retried with the
+// same Idempotency-Key instead of running it again, requests without a key
+// run as normal, server errors, rate limits, panics and failures the client
+// hung up on aren't kept so they can be retried
+func idempotent(fn HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+		key := req.Header.Get("Idempotency-Key")
+		if key == "" || ctx.Idempotency == nil {
+			fn(w, req, ctx)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			ctx.Render.Text(w, http.StatusBadRequest, fmt.Sprintf("Idempotency-Key can't be longer than %d characters", maxIdempotencyKey))
+			return
+		}
+
+		// the same key on another endpoint or from another user is another
+		// request
+		key = req.Method + " " + req.URL.Path + " " + key
+		if user, ok := currentUser(req); ok {
+			key = user.Name + " " + key
+		} else if invite, ok := currentInvite(req); ok {
+			key = "invite:" + invite.ID + " " + key
+		}
+		saved, done, err := ctx.Idempotency.Begin(key)
+		if err == idempotency.ErrInProgress {
+			ctx.Render.Text(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			ctx.Render.Text(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if done {
+			for name, values := range saved.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(saved.Status)
+			w.Write(saved.Body)
+			return
+		}
+
+		r := &recorder{ResponseWriter: w}
+		finished := false
+		defer func() {
+			// the handler panicked, release the key on the way out
+			if !finished {
+				ctx.Idempotency.Abandon(key)
+			}
+		}()
+		fn(r, req, ctx)
+		finished = true
+		if r.header == nil {
+			r.status = http.StatusOK
+			r.header = w.Header().Clone()
+		}
+		gone := req.Context().Err() != nil && r.status >= http.StatusBadRequest
+		if r.status >= http.StatusInternalServerError || r.status == http.StatusTooManyRequests || gone {
+			ctx.Idempotency.Abandon(key)
+			return
+		}
+		r.header.Del("Date")
+		err = ctx.Idempotency.Finish(key, idempotency.Response{Status: r.status, Header: r.header, Body: r.body.Bytes()})
+		if err != nil {
+			fmt.Println("Unable to save the response for", key, "because", err.Error())
+		}
+	}
+}
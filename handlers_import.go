@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+
+	"github.com/blreynolds4/photopi-api/events"
+	"github.com/blreynolds4/photopi-api/ingest"
+)
+
+// most URLs imported in one request and how many are fetched at once
+const (
+	maxImportURLs      = 50
+	importConcurrency  = 4
+	maxImportBodyBytes = 64 * 1024
+)
+
+type importRequest struct {
+	URLs     []string `json:"urls"`
+	Album    string   `json:"album"`
+	Tags     []string `json:"tags"`
+	Frames   []string `json:"frames"`
+	Caption  string   `json:"caption"`
+	Uploader string   `json:"uploader"`
+}
+
+type urlResult struct {
+	URL   string `json:"url"`
+	Photo string `json:"photo,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type importResponse struct {
+	Message string      `json:"message"`
+	Results []urlResult `json:"results"`
+}
+
+// ImportPhotosHandler downloads photos from the URLs given and adds them
+// like uploads, album, tags, frames, caption and uploader apply to every
+// one, the results say what happened to each URL
+func ImportPhotosHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	body := importRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxImportBodyBytes)).Decode(&body); err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: fmt.Sprintf("Invalid import %s", err.Error())})
+		return
+	}
+	if len(body.URLs) == 0 || len(body.URLs) > maxImportURLs {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: fmt.Sprintf("Import between 1 and %d URLs", maxImportURLs)})
+		return
+	}
+	routed, err := ctx.Ingest.CheckFrames(body.Frames)
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: err.Error()})
+		return
+	}
+
+	results := make([]urlResult, len(body.URLs))
+	saved := make([]string, len(body.URLs))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < importConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range work {
+				results[n], saved[n] = importURL(req, ctx, body.URLs[n])
+			}
+		}()
+	}
+	for n := range body.URLs {
+		work <- n
+	}
+	close(work)
+	wg.Wait()
+
+	// backup and stage the photos in the order they were asked for
+	added := []string{}
+	for n, file := range saved {
+		if file == "" {
+			continue
+		}
+		added = append(added, file)
+		w.Header().Add("Location", photoURL(file, req))
+		results[n].Photo = filepath.Base(file)
+	}
+	response := importResponse{Results: results}
+	if len(added) == 0 {
+		response.Message = "No photos were imported"
+		ctx.Render.JSON(w, http.StatusBadRequest, response)
+		return
+	}
+
+	tagErr := ctx.Ingest.Finish(added, ingest.Options{Album: body.Album, Tags: body.Tags, Frames: routed, Caption: body.Caption, Uploader: uploaderFor(req, body.Uploader)})
+	if tagErr != nil {
+		response.Message = fmt.Sprintf("Photos were imported but not added to album %s: %s", body.Album, tagErr.Error())
+		ctx.Render.JSON(w, http.StatusBadRequest, response)
+		return
+	}
+
+	response.Message = fmt.Sprintf("Imported %d of %d photos", len(added), len(body.URLs))
+	ctx.Render.JSON(w, http.StatusOK, response)
+}
+
+// importURL downloads and saves one photo
+func importURL(req *http.Request, ctx AppContext, link string) (urlResult, string) {
+	result := urlResult{URL: link}
+	filename, data, err := ctx.Downloader.Download(req.Context(), link)
+	if err != nil {
+		ctx.Events.Publish(events.PhotoFailed, link, map[string]string{"stage": "download", "error": err.Error()})
+		result.Error = err.Error()
+		return result, ""
+	}
+
+	file, err := ctx.Ingest.Save(filename, data, "url")
+	if err != nil {
+		result.Error = err.Error()
+		return result, ""
+	}
+	return result, file
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/invites"
+	"github.com/gorilla/mux"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// how long invites last unless asked and the longest they can
+const (
+	defaultInviteLifetime = 48 * time.Hour
+	maxInviteLifetime     = 90 * 24 * time.Hour
+)
+
+// sizes of QR code served, in pixels
+const (
+	defaultQRSize = 256
+	maxQRSize     = 1024
+)
+
+type inviteRequest struct {
+	Name      string   `json:"name"`
+	Album     string   `json:"album"`
+	Frames    []string `json:"frames"`
+	MaxPhotos int      `json:"maxPhotos"`
+	Expires   string   `json:"expires"`
+}
+
+// inviteResponse is an invite with the link guests open and its QR code
+type inviteResponse struct {
+	invites.Invite
+	Link string `json:"link"`
+	QR   string `json:"qr"`
+}
+
+func describeInvite(invite invites.Invite, req *http.Request, ctx AppContext) inviteResponse {
+	return inviteResponse{
+		Invite: invite,
+		Link:   urlUnder("/guest", ctx.Invites.Token(invite), req),
+		QR:     "/invites/" + invite.ID + "/qr.png",
+	}
+}
+
+// CreateInviteHandler makes an invite link for guests to add photos with,
+// expires is a duration such as 6h and defaults to 48h, album, frames and
+// maxPhotos are optional
+func CreateInviteHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	body := inviteRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: fmt.Sprintf("Invalid invite %s", err.Error())})
+		return
+	}
+
+	lifetime := defaultInviteLifetime
+	if body.Expires != "" {
+		d, err := time.ParseDuration(body.Expires)
+		if err != nil || d <= 0 || d > maxInviteLifetime {
+			ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: fmt.Sprintf("expires must be a duration up to %s, not %s", maxInviteLifetime, body.Expires)})
+			return
+		}
+		lifetime = d
+	}
+	routed, err := ctx.Ingest.CheckFrames(body.Frames)
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: err.Error()})
+		return
+	}
+
+	user, _ := currentUser(req)
+	invite, err := ctx.Invites.Create(invites.Invite{
+		Name:      body.Name,
+		Album:     body.Album,
+		Frames:    routed,
+		MaxPhotos: body.MaxPhotos,
+		CreatedBy: user.Name,
+		Expires:   time.Now().Add(lifetime),
+	})
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	w.Header().Add("Location", newURL(invite.ID, req))
+	ctx.Render.JSON(w, http.StatusCreated, describeInvite(invite, req, ctx))
+}
+
+// ListInvitesHandler returns every invite, newest first
+func ListInvitesHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	result := []inviteResponse{}
+	for _, invite := range ctx.Invites.List() {
+		result = append(result, describeInvite(invite, req, ctx))
+	}
+	ctx.Render.JSON(w, http.StatusOK, result)
+}
+
+// GetInviteHandler returns one invite
+func GetInviteHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	invite, err := ctx.Invites.Get(mux.Vars(req)["id"])
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusNotFound, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, describeInvite(invite, req, ctx))
+}
+
+// RevokeInviteHandler stops an invite link working, photos already added
+// with it stay
+func RevokeInviteHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	err := ctx.Invites.Revoke(mux.Vars(req)["id"])
+	if err == invites.ErrNotFound {
+		ctx.Render.JSON(w, http.StatusNotFound, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusInternalServerError, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, Status{Status: "ok", Message: "Invite revoked"})
+}
+
+// InviteQRHandler draws the invite's link as a QR code for guests to scan,
+// size is its width in pixels
+func InviteQRHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	invite, err := ctx.Invites.Get(mux.Vars(req)["id"])
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusNotFound, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	size := defaultQRSize
+	if value := req.URL.Query().Get("size"); value != "" {
+		size, err = strconv.Atoi(value)
+		if err != nil || size < 64 || size > maxQRSize {
+			ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: fmt.Sprintf("size must be between 64 and %d", maxQRSize)})
+			return
+		}
+	}
+
+	png, err := qrcode.Encode(describeInvite(invite, req, ctx).Link, qrcode.Medium, size)
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusInternalServerError, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(png)
+}
+
+// guestPage is what an invite link opens, a form like the upload page
+var guestPage = template.Must(template.New("guest").Parse(`<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1" />
+    <title>{{if .Name}}{{.Name}} - {{end}}Add Photos to Pi Frame</title>
+  </head>
+  <body>
+    {{if .Error}}
+    <h1>This link can't be used</h1>
+    <p>The {{.Error}}.</p>
+    {{else}}
+    <h1>{{if .Name}}{{.Name}}{{else}}Add your photos{{end}}</h1>
+    {{if ge .Remaining 0}}<p>You can add {{.Remaining}} more photos.</p>{{end}}
+    <form enctype="multipart/form-data" action="{{.Action}}" method="post">
+      <label for="uploader">Your name:</label>
+      <input type="text" id="uploader" name="uploader" maxlength="100"><br><br>
+      <label for="caption">Caption:</label>
+      <input type="text" id="caption" name="caption" maxlength="200"><br><br>
+      <label for="uploadImages">Select photos:</label>
+      <input type="file" accept="image/*" id="uploadImages" name="{{.TagName}}" multiple><br><br>
+      <input type="submit" value="Upload Photos">
+    </form>
+    <p>Link expires {{.Expires.Format "Mon 2 Jan 15:04"}}.</p>
+    {{end}}
+  </body>
+</html>
+`))
+
+type guestView struct {
+	Name      string
+	Error     string
+	Remaining int
+	Expires   time.Time
+	Action    string
+	TagName   string
+}
+
+// GuestPageHandler is the page an invite link opens, guests pick their
+// photos there without signing in
+func GuestPageHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	token := mux.Vars(req)["token"]
+	invite, err := ctx.Invites.Check(token)
+	view := guestView{
+		Name:      invite.Name,
+		Remaining: invite.Remaining(),
+		Expires:   invite.Expires,
+		Action:    "/photos?invite=" + template.URLQueryEscaper(token),
+		TagName:   ctx.TagName,
+	}
+	status := http.StatusOK
+	if err != nil {
+		view.Error = err.Error()
+		status = http.StatusForbidden
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := guestPage.Execute(w, view); err != nil {
+		fmt.Println("Unable to show the guest page because", err.Error())
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/catalog"
+	"github.com/blreynolds4/photopi-api/frames"
+	"github.com/gorilla/mux"
+)
+
+// photos saved more recently than this aren't retried, they may still be
+// waiting for their upload to finish
+const retryWait = time.Minute
+
+type tagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+// flagsRequest changes only the flags that are set
+type flagsRequest struct {
+	Favourite *bool `json:"favourite"`
+	Hidden    *bool `json:"hidden"`
+}
+
+// ListPhotosHandler returns the catalog, optionally only the photos in an
+// album (id or name) or with a tag
+func ListPhotosHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	albumID := ""
+	if album := req.URL.Query().Get("album"); album != "" {
+		a, err := ctx.Catalog.FindAlbum(album)
+		if err != nil {
+			albumError(w, ctx, err)
+			return
+		}
+		albumID = a.ID
+	}
+	tag := req.URL.Query().Get("tag")
+
+	photos := []catalog.Photo{}
+	for _, p := range ctx.Catalog.List() {
+		if albumID != "" && !p.InAlbum(albumID) {
+			continue
+		}
+		if tag != "" && !p.HasTag(tag) {
+			continue
+		}
+		photos = append(photos, p)
+	}
+	ctx.Render.JSON(w, http.StatusOK, photos)
+}
+
+// GetPhotoHandler returns what the catalog knows about a photo
+func GetPhotoHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	photo, err := ctx.Catalog.Get(mux.Vars(req)["name"])
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusNotFound, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, photo)
+}
+
+// SetPhotoTagsHandler replaces a photo's tags
+func SetPhotoTagsHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	body := tagsRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: fmt.Sprintf("Invalid tags %s", err.Error())})
+		return
+	}
+
+	photo, err := ctx.Catalog.Update(mux.Vars(req)["name"], func(p *catalog.Photo) error {
+		p.Tags = catalog.NormalizeTags(body.Tags)
+		return nil
+	})
+	if err == catalog.ErrNotFound {
+		ctx.Render.JSON(w, http.StatusNotFound, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusInternalServerError, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, photo)
+}
+
+// UpdatePhotoHandler sets a photo's favourite and hidden flags, hiding a
+// photo takes it out of the slideshow now and showing it again puts it back
+func UpdatePhotoHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	body := flagsRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: fmt.Sprintf("Invalid photo %s", err.Error())})
+		return
+	}
+
+	wasHidden := false
+	photo, err := ctx.Catalog.Update(mux.Vars(req)["name"], func(p *catalog.Photo) error {
+		wasHidden = p.Hidden
+		if body.Favourite != nil {
+			p.Favourite = *body.Favourite
+		}
+		if body.Hidden != nil {
+			p.Hidden = *body.Hidden
+		}
+		return nil
+	})
+	if err == catalog.ErrNotFound {
+		ctx.Render.JSON(w, http.StatusNotFound, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusInternalServerError, Status{Status: "error", Message: err.Error()})
+		return
+	}
+
+	if photo.Hidden && !wasHidden {
+		err = ctx.Stager.Unstage(photo.Name, "hidden")
+	} else if wasHidden && !photo.Hidden {
+		err = showAgain(ctx, photo.Name)
+	}
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusInternalServerError, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, photo)
+}
+
+// DeletePhotoHandler trashes a photo, it leaves every slideshow, archive
+// and the catalog
+func DeletePhotoHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	err := ctx.Frames.Trash(mux.Vars(req)["name"])
+	if err == frames.ErrNotFound {
+		ctx.Render.JSON(w, http.StatusNotFound, Status{Status: "error", Message: "photo not found"})
+		return
+	}
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusInternalServerError, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RetryPhotosHandler backs up and stages again the photos staging left
+// waiting, those saved in the last retryWait may still be on their way
+func RetryPhotosHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	retried, err := ctx.Ingest.Retry(retryWait)
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusInternalServerError, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, map[string][]string{"retried": retried})
+}
+
+// showAgain returns an unhidden photo to the slideshow, with a playlist
+// active it is up to the playlist's rules
+func showAgain(ctx AppContext, name string) error {
+	if ctx.Selector != nil && ctx.Selector.Config().Active != "" {
+		_, err := ctx.Selector.Apply()
+		return err
+	}
+	return ctx.Stager.Restore(name)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/blreynolds4/photopi-api/schedule"
+)
+
+// GetScheduleHandler returns the schedule entries
+func GetScheduleHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	ctx.Render.JSON(w, http.StatusOK, ctx.Schedule.Config())
+}
+
+// SetScheduleHandler replaces the schedule, the display moves to whatever state it now says
+func SetScheduleHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	config := schedule.Config{}
+	if err := json.NewDecoder(req.Body).Decode(&config); err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: fmt.Sprintf("Invalid schedule %s", err.Error())})
+		return
+	}
+
+	if err := ctx.Schedule.SetConfig(config); err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, ctx.Schedule.Config())
+}
+
+// GetDisplayHandler returns whether the display is blank and the active playlist
+func GetDisplayHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	ctx.Render.JSON(w, http.StatusOK, ctx.Schedule.State())
+}
+
+// BlankDisplayHandler turns the display off until woken or the schedule changes it
+func BlankDisplayHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	ctx.Render.JSON(w, http.StatusOK, ctx.Schedule.Blank("api"))
+}
+
+// WakeDisplayHandler turns the display on until blanked or the schedule changes it
+func WakeDisplayHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	ctx.Render.JSON(w, http.StatusOK, ctx.Schedule.Wake("api"))
+}
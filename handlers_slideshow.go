@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/blreynolds4/photopi-api/selection"
+	"github.com/blreynolds4/photopi-api/stager"
+)
+
+// EvictionsHandler returns the photos most recently rotated out of the slideshow
+// limit defaults to 100
+func EvictionsHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	evictions(w, req, ctx, ctx.Capacity.EvictionLog)
+}
+
+func evictions(w http.ResponseWriter, req *http.Request, ctx AppContext, log string) {
+	limit := 100
+	if value := req.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: "limit must be a positive number"})
+			return
+		}
+		limit = n
+	}
+
+	evictions, err := stager.ReadEvictions(log, limit)
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusInternalServerError, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, evictions)
+}
+
+type selectionResponse struct {
+	Config selection.Config `json:"config"`
+	Last   selection.Result `json:"last"`
+}
+
+// GetSelectionHandler returns the playlists, which one is active and what it last picked
+func GetSelectionHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	getSelection(w, ctx, ctx.Selector)
+}
+
+func getSelection(w http.ResponseWriter, ctx AppContext, selector selection.Selector) {
+	ctx.Render.JSON(w, http.StatusOK, selectionResponse{
+		Config: selector.Config(),
+		Last:   selector.Last(),
+	})
+}
+
+// SetSelectionHandler replaces the playlists and rebuilds the slideshow from the active one
+func SetSelectionHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	setSelection(w, req, ctx, ctx.Selector)
+}
+
+func setSelection(w http.ResponseWriter, req *http.Request, ctx AppContext, selector selection.Selector) {
+	config := selection.Config{}
+	if err := json.NewDecoder(req.Body).Decode(&config); err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: fmt.Sprintf("Invalid selection %s", err.Error())})
+		return
+	}
+
+	if err := selector.SetConfig(config); err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	getSelection(w, ctx, selector)
+}
+
+// ApplySelectionHandler re-evaluates the active playlist now instead of waiting for the schedule
+func ApplySelectionHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	applySelection(w, ctx, ctx.Selector)
+}
+
+func applySelection(w http.ResponseWriter, ctx AppContext, selector selection.Selector) {
+	result, err := selector.Apply()
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusInternalServerError, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, result)
+}
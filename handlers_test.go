@@ -1,12 +1,43 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/blreynolds4/photopi-api/config"
+	"github.com/blreynolds4/photopi-api/idempotency"
+	"github.com/blreynolds4/photopi-api/ingest"
+	"github.com/blreynolds4/photopi-api/invites"
+	"github.com/blreynolds4/photopi-api/player"
+	"github.com/blreynolds4/photopi-api/ratelimit"
+	"github.com/blreynolds4/photopi-api/tus"
+	"github.com/blreynolds4/photopi-api/users"
+	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/negroni"
 )
 
 func TestHealthcheckHandler(t *testing.T) {
@@ -23,3 +54,766 @@ func TestHealthcheckHandler(t *testing.T) {
 	assert.Equal(t, "photopi-api", obj["appName"], "they should be equal")
 	assert.Equal(t, ctx.Version, obj["version"], "they should be equal")
 }
+
+func TestSlideshowHandlerListsAndServesPhotos(t *testing.T) {
+	ctx := CreateContextForTestSetup()
+	ctx.ShowPath = t.TempDir()
+	require.Nil(t, ioutil.WriteFile(filepath.Join(ctx.ShowPath, "a b.jpg"), []byte("photo"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(ctx.ShowPath, ".hidden"), []byte("x"), 0644))
+	data := t.TempDir()
+	play, err := player.NewPlayer(filepath.Join(data, "player.json"), filepath.Join(data, "now.json"),
+		filepath.Join(data, "shown.json"), ctx.ShowPath, nil, ctx.Events)
+	require.Nil(t, err)
+	defer play.Stop()
+	ctx.Player = play
+
+	router := mux.NewRouter()
+	router.Handle("/slideshow", makeHandler(ctx, SlideshowHandler))
+	router.Handle("/slideshow/photos/{name}", makeHandler(ctx, SlideshowPhotoHandler))
+	router.Handle("/slideshow/show/{name}", makeHandler(ctx, ShowHandler))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/slideshow", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	slides := []player.SlideInfo{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &slides))
+	require.Len(t, slides, 1)
+	assert.Equal(t, "/slideshow/photos/a%20b.jpg", slides[0].URL)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", slides[0].URL, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "photo", w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/slideshow/photos/.hidden", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/slideshow/show/missing.jpg", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRetriedRequestsGetTheOriginalResponse(t *testing.T) {
+	ctx := CreateContextForTestSetup()
+	replays, err := idempotency.NewStore(filepath.Join(t.TempDir(), "idempotency.json"), time.Hour)
+	require.Nil(t, err)
+	ctx.Idempotency = replays
+
+	calls := 0
+	handler := idempotent(func(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+		calls++
+		w.Header().Add("Location", "http://frame/photos/a.jpg")
+		ctx.Render.JSON(w, http.StatusOK, postResponse{Message: "added", Files: []string{"a.jpg"}})
+	})
+
+	post := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/photos", nil)
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		makeHandler(ctx, handler).ServeHTTP(w, r)
+		return w
+	}
+
+	first := post("upload-1")
+	replay := post("upload-1")
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, http.StatusOK, replay.Code)
+	assert.Equal(t, first.Body.String(), replay.Body.String())
+	assert.Equal(t, "http://frame/photos/a.jpg", replay.Header().Get("Location"))
+	assert.Equal(t, "true", replay.Header().Get("Idempotent-Replayed"))
+
+	post("upload-2")
+	post("")
+	assert.Equal(t, 3, calls)
+}
+
+func TestFailedRequestsReleaseTheirKey(t *testing.T) {
+	ctx := CreateContextForTestSetup()
+	replays, err := idempotency.NewStore(filepath.Join(t.TempDir(), "idempotency.json"), time.Hour)
+	require.Nil(t, err)
+	ctx.Idempotency = replays
+
+	fail := true
+	handler := idempotent(func(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+		if fail {
+			panic("lost the disk")
+		}
+		ctx.Render.Text(w, http.StatusBadRequest, "unexpected EOF")
+	})
+	post := func(req *http.Request) *httptest.ResponseRecorder {
+		req.Header.Set("Idempotency-Key", "upload-1")
+		w := httptest.NewRecorder()
+		makeHandler(ctx, handler).ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Panics(t, func() { post(httptest.NewRequest("POST", "/photos", nil)) })
+
+	// the retry runs instead of waiting on the request that panicked,
+	// the client hanging up on it doesn't keep its failure either
+	fail = false
+	hungUp, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, http.StatusBadRequest, post(httptest.NewRequest("POST", "/photos", nil).WithContext(hungUp)).Code)
+	retry := post(httptest.NewRequest("POST", "/photos", nil))
+	assert.Equal(t, http.StatusBadRequest, retry.Code)
+	assert.Empty(t, retry.Header().Get("Idempotent-Replayed"))
+}
+
+func TestRoutesNeedTheRightUser(t *testing.T) {
+	ctx := CreateContextForTestSetup()
+	accounts, err := users.NewStore(filepath.Join(t.TempDir(), "users.json"))
+	require.Nil(t, err)
+	_, err = accounts.Add("sam", "battery staple", users.Admin)
+	require.Nil(t, err)
+	_, err = accounts.Add("nana", "correct horse", users.Member)
+	require.Nil(t, err)
+	ctx.Users = accounts
+	ctx.AuthRequired = true
+	ctx.RateLimits = ratelimit.Budgets{"Login": {Requests: ratelimit.Rate{Amount: 2, Per: time.Minute}}}
+
+	ok := func(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+		user, _ := currentUser(req)
+		ctx.Render.Text(w, http.StatusOK, user.Name)
+	}
+	router := mux.NewRouter()
+	router.Handle("/login", makeHandler(ctx, LoginHandler)).Name("Login")
+	router.Handle("/open", makeHandler(ctx, ok))
+	router.Handle("/member", makeHandler(ctx, member(ok)))
+	router.Handle("/admin", makeHandler(ctx, admin(ok)))
+	n := negroni.New(authenticate(ctx), rateLimit(ctx, router))
+	n.UseHandler(router)
+	send := func(path string, header string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		n.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, send("/open", "").Code)
+	w := send("/member", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, http.StatusUnauthorized, send("/open", "Bearer ppt_wrong").Code)
+
+	nanaToken, _, err := accounts.IssueToken("nana", "test", 0, false)
+	require.Nil(t, err)
+	w = send("/member", "Bearer "+nanaToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "nana", w.Body.String())
+	assert.Equal(t, http.StatusForbidden, send("/admin", "Bearer "+nanaToken).Code)
+
+	// signing in sets a cookie that works like a token
+	w = httptest.NewRecorder()
+	n.ServeHTTP(w, httptest.NewRequest("POST", "/login", strings.NewReader(`{"name":"Sam","password":"battery staple"}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 2)
+	require.Equal(t, sessionCookie, cookies[0].Name)
+	req := httptest.NewRequest("GET", "/admin", nil)
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	n.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "sam", w.Body.String())
+
+	// guessing passwords is slowed down
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		n.ServeHTTP(w, httptest.NewRequest("POST", "/login", strings.NewReader(`{"name":"sam","password":"guess"}`)))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// without AUTH_REQUIRED anyone with an account still has to sign in
+	ctx.AuthRequired = false
+	router = mux.NewRouter()
+	router.Handle("/admin", makeHandler(ctx, admin(ok)))
+	n = negroni.New(authenticate(ctx))
+	n.UseHandler(router)
+	assert.Equal(t, http.StatusUnauthorized, send("/admin", "").Code)
+	assert.Equal(t, http.StatusForbidden, send("/admin", "Bearer "+nanaToken).Code)
+
+	// until there are accounts anyone can
+	ctx.Users, err = users.NewStore(filepath.Join(t.TempDir(), "users.json"))
+	require.Nil(t, err)
+	router = mux.NewRouter()
+	router.Handle("/admin", makeHandler(ctx, admin(ok)))
+	n = negroni.New(authenticate(ctx))
+	n.UseHandler(router)
+	assert.Equal(t, http.StatusOK, send("/admin", "").Code)
+}
+
+func TestRateLimitsAreKeptPerRouteAndClient(t *testing.T) {
+	ctx := CreateContextForTestSetup()
+	accounts, err := users.NewStore(filepath.Join(t.TempDir(), "users.json"))
+	require.Nil(t, err)
+	_, err = accounts.Add("nana", "correct horse", users.Member)
+	require.Nil(t, err)
+	ctx.Users = accounts
+	ctx.RateLimits, err = ratelimit.ParseBudgets("*=3/min; Upload=10/min 1KB/min")
+	require.Nil(t, err)
+
+	read := func(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+		if _, err := ioutil.ReadAll(req.Body); err != nil {
+			ctx.Render.Text(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	router := mux.NewRouter()
+	router.Handle("/upload", makeHandler(ctx, read)).Name("Upload")
+	router.Handle("/other", makeHandler(ctx, read))
+	n := negroni.New(authenticate(ctx), rateLimit(ctx, router))
+	n.UseHandler(router)
+	send := func(path string, from string, token string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.RemoteAddr = from + ":5000"
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		n.ServeHTTP(w, req)
+		return w
+	}
+
+	// routes without a budget share the default one
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, send("/other", "10.0.0.1", "", "").Code)
+	}
+	w := send("/other", "10.0.0.1", "", "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "20", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, send("/other", "10.0.0.2", "", "").Code)
+
+	// a user has their own budget wherever they send from
+	token, _, err := accounts.IssueToken("nana", "test", 0, false)
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusOK, send("/other", "10.0.0.1", token, "").Code)
+
+	// bytes are counted separately from requests
+	assert.Equal(t, http.StatusOK, send("/upload", "10.0.0.1", "", strings.Repeat("x", 1000)).Code)
+	w = send("/upload", "10.0.0.1", "", strings.Repeat("x", 1000))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, send("/upload", "10.0.0.1", "", "").Code)
+
+	// and a body without a length is cut off once it is over
+	unsized := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/upload", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 2000))))
+		req.RemoteAddr = "10.0.0.3:5000"
+		req.ContentLength = -1
+		w := httptest.NewRecorder()
+		n.ServeHTTP(w, req)
+		return w
+	}
+	unsized()
+	w = unsized()
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "rate limit")
+
+	// frames catching up don't spend everyone else's budget
+	for _, route := range []string{"FrameManifest", "FramePhoto"} {
+		assert.Contains(t, defaultRateLimits, route)
+	}
+}
+
+func TestTheDefaultRateLimitsParse(t *testing.T) {
+	budgets, err := ratelimit.ParseBudgets(DEFAULT_RATE_LIMITS)
+	require.Nil(t, err)
+	assert.Equal(t, budgets, defaultRateLimits)
+	assert.Panics(t, func() { mustParseBudgets("AddPhotos=lots") })
+
+	// settings built from a config that skipped checking still refuse it
+	c := config.Default()
+	c.Server.RateLimits = "AddPhotos=lots"
+	_, err = settingsFromConfig(c)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "server.rate_limits")
+	c = config.Default()
+	c.Server.Web.TrustedProxies = []string{"10.0.0.0/33"}
+	_, err = settingsFromConfig(c)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "server.web.trusted_proxies")
+}
+
+func TestUploadsOverTheByteBudgetAreTooManyRequests(t *testing.T) {
+	ctx := CreateContextForTestSetup()
+	pipeline := &savedPhotos{dir: t.TempDir()}
+	ctx.Ingest = pipeline
+	var err error
+	ctx.RateLimits, err = ratelimit.ParseBudgets("AddPhotos=10/min 1KB/min")
+	require.Nil(t, err)
+	router := mux.NewRouter()
+	router.Handle("/photos", makeHandler(ctx, AddPhotosHandler)).Methods("POST").Name("AddPhotos")
+	n := negroni.New(authenticate(ctx), rateLimit(ctx, router))
+	n.UseHandler(router)
+
+	upload := func() *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		part, err := form.CreateFormFile(ctx.TagName, "beach.jpg")
+		require.Nil(t, err)
+		part.Write(bytes.Repeat([]byte("x"), 2000))
+		require.Nil(t, form.Close())
+
+		// without a length the budget is spent as the photo is read
+		req := httptest.NewRequest("POST", "/photos", ioutil.NopCloser(body))
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.ContentLength = -1
+		w := httptest.NewRecorder()
+		n.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, upload().Code)
+	w := upload()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Empty(t, w.Header().Get("Location"))
+	assert.Equal(t, 1, len(pipeline.saved))
+}
+
+func TestGuestsNeedAValidInvite(t *testing.T) {
+	ctx := CreateContextForTestSetup()
+	data := t.TempDir()
+	guests, err := invites.NewStore(filepath.Join(data, "invites.json"), filepath.Join(data, "invites.key"))
+	require.Nil(t, err)
+	ctx.Invites = guests
+	ctx.AuthRequired = true
+
+	invite, err := guests.Create(invites.Invite{Album: "Party", Expires: time.Now().Add(time.Hour)})
+	require.Nil(t, err)
+	revoked, err := guests.Create(invites.Invite{Expires: time.Now().Add(time.Hour)})
+	require.Nil(t, err)
+	require.Nil(t, guests.Revoke(revoked.ID))
+
+	handler := makeHandler(ctx, memberOrGuest(func(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+		found, _ := currentInvite(req)
+		ctx.Render.Text(w, http.StatusOK, found.Album)
+	}))
+	send := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/photos?invite="+url.QueryEscape(token), nil))
+		return w
+	}
+
+	w := send(guests.Token(invite))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Party", w.Body.String())
+	// scripts can keep the token out of the url
+	req := httptest.NewRequest("POST", "/photos", nil)
+	req.Header.Set(inviteHeader, guests.Token(invite))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, "Party", w.Body.String())
+	assert.Equal(t, http.StatusForbidden, send(guests.Token(revoked)).Code)
+	assert.Equal(t, http.StatusForbidden, send("made.up.token").Code)
+	// without an invite it is up to the user
+	assert.Equal(t, http.StatusUnauthorized, send("").Code)
+}
+
+func TestLocationsUseTheSchemeTheClientUsed(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://photopi.local:8080/albums", nil)
+	assert.Equal(t, "http://photopi.local:8080/albums/a.jpg", newURL("a.jpg", req))
+
+	// only a trusted proxy can say the client used https
+	_, proxy, _ := net.ParseCIDR("10.0.0.0/24")
+	forwarded := func(from string) string {
+		scheme := ""
+		r := httptest.NewRequest("POST", "http://photopi.local:8080/albums", nil)
+		r.RemoteAddr = from + ":4000"
+		r.Header.Set("X-Forwarded-Proto", "https")
+		forwardedScheme(webSettings{trustedProxies: []*net.IPNet{proxy}})(httptest.NewRecorder(), r, func(w http.ResponseWriter, r *http.Request) {
+			scheme = photoURL("a.jpg", r)
+		})
+		return scheme
+	}
+	assert.Equal(t, "https://photopi.local:8080/photos/a.jpg", forwarded("10.0.0.2"))
+	assert.Equal(t, "http://photopi.local:8080/photos/a.jpg", forwarded("192.168.1.20"))
+
+	req = httptest.NewRequest("POST", "https://photopi.local:8443/albums", nil)
+	assert.Equal(t, "https://photopi.local:8443/albums/a.jpg", newURL("a.jpg", req))
+}
+
+func TestPlainRequestsAreRedirectedToHTTPS(t *testing.T) {
+	redirect := func(port string, target string) string {
+		w := httptest.NewRecorder()
+		redirectToTLS(port).ServeHTTP(w, httptest.NewRequest("POST", target, nil))
+		assert.Equal(t, http.StatusPermanentRedirect, w.Code)
+		return w.Header().Get("Location")
+	}
+	assert.Equal(t, "https://photopi.local:8443/photos?invite=x", redirect("8443", "http://photopi.local:8080/photos?invite=x"))
+	assert.Equal(t, "https://photopi.local/slideshow", redirect("443", "http://photopi.local/slideshow"))
+	assert.Equal(t, "https://[::1]/me", redirect("443", "http://[::1]:8080/me"))
+}
+
+func TestCookieSessionsNeedTheCSRFToken(t *testing.T) {
+	ctx := CreateContextForTestSetup()
+	accounts, err := users.NewStore(filepath.Join(t.TempDir(), "users.json"))
+	require.Nil(t, err)
+	_, err = accounts.Add("nana", "correct horse", users.Member)
+	require.Nil(t, err)
+	ctx.Users = accounts
+	ctx.AuthRequired = true
+	web := webSettings{corsOrigins: []string{"http://localhost:8081"}, corsMethods: []string{"GET", "POST"},
+		contentSecurityPolicy: config.Default().Server.Web.ContentSecurityPolicy, frameOptions: "SAMEORIGIN"}
+
+	ok := func(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+		w.WriteHeader(http.StatusOK)
+	}
+	router := mux.NewRouter()
+	router.Handle("/login", makeHandler(ctx, LoginHandler)).Methods("POST").Name("Login")
+	router.Handle("/member", makeHandler(ctx, member(ok)))
+	n := negroni.New(securityHeaders(ctx, web), allowOrigins(web), authenticate(ctx), checkCSRF(ctx, web, router))
+	n.UseHandler(router)
+	send := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		n.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send(httptest.NewRequest("POST", "/login", strings.NewReader(`{"name":"nana","password":"correct horse"}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "SAMEORIGIN", w.Header().Get("X-Frame-Options"))
+	assert.Contains(t, w.Header().Get("Content-Security-Policy"), "default-src 'self'")
+	cookies := map[string]*http.Cookie{}
+	for _, cookie := range w.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+	require.Contains(t, cookies, csrfCookie)
+	assert.False(t, cookies[csrfCookie].HttpOnly)
+
+	post := func(csrf string, origin string) *http.Request {
+		req := httptest.NewRequest("POST", "http://photopi.local/member", nil)
+		req.AddCookie(cookies[sessionCookie])
+		req.AddCookie(cookies[csrfCookie])
+		if csrf != "" {
+			req.Header.Set(csrfHeader, csrf)
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		return req
+	}
+	assert.Equal(t, http.StatusForbidden, send(post("", "")).Code)
+	assert.Equal(t, http.StatusForbidden, send(post("wrong", "")).Code)
+	assert.Equal(t, http.StatusOK, send(post(cookies[csrfCookie].Value, "")).Code)
+	assert.Equal(t, http.StatusOK, send(post(cookies[csrfCookie].Value, "http://photopi.local")).Code)
+	assert.Equal(t, http.StatusForbidden, send(post(cookies[csrfCookie].Value, "http://evil.example")).Code)
+
+	// a page from the dev server can ask first and then send with its cookies
+	preflight := httptest.NewRequest("OPTIONS", "/member", nil)
+	preflight.Header.Set("Origin", "http://localhost:8081")
+	preflight.Header.Set("Access-Control-Request-Method", "POST")
+	w = send(preflight)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "http://localhost:8081", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), csrfHeader)
+	w = send(post(cookies[csrfCookie].Value, "http://localhost:8081"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "http://localhost:8081", w.Header().Get("Access-Control-Allow-Origin"))
+
+	// tokens aren't sent by the browser on its own
+	token, _, err := accounts.IssueToken("nana", "script", 0, false)
+	require.Nil(t, err)
+	req := httptest.NewRequest("POST", "/member", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusOK, send(req).Code)
+
+	// the upload page's form can't send the header, it is let in when the
+	// browser says it came from one of this server's pages
+	page, err := ioutil.ReadFile(filepath.Join("public", "index.html"))
+	require.Nil(t, err)
+	action := regexp.MustCompile(`action="([^"]+)"`).FindSubmatch(page)
+	field := regexp.MustCompile(`type="file"[^>]*name="([^"]+)"`).FindSubmatch(page)
+	require.NotNil(t, action)
+	require.NotNil(t, field)
+	pipeline := &savedPhotos{dir: t.TempDir()}
+	ctx.Ingest = pipeline
+	ctx.TagName = string(field[1])
+	router.Handle(string(action[1]), makeHandler(ctx, member(AddPhotosHandler))).Methods("POST")
+	submit := func(header, from string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		part, err := form.CreateFormFile(string(field[1]), "beach.jpg")
+		require.Nil(t, err)
+		part.Write([]byte("photo"))
+		require.Nil(t, form.Close())
+		req := httptest.NewRequest("POST", "http://photopi.local"+string(action[1]), body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.AddCookie(cookies[sessionCookie])
+		req.AddCookie(cookies[csrfCookie])
+		if header != "" {
+			req.Header.Set(header, from)
+		}
+		return send(req)
+	}
+	assert.Equal(t, http.StatusOK, submit("Origin", "http://photopi.local").Code)
+	assert.Equal(t, http.StatusOK, submit("Referer", "http://photopi.local/").Code)
+	assert.Len(t, pipeline.saved, 2)
+	assert.Equal(t, http.StatusForbidden, submit("", "").Code)
+	assert.Equal(t, http.StatusForbidden, submit("Referer", "http://evil.example/upload.html").Code)
+	assert.Equal(t, http.StatusForbidden, submit("Origin", "https://photopi.local").Code)
+	assert.Len(t, pipeline.saved, 2)
+}
+
+func TestAllowedHostsMatchOnAnyPort(t *testing.T) {
+	ctx := CreateContextForTestSetup()
+	ctx.Env = "PROD"
+	web := webSettings{allowedHosts: []string{"photopi.local", "::1"}, frameOptions: "SAMEORIGIN"}
+	n := negroni.New(securityHeaders(ctx, web))
+	n.UseHandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	send := func(host string) int {
+		req := httptest.NewRequest("GET", "/photos", nil)
+		req.Host = host
+		w := httptest.NewRecorder()
+		n.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send("photopi.local:8080"))
+	assert.Equal(t, http.StatusOK, send("PhotoPi.local"))
+	assert.Equal(t, http.StatusOK, send("[::1]:8443"))
+	assert.Equal(t, http.StatusBadRequest, send("evil.example:8080"))
+	assert.Equal(t, http.StatusBadRequest, send("photopi.local.evil.example"))
+}
+
+// savedPhotos is a pipeline that only writes what it is given to dir
+type savedPhotos struct {
+	dir      string
+	saved    []string
+	finished []string
+}
+
+func (s *savedPhotos) Save(filename string, data []byte, source string) (string, error) {
+	file := filepath.Join(s.dir, fmt.Sprintf("%d-%s", len(s.saved), filename))
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		return "", err
+	}
+	s.saved = append(s.saved, file)
+	return file, nil
+}
+
+func (s *savedPhotos) CheckFrames(names []string) ([]string, error) {
+	return names, nil
+}
+
+func (s *savedPhotos) Finish(files []string, options ingest.Options) error {
+	s.finished = append(s.finished, files...)
+	return nil
+}
+
+func (s *savedPhotos) Archive(files []string) error {
+	return nil
+}
+
+func (s *savedPhotos) Discard(files []string) {
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+func (s *savedPhotos) Add(filename string, data []byte, source string, options ingest.Options) (string, error) {
+	file, err := s.Save(filename, data, source)
+	if err == nil {
+		err = s.Finish([]string{file}, options)
+	}
+	return file, err
+}
+
+func (s *savedPhotos) Retry(settle time.Duration) ([]string, error) {
+	return []string{}, nil
+}
+
+func TestFinishedUploadsAreNotAddedTwice(t *testing.T) {
+	ctx := CreateContextForTestSetup()
+	pipeline := &savedPhotos{dir: t.TempDir()}
+	ctx.Ingest = pipeline
+	uploads, err := tus.NewStore(t.TempDir())
+	require.Nil(t, err)
+	ctx.Uploads = uploads
+	ctx.Limits.MaxPhotoBytes = 10
+
+	router := mux.NewRouter()
+	router.Handle("/uploads", makeHandler(ctx, CreateUploadHandler)).Methods("POST")
+	router.Handle("/uploads/{id}", makeHandler(ctx, UploadStatusHandler)).Methods("HEAD")
+	router.Handle("/uploads/{id}", makeHandler(ctx, AppendUploadHandler)).Methods("PATCH")
+	send := func(method, target string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, bytes.NewReader(body))
+		r.Header.Set("Tus-Resumable", tus.Version)
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	upload := func(filename string, data []byte) (string, *httptest.ResponseRecorder) {
+		w := send("POST", "/uploads", nil, map[string]string{
+			"Upload-Length":   strconv.Itoa(len(data)),
+			"Upload-Metadata": tus.FormatMetadata(map[string]string{"filename": filename}),
+		})
+		require.Equal(t, http.StatusCreated, w.Code)
+		location := w.Header().Get("Location")
+		return location, send("PATCH", location, data, map[string]string{
+			"Upload-Offset": "0",
+			"Content-Type":  "application/offset+octet-stream",
+		})
+	}
+
+	location, w := upload("beach.jpg", []byte("photo"))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	photo := w.Header().Get("Photo-Location")
+	assert.NotEmpty(t, photo)
+
+	// a client that missed that response finds out the upload finished
+	w = send("HEAD", location, nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "5", w.Header().Get("Upload-Offset"))
+	assert.Equal(t, photo, w.Header().Get("Photo-Location"))
+	w = send("PATCH", location, []byte("photo"), map[string]string{
+		"Upload-Offset": "0",
+		"Content-Type":  "application/offset+octet-stream",
+	})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, photo, w.Header().Get("Photo-Location"))
+	assert.Equal(t, 1, len(pipeline.saved))
+
+	// an archive says which of its photos couldn't be added
+	archive := func(files map[string]string) []byte {
+		buf := bytes.Buffer{}
+		tw := tar.NewWriter(&buf)
+		for name, content := range files {
+			require.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}))
+			_, err := tw.Write([]byte(content))
+			require.Nil(t, err)
+		}
+		require.Nil(t, tw.Close())
+		return buf.Bytes()
+	}
+	_, w = upload("holiday.tar", archive(map[string]string{"a.jpg": "photo", "b.jpg": "far too large"}))
+	assert.Equal(t, http.StatusOK, w.Code)
+	result := postResponse{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &result))
+	require.Equal(t, 2, len(result.Entries))
+	assert.Equal(t, 2, len(pipeline.saved))
+
+	location, w = upload("nothing.tar", archive(map[string]string{"c.jpg": "also far too large"}))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, 1, len(result.Entries))
+	assert.Equal(t, http.StatusNotFound, send("HEAD", location, nil, nil).Code)
+}
+
+// photoForm is a POST /photos body with one part per photo, each with the
+// headers given
+func photoForm(t *testing.T, ctx AppContext, photos map[string]map[string]string) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	for filename, headers := range photos {
+		part := textproto.MIMEHeader{}
+		part.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, ctx.TagName, filename))
+		for name, value := range headers {
+			part.Set(name, value)
+		}
+		w, err := form.CreatePart(part)
+		require.Nil(t, err)
+		_, err = w.Write([]byte("photo of " + filename))
+		require.Nil(t, err)
+	}
+	require.Nil(t, form.Close())
+	return body, form.FormDataContentType()
+}
+
+func TestPhotosMustMatchTheirChecksums(t *testing.T) {
+	ctx := CreateContextForTestSetup()
+	pipeline := &savedPhotos{dir: t.TempDir()}
+	ctx.Ingest = pipeline
+	post := func(photos map[string]map[string]string) *httptest.ResponseRecorder {
+		body, contentType := photoForm(t, ctx, photos)
+		r := httptest.NewRequest("POST", "/photos", body)
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		makeHandler(ctx, AddPhotosHandler).ServeHTTP(w, r)
+		return w
+	}
+	md5sum := func(data string) string {
+		sum := md5.Sum([]byte(data))
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+	sha256sum := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(sum[:])
+	}
+
+	w := post(map[string]map[string]string{"a.jpg": {"Content-MD5": md5sum("something else")}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = post(map[string]map[string]string{"a.jpg": {"X-Checksum-SHA256": sha256sum("something else")}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, w.Header().Get("Location"))
+	assert.Empty(t, pipeline.saved)
+	assert.Empty(t, pipeline.finished)
+
+	w = post(map[string]map[string]string{"a.jpg": {
+		"Content-MD5":       md5sum("photo of a.jpg"),
+		"X-Checksum-SHA256": sha256sum("photo of a.jpg"),
+	}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, len(pipeline.finished))
+}
+
+func TestGuestsStopAtWhatTheirInviteHasLeft(t *testing.T) {
+	ctx := CreateContextForTestSetup()
+	pipeline := &savedPhotos{dir: t.TempDir()}
+	ctx.Ingest = pipeline
+	data := t.TempDir()
+	guests, err := invites.NewStore(filepath.Join(data, "invites.json"), filepath.Join(data, "invites.key"))
+	require.Nil(t, err)
+	ctx.Invites = guests
+	invite, err := guests.Create(invites.Invite{MaxPhotos: 2, Expires: time.Now().Add(time.Hour)})
+	require.Nil(t, err)
+
+	body, contentType := photoForm(t, ctx, map[string]map[string]string{"a.jpg": nil, "b.jpg": nil, "c.jpg": nil})
+	r := httptest.NewRequest("POST", "/photos", body)
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set(inviteHeader, guests.Token(invite))
+	w := httptest.NewRecorder()
+	makeHandler(ctx, memberOrGuest(AddPhotosHandler)).ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Len(t, pipeline.saved, 2)
+	assert.Empty(t, pipeline.finished)
+	left, err := ioutil.ReadDir(pipeline.dir)
+	require.Nil(t, err)
+	assert.Empty(t, left)
+	found, err := guests.Get(invite.ID)
+	require.Nil(t, err)
+	assert.Equal(t, 2, found.Remaining())
+}
+
+func TestInviteTokensAreNotLogged(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger := negroni.NewLogger()
+	logger.ALogger = log.New(out, "", 0)
+	n := negroni.New(logRequests(logger))
+	path := ""
+	n.UseHandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path = req.URL.Path
+	})
+
+	n.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/guest/secret.token.sig", nil))
+	assert.Equal(t, "/guest/secret.token.sig", path)
+	assert.Contains(t, out.String(), "/guest/...")
+	assert.NotContains(t, out.String(), "secret")
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/blreynolds4/photopi-api/events"
+	"github.com/blreynolds4/photopi-api/ingest"
+	"github.com/blreynolds4/photopi-api/tus"
+	"github.com/gorilla/mux"
+)
+
+// tus status for a chunk that doesn't match its checksum
+const statusChecksumMismatch = 460
+
+// tusHeaders go on every tus response
+func tusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tus.Version)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// tusVersion checks the client speaks our version of tus
+func tusVersion(w http.ResponseWriter, req *http.Request) bool {
+	tusHeaders(w)
+	if req.Header.Get("Tus-Resumable") != tus.Version {
+		w.Header().Set("Tus-Version", tus.Version)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// maxUploadSize is the largest photo or archive accepted
+func maxUploadSize(limits ingest.Limits, filename string) int64 {
+	if ingest.IsArchive(filename) {
+		return limits.MaxArchiveBytes
+	}
+	return limits.MaxPhotoBytes
+}
+
+// uploadOptions reads the album, tags, frames, caption and uploader from
+// the upload metadata, they mean the same as the form fields on POST /photos
+func uploadOptions(metadata map[string]string) ingest.Options {
+	options := ingest.Options{
+		Album:    strings.TrimSpace(metadata["album"]),
+		Caption:  strings.TrimSpace(metadata["caption"]),
+		Uploader: strings.TrimSpace(metadata["uploader"]),
+	}
+	if metadata["tags"] != "" {
+		options.Tags = strings.Split(metadata["tags"], ",")
+	}
+	if metadata["frames"] != "" {
+		options.Frames = strings.Split(metadata["frames"], ",")
+	}
+	return options
+}
+
+// uploadFilename is the name the client gave the file, clients differ in
+// which key they use
+func uploadFilename(metadata map[string]string) string {
+	name := metadata["filename"]
+	if name == "" {
+		name = metadata["name"]
+	}
+	return path.Base(strings.ReplaceAll(name, "\\", "/"))
+}
+
+// UploadOptionsHandler tells tus clients what the server supports
+func UploadOptionsHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	tusHeaders(w)
+	w.Header().Set("Tus-Version", tus.Version)
+	w.Header().Set("Tus-Extension", "creation,termination,checksum")
+	w.Header().Set("Tus-Checksum-Algorithm", strings.Join(tus.Algorithms, ","))
+	maxSize := ctx.Limits.MaxArchiveBytes
+	if ctx.Limits.MaxPhotoBytes > maxSize {
+		maxSize = ctx.Limits.MaxPhotoBytes
+	}
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateUploadHandler starts a resumable upload of a photo or archive, the
+// filename, album, tags, frames, caption and uploader come in the
+// Upload-Metadata
+func CreateUploadHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	if !tusVersion(w, req) {
+		return
+	}
+
+	length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		ctx.Render.Text(w, http.StatusBadRequest, "Upload-Length must be the size of the file")
+		return
+	}
+	metadata, err := tus.ParseMetadata(req.Header.Get("Upload-Metadata"))
+	if err != nil {
+		ctx.Render.Text(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filename := uploadFilename(metadata)
+	if filename == "" || filename == "." || filename == "/" {
+		ctx.Render.Text(w, http.StatusBadRequest, "Upload-Metadata must have a filename")
+		return
+	}
+	if length > maxUploadSize(ctx.Limits, filename) {
+		ctx.Render.Text(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("%s is too large", filename))
+		return
+	}
+	// catch unknown frames before anything is uploaded
+	if _, err := ctx.Ingest.CheckFrames(uploadOptions(metadata).Frames); err != nil {
+		ctx.Render.Text(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// the photos are attributed to whoever started the upload
+	if uploader := uploaderFor(req, metadata["uploader"]); uploader != "" {
+		metadata["uploader"] = uploader
+	}
+
+	upload, err := ctx.Uploads.Create(length, metadata)
+	if err != nil {
+		ctx.Render.Text(w, http.StatusInternalServerError, fmt.Sprintf("Unable to start upload: %s", err.Error()))
+		return
+	}
+	w.Header().Set("Location", strings.TrimSuffix(req.URL.Path, "/")+"/"+upload.ID)
+	w.Header().Set("Upload-Offset", "0")
+	if length == 0 {
+		finishUpload(w, ctx, upload)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// UploadStatusHandler says how much of an upload has arrived
+func UploadStatusHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	if !tusVersion(w, req) {
+		return
+	}
+	upload, err := ctx.Uploads.Get(mux.Vars(req)["id"])
+	if err == tus.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if len(upload.Metadata) > 0 {
+		w.Header().Set("Upload-Metadata", tus.FormatMetadata(upload.Metadata))
+	}
+	for _, photo := range upload.Photos {
+		w.Header().Add("Photo-Location", photo)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// AppendUploadHandler adds a chunk to an upload, once the last chunk is in
+// the photo goes through the same pipeline as POST /photos
+func AppendUploadHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	if !tusVersion(w, req) {
+		return
+	}
+	if req.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		ctx.Render.Text(w, http.StatusUnsupportedMediaType, "chunks must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		ctx.Render.Text(w, http.StatusBadRequest, "Upload-Offset must be where the chunk starts")
+		return
+	}
+
+	upload, err := ctx.Uploads.Append(mux.Vars(req)["id"], offset, req.Body, req.Header.Get("Upload-Checksum"))
+	switch err {
+	case nil:
+	case tus.ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case tus.ErrOffset:
+		ctx.Render.Text(w, http.StatusConflict, fmt.Sprintf("the upload is at offset %d", upload.Offset))
+		return
+	case tus.ErrBusy:
+		ctx.Render.Text(w, http.StatusLocked, err.Error())
+		return
+	case tus.ErrTooLong:
+		ctx.Render.Text(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	case tus.ErrChecksum:
+		ctx.Render.Text(w, statusChecksumMismatch, err.Error())
+		return
+	case tus.ErrAlgorithm:
+		ctx.Render.Text(w, http.StatusBadRequest, err.Error())
+		return
+	case tus.ErrFinished:
+		// the client missed the response to its last chunk, it isn't
+		// added again
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Length, 10))
+		for _, photo := range upload.Photos {
+			w.Header().Add("Photo-Location", photo)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		// what arrived before the connection dropped or the byte budget
+		// ran out is kept
+		if overBudget(w, ctx, err) {
+			return
+		}
+		fmt.Println("Upload", upload.ID, "stopped at", upload.Offset, "because", err.Error())
+		ctx.Render.Text(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if upload.Complete() {
+		finishUpload(w, ctx, upload)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload hands a complete upload to the pipeline, the photos it
+// added are in Photo-Location headers and the upload is remembered as
+// finished so a client that missed the response doesn't add them again
+// an archive with photos that couldn't be added gets the entries back like
+// POST /photos, one with none that could fails and can be sent again
+func finishUpload(w http.ResponseWriter, ctx AppContext, upload tus.Upload) {
+	f, err := ctx.Uploads.Open(upload.ID)
+	if err != nil {
+		ctx.Render.Text(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer f.Close()
+
+	filename := uploadFilename(upload.Metadata)
+	options := uploadOptions(upload.Metadata)
+	options.Frames, err = ctx.Ingest.CheckFrames(options.Frames)
+	if err != nil {
+		forgetUpload(ctx, upload.ID)
+		ctx.Render.Text(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result := postResponse{Files: []string{filename}}
+	added := []string{}
+	locations := []string{}
+	save := func(name string, data []byte) (string, error) {
+		createdPath, err := ctx.Ingest.Save(name, data, "tus")
+		if err != nil {
+			return "", err
+		}
+		added = append(added, createdPath)
+		locations = append(locations, "/photos/"+filepath.Base(createdPath))
+		w.Header().Add("Photo-Location", "/photos/"+filepath.Base(createdPath))
+		return filepath.Base(createdPath), nil
+	}
+
+	if ingest.IsArchive(filename) {
+		entries, err := ingest.ExtractArchive(filename, f, ctx.PhotoPath, ctx.Limits, save)
+		if err != nil {
+			entries = append(entries, ingest.EntryResult{Archive: filename, Error: err.Error()})
+			ctx.Events.Publish(events.PhotoFailed, filename, map[string]string{"stage": "receive", "error": err.Error()})
+		}
+		result.Entries = entries
+		if len(added) == 0 {
+			forgetUpload(ctx, upload.ID)
+			result.Message = fmt.Sprintf("No photos in %s could be added", filename)
+			ctx.Render.JSON(w, http.StatusUnprocessableEntity, result)
+			return
+		}
+	} else {
+		data, err := ingest.ReadPhoto(f, ctx.Limits)
+		if err == nil {
+			_, err = save(filename, data)
+		}
+		if err != nil {
+			forgetUpload(ctx, upload.ID)
+			ctx.Render.Text(w, http.StatusUnprocessableEntity, fmt.Sprintf("Unable to add %s: %s", filename, err.Error()))
+			return
+		}
+	}
+
+	if _, err := ctx.Uploads.Finish(upload.ID, locations); err != nil {
+		fmt.Println("Unable to record upload", upload.ID, "as finished because", err.Error())
+	}
+
+	if err := ctx.Ingest.Finish(added, options); err != nil {
+		result.Message = fmt.Sprintf("Photos were saved but not added to album %s: %s", options.Album, err.Error())
+		ctx.Render.JSON(w, http.StatusBadRequest, result)
+		return
+	}
+	for _, entry := range result.Entries {
+		if entry.Error != "" {
+			result.Message = "Uploaded files, some photos in archives could not be added"
+			ctx.Render.JSON(w, http.StatusOK, result)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// forgetUpload removes an upload that added nothing, the client can send
+// it again
+func forgetUpload(ctx AppContext, id string) {
+	if err := ctx.Uploads.Remove(id); err != nil {
+		fmt.Println("Unable to remove upload", id, "because", err.Error())
+	}
+}
+
+// DeleteUploadHandler abandons an upload
+func DeleteUploadHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	if !tusVersion(w, req) {
+		return
+	}
+	err := ctx.Uploads.Remove(mux.Vars(req)["id"])
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case tus.ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	case tus.ErrBusy:
+		w.WriteHeader(http.StatusLocked)
+	default:
+		ctx.Render.Text(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/users"
+	"github.com/gorilla/mux"
+)
+
+type loginRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type userRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+type passwordRequest struct {
+	Password string `json:"password"`
+}
+
+type tokenRequest struct {
+	Name    string `json:"name"`
+	Expires string `json:"expires"`
+}
+
+// tokenResponse is the only place a token's secret is returned
+type tokenResponse struct {
+	users.Token
+	Secret string `json:"token"`
+}
+
+// LoginHandler checks a name and password and signs the browser in with a
+// session cookie, and a CSRF cookie the page sends back in X-CSRF-Token
+func LoginHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	body := loginRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: fmt.Sprintf("Invalid login %s", err.Error())})
+		return
+	}
+
+	user, err := ctx.Users.Login(body.Name, body.Password)
+	if err != nil {
+		unauthorized(w, ctx, err.Error())
+		return
+	}
+	secret, _, err := ctx.Users.IssueToken(user.Name, req.UserAgent(), sessionLifetime, true)
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusInternalServerError, Status{Status: "error", Message: err.Error()})
+		return
+	}
+
+	csrf, err := newCSRFToken()
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusInternalServerError, Status{Status: "error", Message: err.Error()})
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    secret,
+		Path:     "/",
+		MaxAge:   int(sessionLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   requestScheme(req) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	// scripts have to be able to read this one
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    csrf,
+		Path:     "/",
+		MaxAge:   int(sessionLifetime.Seconds()),
+		Secure:   requestScheme(req) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	ctx.Render.JSON(w, http.StatusOK, user)
+}
+
+// LogoutHandler ends the browser's session
+func LogoutHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	if id, ok := req.Context().Value(identityKey{}).(identity); ok && id.token.Session {
+		ctx.Users.Revoke(id.token.ID)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	http.SetCookie(w, &http.Cookie{Name: csrfCookie, Value: "", Path: "/", MaxAge: -1})
+	ctx.Render.JSON(w, http.StatusOK, Status{Status: "ok", Message: "Signed out"})
+}
+
+// MeHandler returns the signed in user
+func MeHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	user, _ := currentUser(req)
+	ctx.Render.JSON(w, http.StatusOK, user)
+}
+
+// ListUsersHandler returns everyone who can sign in
+func ListUsersHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	ctx.Render.JSON(w, http.StatusOK, ctx.Users.List())
+}
+
+// AddUserHandler creates a user, a member unless role says admin
+func AddUserHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	body := userRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: fmt.Sprintf("Invalid user %s", err.Error())})
+		return
+	}
+	if body.Role == "" {
+		body.Role = users.Member
+	}
+
+	user, err := ctx.Users.Add(body.Name, body.Password, body.Role)
+	if err == users.ErrExists {
+		ctx.Render.JSON(w, http.StatusConflict, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	w.Header().Add("Location", newURL(user.Name, req))
+	ctx.Render.JSON(w, http.StatusCreated, user)
+}
+
+// DeleteUserHandler removes a user and their tokens, the photos they added
+// keep their name
+func DeleteUserHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	err := ctx.Users.Delete(mux.Vars(req)["name"])
+	if err == users.ErrNotFound {
+		ctx.Render.JSON(w, http.StatusNotFound, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, Status{Status: "ok", Message: "User deleted"})
+}
+
+// SetPasswordHandler changes a password, users change their own and admins
+// anyone's, it signs them out of every browser
+func SetPasswordHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	name := users.Name(mux.Vars(req)["name"])
+	if user, _ := currentUser(req); user.Name != name && !user.Can(users.Admin) {
+		ctx.Render.JSON(w, http.StatusForbidden, Status{Status: "error", Message: "Only admins can change other users' passwords"})
+		return
+	}
+	body := passwordRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: fmt.Sprintf("Invalid password %s", err.Error())})
+		return
+	}
+
+	err := ctx.Users.SetPassword(name, body.Password)
+	if err == users.ErrNotFound {
+		ctx.Render.JSON(w, http.StatusNotFound, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, Status{Status: "ok", Message: "Password changed"})
+}
+
+// ListTokensHandler returns the signed in user's tokens and sessions
+func ListTokensHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	user, _ := currentUser(req)
+	ctx.Render.JSON(w, http.StatusOK, ctx.Users.Tokens(user.Name))
+}
+
+// CreateTokenHandler issues an API token for the signed in user, optionally
+// expiring after a duration such as 720h, the response is the only place
+// its secret is returned
+func CreateTokenHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	body := tokenRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: fmt.Sprintf("Invalid token %s", err.Error())})
+		return
+	}
+	ttl := time.Duration(0)
+	if body.Expires != "" {
+		d, err := time.ParseDuration(body.Expires)
+		if err != nil || d <= 0 {
+			ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: fmt.Sprintf("expires must be a duration such as 720h, not %s", body.Expires)})
+			return
+		}
+		ttl = d
+	}
+
+	user, _ := currentUser(req)
+	secret, token, err := ctx.Users.IssueToken(user.Name, body.Name, ttl, false)
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusInternalServerError, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	w.Header().Add("Location", newURL(token.ID, req))
+	ctx.Render.JSON(w, http.StatusCreated, tokenResponse{Token: token, Secret: secret})
+}
+
+// DeleteTokenHandler revokes one of the signed in user's tokens, admins can
+// revoke anyone's
+func DeleteTokenHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	id := mux.Vars(req)["id"]
+	user, _ := currentUser(req)
+	if !user.Can(users.Admin) && !ownsToken(ctx, user.Name, id) {
+		ctx.Render.JSON(w, http.StatusNotFound, Status{Status: "error", Message: users.ErrTokenNotFound.Error()})
+		return
+	}
+
+	err := ctx.Users.Revoke(id)
+	if err == users.ErrTokenNotFound {
+		ctx.Render.JSON(w, http.StatusNotFound, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusInternalServerError, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, Status{Status: "ok", Message: "Token revoked"})
+}
+
+func ownsToken(ctx AppContext, user, id string) bool {
+	for _, t := range ctx.Users.Tokens(user) {
+		if t.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/blreynolds4/photopi-api/webhooks"
+	"github.com/gorilla/mux"
+)
+
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+	Active *bool    `json:"active"`
+}
+
+// hideSecret keeps webhook secrets out of everything but the create response
+func hideSecret(sub webhooks.Subscription) webhooks.Subscription {
+	sub.Secret = ""
+	return sub
+}
+
+// ListWebhooksHandler returns all webhook subscriptions
+func ListWebhooksHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	subs := ctx.Webhooks.List()
+	for i := range subs {
+		subs[i] = hideSecret(subs[i])
+	}
+	ctx.Render.JSON(w, http.StatusOK, subs)
+}
+
+// AddWebhookHandler creates a webhook subscription, the response is the only
+// place the signing secret is returned
+func AddWebhookHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	body := webhookRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: fmt.Sprintf("Invalid webhook %s", err.Error())})
+		return
+	}
+
+	sub := webhooks.Subscription{
+		URL:    body.URL,
+		Secret: body.Secret,
+		Events: body.Events,
+		Active: body.Active == nil || *body.Active,
+	}
+	sub, err := ctx.Webhooks.Add(sub)
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: err.Error()})
+		return
+	}
+
+	w.Header().Add("Location", newURL(sub.ID, req))
+	ctx.Render.JSON(w, http.StatusCreated, sub)
+}
+
+// GetWebhookHandler returns one webhook subscription
+func GetWebhookHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	sub, err := ctx.Webhooks.Get(mux.Vars(req)["id"])
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusNotFound, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, hideSecret(sub))
+}
+
+// DeleteWebhookHandler removes a webhook subscription
+func DeleteWebhookHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	err := ctx.Webhooks.Delete(mux.Vars(req)["id"])
+	if err == webhooks.ErrNotFound {
+		ctx.Render.JSON(w, http.StatusNotFound, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusInternalServerError, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, Status{Status: "ok", Message: "Webhook deleted"})
+}
+
+// WebhookDeliveriesHandler returns the delivery log for a subscription, newest first
+func WebhookDeliveriesHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	id := mux.Vars(req)["id"]
+	if _, err := ctx.Webhooks.Get(id); err != nil {
+		ctx.Render.JSON(w, http.StatusNotFound, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, ctx.Webhooks.Deliveries(id))
+}
+
+// TestWebhookHandler sends a test event to a subscription and returns the delivery
+func TestWebhookHandler(w http.ResponseWriter, req *http.Request, ctx AppContext) {
+	delivery, err := ctx.Webhooks.TestFire(mux.Vars(req)["id"])
+	if err != nil {
+		ctx.Render.JSON(w, http.StatusNotFound, Status{Status: "error", Message: err.Error()})
+		return
+	}
+	ctx.Render.JSON(w, http.StatusOK, delivery)
+}
@@ -1,30 +1,87 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
+	"net"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/blreynolds4/photopi-api/backup"
+	"github.com/blreynolds4/photopi-api/catalog"
+	"github.com/blreynolds4/photopi-api/certs"
+	"github.com/blreynolds4/photopi-api/config"
+	"github.com/blreynolds4/photopi-api/events"
+	"github.com/blreynolds4/photopi-api/frames"
+	"github.com/blreynolds4/photopi-api/framesync"
+	"github.com/blreynolds4/photopi-api/idempotency"
+	"github.com/blreynolds4/photopi-api/ingest"
+	"github.com/blreynolds4/photopi-api/invites"
+	"github.com/blreynolds4/photopi-api/player"
+	"github.com/blreynolds4/photopi-api/ratelimit"
+	"github.com/blreynolds4/photopi-api/schedule"
+	"github.com/blreynolds4/photopi-api/selection"
+	"github.com/blreynolds4/photopi-api/stager"
+	"github.com/blreynolds4/photopi-api/tus"
+	"github.com/blreynolds4/photopi-api/users"
+	"github.com/blreynolds4/photopi-api/webhooks"
 	"github.com/palantir/stacktrace"
 	"github.com/unrolled/render"
 )
 
-const DEFAULT_UPLOAD_TAG_NAME string = "uploadImages"
-const DEFAULT_PHOTO_PATH string = "./piphotos"
-const DEFAULT_UI_PATH string = "./ui/build"
-const DEFAULT_SLIDESHOW_DIR string = "./slideshow"
+const DEFAULT_EVENT_BUFFER int = 256
+const DEFAULT_SMTP_TIMEOUT = 5 * time.Minute
+const DEFAULT_UI_DEV_ORIGIN string = "http://localhost:8081"
+
+// frames have their own budgets, a frame catching up fetches every photo
+const DEFAULT_RATE_LIMITS string = "*=600/min; Login=10/min; AddPhotos=30/min 500MB/min; ImportPhotos=10/min; " +
+	"CreateUpload=30/min; AppendUpload=1GB/min; FrameManifest=60/min; FramePhoto=3000/min"
+
+// defaultRateLimits are DEFAULT_RATE_LIMITS parsed once, a mistake in them
+// stops the program as it starts instead of leaving every route unlimited
+var defaultRateLimits = mustParseBudgets(DEFAULT_RATE_LIMITS)
+
+func mustParseBudgets(text string) ratelimit.Budgets {
+	budgets, err := ratelimit.ParseBudgets(text)
+	if err != nil {
+		panic(fmt.Sprintf("bad rate limits %q: %s", text, err.Error()))
+	}
+	return budgets
+}
 
 // AppContext holds application configuration data
 type AppContext struct {
-	Render    *render.Render
-	Version   string
-	Env       string
-	Port      string
-	TagName   string
-	PhotoPath string
-	UIPath    string
-	PhotoSave backup.PhotoBackup
+	Render       *render.Render
+	Version      string
+	Env          string
+	Port         string
+	TagName      string
+	PhotoPath    string
+	UIPath       string
+	FramePath    string
+	ShowPath     string
+	DataPath     string
+	Capacity     stager.Capacity
+	Stager       stager.PhotoStager
+	Frames       frames.Frames
+	Hashes       *framesync.HashCache
+	PhotoSave    backup.PhotoBackup
+	Ingest       ingest.Pipeline
+	Limits       ingest.Limits
+	Uploads      tus.Store
+	Idempotency  idempotency.Store
+	Downloader   *ingest.Downloader
+	Users        users.Store
+	Invites      invites.Store
+	AuthRequired bool
+	RateLimits   ratelimit.Budgets
+	Events       events.EventBus
+	Webhooks     webhooks.Webhooks
+	Catalog      catalog.Catalog
+	Selector     selection.Selector
+	Schedule     schedule.Scheduler
+	Player       player.Player
 }
 
 // Healthcheck will store information about its name and version
@@ -45,14 +102,22 @@ type Status struct {
 // for testing purposes
 func CreateContextForTestSetup() AppContext {
 	testVersion := "0.0.0"
+	defaults := config.Default()
 	ctx := AppContext{
-		Render:    render.New(),
-		Version:   testVersion,
-		Env:       local,
-		Port:      "3001",
-		TagName:   DEFAULT_UPLOAD_TAG_NAME,
-		PhotoPath: DEFAULT_PHOTO_PATH,
-		UIPath:    DEFAULT_UI_PATH,
+		Render:     render.New(),
+		Version:    testVersion,
+		Env:        local,
+		Port:       "3001",
+		TagName:    defaults.Server.UploadTag,
+		PhotoPath:  defaults.Paths.Photos,
+		UIPath:     defaults.Paths.UI,
+		FramePath:  defaults.Paths.Frame,
+		ShowPath:   defaults.Paths.Show,
+		DataPath:   defaults.Paths.Data,
+		Events:     events.NewEventBus(DEFAULT_EVENT_BUFFER),
+		Hashes:     framesync.NewHashCache(),
+		Limits:     ingest.DefaultLimits,
+		Downloader: ingest.NewDownloader(ingest.DefaultDownloadOptions, ingest.DefaultLimits),
 	}
 	return ctx
 }
@@ -76,3 +141,27 @@ func ParseVersionFile(versionPath string) (string, error) {
 	}
 	return version, nil
 }
+
+// tlsSettings say how the service is served over HTTPS, it is off when
+// port is empty
+type tlsSettings struct {
+	port     string
+	redirect bool
+	certs    certs.Options
+}
+
+// webSettings say which hosts and pages browsers can use the service from
+type webSettings struct {
+	allowedHosts          []string
+	corsOrigins           []string
+	corsMethods           []string
+	contentSecurityPolicy string
+	frameOptions          string
+	trustedProxies        []*net.IPNet
+}
+
+// authSettings say who may use the service
+type authSettings struct {
+	required bool
+	limits   ratelimit.Budgets
+}
@@ -0,0 +1,114 @@
+package idempotency
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrInProgress is returned while the first request with a key is running
+var ErrInProgress = errors.New("a request with this key is in progress")
+
+// a key claimed this long ago without a response is taken to belong to a
+// request that died and can be claimed again
+const staleClaim = 10 * time.Minute
+
+// Response is what was sent for the first request with a key
+type Response struct {
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header"`
+	Body    []byte      `json:"body"`
+	Created time.Time   `json:"created"`
+}
+
+// Store remembers responses by key so a retried request gets the original
+// response instead of being run again
+// Begin returns the saved response and true for a key that has one, or
+// claims the key for a new request which must then Finish or Abandon it
+type Store interface {
+	Begin(key string) (Response, bool, error)
+	Finish(key string, response Response) error
+	Abandon(key string)
+}
+
+type fileStore struct {
+	lock      sync.Mutex
+	file      string
+	ttl       time.Duration
+	responses map[string]Response
+	running   map[string]time.Time
+	now       func() time.Time
+}
+
+// NewStore keeps responses in file for ttl
+func NewStore(file string, ttl time.Duration) (Store, error) {
+	s := fileStore{
+		file:      file,
+		ttl:       ttl,
+		responses: make(map[string]Response),
+		running:   make(map[string]time.Time),
+		now:       time.Now,
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.responses); err != nil {
+			return nil, fmt.Errorf("reading idempotency keys %s: %s", file, err.Error())
+		}
+	}
+	return &s, nil
+}
+
+func (s *fileStore) Begin(key string) (Response, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if response, ok := s.responses[key]; ok && time.Since(response.Created) < s.ttl {
+		return response, true, nil
+	}
+	if started, ok := s.running[key]; ok && s.now().Sub(started) < staleClaim {
+		return Response{}, false, ErrInProgress
+	}
+	s.running[key] = s.now()
+	return Response{}, false, nil
+}
+
+func (s *fileStore) Finish(key string, response Response) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.running, key)
+	response.Created = time.Now()
+	s.responses[key] = response
+
+	// forget the expired responses while saving
+	for k, r := range s.responses {
+		if time.Since(r.Created) >= s.ttl {
+			delete(s.responses, k)
+		}
+	}
+	data, err := json.Marshal(s.responses)
+	if err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// Abandon releases a key without a response, the request can be retried
+func (s *fileStore) Abandon(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.running, key)
+}
@@ -0,0 +1,65 @@
+package idempotency
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponsesAreReplayedUntilTheyExpire(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "idempotency.json")
+	store, err := NewStore(file, time.Hour)
+	require.Nil(t, err)
+
+	_, done, err := store.Begin("POST /photos abc")
+	require.Nil(t, err)
+	assert.False(t, done)
+
+	// a retry while the first request runs is turned away
+	_, _, err = store.Begin("POST /photos abc")
+	assert.Equal(t, ErrInProgress, err)
+
+	header := http.Header{"Location": []string{"http://frame/photos/a.jpg"}}
+	require.Nil(t, store.Finish("POST /photos abc", Response{Status: 200, Header: header, Body: []byte("ok")}))
+
+	// responses survive a restart
+	store, err = NewStore(file, time.Hour)
+	require.Nil(t, err)
+	response, done, err := store.Begin("POST /photos abc")
+	require.Nil(t, err)
+	assert.True(t, done)
+	assert.Equal(t, 200, response.Status)
+	assert.Equal(t, header, response.Header)
+	assert.Equal(t, "ok", string(response.Body))
+
+	// an abandoned key can be used again
+	_, done, err = store.Begin("POST /photos def")
+	require.Nil(t, err)
+	store.Abandon("POST /photos def")
+	_, done, err = store.Begin("POST /photos def")
+	require.Nil(t, err)
+	assert.False(t, done)
+
+	// a claim left by a request that never finished goes stale
+	clock := time.Now()
+	store.(*fileStore).now = func() time.Time { return clock }
+	_, _, err = store.Begin("POST /photos ghi")
+	require.Nil(t, err)
+	clock = clock.Add(staleClaim - time.Second)
+	_, _, err = store.Begin("POST /photos ghi")
+	assert.Equal(t, ErrInProgress, err)
+	clock = clock.Add(time.Second)
+	_, done, err = store.Begin("POST /photos ghi")
+	require.Nil(t, err)
+	assert.False(t, done)
+
+	expired, err := NewStore(file, 0)
+	require.Nil(t, err)
+	_, done, err = expired.Begin("POST /photos abc")
+	require.Nil(t, err)
+	assert.False(t, done)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/blreynolds4/photopi-api/catalog"
+	"github.com/blreynolds4/photopi-api/ingest"
+	"github.com/blreynolds4/photopi-api/naming"
+)
+
+// runImport loads an existing photo library into the service, it uses the
+// same environment as the server, which should not be running at the time
+func runImport(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	stage := flags.Bool("stage", false, "back up and stage the photos like uploads instead of archiving them")
+	dryRun := flags.Bool("dry-run", false, "report what would be imported without changing anything")
+	stateFile := flags.String("state", "", "file that lets an interrupted import carry on (default DATA_PATH/import.jsonl)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: photopi-api import [-stage] [-dry-run] [-state file] <dir>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	s := loadSettings()
+	options := ingest.ImportOptions{
+		Dir:       flags.Arg(0),
+		StateFile: *stateFile,
+		Stage:     *stage,
+		DryRun:    *dryRun,
+		Progress:  os.Stdout,
+		Namer:     naming.NewImageNamer(s.nameFormat),
+	}
+	if options.StateFile == "" {
+		options.StateFile = filepath.Join(s.dataPath, "import.jsonl")
+	}
+
+	// stop after the current photo on ctrl-c, running again carries on
+	cancel := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Println("Stopping after the current photo")
+		close(cancel)
+	}()
+	options.Cancel = cancel
+
+	var (
+		pipeline ingest.Pipeline
+		index    *ingest.Index
+		stop     = func() {}
+	)
+	if options.DryRun {
+		// only the catalog is needed to find duplicates
+		photos, err := catalog.NewJSONCatalog(filepath.Join(s.dataPath, "catalog.json"))
+		if err != nil {
+			fmt.Println("Unable to read the catalog because", err.Error())
+			os.Exit(1)
+		}
+		index = ingest.NewIndex(photos, []string{s.showPath, s.archivePath})
+	} else {
+		var ctx AppContext
+		ctx, stop = startApp(s)
+		pipeline = ctx.Ingest
+		index = ingest.NewIndex(ctx.Catalog, ctx.Frames.Dirs())
+	}
+
+	report, err := ingest.Import(options, pipeline, index)
+	// staging what was imported finishes before the summary
+	stop()
+	if err != nil {
+		fmt.Println("Unable to import", options.Dir, "because", err.Error())
+		os.Exit(1)
+	}
+
+	printImportReport(options, report)
+	if len(report.Failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+func printImportReport(options ingest.ImportOptions, report ingest.ImportReport) {
+	imported := "imported"
+	if options.DryRun {
+		imported = "to import"
+	}
+	fmt.Println()
+	fmt.Printf("Found %d photos in %s\n", report.Found, options.Dir)
+	fmt.Printf("  %-16s %d\n", imported, report.Imported)
+	fmt.Printf("  %-16s %d\n", "duplicates", report.Duplicates)
+	fmt.Printf("  %-16s %d\n", "already imported", report.Resumed)
+	fmt.Printf("  %-16s %d\n", "failed", len(report.Failed))
+	fmt.Printf("  %-16s %d\n", "not photos", report.Skipped)
+
+	if len(report.Failed) > 0 {
+		files := []string{}
+		for file := range report.Failed {
+			files = append(files, file)
+		}
+		sort.Strings(files)
+		fmt.Println("Failed:")
+		for _, file := range files {
+			fmt.Println(" ", file, report.Failed[file])
+		}
+	}
+	if report.Cancelled {
+		fmt.Println("Stopped early, run the import again to carry on")
+	}
+}
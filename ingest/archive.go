@@ -0,0 +1,262 @@
+package ingest
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// ErrTooLarge is returned for a photo over the size limit
+var ErrTooLarge = errors.New("photo is too large")
+
+// Limits keep one upload from filling the disk or memory, MaxPhotoBytes
+// applies to every photo including those in archives, the rest to each
+// archive, MaxRatio is how much a zip entry may expand
+type Limits struct {
+	MaxPhotoBytes   int64
+	MaxArchiveBytes int64
+	MaxEntries      int
+	MaxRatio        int64
+}
+
+// DefaultLimits are used when none are configured
+var DefaultLimits = Limits{
+	MaxPhotoBytes:   50 * 1024 * 1024,
+	MaxArchiveBytes: 2 * 1024 * 1024 * 1024,
+	MaxEntries:      5000,
+	MaxRatio:        100,
+}
+
+// EntryResult says what happened to one photo in an archive
+type EntryResult struct {
+	Archive string `json:"archive"`
+	Entry   string `json:"entry"`
+	Photo   string `json:"photo,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ReadPhoto reads a photo, failing with ErrTooLarge rather than reading
+// more than the limit
+func ReadPhoto(r io.Reader, limits Limits) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, limits.MaxPhotoBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limits.MaxPhotoBytes {
+		return nil, ErrTooLarge
+	}
+	return data, nil
+}
+
+// IsArchive is true for the zip and tar files ExtractArchive reads
+func IsArchive(filename string) bool {
+	name := strings.ToLower(filename)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExtractArchive reads the photos out of an archive and hands each one to
+// add, which returns the name it was saved as, anything that isn't a photo
+// is skipped
+// tar files are read as they arrive, zip files keep their index at the end
+// so they are spooled to a temporary file in tmpDir first
+// an error means the archive couldn't be read any further, the results
+// cover every entry handled before then
+func ExtractArchive(filename string, r io.Reader, tmpDir string, limits Limits, add func(name string, data []byte) (string, error)) ([]EntryResult, error) {
+	e := extraction{
+		archive: filename,
+		limits:  limits,
+		add:     add,
+		results: []EntryResult{},
+	}
+
+	name := strings.ToLower(filename)
+	var err error
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		err = e.zip(r, tmpDir)
+	case strings.HasSuffix(name, ".tar"):
+		err = e.tar(r)
+	case strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(r)
+		if err == nil {
+			defer gz.Close()
+			err = e.tar(gz)
+		}
+	default:
+		err = fmt.Errorf("%s is not a zip or tar file", filename)
+	}
+	return e.results, err
+}
+
+type extraction struct {
+	archive string
+	limits  Limits
+	add     func(name string, data []byte) (string, error)
+	results []EntryResult
+	entries int
+	total   int64
+}
+
+func (e *extraction) tar(r io.Reader) error {
+	// everything read counts against the archive limit, skipped entries
+	// and all, so a compressed tar can't expand without end
+	counted := &limitedReader{r: r, remaining: e.limits.MaxArchiveBytes}
+	archive := tar.NewReader(counted)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			// directories, links and devices are never extracted
+			continue
+		}
+		open := func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(archive), nil
+		}
+		if err := e.entry(header.Name, header.Size, 0, open); err != nil {
+			return err
+		}
+	}
+}
+
+func (e *extraction) zip(r io.Reader, tmpDir string) error {
+	spool, err := ioutil.TempFile(tmpDir, ".upload-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, io.LimitReader(r, e.limits.MaxArchiveBytes+1))
+	if err != nil {
+		return err
+	}
+	if size > e.limits.MaxArchiveBytes {
+		return fmt.Errorf("archive is larger than %d bytes", e.limits.MaxArchiveBytes)
+	}
+
+	archive, err := zip.NewReader(spool, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range archive.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		if err := e.entry(f.Name, int64(f.UncompressedSize64), int64(f.CompressedSize64), f.Open); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entry reads one file from the archive, compressed is its size in the
+// archive when it is compressed on its own, only an error that stops the
+// whole archive is returned
+func (e *extraction) entry(name string, size int64, compressed int64, open func() (io.ReadCloser, error)) error {
+	base := path.Base(name)
+	if strings.HasPrefix(base, ".") || strings.HasPrefix(name, "__MACOSX/") || !IsPhotoName(base) {
+		return nil
+	}
+
+	e.entries++
+	if e.entries > e.limits.MaxEntries {
+		return fmt.Errorf("archive has more than %d photos", e.limits.MaxEntries)
+	}
+	if !safeEntryName(name) {
+		e.fail(name, fmt.Errorf("unsafe path"))
+		return nil
+	}
+	if size > e.limits.MaxPhotoBytes {
+		e.fail(name, ErrTooLarge)
+		return nil
+	}
+	if compressed > 0 && size/compressed > e.limits.MaxRatio {
+		e.fail(name, fmt.Errorf("expands too much to be a photo"))
+		return nil
+	}
+	if e.total+size > e.limits.MaxArchiveBytes {
+		return fmt.Errorf("archive expands to more than %d bytes", e.limits.MaxArchiveBytes)
+	}
+
+	r, err := open()
+	if err != nil {
+		e.fail(name, err)
+		return nil
+	}
+	defer r.Close()
+
+	// sizes in headers can't be trusted, so the limit applies to what is read
+	data, err := ReadPhoto(r, e.limits)
+	if err == ErrTooLarge {
+		e.fail(name, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	e.total += int64(len(data))
+
+	photo, err := e.add(base, data)
+	if err != nil {
+		e.fail(name, err)
+		return nil
+	}
+	e.results = append(e.results, EntryResult{Archive: e.archive, Entry: name, Photo: photo})
+	return nil
+}
+
+func (e *extraction) fail(name string, err error) {
+	e.results = append(e.results, EntryResult{Archive: e.archive, Entry: name, Error: err.Error()})
+}
+
+// safeEntryName rejects names that would land outside a directory the
+// archive was extracted into, photos are saved under new names anyway but
+// an archive with such names isn't to be trusted
+func safeEntryName(name string) bool {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if name == "" || strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// limitedReader fails once more than remaining bytes are read
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, fmt.Errorf("archive expands to too many bytes")
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, fmt.Errorf("archive expands to too many bytes")
+	}
+	return n, err
+}
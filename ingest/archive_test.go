@@ -0,0 +1,96 @@
+package ingest
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type entry struct {
+	name string
+	data []byte
+}
+
+func zipOf(t *testing.T, entries ...entry) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, e := range entries {
+		f, err := w.Create(e.name)
+		require.Nil(t, err)
+		_, err = f.Write(e.data)
+		require.Nil(t, err)
+	}
+	require.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func tarGzOf(t *testing.T, entries ...entry) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	w := tar.NewWriter(gz)
+	for _, e := range entries {
+		require.Nil(t, w.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data)), Typeflag: tar.TypeReg}))
+		_, err := w.Write(e.data)
+		require.Nil(t, err)
+	}
+	require.Nil(t, w.Close())
+	require.Nil(t, gz.Close())
+	return buf.Bytes()
+}
+
+// keep records what would have been saved
+func keep(saved *[]string) func(string, []byte) (string, error) {
+	return func(name string, data []byte) (string, error) {
+		*saved = append(*saved, name)
+		return "saved-" + name, nil
+	}
+}
+
+func TestExtractArchiveChecksEveryEntry(t *testing.T) {
+	limits := Limits{MaxPhotoBytes: 1000, MaxArchiveBytes: 10000, MaxEntries: 10, MaxRatio: 5}
+	noise := make([]byte, 2000)
+	rand.New(rand.NewSource(1)).Read(noise)
+	archive := zipOf(t,
+		entry{"DCIM/one.jpg", []byte("photo one")},
+		entry{"../../etc/two.jpg", []byte("photo two")},
+		entry{"big.jpg", noise},
+		entry{"bomb.jpg", make([]byte, 1000)},
+		entry{"one.jpg.json", []byte("{}")},
+		entry{"__MACOSX/DCIM/._one.jpg", []byte("resource fork")},
+	)
+
+	saved := []string{}
+	results, err := ExtractArchive("takeout.zip", bytes.NewReader(archive), t.TempDir(), limits, keep(&saved))
+	require.Nil(t, err)
+	assert.Equal(t, []string{"one.jpg"}, saved)
+	require.Equal(t, 4, len(results))
+	assert.Equal(t, EntryResult{Archive: "takeout.zip", Entry: "DCIM/one.jpg", Photo: "saved-one.jpg"}, results[0])
+	assert.Equal(t, "unsafe path", results[1].Error)
+	assert.Equal(t, ErrTooLarge.Error(), results[2].Error)
+	assert.Equal(t, "bomb.jpg", results[3].Entry)
+	assert.NotEmpty(t, results[3].Error)
+}
+
+func TestExtractArchiveStopsCompressedTarsExpandingTooFar(t *testing.T) {
+	limits := Limits{MaxPhotoBytes: 100, MaxArchiveBytes: 10000, MaxEntries: 10, MaxRatio: 20}
+
+	saved := []string{}
+	archive := tarGzOf(t, entry{"a.jpg", []byte("photo a")}, entry{"b.JPEG", []byte("photo b")})
+	results, err := ExtractArchive("phone.tar.gz", bytes.NewReader(archive), t.TempDir(), limits, keep(&saved))
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a.jpg", "b.JPEG"}, saved)
+	assert.Equal(t, 2, len(results))
+
+	// a skipped entry still counts towards what the archive expands to
+	saved = []string{}
+	archive = tarGzOf(t, entry{"a.jpg", []byte("photo a")}, entry{"padding.bin", make([]byte, 20000)}, entry{"b.jpg", []byte("photo b")})
+	_, err = ExtractArchive("bomb.tgz", bytes.NewReader(archive), t.TempDir(), limits, keep(&saved))
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"a.jpg"}, saved)
+}
@@ -0,0 +1,78 @@
+package ingest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// ErrChecksum is returned when a photo doesn't match the checksum sent with it
+var ErrChecksum = errors.New("checksum mismatch")
+
+// Checksums are digests a client sent with a photo, MD5 in base64 as in a
+// Content-MD5 header and SHA256 in hex or base64, blank ones aren't checked
+type Checksums struct {
+	MD5    string
+	SHA256 string
+}
+
+// CheckedReader hashes what is read through it so it can be verified
+type CheckedReader struct {
+	r      io.Reader
+	hashes []hash.Hash
+	wanted [][]byte
+}
+
+// Reader wraps r to check it against the checksums once it has been read
+func (c Checksums) Reader(r io.Reader) (*CheckedReader, error) {
+	checked := CheckedReader{r: r}
+	if c.MD5 != "" {
+		wanted, err := base64.StdEncoding.DecodeString(strings.TrimSpace(c.MD5))
+		if err != nil || len(wanted) != md5.Size {
+			return nil, fmt.Errorf("Content-MD5 must be a base64 md5 digest")
+		}
+		checked.hashes = append(checked.hashes, md5.New())
+		checked.wanted = append(checked.wanted, wanted)
+	}
+	if c.SHA256 != "" {
+		wanted, err := decodeDigest(strings.TrimSpace(c.SHA256))
+		if err != nil || len(wanted) != sha256.Size {
+			return nil, fmt.Errorf("X-Checksum-SHA256 must be a hex or base64 sha256 digest")
+		}
+		checked.hashes = append(checked.hashes, sha256.New())
+		checked.wanted = append(checked.wanted, wanted)
+	}
+	return &checked, nil
+}
+
+func decodeDigest(digest string) ([]byte, error) {
+	if sum, err := hex.DecodeString(digest); err == nil {
+		return sum, nil
+	}
+	return base64.StdEncoding.DecodeString(digest)
+}
+
+func (c *CheckedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	for _, h := range c.hashes {
+		h.Write(p[:n])
+	}
+	return n, err
+}
+
+// Verify checks everything read so far against the checksums
+func (c *CheckedReader) Verify() error {
+	for i, h := range c.hashes {
+		if !bytes.Equal(h.Sum(nil), c.wanted[i]) {
+			return ErrChecksum
+		}
+	}
+	return nil
+}
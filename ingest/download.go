@@ -0,0 +1,203 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrPrivateAddress is returned for a URL on the local network when those
+// aren't allowed
+var ErrPrivateAddress = errors.New("address is on a private network")
+
+// networks a download can't reach unless private addresses are allowed,
+// the private, shared (CGNAT), loopback, link local and multicast ranges
+var privateNetworks = parseNetworks(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"255.255.255.255/32",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// privateAddress is true for an address in one of the private networks,
+// IPv4 addresses written as IPv6 included
+func privateAddress(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// DownloadOptions control fetching photos by URL, AllowPrivate lets the
+// server fetch from its own network which a link from outside shouldn't
+type DownloadOptions struct {
+	Timeout      time.Duration
+	MaxRedirects int
+	AllowPrivate bool
+}
+
+// DefaultDownloadOptions are used when none are configured
+var DefaultDownloadOptions = DownloadOptions{
+	Timeout:      30 * time.Second,
+	MaxRedirects: 5,
+}
+
+// Downloader fetches photos by URL
+type Downloader struct {
+	client *http.Client
+	limits Limits
+}
+
+// NewDownloader fetches photos within the limits
+func NewDownloader(options DownloadOptions, limits Limits) *Downloader {
+	dialer := &net.Dialer{Timeout: options.Timeout}
+	if !options.AllowPrivate {
+		// checked on the address actually dialled so a name can't resolve
+		// somewhere else after it has been checked
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || privateAddress(ip) {
+				return ErrPrivateAddress
+			}
+			return nil
+		}
+	}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   options.Timeout,
+		ResponseHeaderTimeout: options.Timeout,
+	}
+
+	return &Downloader{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   options.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > options.MaxRedirects {
+					return fmt.Errorf("more than %d redirects", options.MaxRedirects)
+				}
+				if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+					return fmt.Errorf("redirected to a %s URL", req.URL.Scheme)
+				}
+				return nil
+			},
+		},
+		limits: limits,
+	}
+}
+
+// Download fetches the photo at link and says what it is called
+func (d *Downloader) Download(ctx context.Context, link string) (string, []byte, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", nil, fmt.Errorf("only http and https URLs can be imported")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Accept", "image/*")
+	res, err := d.client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("server responded %s", res.Status)
+	}
+	if res.ContentLength > d.limits.MaxPhotoBytes {
+		return "", nil, ErrTooLarge
+	}
+
+	data, err := ReadPhoto(res.Body, d.limits)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// trust the content, servers often say octet-stream for anything
+	contentType := res.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") {
+		contentType = http.DetectContentType(data)
+	}
+	if !strings.HasPrefix(contentType, "image/") {
+		return "", nil, fmt.Errorf("%s is not a photo", contentType)
+	}
+
+	return downloadName(res, contentType), data, nil
+}
+
+// downloadName is the file name the server gave the photo, with an
+// extension to match its type when it has none
+func downloadName(res *http.Response, contentType string) string {
+	name := ""
+	if _, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition")); err == nil {
+		name = path.Base(strings.ReplaceAll(params["filename"], "\\", "/"))
+	}
+	if name == "" || name == "." || name == "/" {
+		name = path.Base(res.Request.URL.Path)
+	}
+	if name == "" || name == "." || name == "/" {
+		name = "photo"
+	}
+	if IsPhotoName(name) {
+		return name
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "image/jpeg":
+		return name + ".jpg"
+	case "image/png":
+		return name + ".png"
+	case "image/gif":
+		return name + ".gif"
+	case "image/webp":
+		return name + ".webp"
+	case "image/heic":
+		return name + ".heic"
+	case "image/tiff":
+		return name + ".tif"
+	}
+	return name
+}
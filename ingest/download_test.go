@@ -0,0 +1,101 @@
+package ingest
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadChecksWhatItFetches(t *testing.T) {
+	photo := readPhoto(t, "image000.jpg")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/beach", func(w http.ResponseWriter, r *http.Request) {
+		// no extension and a vague type, the content says it's a jpeg
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(photo)
+	})
+	mux.HandleFunc("/named", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="../../sunset.jpg"`)
+		w.Write(photo)
+	})
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html><body>not a photo</body></html>"))
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.Write(photo)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	limits := DefaultLimits
+	local := NewDownloader(DownloadOptions{Timeout: 200 * time.Millisecond, MaxRedirects: 2, AllowPrivate: true}, limits)
+	ctx := context.Background()
+
+	name, data, err := local.Download(ctx, server.URL+"/beach")
+	require.Nil(t, err)
+	assert.Equal(t, "beach.jpg", name)
+	assert.Equal(t, photo, data)
+
+	name, _, err = local.Download(ctx, server.URL+"/named")
+	require.Nil(t, err)
+	assert.Equal(t, "sunset.jpg", name)
+
+	_, _, err = local.Download(ctx, server.URL+"/page")
+	assert.Contains(t, err.Error(), "not a photo")
+	_, _, err = local.Download(ctx, server.URL+"/loop")
+	assert.Contains(t, err.Error(), "redirects")
+	_, _, err = local.Download(ctx, server.URL+"/slow")
+	assert.NotNil(t, err)
+	_, _, err = local.Download(ctx, "file:///etc/passwd")
+	assert.NotNil(t, err)
+
+	small := limits
+	small.MaxPhotoBytes = 1000
+	_, _, err = NewDownloader(DownloadOptions{Timeout: time.Second, AllowPrivate: true}, small).Download(ctx, server.URL+"/beach")
+	assert.Equal(t, ErrTooLarge, err)
+
+	// the test server is on loopback, which is off limits by default
+	_, _, err = NewDownloader(DefaultDownloadOptions, limits).Download(ctx, server.URL+"/beach")
+	assert.Contains(t, err.Error(), ErrPrivateAddress.Error())
+}
+
+func TestPrivateAddressesAreBlocked(t *testing.T) {
+	for address, private := range map[string]bool{
+		"0.0.0.0":           true,
+		"10.1.2.3":          true,
+		"100.64.0.1":        true,
+		"100.127.255.254":   true,
+		"127.0.0.1":         true,
+		"169.254.169.254":   true,
+		"172.16.0.1":        true,
+		"172.31.255.255":    true,
+		"192.168.1.20":      true,
+		"224.0.0.251":       true,
+		"::":                true,
+		"::1":               true,
+		"::ffff:10.0.0.1":   true,
+		"fc00::1":           true,
+		"fd12:3456::1":      true,
+		"fe80::1":           true,
+		"ff02::1":           true,
+		"8.8.8.8":           false,
+		"100.63.255.255":    false,
+		"100.128.0.1":       false,
+		"172.32.0.1":        false,
+		"192.169.0.1":       false,
+		"2001:4860::8888":   false,
+		"::ffff:93.184.0.1": false,
+	} {
+		assert.Equal(t, private, privateAddress(net.ParseIP(address)), address)
+	}
+}
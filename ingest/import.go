@@ -0,0 +1,292 @@
+package ingest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/naming"
+)
+
+// how many photos are imported between catalog saves
+const importBatch = 100
+
+// files with these extensions are imported, anything else is skipped
+var photoExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".heic": true,
+	".tif":  true,
+	".tiff": true,
+	".webp": true,
+}
+
+// ImportOptions say what to import and how
+// Stage backs up and stages the photos like uploads, otherwise they go
+// straight to the archive for playlists to pick, DryRun reports what would
+// happen without changing anything, naming photos with Namer like the
+// pipeline does, the StateFile lets an interrupted import carry on where it
+// stopped, closing Cancel stops it after the current photo
+type ImportOptions struct {
+	Dir       string
+	Namer     naming.ImageNamer
+	StateFile string
+	Stage     bool
+	DryRun    bool
+	Progress  io.Writer
+	Cancel    <-chan struct{}
+}
+
+// ImportReport sums up an import
+// Resumed files were dealt with by an earlier run
+type ImportReport struct {
+	Found      int               `json:"found"`
+	Imported   int               `json:"imported"`
+	Duplicates int               `json:"duplicates"`
+	Resumed    int               `json:"resumed"`
+	Skipped    int               `json:"skipped"`
+	Failed     map[string]string `json:"failed"`
+	Cancelled  bool              `json:"cancelled"`
+}
+
+// importedFile is a file that was imported or found to be a duplicate of
+// Photo, the state file has a line for each one
+type importedFile struct {
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	Modified  time.Time `json:"modified"`
+	Photo     string    `json:"photo"`
+	Duplicate bool      `json:"duplicate,omitempty"`
+}
+
+type importer struct {
+	options  ImportOptions
+	pipeline Pipeline
+	index    *Index
+	done     map[string]importedFile
+	report   ImportReport
+}
+
+// Import adds every photo under options.Dir that the index doesn't already
+// have, one at a time so a large library never needs much memory
+func Import(options ImportOptions, pipeline Pipeline, index *Index) (ImportReport, error) {
+	if options.Progress == nil {
+		options.Progress = ioutil.Discard
+	}
+	if options.Namer == nil {
+		options.Namer = naming.NewExifImageNamer()
+	}
+	dir, err := filepath.Abs(options.Dir)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return ImportReport{}, fmt.Errorf("%s is not a directory", options.Dir)
+	}
+
+	i := importer{
+		options:  options,
+		pipeline: pipeline,
+		index:    index,
+		done:     make(map[string]importedFile),
+		report:   ImportReport{Failed: make(map[string]string)},
+	}
+	if err := i.loadState(); err != nil {
+		return i.report, err
+	}
+
+	files, err := i.find(dir)
+	if err != nil {
+		return i.report, err
+	}
+	i.report.Found = len(files)
+
+	// the catalog is saved a batch at a time rather than for every photo,
+	// if the import dies mid batch the indexer catalogs the photos it saved
+	// again on the next start
+	for start := 0; start < len(files) && !i.report.Cancelled; start += importBatch {
+		end := start + importBatch
+		if end > len(files) {
+			end = len(files)
+		}
+		err := i.index.catalog.Batch(func() error {
+			for n := start; n < end; n++ {
+				select {
+				case <-options.Cancel:
+					i.report.Cancelled = true
+					return nil
+				default:
+				}
+				outcome := i.importFile(files[n])
+				fmt.Fprintf(options.Progress, "[%d/%d] %s %s\n", n+1, len(files), strings.TrimPrefix(files[n], dir+string(filepath.Separator)), outcome)
+			}
+			return nil
+		})
+		if err != nil {
+			return i.report, err
+		}
+	}
+	return i.report, nil
+}
+
+// find lists the photos under dir in name order, skipping hidden files and
+// directories
+func (i *importer) find(dir string) ([]string, error) {
+	files := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && path != dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if !IsPhotoName(path) {
+			i.report.Skipped++
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// importFile imports one file and says what happened to it
+func (i *importer) importFile(file string) string {
+	info, err := os.Stat(file)
+	if err != nil {
+		return i.failed(file, err)
+	}
+	if done, ok := i.done[file]; ok && done.Size == info.Size() && done.Modified.Equal(info.ModTime()) {
+		i.report.Resumed++
+		return "already imported as " + done.Photo
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return i.failed(file, err)
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	if name, ok := i.index.Find(hash); ok {
+		i.report.Duplicates++
+		if err := i.record(file, info, importedFile{Photo: name, Duplicate: true}); err != nil {
+			return i.failed(file, err)
+		}
+		return "is a duplicate of " + name
+	}
+
+	if i.options.DryRun {
+		// name it to catch what would fail, the final name may differ if
+		// it is taken by then
+		name, err := i.options.Namer.NameImage(data)
+		if err != nil {
+			return i.failed(file, err)
+		}
+		i.index.Add(hash, file)
+		i.report.Imported++
+		if name == "" {
+			return "would be imported"
+		}
+		return "would be imported as " + name + filepath.Ext(file)
+	}
+
+	saved, err := i.pipeline.Save(filepath.Base(file), data, "import")
+	if err != nil {
+		return i.failed(file, err)
+	}
+	if i.options.Stage {
+		err = i.pipeline.Finish([]string{saved}, Options{})
+	} else {
+		err = i.pipeline.Archive([]string{saved})
+	}
+	if err != nil {
+		return i.failed(file, err)
+	}
+
+	name := filepath.Base(saved)
+	i.index.Add(hash, name)
+	i.report.Imported++
+	if err := i.record(file, info, importedFile{Photo: name}); err != nil {
+		fmt.Println("Unable to record the import of", file, "because", err.Error())
+	}
+	return "imported as " + name
+}
+
+// IsPhotoName is true when the file's extension is one photos have
+func IsPhotoName(name string) bool {
+	return photoExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+func (i *importer) failed(file string, err error) string {
+	i.report.Failed[file] = err.Error()
+	return "failed: " + err.Error()
+}
+
+// record saves that the file was dealt with so a later run skips it
+func (i *importer) record(file string, info os.FileInfo, done importedFile) error {
+	if i.options.DryRun || i.options.StateFile == "" {
+		return nil
+	}
+	done.Path = file
+	done.Size = info.Size()
+	done.Modified = info.ModTime()
+	i.done[file] = done
+
+	f, err := os.OpenFile(i.options.StateFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := json.Marshal(done)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+func (i *importer) loadState() error {
+	if i.options.StateFile == "" {
+		return nil
+	}
+	f, err := os.Open(i.options.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	for {
+		var done importedFile
+		err := decoder.Decode(&done)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading import state %s: %s", i.options.StateFile, err.Error())
+		}
+		i.done[done.Path] = done
+	}
+}
@@ -0,0 +1,56 @@
+package ingest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportSkipsDuplicatesAndResumes(t *testing.T) {
+	lib := newLibrary(t)
+	dir := t.TempDir()
+	state := filepath.Join(t.TempDir(), "import.jsonl")
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "2019"), 0744))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "2019", "one.jpg"), readPhoto(t, "image000.jpg"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "2019", "copy.JPG"), readPhoto(t, "image000.jpg"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "two.jpg"), readPhoto(t, "image001.jpg"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "broken.jpg"), []byte("not a photo"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes"), 0644))
+
+	options := ImportOptions{Dir: dir, StateFile: state, DryRun: true}
+	report, err := Import(options, lib.pipeline, NewIndex(lib.catalog, lib.frames.Dirs()))
+	require.Nil(t, err)
+	assert.Equal(t, 4, report.Found)
+	assert.Equal(t, 2, report.Imported)
+	assert.Equal(t, 1, report.Duplicates)
+	assert.Equal(t, 1, report.Skipped)
+	assert.Contains(t, report.Failed, filepath.Join(dir, "broken.jpg"))
+	assert.Empty(t, names(t, lib.archive))
+	assert.NoFileExists(t, state)
+
+	options.DryRun = false
+	report, err = Import(options, lib.pipeline, NewIndex(lib.catalog, lib.frames.Dirs()))
+	require.Nil(t, err)
+	assert.Equal(t, 2, report.Imported)
+	assert.Equal(t, 1, report.Duplicates)
+	assert.Equal(t, 1, len(report.Failed))
+	assert.Contains(t, report.Failed, filepath.Join(dir, "broken.jpg"))
+	assert.Equal(t, 2, len(names(t, lib.archive)))
+	assert.Empty(t, names(t, lib.photos))
+	assert.Empty(t, lib.saver.files)
+	assert.Equal(t, 2, len(lib.catalog.List()))
+
+	// a second run only retries what failed and the catalog catches copies
+	// in new places
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "again.jpg"), readPhoto(t, "image001.jpg"), 0644))
+	report, err = Import(options, lib.pipeline, NewIndex(lib.catalog, lib.frames.Dirs()))
+	require.Nil(t, err)
+	assert.Equal(t, 3, report.Resumed)
+	assert.Equal(t, 1, report.Duplicates)
+	assert.Equal(t, 0, report.Imported)
+	assert.Equal(t, 1, len(report.Failed))
+}
@@ -0,0 +1,173 @@
+package ingest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/naming"
+)
+
+// where photos that couldn't be ingested are moved, inside the inbox
+const failedDir = ".failed"
+
+// InboxOptions configure a watched folder
+// with no KeepDir the originals are deleted once ingested
+type InboxOptions struct {
+	Dir      string
+	KeepDir  string
+	Interval time.Duration
+}
+
+// KeepsInside says whether KeepDir is Dir or inside it, the originals kept
+// would then be ingested again on the next poll
+func (o InboxOptions) KeepsInside() bool {
+	if o.Dir == "" || o.KeepDir == "" {
+		return false
+	}
+	dir, err := filepath.Abs(o.Dir)
+	if err != nil {
+		return false
+	}
+	keep, err := filepath.Abs(o.KeepDir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, keep)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Inbox polls a folder and feeds new photos through the pipeline
+type Inbox interface {
+	Stop()
+}
+
+// seen is what a file looked like on the last poll
+type seen struct {
+	size     int64
+	modified time.Time
+}
+
+type folderInbox struct {
+	options  InboxOptions
+	pipeline Pipeline
+	pending  map[string]seen
+	done     chan bool
+}
+
+// NewInbox starts polling options.Dir, a file is ingested once it has been
+// the same size for a whole interval so copies still being written are left
+// alone
+func NewInbox(options InboxOptions, pipeline Pipeline) (Inbox, error) {
+	if options.Interval <= 0 {
+		return nil, fmt.Errorf("inbox interval must be positive")
+	}
+	if options.KeepsInside() {
+		return nil, fmt.Errorf("inbox keep directory %s can't be inside the inbox %s", options.KeepDir, options.Dir)
+	}
+	for _, dir := range []string{options.Dir, options.KeepDir} {
+		if dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0744); err != nil {
+			return nil, err
+		}
+	}
+
+	inbox := folderInbox{
+		options:  options,
+		pipeline: pipeline,
+		pending:  make(map[string]seen),
+		done:     make(chan bool),
+	}
+
+	go func() {
+		ticker := time.NewTicker(options.Interval)
+		defer ticker.Stop()
+		for {
+			inbox.poll()
+			select {
+			case <-inbox.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return &inbox, nil
+}
+
+// poll ingests the files that haven't changed since the last poll
+func (i *folderInbox) poll() {
+	current := make(map[string]seen)
+	err := filepath.Walk(i.options.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// the file went away mid walk
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") && path != i.options.Dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		state := seen{size: info.Size(), modified: info.ModTime()}
+		last, ok := i.pending[path]
+		if !ok || last != state {
+			current[path] = state
+			return nil
+		}
+		i.ingest(path)
+		return nil
+	})
+	if err != nil {
+		fmt.Println("Unable to read inbox", i.options.Dir, "because", err.Error())
+	}
+	i.pending = current
+}
+
+func (i *folderInbox) ingest(file string) {
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		_, err = i.pipeline.Add(filepath.Base(file), data, "inbox", Options{})
+	}
+	if err != nil {
+		fmt.Println("Unable to ingest", file, "because", err.Error())
+		i.moveTo(file, filepath.Join(i.options.Dir, failedDir))
+		return
+	}
+
+	fmt.Println("Ingested", file, "from the inbox")
+	if i.options.KeepDir != "" {
+		i.moveTo(file, i.options.KeepDir)
+		return
+	}
+	if err := os.Remove(file); err != nil {
+		fmt.Println("Unable to remove", file, "because", err.Error())
+	}
+}
+
+// moveTo moves the file into dir without replacing anything already there
+func (i *folderInbox) moveTo(file string, dir string) {
+	name := filepath.Base(file)
+	ext := filepath.Ext(name)
+	target := naming.UniqueFileNameIn(dir, nil, strings.TrimSuffix(name, ext), ext)
+	err := os.MkdirAll(dir, 0744)
+	if err == nil {
+		err = os.Rename(file, target)
+	}
+	if err != nil {
+		fmt.Println("Unable to move", file, "to", dir, "because", err.Error())
+	}
+}
+
+func (i *folderInbox) Stop() {
+	close(i.done)
+}
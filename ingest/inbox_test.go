@@ -0,0 +1,127 @@
+package ingest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/catalog"
+	"github.com/blreynolds4/photopi-api/events"
+	"github.com/blreynolds4/photopi-api/frames"
+	"github.com/blreynolds4/photopi-api/naming"
+	"github.com/blreynolds4/photopi-api/stager"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type savedPhotos struct {
+	lock  sync.Mutex
+	files []string
+}
+
+func (s *savedPhotos) BackupPhoto(source string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.files = append(s.files, source)
+	return nil
+}
+
+func (s *savedPhotos) Stop() {}
+
+func names(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	found := []string{}
+	for _, info := range infos {
+		if !info.IsDir() {
+			found = append(found, info.Name())
+		}
+	}
+	return found
+}
+
+// library is a pipeline into temporary frame directories
+type library struct {
+	photos   string
+	archive  string
+	catalog  catalog.Catalog
+	frames   frames.Frames
+	saver    *savedPhotos
+	pipeline Pipeline
+}
+
+func newLibrary(t *testing.T) library {
+	data := t.TempDir()
+	bus := events.NewEventBus(100)
+	cat, err := catalog.NewJSONCatalog(filepath.Join(data, "catalog.json"))
+	require.Nil(t, err)
+	home, err := frames.Start(frames.Config{Name: frames.Default, ShowDir: filepath.Join(data, "show"), ArchiveDir: filepath.Join(data, "archive")},
+		stager.Capacity{}, filepath.Join(data, "selection.json"), cat, bus)
+	require.Nil(t, err)
+	all := frames.NewFrames(cat, bus, home)
+	t.Cleanup(all.Stop)
+	saver := &savedPhotos{}
+	photos := filepath.Join(data, "photos")
+	require.Nil(t, os.Mkdir(photos, 0744))
+
+	return library{
+		photos:   photos,
+		archive:  filepath.Join(data, "archive"),
+		catalog:  cat,
+		frames:   all,
+		saver:    saver,
+		pipeline: NewPipeline(photos, naming.NewExifImageNamer(), all, cat, saver, bus),
+	}
+}
+
+func readPhoto(t *testing.T, name string) []byte {
+	photo, err := ioutil.ReadFile(filepath.Join("..", "integration_tests", "photos", name))
+	require.Nil(t, err)
+	return photo
+}
+
+func TestInboxIngestsFilesOnceTheyStopChanging(t *testing.T) {
+	lib := newLibrary(t)
+	dir := t.TempDir()
+	keep := t.TempDir()
+	saver := lib.saver
+
+	inbox := folderInbox{
+		options:  InboxOptions{Dir: dir, KeepDir: keep},
+		pipeline: lib.pipeline,
+		pending:  make(map[string]seen),
+	}
+
+	photo := readPhoto(t, "image000.jpg")
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "holiday"), 0744))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "holiday", "beach.jpg"), photo, 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a photo"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".partial.jpg"), photo[:100], 0644))
+
+	// the first poll only notes what is there
+	inbox.poll()
+	assert.Empty(t, saver.files)
+
+	inbox.poll()
+	require.Equal(t, 1, len(saver.files))
+	assert.Equal(t, lib.photos, filepath.Dir(saver.files[0]))
+	_, err := lib.catalog.Get(filepath.Base(saver.files[0]))
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"beach.jpg"}, names(t, keep))
+	assert.Equal(t, []string{"notes.txt"}, names(t, filepath.Join(dir, failedDir)))
+	assert.Equal(t, []string{".partial.jpg"}, names(t, dir))
+}
+
+func TestInboxCantKeepOriginalsInsideItself(t *testing.T) {
+	dir := t.TempDir()
+	for _, keep := range []string{dir, filepath.Join(dir, "kept"), dir + "/./kept/"} {
+		_, err := NewInbox(InboxOptions{Dir: dir, KeepDir: keep, Interval: time.Second}, nil)
+		assert.NotNil(t, err, keep)
+	}
+	assert.False(t, InboxOptions{Dir: dir, KeepDir: dir + "-kept"}.KeepsInside())
+	assert.False(t, InboxOptions{Dir: filepath.Join(dir, "inbox"), KeepDir: filepath.Join(dir, "..kept")}.KeepsInside())
+}
@@ -0,0 +1,64 @@
+package ingest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/blreynolds4/photopi-api/catalog"
+)
+
+// Index finds photos the library already has by the hash of their contents
+type Index struct {
+	lock    sync.Mutex
+	catalog catalog.Catalog
+	hashes  map[string]string
+}
+
+// NewIndex indexes the catalog, photos cataloged before hashes were
+// recorded are hashed from the first of dirs that has them
+func NewIndex(cat catalog.Catalog, dirs []string) *Index {
+	index := Index{catalog: cat, hashes: make(map[string]string)}
+	for _, photo := range cat.List() {
+		sum := photo.SHA256
+		if sum == "" {
+			sum = hashIn(dirs, photo.Name)
+		}
+		if sum != "" {
+			index.hashes[sum] = photo.Name
+		}
+	}
+	return &index
+}
+
+func hashIn(dirs []string, name string) string {
+	for _, dir := range dirs {
+		file := filepath.Join(dir, name)
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		sum, err := catalog.HashFile(file)
+		if err != nil {
+			fmt.Println("Unable to hash", file, "because", err.Error())
+			return ""
+		}
+		return sum
+	}
+	return ""
+}
+
+// Find returns the name of the photo with the hash
+func (i *Index) Find(sum string) (string, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	name, ok := i.hashes[sum]
+	return name, ok
+}
+
+// Add records a photo's hash
+func (i *Index) Add(sum string, name string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.hashes[sum] = name
+}
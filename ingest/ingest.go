@@ -0,0 +1,297 @@
+package ingest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/backup"
+	"github.com/blreynolds4/photopi-api/catalog"
+	"github.com/blreynolds4/photopi-api/events"
+	"github.com/blreynolds4/photopi-api/frames"
+	"github.com/blreynolds4/photopi-api/naming"
+)
+
+// Options say where ingested photos go, photos go to every frame unless
+// Frames names them, Caption is shown with each photo in place of any
+// written into it and Uploader says who sent them
+type Options struct {
+	Album    string
+	Tags     []string
+	Frames   []string
+	Caption  string
+	Uploader string
+}
+
+// Pipeline takes new photos from any source through naming, the catalog,
+// backup and staging
+// Save names and stores a photo, Finish hands the saved photos on once the
+// options for them are known, Archive keeps them out of the slideshow and
+// Discard throws saved photos away, Retry sends on again photos staging
+// left behind
+type Pipeline interface {
+	Save(filename string, data []byte, source string) (string, error)
+	CheckFrames(names []string) ([]string, error)
+	Finish(files []string, options Options) error
+	Archive(files []string) error
+	Discard(files []string)
+	Add(filename string, data []byte, source string, options Options) (string, error)
+	Retry(settle time.Duration) ([]string, error)
+}
+
+type photoPipeline struct {
+	// naming holds off other saves between picking a free name and
+	// writing the photo under it
+	naming   sync.Mutex
+	photoDir string
+	namer    naming.ImageNamer
+	frames   frames.Frames
+	catalog  catalog.Catalog
+	saver    backup.PhotoBackup
+	events   events.Publisher
+}
+
+// NewPipeline saves photos in photoDir under names from namer unused in
+// any frame
+func NewPipeline(photoDir string, namer naming.ImageNamer, frameSet frames.Frames, cat catalog.Catalog, saver backup.PhotoBackup, publisher events.Publisher) Pipeline {
+	return &photoPipeline{
+		photoDir: photoDir,
+		namer:    namer,
+		frames:   frameSet,
+		catalog:  cat,
+		saver:    saver,
+		events:   publisher,
+	}
+}
+
+// Save names the photo from its EXIF date, writes it to the photos
+// directory and catalogs it, source says where it came from
+func (p *photoPipeline) Save(filename string, data []byte, source string) (string, error) {
+	p.naming.Lock()
+	createdPath, err := addFileToPath(p.photoDir, p.namer, p.frames.Dirs(), filename, data)
+	p.naming.Unlock()
+	if err != nil {
+		p.events.Publish(events.PhotoFailed, filename, map[string]string{"stage": "save", "source": source, "error": err.Error()})
+		return "", err
+	}
+	name := filepath.Base(createdPath)
+	p.events.Publish(events.PhotoReceived, name, map[string]string{"upload": filename, "source": source})
+
+	// catalog it before it is staged, with any caption written into it and
+	// when it was taken from the name it was given
+	photo, err := catalog.PhotoFromFile(createdPath, p.namer)
+	if err == nil {
+		photo.Caption = naming.Description(data)
+		err = p.catalog.Put(photo)
+	}
+	if err != nil {
+		fmt.Println("Unable to catalog", createdPath, "because", err.Error())
+	}
+	return createdPath, nil
+}
+
+// CheckFrames trims the frame names and makes sure each one exists
+func (p *photoPipeline) CheckFrames(names []string) ([]string, error) {
+	routed := []string{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, err := p.frames.Get(name); err != nil {
+			return nil, fmt.Errorf("there is no frame %s", name)
+		}
+		routed = append(routed, name)
+	}
+	return routed, nil
+}
+
+// Finish routes, captions and tags the saved photos then backs them up,
+// which stages them, frames must already be checked, an album that can't be
+// found or created is returned after the photos are on their way
+func (p *photoPipeline) Finish(files []string, options Options) error {
+	caption := strings.TrimSpace(options.Caption)
+	uploader := strings.TrimSpace(options.Uploader)
+	if len(options.Frames) > 0 || caption != "" || uploader != "" {
+		for _, file := range files {
+			_, err := p.catalog.Update(filepath.Base(file), func(photo *catalog.Photo) error {
+				if len(options.Frames) > 0 {
+					photo.Frames = options.Frames
+				}
+				if caption != "" {
+					photo.Caption = caption
+				}
+				if uploader != "" {
+					photo.Uploader = uploader
+				}
+				return nil
+			})
+			if err != nil {
+				fmt.Println("Unable to route", file, "because", err.Error())
+			}
+		}
+	}
+
+	tagErr := p.tag(files, options.Album, options.Tags)
+
+	for _, file := range files {
+		p.saver.BackupPhoto(file)
+	}
+	return tagErr
+}
+
+// Archive moves saved photos straight to the default frame's archive
+// without backing them up, playlists can still pick them
+func (p *photoPipeline) Archive(files []string) error {
+	archive := p.frames.Default().ArchiveDir
+	for _, file := range files {
+		name := filepath.Base(file)
+		destination := filepath.Join(archive, name)
+		if err := os.Rename(file, destination); err != nil {
+			return err
+		}
+		p.events.Publish(events.PhotoArchived, name, map[string]string{"archive": destination, "reason": "imported"})
+	}
+	return nil
+}
+
+// Discard removes photos that were saved but won't be staged
+func (p *photoPipeline) Discard(files []string) {
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			fmt.Println("Unable to remove", file, "because", err.Error())
+		}
+		p.catalog.Delete(filepath.Base(file))
+		p.events.Publish(events.PhotoFailed, filepath.Base(file), map[string]string{"stage": "route", "error": "discarded"})
+	}
+}
+
+// Add saves a single photo and sends it on
+func (p *photoPipeline) Add(filename string, data []byte, source string, options Options) (string, error) {
+	routed, err := p.CheckFrames(options.Frames)
+	if err != nil {
+		return "", err
+	}
+	options.Frames = routed
+
+	file, err := p.Save(filename, data, source)
+	if err != nil {
+		return "", err
+	}
+	return file, p.Finish([]string{file}, options)
+}
+
+// Retry backs up and stages again photos that have waited in the photos
+// directory longer than settle, staging leaves them there when it fails,
+// copies made for other frames go back to their own frame
+func (p *photoPipeline) Retry(settle time.Duration) ([]string, error) {
+	cutoff := time.Now().Add(-settle)
+	retried := []string{}
+
+	waiting, err := waitingIn(p.photoDir, cutoff)
+	if err != nil {
+		return retried, err
+	}
+	for _, name := range waiting {
+		p.saver.BackupPhoto(filepath.Join(p.photoDir, name))
+		retried = append(retried, name)
+	}
+
+	for _, f := range p.frames.List() {
+		dir := filepath.Join(p.photoDir, ".frames", f.Name)
+		waiting, err := waitingIn(dir, cutoff)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return retried, err
+		}
+		for _, name := range waiting {
+			f.Stager.StagePhoto(filepath.Join(dir, name))
+			retried = append(retried, name)
+		}
+	}
+	return retried, nil
+}
+
+// waitingIn lists the photos in dir last changed before cutoff
+func waitingIn(dir string, cutoff time.Time) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") || info.ModTime().After(cutoff) {
+			continue
+		}
+		names = append(names, info.Name())
+	}
+	return names, nil
+}
+
+// tag puts the photos in the album, creating it if there is no album with
+// that id or name, and adds the tags
+func (p *photoPipeline) tag(files []string, album string, tags []string) error {
+	tags = catalog.NormalizeTags(tags)
+	if len(files) == 0 || (album == "" && len(tags) == 0) {
+		return nil
+	}
+
+	albumID := ""
+	if album != "" {
+		a, err := p.catalog.FindAlbum(album)
+		if err == catalog.ErrAlbumNotFound {
+			a, err = p.catalog.AddAlbum(catalog.Album{Name: album})
+		}
+		if err != nil {
+			return err
+		}
+		albumID = a.ID
+	}
+
+	for _, file := range files {
+		name := filepath.Base(file)
+		_, err := p.catalog.Update(name, func(photo *catalog.Photo) error {
+			if albumID != "" && !photo.InAlbum(albumID) {
+				photo.Albums = append(photo.Albums, albumID)
+			}
+			photo.Tags = catalog.NormalizeTags(append(photo.Tags, tags...))
+			return nil
+		})
+		if err != nil {
+			fmt.Println("Unable to tag", name, "because", err.Error())
+		}
+	}
+	return nil
+}
+
+// addFileToPath saves the photo in rootDir under a name that isn't used in
+// rootDir or any of the otherDirs the photo will move through
+func addFileToPath(rootDir string, namer naming.ImageNamer, otherDirs []string, filename string, data []byte) (string, error) {
+	// need to create a unique filename for our new file, starting with what we
+	// have and adding numeric extentions until it doesn't exist
+	exifName, err := namer.NameImage(data)
+	if err != nil {
+		return "", err
+	}
+
+	if "" == exifName {
+		exifName = namer.NameTime(time.Now())
+	}
+
+	fqFilename := naming.UniqueFileNameIn(rootDir, otherDirs, exifName, filepath.Ext(filename))
+
+	// write the new file
+	err = ioutil.WriteFile(fqFilename, data, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	// return the name we used
+	return fqFilename, nil
+}
@@ -0,0 +1,167 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/events"
+	"github.com/blreynolds4/photopi-api/naming"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withXMP puts an XMP packet with the description into a jpeg
+func withXMP(jpeg []byte, description string) []byte {
+	packet := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:description><rdf:Alt>` +
+		`<rdf:li xml:lang="x-default">` + description + `</rdf:li></rdf:Alt></dc:description>` +
+		`</rdf:Description></rdf:RDF></x:xmpmeta>`
+	segment := append([]byte("http://ns.adobe.com/xap/1.0/\x00"), packet...)
+	return insertSegment(jpeg, segment)
+}
+
+// withImageDescription is a jpeg with only an EXIF ImageDescription
+func withImageDescription(description string) []byte {
+	text := append([]byte(description), 0)
+	tiff := new(bytes.Buffer)
+	tiff.WriteString("II")
+	binary.Write(tiff, binary.LittleEndian, uint16(42))
+	binary.Write(tiff, binary.LittleEndian, uint32(8))
+	binary.Write(tiff, binary.LittleEndian, uint16(1))
+	binary.Write(tiff, binary.LittleEndian, uint16(0x010e))
+	binary.Write(tiff, binary.LittleEndian, uint16(2))
+	binary.Write(tiff, binary.LittleEndian, uint32(len(text)))
+	binary.Write(tiff, binary.LittleEndian, uint32(26))
+	binary.Write(tiff, binary.LittleEndian, uint32(0))
+	tiff.Write(text)
+
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	return insertSegment([]byte{0xff, 0xd8, 0xff, 0xd9}, segment)
+}
+
+// insertSegment adds an APP1 segment after the start of image marker
+func insertSegment(jpeg []byte, segment []byte) []byte {
+	header := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(segment)+2))
+	result := append([]byte{}, jpeg[:2]...)
+	result = append(result, header...)
+	result = append(result, segment...)
+	return append(result, jpeg[2:]...)
+}
+
+func TestPhotosKeepTheCaptionWrittenIntoThem(t *testing.T) {
+	lib := newLibrary(t)
+
+	file, err := lib.pipeline.Save("lake.jpg", withXMP(readPhoto(t, "image000.jpg"), "Grandkids at the lake &amp; dock"), "upload")
+	require.Nil(t, err)
+	photo, err := lib.catalog.Get(filepath.Base(file))
+	require.Nil(t, err)
+	assert.Equal(t, "Grandkids at the lake & dock", photo.Caption)
+
+	file, err = lib.pipeline.Save("party.jpg", withImageDescription("Birthday party"), "upload")
+	require.Nil(t, err)
+	photo, err = lib.catalog.Get(filepath.Base(file))
+	require.Nil(t, err)
+	assert.Equal(t, "Birthday party", photo.Caption)
+
+	// descriptions cameras write themselves are not captions
+	file, err = lib.pipeline.Save("camera.jpg", withImageDescription("OLYMPUS DIGITAL CAMERA         "), "upload")
+	require.Nil(t, err)
+	photo, err = lib.catalog.Get(filepath.Base(file))
+	require.Nil(t, err)
+	assert.Equal(t, "", photo.Caption)
+}
+
+func TestPhotosAreNamedInTheConfiguredFormat(t *testing.T) {
+	lib := newLibrary(t)
+	file, err := lib.pipeline.Save("lake.jpg", readPhoto(t, "image000.jpg"), "upload")
+	require.Nil(t, err)
+	assert.Equal(t, "2005-12-31-09-08-07.jpg", filepath.Base(file))
+
+	lib.pipeline = NewPipeline(lib.photos, naming.NewImageNamer("20060102_150405"), lib.frames, lib.catalog, lib.saver, events.NewEventBus(10))
+	file, err = lib.pipeline.Save("lake.jpg", readPhoto(t, "image000.jpg"), "upload")
+	require.Nil(t, err)
+	assert.Equal(t, "20051231_090807.jpg", filepath.Base(file))
+	photo, err := lib.catalog.Get(filepath.Base(file))
+	require.Nil(t, err)
+	assert.Equal(t, time.Date(2005, 12, 31, 9, 8, 7, 0, time.Local), photo.Taken)
+
+	// a second photo taken then gets a suffix but keeps the time
+	file, err = lib.pipeline.Save("lake.jpg", readPhoto(t, "image000.jpg"), "upload")
+	require.Nil(t, err)
+	photo, err = lib.catalog.Get(filepath.Base(file))
+	require.Nil(t, err)
+	assert.NotEqual(t, "20051231_090807.jpg", photo.Name)
+	assert.Equal(t, time.Date(2005, 12, 31, 9, 8, 7, 0, time.Local), photo.Taken)
+
+	assert.Nil(t, naming.ValidFormat("2006-01"))
+	assert.Error(t, naming.ValidFormat("2006/01/02"))
+	assert.Error(t, naming.ValidFormat("photo"))
+}
+
+func TestCaptionAndUploaderGivenWithThePhoto(t *testing.T) {
+	lib := newLibrary(t)
+
+	file, err := lib.pipeline.Add("lake.jpg", withXMP(readPhoto(t, "image000.jpg"), "From the camera"), "upload",
+		Options{Caption: " Summer 2005 ", Uploader: "Nana"})
+	require.Nil(t, err)
+
+	photo, err := lib.catalog.Get(filepath.Base(file))
+	require.Nil(t, err)
+	assert.Equal(t, "Summer 2005", photo.Caption)
+	assert.Equal(t, "Nana", photo.Uploader)
+
+	// without a caption the one in the photo stays
+	file, err = lib.pipeline.Add("lake.jpg", withXMP(readPhoto(t, "image000.jpg"), "From the camera"), "upload", Options{Uploader: "Nana"})
+	require.Nil(t, err)
+	photo, err = lib.catalog.Get(filepath.Base(file))
+	require.Nil(t, err)
+	assert.Equal(t, "From the camera", photo.Caption)
+}
+
+func TestPhotosTakenTheSameSecondGetTheirOwnNames(t *testing.T) {
+	lib := newLibrary(t)
+	photo := readPhoto(t, "image000.jpg")
+
+	files := make(chan string, 8)
+	wg := sync.WaitGroup{}
+	for i := 0; i < cap(files); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			file, err := lib.pipeline.Save("lake.jpg", photo, "import")
+			assert.Nil(t, err)
+			files <- filepath.Base(file)
+		}()
+	}
+	wg.Wait()
+	close(files)
+
+	unique := make(map[string]bool)
+	for name := range files {
+		unique[name] = true
+	}
+	assert.Equal(t, cap(files), len(unique))
+	assert.Equal(t, cap(files), len(names(t, lib.photos)))
+}
+
+func TestPhotosLeftBehindAreRetried(t *testing.T) {
+	lib := newLibrary(t)
+	left := filepath.Join(lib.photos, "2005-12-31-09-08-07.jpg")
+	require.Nil(t, ioutil.WriteFile(left, readPhoto(t, "image000.jpg"), 0644))
+	old := time.Now().Add(-time.Hour)
+	require.Nil(t, os.Chtimes(left, old, old))
+	// one still on its way is left alone
+	require.Nil(t, ioutil.WriteFile(filepath.Join(lib.photos, "2005-12-31-09-08-08.jpg"), readPhoto(t, "image000.jpg"), 0644))
+
+	retried, err := lib.pipeline.Retry(time.Minute)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"2005-12-31-09-08-07.jpg"}, retried)
+	assert.Equal(t, []string{left}, lib.saver.files)
+}
@@ -0,0 +1,311 @@
+package invites
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long expired invites are kept for the record
+const keepExpired = 30 * 24 * time.Hour
+
+// ErrNotFound is returned when there is no invite with the id
+var ErrNotFound = errors.New("invite not found")
+
+// ErrInvalid is returned for links that weren't made here or were changed
+var ErrInvalid = errors.New("invite link is not valid")
+
+// ErrExpired is returned for invites past their expiry
+var ErrExpired = errors.New("invite has expired")
+
+// ErrRevoked is returned for invites that were withdrawn
+var ErrRevoked = errors.New("invite was revoked")
+
+// ErrUsedUp is returned when an invite has no photos left
+var ErrUsedUp = errors.New("invite has no photos left")
+
+// Invite lets guests without an account add photos until it expires, into
+// Album and to Frames when set, MaxPhotos limits how many when not 0
+type Invite struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Album     string    `json:"album,omitempty"`
+	Frames    []string  `json:"frames,omitempty"`
+	MaxPhotos int       `json:"maxPhotos,omitempty"`
+	Used      int       `json:"used"`
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	Expires   time.Time `json:"expires"`
+	Revoked   bool      `json:"revoked,omitempty"`
+}
+
+// Remaining is how many more photos the invite takes, -1 for no limit
+func (i Invite) Remaining() int {
+	if i.MaxPhotos == 0 {
+		return -1
+	}
+	if i.Used >= i.MaxPhotos {
+		return 0
+	}
+	return i.MaxPhotos - i.Used
+}
+
+// check says why the invite can't be used, if it can't
+func (i Invite) check(now time.Time) error {
+	switch {
+	case i.Revoked:
+		return ErrRevoked
+	case now.After(i.Expires):
+		return ErrExpired
+	case i.Remaining() == 0:
+		return ErrUsedUp
+	}
+	return nil
+}
+
+// Store keeps invites and signs the links for them
+// Token is the secret part of an invite's link, Check finds the invite a
+// token is for if it can still be used and Use counts photos against it
+type Store interface {
+	Create(invite Invite) (Invite, error)
+	Get(id string) (Invite, error)
+	List() []Invite
+	Revoke(id string) error
+	Token(invite Invite) string
+	Check(token string) (Invite, error)
+	Use(id string, photos int) error
+}
+
+type fileStore struct {
+	lock    sync.Mutex
+	file    string
+	key     []byte
+	invites map[string]Invite
+	now     func() time.Time
+}
+
+// NewStore keeps invites in file and signs links with the key in keyFile,
+// which is created the first time
+func NewStore(file, keyFile string) (Store, error) {
+	return newStore(file, keyFile, time.Now)
+}
+
+func newStore(file, keyFile string, now func() time.Time) (*fileStore, error) {
+	key, err := loadKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	s := fileStore{
+		file:    file,
+		key:     key,
+		invites: make(map[string]Invite),
+		now:     now,
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		saved := []Invite{}
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return nil, fmt.Errorf("reading invites %s: %s", file, err.Error())
+		}
+		for _, i := range saved {
+			s.invites[i.ID] = i
+		}
+	}
+	return &s, nil
+}
+
+// loadKey reads the signing key, making one if there isn't one yet
+func loadKey(keyFile string) ([]byte, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) < 16 {
+			return nil, fmt.Errorf("invite key %s is not valid", keyFile)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(keyFile, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (s *fileStore) Create(invite Invite) (Invite, error) {
+	if invite.MaxPhotos < 0 {
+		return invite, fmt.Errorf("maxPhotos can't be negative")
+	}
+	if !invite.Expires.After(s.now()) {
+		return invite, fmt.Errorf("invites must expire in the future")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	invite.ID = newID()
+	invite.Name = strings.TrimSpace(invite.Name)
+	invite.Album = strings.TrimSpace(invite.Album)
+	invite.Used = 0
+	invite.Revoked = false
+	invite.Created = s.now()
+	// links carry the expiry to the second
+	invite.Expires = invite.Expires.Truncate(time.Second)
+	s.invites[invite.ID] = invite
+	return invite, s.save()
+}
+
+func (s *fileStore) Get(id string) (Invite, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	i, ok := s.invites[id]
+	if !ok {
+		return i, ErrNotFound
+	}
+	return i, nil
+}
+
+// List returns the invites, newest first
+func (s *fileStore) List() []Invite {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := make([]Invite, 0, len(s.invites))
+	for _, i := range s.invites {
+		result = append(result, i)
+	}
+	sort.Slice(result, func(a, b int) bool {
+		return result[a].Created.After(result[b].Created)
+	})
+	return result
+}
+
+func (s *fileStore) Revoke(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	i, ok := s.invites[id]
+	if !ok {
+		return ErrNotFound
+	}
+	i.Revoked = true
+	s.invites[id] = i
+	return s.save()
+}
+
+// Token signs the invite's id and expiry, so links can't be made up or
+// made to last longer
+func (s *fileStore) Token(invite Invite) string {
+	payload := invite.ID + "." + strconv.FormatInt(invite.Expires.Unix(), 36)
+	return payload + "." + s.sign(payload)
+}
+
+func (s *fileStore) Check(token string) (Invite, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Invite{}, ErrInvalid
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(s.sign(payload))) {
+		return Invite{}, ErrInvalid
+	}
+	expires, err := strconv.ParseInt(parts[1], 36, 64)
+	if err != nil {
+		return Invite{}, ErrInvalid
+	}
+	now := s.now()
+	if now.After(time.Unix(expires, 0)) {
+		return Invite{}, ErrExpired
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	i, ok := s.invites[parts[0]]
+	if !ok || i.Expires.Unix() != expires {
+		return Invite{}, ErrInvalid
+	}
+	return i, i.check(now)
+}
+
+// Use counts photos against the invite, if it doesn't have room for them
+// all none are counted
+func (s *fileStore) Use(id string, photos int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	i, ok := s.invites[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := i.check(s.now()); err != nil {
+		return err
+	}
+	if remaining := i.Remaining(); remaining >= 0 && photos > remaining {
+		return fmt.Errorf("invite only takes %d more photos", remaining)
+	}
+	i.Used += photos
+	s.invites[id] = i
+	return s.save()
+}
+
+func (s *fileStore) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// save writes the invites out, dropping ones long expired, the lock must be
+// held
+func (s *fileStore) save() error {
+	saved := make([]Invite, 0, len(s.invites))
+	for id, i := range s.invites {
+		if s.now().Sub(i.Expires) > keepExpired {
+			delete(s.invites, id)
+			continue
+		}
+		saved = append(saved, i)
+	}
+	sort.Slice(saved, func(a, b int) bool {
+		return saved[a].Created.Before(saved[b].Created)
+	})
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
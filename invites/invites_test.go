@@ -0,0 +1,86 @@
+package invites
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func newTestStore(t *testing.T, c *clock) (Store, string) {
+	dir := t.TempDir()
+	store, err := newStore(filepath.Join(dir, "invites.json"), filepath.Join(dir, "invites.key"), c.Now)
+	require.Nil(t, err)
+	return store, dir
+}
+
+func TestInviteLinksAreSignedAndExpire(t *testing.T) {
+	c := &clock{now: time.Now()}
+	store, dir := newTestStore(t, c)
+
+	invite, err := store.Create(Invite{Name: "Party", Album: "Party", Expires: c.now.Add(time.Hour)})
+	require.Nil(t, err)
+	token := store.Token(invite)
+
+	found, err := store.Check(token)
+	require.Nil(t, err)
+	assert.Equal(t, invite, found)
+
+	// changing any part of the link breaks the signature
+	parts := strings.Split(token, ".")
+	_, err = store.Check(parts[0] + "." + "zzzzzz" + "." + parts[2])
+	assert.Equal(t, ErrInvalid, err)
+	_, err = store.Check(token + "x")
+	assert.Equal(t, ErrInvalid, err)
+
+	// links stay good across restarts but not with another key
+	again, err := NewStore(filepath.Join(dir, "invites.json"), filepath.Join(dir, "invites.key"))
+	require.Nil(t, err)
+	_, err = again.Check(token)
+	assert.Nil(t, err)
+	other, _ := newTestStore(t, c)
+	_, err = other.Check(token)
+	assert.Equal(t, ErrInvalid, err)
+
+	_, err = store.Create(Invite{Expires: c.now.Add(-time.Second)})
+	assert.Error(t, err)
+	soon, err := store.Create(Invite{Expires: c.now.Add(time.Minute)})
+	require.Nil(t, err)
+	c.now = c.now.Add(2 * time.Minute)
+	_, err = store.Check(store.Token(soon))
+	assert.Equal(t, ErrExpired, err)
+
+	require.Nil(t, store.Revoke(invite.ID))
+	_, err = store.Check(token)
+	assert.Equal(t, ErrRevoked, err)
+}
+
+func TestInvitesTakeOnlyTheirPhotos(t *testing.T) {
+	c := &clock{now: time.Now()}
+	store, _ := newTestStore(t, c)
+	invite, err := store.Create(Invite{MaxPhotos: 3, Expires: c.now.Add(time.Hour)})
+	require.Nil(t, err)
+
+	require.Nil(t, store.Use(invite.ID, 2))
+	// too many for what is left counts none of them
+	assert.Error(t, store.Use(invite.ID, 2))
+	require.Nil(t, store.Use(invite.ID, 1))
+
+	_, err = store.Check(store.Token(invite))
+	assert.Equal(t, ErrUsedUp, err)
+	found, err := store.Get(invite.ID)
+	require.Nil(t, err)
+	assert.Equal(t, 3, found.Used)
+	assert.Equal(t, 0, found.Remaining())
+}
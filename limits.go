@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/ratelimit"
+	"github.com/gorilla/mux"
+	"github.com/urfave/negroni"
+)
+
+// tooFastError is what reading a body gives once its byte budget is spent,
+// wait is how long until there is budget again
+type tooFastError struct {
+	wait time.Duration
+}
+
+func (e tooFastError) Error() string {
+	return "upload is over its rate limit"
+}
+
+// routeLimiters are the buckets for one route's budget, nil for no limit
+type routeLimiters struct {
+	requests ratelimit.Limiter
+	bytes    ratelimit.Limiter
+}
+
+// rateLimit holds each user, or each address for those not signed in, to
+// the budget of the route they are calling, it runs after authenticate so
+// it knows who that is
+func rateLimit(ctx AppContext, router *mux.Router) negroni.HandlerFunc {
+	var mutex sync.Mutex
+	limiters := map[string]*routeLimiters{}
+	limitersFor := func(name string) *routeLimiters {
+		if _, ok := ctx.RateLimits[name]; !ok {
+			name = ratelimit.Default
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		found, ok := limiters[name]
+		if !ok {
+			budget := ctx.RateLimits[name]
+			found = &routeLimiters{requests: budget.Requests.Limiter(), bytes: budget.Bytes.Limiter()}
+			limiters[name] = found
+		}
+		return found
+	}
+
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		limits := limitersFor(routeName(router, req))
+		key := rateKey(req)
+
+		if limits.requests != nil && !allow(w, ctx, limits.requests, key, 1) {
+			return
+		}
+		if limits.bytes != nil && req.ContentLength > 0 && !allow(w, ctx, limits.bytes, key, float64(req.ContentLength)) {
+			return
+		}
+		// without a length the body is counted as it is read
+		if limits.bytes != nil && req.ContentLength < 0 && req.Body != nil {
+			req.Body = &meteredBody{ReadCloser: req.Body, limiter: limits.bytes, key: key}
+		}
+		next(w, req)
+	}
+}
+
+// routeName is the name of the route the request is for, blank for the
+// static files
+func routeName(router *mux.Router, req *http.Request) string {
+	match := mux.RouteMatch{}
+	if router.Match(req, &match) && match.Route != nil {
+		return match.Route.GetName()
+	}
+	return ""
+}
+
+// allow takes n from the budget, answering 429 when it is spent
+func allow(w http.ResponseWriter, ctx AppContext, limiter ratelimit.Limiter, key string, n float64) bool {
+	ok, wait := limiter.Take(key, n)
+	if ok {
+		return true
+	}
+	retryLater(w, ctx, wait)
+	return false
+}
+
+// overBudget answers 429 when err is the byte budget running out while the
+// body was read, it says whether it did
+func overBudget(w http.ResponseWriter, ctx AppContext, err error) bool {
+	var tooFast tooFastError
+	if !errors.As(err, &tooFast) {
+		return false
+	}
+	retryLater(w, ctx, tooFast.wait)
+	return true
+}
+
+func retryLater(w http.ResponseWriter, ctx AppContext, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	ctx.Render.JSON(w, http.StatusTooManyRequests, Status{Status: "error", Message: fmt.Sprintf("Too many requests, try again in %d seconds", seconds)})
+}
+
+// meteredBody takes what is read from the byte budget and stops reading
+// once it is spent
+type meteredBody struct {
+	io.ReadCloser
+	limiter ratelimit.Limiter
+	key     string
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		// what was read is dropped so the handler never sees a body that
+		// looks complete
+		if ok, wait := b.limiter.Take(b.key, float64(n)); !ok {
+			return 0, tooFastError{wait: wait}
+		}
+	}
+	return n, err
+}
+
+// rateKey is the signed in user or else the address the request came from,
+// guests with an invite share its link so they are kept apart by address
+func rateKey(req *http.Request) string {
+	if user, ok := currentUser(req); ok {
+		return "user:" + user.Name
+	}
+	return "ip:" + clientIP(req)
+}
+
+// clientIP is the address that connected, forwarded headers are not trusted
+// because anyone could set them to get a fresh budget
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/blreynolds4/photopi-api/events"
+	"github.com/blreynolds4/photopi-api/ingest"
+	"github.com/blreynolds4/photopi-api/mailbox"
+)
+
+// deliverMail adds the photos attached to an email like an upload, the
+// subject becomes each photo's caption and the sender its uploader
+// photos too large to upload are left out, the message is only turned
+// down when none of its photos could be added
+func deliverMail(ctx AppContext) func(mailbox.Message) (int, error) {
+	return func(message mailbox.Message) (int, error) {
+		fmt.Println("Received email from", message.From, "with", len(message.Attachments), "photos")
+		added := []string{}
+		for _, attachment := range message.Attachments {
+			if ctx.Limits.MaxPhotoBytes > 0 && int64(len(attachment.Data)) > ctx.Limits.MaxPhotoBytes {
+				ctx.Events.Publish(events.PhotoFailed, attachment.Filename, map[string]string{"stage": "receive", "source": "email", "error": ingest.ErrTooLarge.Error()})
+				continue
+			}
+			createdPath, err := ctx.Ingest.Save(attachment.Filename, attachment.Data, "email")
+			if err != nil {
+				continue
+			}
+			added = append(added, createdPath)
+		}
+		if len(added) == 0 {
+			return 0, mailbox.ErrNoPhotos
+		}
+
+		if err := ctx.Ingest.Finish(added, ingest.Options{Caption: message.Subject, Uploader: message.From}); err != nil {
+			fmt.Println("Unable to tag emailed photos because", err.Error())
+		}
+		return len(added), nil
+	}
+}
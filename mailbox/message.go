@@ -0,0 +1,133 @@
+package mailbox
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"strings"
+
+	"github.com/blreynolds4/photopi-api/ingest"
+)
+
+// how deep multipart messages are searched for photos
+const maxDepth = 5
+
+// Message is a received email and the photos attached to it
+type Message struct {
+	From        string
+	To          []string
+	Subject     string
+	Attachments []Attachment
+}
+
+// Attachment is a photo from an email, attached or inline
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// ParseMessage reads an email and collects every photo in it
+func ParseMessage(r io.Reader) (Message, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return Message{}, err
+	}
+
+	decoder := new(mime.WordDecoder)
+	subject, err := decoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	message := Message{Subject: strings.TrimSpace(subject)}
+	if from, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+		message.From = from.Address
+	}
+
+	message.Attachments, err = collect(textproto.MIMEHeader(msg.Header), msg.Body, 0)
+	return message, err
+}
+
+// collect finds the photos in a part of a message
+func collect(header textproto.MIMEHeader, body io.Reader, depth int) ([]Attachment, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxDepth {
+			return nil, nil
+		}
+		attachments := []Attachment{}
+		parts := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := parts.NextPart()
+			if err == io.EOF {
+				return attachments, nil
+			}
+			if err != nil {
+				return attachments, err
+			}
+			found, err := collect(part.Header, part, depth+1)
+			attachments = append(attachments, found...)
+			if err != nil {
+				return attachments, err
+			}
+		}
+	}
+
+	filename := ""
+	if _, disposition, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		filename = disposition["filename"]
+	}
+	if filename == "" {
+		filename = params["name"]
+	}
+	filename = path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	if !isPhoto(mediaType, filename) {
+		return nil, nil
+	}
+	if filename == "" || filename == "." || filename == "/" {
+		filename = "photo" + extension(mediaType)
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return []Attachment{{Filename: filename, ContentType: mediaType, Data: data}}, nil
+}
+
+// isPhoto is true for images and for attachments named like photos that
+// were sent without a proper type
+func isPhoto(mediaType string, filename string) bool {
+	if strings.HasPrefix(mediaType, "image/") {
+		return true
+	}
+	return mediaType == "application/octet-stream" && ingest.IsPhotoName(filename)
+}
+
+func extension(mediaType string) string {
+	switch mediaType {
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/heic":
+		return ".heic"
+	}
+	return ".jpg"
+}
@@ -0,0 +1,275 @@
+package mailbox
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// most recipients accepted for one message
+const maxRecipients = 100
+
+// ErrNoPhotos is returned by a delivery when the message had no photos
+var ErrNoPhotos = errors.New("no photos were found in the message")
+
+// Options configure the mail server
+// Recipients are the addresses mail is accepted for, any when empty, and
+// Senders who may send, whole addresses or @domain, mail from anyone else
+// is refused
+// the sender is taken from the envelope, which mail clients fill in from
+// the From they show, so this keeps out strangers but not a forger
+type Options struct {
+	Addr       string
+	Domain     string
+	Recipients []string
+	Senders    []string
+	MaxBytes   int64
+	Timeout    time.Duration
+}
+
+// Server receives mail over SMTP and hands each message to the delivery
+type Server interface {
+	Addr() net.Addr
+	Stop()
+}
+
+type smtpServer struct {
+	options  Options
+	deliver  func(Message) (int, error)
+	listener net.Listener
+	sessions sync.WaitGroup
+	done     chan bool
+}
+
+// NewServer listens on options.Addr and delivers each message accepted
+// with deliver, which returns how many photos it added, an error from it is
+// sent back to the sender
+func NewServer(options Options, deliver func(Message) (int, error)) (Server, error) {
+	if len(options.Senders) == 0 {
+		return nil, fmt.Errorf("the mail server needs senders to accept mail from")
+	}
+	if options.Domain == "" {
+		options.Domain = "localhost"
+	}
+	listener, err := net.Listen("tcp", options.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := smtpServer{
+		options:  options,
+		deliver:  deliver,
+		listener: listener,
+		done:     make(chan bool),
+	}
+	go func() {
+		defer close(s.done)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				// the listener was closed by Stop
+				return
+			}
+			s.sessions.Add(1)
+			go func() {
+				defer s.sessions.Done()
+				s.serve(conn)
+			}()
+		}
+	}()
+	return &s, nil
+}
+
+func (s *smtpServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Stop refuses new connections and waits for those open to finish
+func (s *smtpServer) Stop() {
+	s.listener.Close()
+	<-s.done
+	s.sessions.Wait()
+}
+
+// session is the envelope of the message being sent
+type session struct {
+	from string
+	to   []string
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	deadline := func() {
+		if s.options.Timeout > 0 {
+			conn.SetDeadline(time.Now().Add(s.options.Timeout))
+		}
+	}
+
+	deadline()
+	text.PrintfLine("220 %s ESMTP photopi-api ready", s.options.Domain)
+	envelope := session{}
+	for {
+		deadline()
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			envelope = session{}
+			text.PrintfLine("250 %s", s.options.Domain)
+		case "EHLO":
+			envelope = session{}
+			text.PrintfLine("250-%s", s.options.Domain)
+			if s.options.MaxBytes > 0 {
+				text.PrintfLine("250-SIZE %d", s.options.MaxBytes)
+			}
+			text.PrintfLine("250 8BITMIME")
+		case "MAIL":
+			from, params, ok := address(arg, "FROM:")
+			if !ok {
+				text.PrintfLine("501 5.5.4 Syntax: MAIL FROM:<address>")
+				continue
+			}
+			if !matches(s.options.Senders, from) {
+				text.PrintfLine("550 5.7.1 %s may not send photos here", from)
+				continue
+			}
+			if size, err := strconv.ParseInt(params["SIZE"], 10, 64); err == nil && s.options.MaxBytes > 0 && size > s.options.MaxBytes {
+				text.PrintfLine("552 5.3.4 Message is too large")
+				continue
+			}
+			envelope = session{from: from}
+			text.PrintfLine("250 2.1.0 OK")
+		case "RCPT":
+			if envelope.from == "" {
+				text.PrintfLine("503 5.5.1 MAIL first")
+				continue
+			}
+			to, _, ok := address(arg, "TO:")
+			if !ok {
+				text.PrintfLine("501 5.5.4 Syntax: RCPT TO:<address>")
+				continue
+			}
+			if len(s.options.Recipients) > 0 && !matches(s.options.Recipients, to) {
+				text.PrintfLine("550 5.1.1 No such mailbox %s", to)
+				continue
+			}
+			if len(envelope.to) >= maxRecipients {
+				text.PrintfLine("452 4.5.3 Too many recipients")
+				continue
+			}
+			envelope.to = append(envelope.to, to)
+			text.PrintfLine("250 2.1.5 OK")
+		case "DATA":
+			if len(envelope.to) == 0 {
+				text.PrintfLine("503 5.5.1 RCPT first")
+				continue
+			}
+			text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			text.PrintfLine("%s", s.receive(text, envelope))
+			envelope = session{}
+		case "RSET":
+			envelope = session{}
+			text.PrintfLine("250 2.0.0 OK")
+		case "NOOP":
+			text.PrintfLine("250 2.0.0 OK")
+		case "VRFY":
+			text.PrintfLine("252 2.5.0 Cannot verify")
+		case "QUIT":
+			text.PrintfLine("221 2.0.0 Bye")
+			return
+		default:
+			text.PrintfLine("502 5.5.2 Command not recognised")
+		}
+	}
+}
+
+// receive reads and delivers a message, returning the reply for it
+func (s *smtpServer) receive(text *textproto.Conn, envelope session) string {
+	data := text.DotReader()
+	var r io.Reader = data
+	if s.options.MaxBytes > 0 {
+		r = io.LimitReader(data, s.options.MaxBytes+1)
+	}
+	raw, err := ioutil.ReadAll(r)
+	// always read to the end so the next command is in step
+	io.Copy(ioutil.Discard, data)
+	if err != nil {
+		return "451 4.3.0 Unable to read the message"
+	}
+	if s.options.MaxBytes > 0 && int64(len(raw)) > s.options.MaxBytes {
+		return "552 5.3.4 Message is too large"
+	}
+
+	message, err := ParseMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		return "554 5.6.0 Unable to read the message: " + oneLine(err.Error())
+	}
+	message.From = envelope.from
+	message.To = envelope.to
+
+	if len(message.Attachments) == 0 {
+		return "554 5.6.0 " + ErrNoPhotos.Error()
+	}
+	added, err := s.deliver(message)
+	if err != nil {
+		return "554 5.6.0 " + oneLine(err.Error())
+	}
+	return fmt.Sprintf("250 2.0.0 Added %d photos", added)
+}
+
+// address reads the address and parameters from a MAIL or RCPT argument
+func address(arg string, prefix string) (string, map[string]string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", nil, false
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", nil, false
+	}
+
+	params := make(map[string]string)
+	for _, param := range strings.Fields(arg[end+1:]) {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToUpper(kv[0])] = kv[1]
+		}
+	}
+	addr := strings.ToLower(strings.TrimSpace(arg[1:end]))
+	return addr, params, addr != "" && strings.Contains(addr, "@")
+}
+
+// matches is true when the address is in the list or its domain is there
+// as @domain
+func matches(list []string, addr string) bool {
+	domain := addr[strings.LastIndexByte(addr, '@'):]
+	for _, allowed := range list {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == addr || allowed == domain {
+			return true
+		}
+	}
+	return false
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,181 @@
+package mailbox
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// inbox collects what the server delivers
+type inbox struct {
+	lock     sync.Mutex
+	messages []Message
+}
+
+// deliver adds every attachment except those named skip.jpg
+func (i *inbox) deliver(message Message) (int, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.messages = append(i.messages, message)
+	added := 0
+	for _, attachment := range message.Attachments {
+		if attachment.Filename != "skip.jpg" {
+			added++
+		}
+	}
+	return added, nil
+}
+
+func newServer(t *testing.T) (Server, *inbox) {
+	received := &inbox{}
+	server, err := NewServer(Options{
+		Addr:       "127.0.0.1:0",
+		Recipients: []string{"frame@photopi.local"},
+		Senders:    []string{"nana@example.com", "@family.example"},
+		MaxBytes:   1024 * 1024,
+		Timeout:    10 * time.Second,
+	}, received.deliver)
+	require.NoError(t, err)
+	t.Cleanup(server.Stop)
+	return server, received
+}
+
+// photoMail is a multipart email with a photo attached
+func photoMail(from, subject string, photo []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(photo)
+	var b bytes.Buffer
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: frame@photopi.local\r\n")
+	b.WriteString("Subject: " + subject + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: multipart/mixed; boundary=\"photos\"\r\n\r\n")
+	b.WriteString("--photos\r\nContent-Type: text/plain\r\n\r\nA day at the beach\r\n")
+	b.WriteString("--photos\r\nContent-Type: image/jpeg; name=\"beach.jpg\"\r\n")
+	b.WriteString("Content-Disposition: attachment; filename=\"beach.jpg\"\r\n")
+	b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded + "\r\n--photos--\r\n")
+	return b.Bytes()
+}
+
+func TestEmailedPhotosAreDelivered(t *testing.T) {
+	server, received := newServer(t)
+	photo := bytes.Repeat([]byte{0xff, 0xd8, 0x01}, 500)
+
+	err := smtp.SendMail(server.Addr().String(), nil, "nana@example.com", []string{"frame@photopi.local"},
+		photoMail("Nana <nana@example.com>", "=?utf-8?q?Beach_=E2=98=80?=", photo))
+	require.NoError(t, err)
+
+	require.Len(t, received.messages, 1)
+	message := received.messages[0]
+	assert.Equal(t, "nana@example.com", message.From)
+	assert.Equal(t, []string{"frame@photopi.local"}, message.To)
+	assert.Equal(t, "Beach ☀", message.Subject)
+	require.Len(t, message.Attachments, 1)
+	assert.Equal(t, "beach.jpg", message.Attachments[0].Filename)
+	assert.Equal(t, photo, message.Attachments[0].Data)
+}
+
+func TestSendersFromAnAllowedDomainAreAccepted(t *testing.T) {
+	server, received := newServer(t)
+
+	err := smtp.SendMail(server.Addr().String(), nil, "Cousin@Family.example", []string{"frame@photopi.local"},
+		photoMail("cousin@family.example", "Party", []byte("photo")))
+	require.NoError(t, err)
+	assert.Len(t, received.messages, 1)
+}
+
+func TestUnknownSendersAreRefused(t *testing.T) {
+	server, received := newServer(t)
+
+	err := smtp.SendMail(server.Addr().String(), nil, "stranger@example.com", []string{"frame@photopi.local"},
+		photoMail("stranger@example.com", "Hi", []byte("photo")))
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "550"), err.Error())
+	assert.Empty(t, received.messages)
+}
+
+func TestOnlyConfiguredRecipientsAreAccepted(t *testing.T) {
+	server, received := newServer(t)
+
+	err := smtp.SendMail(server.Addr().String(), nil, "nana@example.com", []string{"someone@photopi.local"},
+		photoMail("nana@example.com", "Hi", []byte("photo")))
+	require.Error(t, err)
+	assert.Empty(t, received.messages)
+}
+
+func TestMessagesWithoutPhotosAreRefused(t *testing.T) {
+	server, received := newServer(t)
+
+	body := "From: nana@example.com\r\nSubject: Hello\r\n\r\nNo photos today\r\n"
+	err := smtp.SendMail(server.Addr().String(), nil, "nana@example.com", []string{"frame@photopi.local"}, []byte(body))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), ErrNoPhotos.Error())
+	assert.Empty(t, received.messages)
+}
+
+func TestLargeMessagesAreRefused(t *testing.T) {
+	server, received := newServer(t)
+
+	err := smtp.SendMail(server.Addr().String(), nil, "nana@example.com", []string{"frame@photopi.local"},
+		photoMail("nana@example.com", "Big", bytes.Repeat([]byte("x"), 2*1024*1024)))
+	require.Error(t, err)
+	assert.Empty(t, received.messages)
+}
+
+func TestSendersAreRequired(t *testing.T) {
+	_, err := NewServer(Options{Addr: "127.0.0.1:0"}, func(Message) (int, error) { return 0, nil })
+	assert.Error(t, err)
+}
+
+func TestReplySaysHowManyPhotosWereAdded(t *testing.T) {
+	server, _ := newServer(t)
+
+	var b bytes.Buffer
+	b.WriteString("From: nana@example.com\r\nSubject: Beach\r\nMIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: multipart/mixed; boundary=\"photos\"\r\n\r\n")
+	for _, name := range []string{"beach.jpg", "skip.jpg"} {
+		b.WriteString("--photos\r\nContent-Type: image/jpeg\r\n")
+		b.WriteString("Content-Disposition: attachment; filename=\"" + name + "\"\r\n")
+		b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+		b.WriteString(base64.StdEncoding.EncodeToString([]byte("photo")) + "\r\n")
+	}
+	b.WriteString("--photos--\r\n")
+
+	conn, err := textproto.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	command := func(code int, format string, args ...interface{}) string {
+		id, err := conn.Cmd(format, args...)
+		require.NoError(t, err)
+		conn.StartResponse(id)
+		defer conn.EndResponse(id)
+		_, message, err := conn.ReadResponse(code)
+		require.NoError(t, err)
+		return message
+	}
+	_, _, err = conn.ReadResponse(220)
+	require.NoError(t, err)
+	command(250, "HELO test")
+	command(250, "MAIL FROM:<nana@example.com>")
+	command(250, "RCPT TO:<frame@photopi.local>")
+	command(354, "DATA")
+
+	w := conn.DotWriter()
+	w.Write(b.Bytes())
+	require.NoError(t, w.Close())
+	_, message, err := conn.ReadResponse(250)
+	require.NoError(t, err)
+	assert.Equal(t, "2.0.0 Added 1 photos", message)
+}
@@ -5,83 +5,75 @@ import (
 	"log"
 	"os"
 
-	"github.com/blreynolds4/photopi-api/backup"
-	"github.com/blreynolds4/photopi-api/stager"
-	"github.com/unrolled/render"
+	"github.com/blreynolds4/photopi-api/ingest"
+	"github.com/blreynolds4/photopi-api/mailbox"
 )
 
 const local string = "LOCAL"
 
 func main() {
-	var (
-		// environment variables
-		env        = os.Getenv("ENV")         // LOCAL, DEV, STG, PRD
-		port       = os.Getenv("PORT")        // server traffic on this port
-		version    = os.Getenv("VERSION")     // path to VERSION file
-		tagName    = os.Getenv("UPLOAD_TAG")  // tag files are uploaded in
-		photosPath = os.Getenv("PHOTOS_PATH") // get the location to save files
-		uiPath     = os.Getenv("UI_PATH")     // get the location of the ui app
-		showPath   = os.Getenv("SHOW_PATH")
-	)
-
-	if env == "" || env == local {
-		// running from localhost, so set some default values
-		env = local
-		port = "8080"
-		version = "VERSION"
-		tagName = DEFAULT_UPLOAD_TAG_NAME
-		photosPath = DEFAULT_PHOTO_PATH
-		uiPath = DEFAULT_UI_PATH
-		showPath = DEFAULT_SLIDESHOW_DIR
-	}
-
-	// create the photo path if needed
-	if _, err := os.Stat(photosPath); os.IsNotExist(err) {
-		err := os.Mkdir(photosPath, 0744)
-		if err != nil {
-			fmt.Println("Unable to create phtoto path ", photosPath)
-			os.Exit(1)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "frame-client":
+			// a frame on another network syncs its slideshow from a hub instead
+			runFrameClient()
+			return
+		case "import":
+			// load an existing photo library
+			runImport(os.Args[2:])
+			return
+		case "user":
+			// manage who can sign in
+			runUser(os.Args[2:])
+			return
+		case "config":
+			// check a config file before starting with it
+			runConfig(os.Args[2:])
+			return
 		}
 	}
 
-	// create the slideshow path if needed
-	if _, err := os.Stat(showPath); os.IsNotExist(err) {
-		err := os.Mkdir(showPath, 0744)
-		if err != nil {
-			fmt.Println("Unable to create slideshow path ", showPath)
-			os.Exit(1)
-		}
-	}
+	s := loadSettings()
 
 	// reading version from file
-	version, err := ParseVersionFile(version)
+	version, err := ParseVersionFile(s.version)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// create staging and backup
-	stage := stager.NewDirectoryStager(showPath, 25)
-	saver := backup.NewAWSBackup(stage, 25)
+	ctx, stop := startApp(s)
+	ctx.Version = version
 
-	// initialse application context
-	ctx := AppContext{
-		Render:    render.New(),
-		Version:   version,
-		Env:       env,
-		Port:      port,
-		TagName:   tagName,
-		PhotoPath: photosPath,
-		UIPath:    uiPath,
-		PhotoSave: saver,
+	var inbox ingest.Inbox
+	if s.inbox.Dir != "" {
+		inbox, err = ingest.NewInbox(s.inbox, ctx.Ingest)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Watching", s.inbox.Dir, "for photos")
+	}
+
+	var mailServer mailbox.Server
+	if s.mail.Addr != "" {
+		mailServer, err = mailbox.NewServer(s.mail, deliverMail(ctx))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Receiving emailed photos on", mailServer.Addr())
 	}
 
 	defer func() {
-		stage.Stop()
-		fmt.Println("Staged stopped")
-		saver.Stop()
-		fmt.Println("Saver stopped")
+		if mailServer != nil {
+			mailServer.Stop()
+			fmt.Println("Mail server stopped")
+		}
+		if inbox != nil {
+			inbox.Stop()
+			fmt.Println("Inbox stopped")
+		}
+		stop()
 	}()
 
 	// start application
-	StartServer(ctx)
+	StartServer(ctx, s)
 }
@@ -0,0 +1,108 @@
+package naming
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/dsoprea/go-exif"
+	log "github.com/dsoprea/go-logging"
+)
+
+const DESCRIPTION_TAG = "ImageDescription"
+
+// descriptions cameras fill in on their own, they say nothing about the photo
+var cameraDescriptions = map[string]bool{
+	"":                       true,
+	"olympus digital camera": true,
+	"sony dsc":               true,
+	"default":                true,
+	"image":                  true,
+}
+
+var xmpDescription = regexp.MustCompile(`(?s)<dc:description[^>]*>.*?<rdf:li[^>]*>(.*?)</rdf:li>`)
+var xmpDescriptionAttr = regexp.MustCompile(`dc:description="([^"]*)"`)
+
+// Description returns the caption written into a photo, the XMP
+// dc:description editors set is preferred to the EXIF ImageDescription,
+// empty when it has neither
+func Description(data []byte) string {
+	if d := xmpText(data); d != "" {
+		return d
+	}
+	d, err := exifText(data, DESCRIPTION_TAG)
+	if err != nil {
+		return ""
+	}
+	return d
+}
+
+// xmpText finds the description in the photo's XMP packet
+func xmpText(data []byte) string {
+	start := bytes.Index(data, []byte("<x:xmpmeta"))
+	if start < 0 {
+		return ""
+	}
+	end := bytes.Index(data[start:], []byte("</x:xmpmeta>"))
+	if end < 0 {
+		return ""
+	}
+	packet := data[start : start+end]
+
+	for _, re := range []*regexp.Regexp{xmpDescription, xmpDescriptionAttr} {
+		if m := re.FindSubmatch(packet); m != nil {
+			if d := clean(html.UnescapeString(string(m[1]))); d != "" {
+				return d
+			}
+		}
+	}
+	return ""
+}
+
+// exifText returns the value of the first EXIF tag with the name
+func exifText(data []byte, name string) (text string, err error) {
+	rawExif, err := exif.SearchAndExtractExif(data)
+	if err != nil {
+		return "", err
+	}
+
+	im := exif.NewIfdMappingWithStandard()
+	ti := exif.NewTagIndex()
+	visitor := func(fqIfdPath string, ifdIndex int, tagId uint16, tagType exif.TagType, valueContext exif.ValueContext) (err error) {
+		defer func() {
+			if state := recover(); state != nil {
+				err = log.Wrap(state.(error))
+			}
+		}()
+		if text != "" {
+			return nil
+		}
+
+		ifdPath, err := im.StripPathPhraseIndices(fqIfdPath)
+		log.PanicIf(err)
+
+		it, err := ti.Get(ifdPath, tagId)
+		if err != nil || it.Name != name {
+			// unknown tags are skipped quietly here, naming warns about them
+			return nil
+		}
+
+		value, err := valueContext.Format()
+		log.PanicIf(err)
+		text = clean(value)
+		return nil
+	}
+
+	_, err = exif.Visit(exif.IfdStandard, im, ti, rawExif, visitor)
+	return text, err
+}
+
+// clean trims padding and drops the descriptions cameras write themselves
+func clean(d string) string {
+	d = strings.TrimSpace(strings.Trim(d, "\x00"))
+	if cameraDescriptions[strings.ToLower(d)] {
+		return ""
+	}
+	return d
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/dsoprea/go-exif"
 	log "github.com/dsoprea/go-logging"
@@ -12,21 +13,67 @@ import (
 
 const DATE_TIME_TAG = "DateTime"
 
+// DefaultFormat names photos like 2005-12-31-09-08-07
+const DefaultFormat = "2006-01-02-15-04-05"
+
+// how EXIF writes DateTime
+const exifDateTime = "2006:01:02 15:04:05"
+
 // ImageNamer generates an image filename based on
-// metadata in the image
+// metadata in the image, NameTime names one without by when it arrived and
+// TimeOf reads the time back from the start of a name it made, as far as
+// the format records it
 type ImageNamer interface {
 	NameImage(image []byte) (string, error)
+	NameTime(t time.Time) string
+	TimeOf(name string) (time.Time, bool)
 }
 
 type exifDataNamer struct {
+	format string
 }
 
 func NewExifImageNamer() ImageNamer {
-	result := exifDataNamer{}
+	return NewImageNamer(DefaultFormat)
+}
+
+// NewImageNamer names photos by their EXIF date written in format, a Go
+// time layout
+func NewImageNamer(format string) ImageNamer {
+	result := exifDataNamer{format: format}
 
 	return &result
 }
 
+// ValidFormat checks a name format writes a date and stays in one directory
+func ValidFormat(format string) error {
+	name := time.Date(2005, 12, 31, 9, 8, 7, 0, time.UTC).Format(format)
+	if !strings.Contains(name, "2005") && !strings.Contains(name, "05") {
+		return fmt.Errorf("name format %q must include the year, 2006 or 06", format)
+	}
+	if strings.ContainsAny(name, `/\:`) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("name format %q can't make names with / \\ : or a leading dot", format)
+	}
+	return nil
+}
+
+func (edn *exifDataNamer) NameTime(t time.Time) string {
+	return t.Format(edn.format)
+}
+
+// TimeOf parses the name's start in the format, names it didn't make are
+// not ok, fields the format leaves out come back zero so a format without
+// the time of day gives midnight
+func (edn *exifDataNamer) TimeOf(name string) (time.Time, bool) {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	size := len(edn.NameTime(time.Date(2005, 12, 31, 9, 8, 7, 0, time.Local)))
+	if len(base) < size {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(edn.format, base[:size], time.Local)
+	return t, err == nil
+}
+
 func (edn *exifDataNamer) NameImage(data []byte) (string, error) {
 	rawExif, err := exif.SearchAndExtractExif(data)
 	if err != nil {
@@ -84,7 +131,12 @@ func (edn *exifDataNamer) NameImage(data []byte) (string, error) {
 				photoTimeStamp = valueString
 			}
 
-			// found datatime stamp remove :'s and spaces for filename
+			// found datatime stamp, write it in the format or failing that
+			// remove :'s and spaces for filename
+			if taken, err := time.Parse(exifDateTime, strings.TrimSpace(photoTimeStamp)); err == nil {
+				photoTimeStamp = edn.NameTime(taken)
+				return nil
+			}
 			photoTimeStamp = strings.ReplaceAll(photoTimeStamp, ":", "-")
 			photoTimeStamp = strings.ReplaceAll(photoTimeStamp, " ", "-")
 			return nil
@@ -117,3 +169,29 @@ func UniqueFileName(root, filename, extension string) string {
 
 	return fqFilename
 }
+
+// UniqueFileNameIn works like UniqueFileName but the name it picks in root
+// is also unused in each of the other directories, so the file keeps its
+// name as it moves between them
+func UniqueFileNameIn(root string, others []string, filename, extension string) string {
+	dirs := append([]string{root}, others...)
+
+	name := filename + extension
+	uniqExt := 1
+	for {
+		used := false
+		for _, dir := range dirs {
+			if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+				used = true
+				break
+			}
+		}
+		if !used {
+			return filepath.Join(root, name)
+		}
+
+		// add an extension to the name and keep trying
+		name = fmt.Sprintf("%s_%d", filename, uniqExt) + extension
+		uniqExt = uniqExt + 1
+	}
+}
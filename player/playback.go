@@ -0,0 +1,372 @@
+package player
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/events"
+)
+
+// how many times a favourite is dealt into a shuffled deck
+const favouriteCopies = 2
+
+// how many shown photos previous can go back through
+const maxHistory = 100
+
+// PhotoURL is where the slideshow's photos are served from
+const PhotoURL = "/slideshow/photos/"
+
+// SlideInfo is a photo in the slideshow as a player sees it
+type SlideInfo struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	Taken     time.Time `json:"taken"`
+	Favourite bool      `json:"favourite"`
+	Tags      []string  `json:"tags,omitempty"`
+	Caption   string    `json:"caption,omitempty"`
+	Uploader  string    `json:"uploader,omitempty"`
+}
+
+// NowPlaying is the photo on screen, an empty name means the slideshow
+// has nothing to show, Until is when playback moves on unless paused
+type NowPlaying struct {
+	SlideInfo
+	Paused bool       `json:"paused"`
+	Reason string     `json:"reason"`
+	Since  time.Time  `json:"since"`
+	Until  *time.Time `json:"until,omitempty"`
+	Count  int        `json:"count"`
+}
+
+// refresh reads the slideshow directory and moves on when the photo on
+// screen has gone or there was nothing to show
+func (p *slideshowPlayer) refresh() {
+	present, ok := p.load()
+	if !ok {
+		return
+	}
+
+	current := p.Now().Name
+	switch {
+	case len(present) == 0 && current != "":
+		p.clear()
+	case current != "" && !present[current]:
+		// the photo on screen was taken out of the slideshow
+		p.position = len(p.history) - 1
+		p.advance("removed")
+	case current == "" && len(present) > 0:
+		p.advance("added")
+	}
+}
+
+// load reads the slideshow directory and drops photos that have left it
+// from what is queued and remembered, it returns the photos present
+func (p *slideshowPlayer) load() (map[string]bool, bool) {
+	infos, err := ioutil.ReadDir(p.showDir)
+	if err != nil {
+		fmt.Println("Unable to list slideshow", p.showDir, "because", err.Error())
+		return nil, false
+	}
+
+	slides := []SlideInfo{}
+	present := make(map[string]bool)
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		s := SlideInfo{
+			Name:  info.Name(),
+			URL:   PhotoURL + url.PathEscape(info.Name()),
+			Taken: info.ModTime(),
+		}
+		if p.catalog != nil {
+			if photo, err := p.catalog.Get(info.Name()); err == nil {
+				s.Taken = photo.Taken
+				s.Favourite = photo.Favourite
+				s.Tags = photo.Tags
+				s.Caption = photo.Caption
+				s.Uploader = photo.Uploader
+			}
+		}
+		present[s.Name] = true
+		slides = append(slides, s)
+	}
+	sort.Slice(slides, func(i, j int) bool {
+		return slides[i].Name < slides[j].Name
+	})
+
+	p.lock.Lock()
+	p.slides = slides
+	p.now.Count = len(slides)
+	// only remember when photos still in the library were shown
+	for name := range p.shown {
+		if present[name] {
+			continue
+		}
+		if p.catalog != nil {
+			if _, err := p.catalog.Get(name); err == nil {
+				continue
+			}
+		}
+		delete(p.shown, name)
+		p.dirty = true
+	}
+	p.lock.Unlock()
+
+	p.deck = keep(p.deck, present)
+	history := []string{}
+	position := 0
+	for i, name := range p.history {
+		if !present[name] {
+			continue
+		}
+		if i < p.position {
+			position = position + 1
+		}
+		history = append(history, name)
+	}
+	p.history = history
+	p.position = position
+	return present, true
+}
+
+func keep(names []string, present map[string]bool) []string {
+	result := []string{}
+	for _, name := range names {
+		if present[name] {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+func (p *slideshowPlayer) has(name string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, s := range p.slides {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// start picks up where playback was before a restart when it can
+func (p *slideshowPlayer) start(previous NowPlaying) {
+	p.lock.Lock()
+	p.now.Paused = previous.Paused
+	p.lock.Unlock()
+
+	if previous.Name != "" && p.has(previous.Name) {
+		p.jump(previous.Name, "start")
+		return
+	}
+	if len(p.Slides()) == 0 {
+		p.clear()
+		return
+	}
+	p.advance("start")
+}
+
+// advance moves forward through photos gone back over with previous, then
+// on to the next one dealt
+func (p *slideshowPlayer) advance(reason string) {
+	if len(p.Slides()) == 0 {
+		p.clear()
+		return
+	}
+	if p.position < len(p.history)-1 {
+		p.position = p.position + 1
+		p.current(reason)
+		return
+	}
+	p.remember(p.nextFromDeck())
+	p.current(reason)
+}
+
+// jump shows name next, whatever was gone back over is forgotten
+func (p *slideshowPlayer) jump(name, reason string) {
+	if len(p.history) > 0 {
+		p.history = p.history[:p.position+1]
+	}
+	p.remember(name)
+	p.current(reason)
+}
+
+func (p *slideshowPlayer) remember(name string) {
+	p.history = append(p.history, name)
+	if len(p.history) > maxHistory {
+		p.history = p.history[len(p.history)-maxHistory:]
+	}
+	p.position = len(p.history) - 1
+}
+
+func (p *slideshowPlayer) nextFromDeck() string {
+	current := p.Now().Name
+	if len(p.deck) == 0 {
+		p.deck = p.deal(current)
+	}
+	// don't show the same photo twice in a row
+	if len(p.deck) > 1 && p.deck[0] == current {
+		p.deck = append(p.deck[1:], p.deck[0])
+	}
+	name := p.deck[0]
+	p.deck = p.deck[1:]
+	return name
+}
+
+// deal orders the next pass through the slideshow, shuffled with favourites
+// dealt more than once or in name order carrying on after current
+func (p *slideshowPlayer) deal(current string) []string {
+	slides := p.Slides()
+
+	if !p.Settings().Shuffle {
+		names := []string{}
+		start := 0
+		for i, s := range slides {
+			names = append(names, s.Name)
+			if s.Name == current {
+				start = i + 1
+			}
+		}
+		return append(names[start:], names[:start]...)
+	}
+
+	cards := []string{}
+	for _, s := range slides {
+		copies := 1
+		if s.Favourite {
+			copies = favouriteCopies
+		}
+		for i := 0; i < copies; i++ {
+			cards = append(cards, s.Name)
+		}
+	}
+	p.rng.Shuffle(len(cards), func(i, j int) {
+		cards[i], cards[j] = cards[j], cards[i]
+	})
+	// move copies that landed together apart
+	for i := 1; i < len(cards)-1; i++ {
+		if cards[i] == cards[i-1] {
+			cards = append(append(cards[:i:i], cards[i+1:]...), cards[i])
+		}
+	}
+	return cards
+}
+
+// current puts the photo at the history position on screen
+func (p *slideshowPlayer) current(reason string) {
+	name := p.history[p.position]
+	info := SlideInfo{Name: name, URL: PhotoURL + url.PathEscape(name)}
+	for _, s := range p.Slides() {
+		if s.Name == name {
+			info = s
+		}
+	}
+
+	now := time.Now()
+	p.lock.Lock()
+	p.now = NowPlaying{
+		SlideInfo: info,
+		Paused:    p.now.Paused,
+		Reason:    reason,
+		Since:     now,
+		Count:     len(p.slides),
+	}
+	p.shown[name] = now
+	p.lock.Unlock()
+	p.dirty = true
+
+	p.restartTimer()
+	p.announce()
+}
+
+// clear shows nothing, the slideshow is empty
+func (p *slideshowPlayer) clear() {
+	p.history = nil
+	p.position = 0
+	p.deck = nil
+
+	p.lock.Lock()
+	p.now = NowPlaying{
+		Paused: p.now.Paused,
+		Reason: "empty",
+		Since:  time.Now(),
+	}
+	p.lock.Unlock()
+
+	p.restartTimer()
+	p.announce()
+}
+
+func (p *slideshowPlayer) setPaused(paused bool) {
+	p.lock.Lock()
+	if p.now.Paused == paused {
+		p.lock.Unlock()
+		return
+	}
+	p.now.Paused = paused
+	p.now.Reason = "resume"
+	if paused {
+		p.now.Reason = "pause"
+	}
+	p.lock.Unlock()
+
+	p.restartTimer()
+	p.announce()
+}
+
+// restartTimer gives the photo on screen a full interval unless paused
+func (p *slideshowPlayer) restartTimer() {
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+
+	now := p.Now()
+	var until *time.Time
+	if !now.Paused && now.Name != "" {
+		interval, _ := p.Settings().interval()
+		p.timer = time.NewTimer(interval)
+		t := time.Now().Add(interval)
+		until = &t
+	}
+
+	p.lock.Lock()
+	p.now.Until = until
+	p.lock.Unlock()
+}
+
+// announce writes the state file and tells the frames what is on screen
+func (p *slideshowPlayer) announce() {
+	now := p.Now()
+	if p.stateFile != "" {
+		if err := writeJSON(p.stateFile, now); err != nil {
+			fmt.Println("Unable to write playback state", p.stateFile, "because", err.Error())
+		}
+	}
+	p.events.Publish(events.PlaybackChanged, now.Name, now)
+}
+
+func (p *slideshowPlayer) saveHistory() {
+	if !p.dirty || p.historyFile == "" {
+		return
+	}
+
+	p.lock.Lock()
+	shown := make(map[string]time.Time, len(p.shown))
+	for name, t := range p.shown {
+		shown[name] = t
+	}
+	p.lock.Unlock()
+
+	if err := writeJSON(p.historyFile, shown); err != nil {
+		fmt.Println("Unable to save show history", p.historyFile, "because", err.Error())
+		return
+	}
+	p.dirty = false
+}
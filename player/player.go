@@ -0,0 +1,393 @@
+package player
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/catalog"
+	"github.com/blreynolds4/photopi-api/events"
+)
+
+// transitions between photos
+const (
+	Fade  = "fade"
+	Slide = "slide"
+	Cut   = "none"
+)
+
+// how photos fill the screen
+const (
+	Contain = "contain"
+	Cover   = "cover"
+)
+
+// how often the last shown times are saved when they have changed
+const historyFlush = time.Minute
+
+// ErrNotInSlideshow is returned when asked to show a photo the slideshow doesn't have
+var ErrNotInSlideshow = errors.New("photo is not in the slideshow")
+
+// ErrStopped is returned for requests made after the player stopped
+var ErrStopped = errors.New("player is stopped")
+
+// Settings control how the slideshow is played
+// Interval is how long each photo is on screen and ShowNew jumps to
+// photos as soon as they are uploaded
+type Settings struct {
+	Interval   string `json:"interval"`
+	Transition string `json:"transition"`
+	Fit        string `json:"fit"`
+	Shuffle    bool   `json:"shuffle"`
+	ShowNew    bool   `json:"showNew"`
+	Clock      bool   `json:"clock"`
+	Captions   bool   `json:"captions"`
+}
+
+// DefaultSettings are used until settings are saved
+var DefaultSettings = Settings{
+	Interval:   "10s",
+	Transition: Fade,
+	Fit:        Contain,
+	Shuffle:    true,
+	ShowNew:    true,
+	Clock:      false,
+	Captions:   true,
+}
+
+// Validate checks the settings can be played
+func (s Settings) Validate() error {
+	if _, err := s.interval(); err != nil {
+		return err
+	}
+
+	switch s.Transition {
+	case Fade, Slide, Cut:
+	default:
+		return fmt.Errorf("unknown transition %q", s.Transition)
+	}
+
+	switch s.Fit {
+	case Contain, Cover:
+	default:
+		return fmt.Errorf("unknown fit %q", s.Fit)
+	}
+	return nil
+}
+
+func (s Settings) interval() (time.Duration, error) {
+	d, err := time.ParseDuration(s.Interval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid interval %q: %s", s.Interval, err.Error())
+	}
+	if d < time.Second {
+		return 0, fmt.Errorf("interval %s is shorter than a second", s.Interval)
+	}
+	return d, nil
+}
+
+// Player decides which slideshow photo is on screen, frames follow it
+// through the event bus and viewers without one can read the state file
+type Player interface {
+	Settings() Settings
+	SetSettings(settings Settings) error
+	Slides() []SlideInfo
+
+	Now() NowPlaying
+	Next() (NowPlaying, error)
+	Previous() (NowPlaying, error)
+	Pause() (NowPlaying, error)
+	Resume() (NowPlaying, error)
+	Show(name string) (NowPlaying, error)
+
+	LastShown(name string) time.Time
+	Stop()
+}
+
+// request is work done on the playback goroutine
+type request struct {
+	run  func() error
+	done chan error
+}
+
+type slideshowPlayer struct {
+	// lock guards what is read from outside the playback goroutine
+	lock     sync.Mutex
+	settings Settings
+	slides   []SlideInfo
+	now      NowPlaying
+	shown    map[string]time.Time
+
+	file        string
+	stateFile   string
+	historyFile string
+	showDir     string
+	catalog     catalog.Catalog
+	events      events.Publisher
+
+	// owned by the playback goroutine
+	deck     []string
+	history  []string
+	position int
+	timer    *time.Timer
+	dirty    bool
+	rng      *rand.Rand
+
+	requests chan request
+	done     chan bool
+	stopped  chan bool
+}
+
+// NewPlayer loads the player settings kept in file and starts playing the
+// photos in showDir, the photo on screen is written to stateFile and when
+// each photo was last shown to historyFile, cat may be nil
+func NewPlayer(file, stateFile, historyFile, showDir string, cat catalog.Catalog, bus events.EventBus) (Player, error) {
+	p := slideshowPlayer{
+		settings:    DefaultSettings,
+		shown:       make(map[string]time.Time),
+		file:        file,
+		stateFile:   stateFile,
+		historyFile: historyFile,
+		showDir:     showDir,
+		catalog:     cat,
+		events:      bus,
+		rng:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		requests:    make(chan request),
+		done:        make(chan bool),
+		stopped:     make(chan bool),
+	}
+
+	if err := readJSON(file, &p.settings); err != nil {
+		return nil, fmt.Errorf("reading player settings %s: %s", file, err.Error())
+	}
+	if err := p.settings.Validate(); err != nil {
+		return nil, fmt.Errorf("player settings %s: %s", file, err.Error())
+	}
+	if err := readJSON(historyFile, &p.shown); err != nil {
+		return nil, fmt.Errorf("reading show history %s: %s", historyFile, err.Error())
+	}
+	previous := NowPlaying{}
+	if err := readJSON(stateFile, &previous); err != nil {
+		fmt.Println("Ignoring playback state", stateFile, "because", err.Error())
+	}
+
+	// subscribe before listing so nothing staged meanwhile is missed
+	sub := bus.Subscribe(0)
+	p.load()
+	p.start(previous)
+
+	go p.run(bus, sub)
+
+	return &p, nil
+}
+
+func (p *slideshowPlayer) run(bus events.EventBus, sub events.Subscription) {
+	defer close(p.stopped)
+	defer func() {
+		sub.Close()
+	}()
+
+	flush := time.NewTicker(historyFlush)
+	defer flush.Stop()
+
+	for {
+		var timeout <-chan time.Time
+		if p.timer != nil {
+			timeout = p.timer.C
+		}
+
+		select {
+		case <-p.done:
+			p.saveHistory()
+			return
+		case <-timeout:
+			p.timer = nil
+			p.advance("timer")
+		case e, more := <-sub.Events():
+			if !more {
+				// fell behind, catch up from the directory instead
+				sub = bus.Subscribe(0)
+				p.refresh()
+				continue
+			}
+			p.handle(e)
+		case req := <-p.requests:
+			req.done <- req.run()
+		case <-flush.C:
+			p.saveHistory()
+		}
+	}
+}
+
+func (p *slideshowPlayer) handle(e events.Event) {
+	switch e.Type {
+	case events.SlideshowChanged:
+		p.refresh()
+	case events.PhotoStaged:
+		// a new upload, show it now if it made it into the slideshow
+		p.refresh()
+		if p.Settings().ShowNew && p.has(e.Photo) {
+			p.jump(e.Photo, "new")
+		}
+	}
+}
+
+// do runs the request on the playback goroutine and waits for it
+func (p *slideshowPlayer) do(run func() error) (NowPlaying, error) {
+	req := request{
+		run:  run,
+		done: make(chan error, 1),
+	}
+
+	select {
+	case p.requests <- req:
+		if err := <-req.done; err != nil {
+			return p.Now(), err
+		}
+		return p.Now(), nil
+	case <-p.stopped:
+		return p.Now(), ErrStopped
+	}
+}
+
+func (p *slideshowPlayer) Settings() Settings {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.settings
+}
+
+// SetSettings validates and saves the settings, playback picks them up
+// straight away and frames are told about them
+func (p *slideshowPlayer) SetSettings(settings Settings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	if err := writeJSON(p.file, settings); err != nil {
+		return err
+	}
+
+	_, err := p.do(func() error {
+		p.lock.Lock()
+		shuffled := p.settings.Shuffle != settings.Shuffle
+		p.settings = settings
+		p.lock.Unlock()
+
+		if shuffled {
+			p.deck = nil
+		}
+		p.restartTimer()
+		p.announce()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	p.events.Publish(events.PlayerChanged, "", settings)
+	return nil
+}
+
+// Slides lists the photos in the slideshow
+func (p *slideshowPlayer) Slides() []SlideInfo {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]SlideInfo{}, p.slides...)
+}
+
+// Now is the photo on screen
+func (p *slideshowPlayer) Now() NowPlaying {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.now
+}
+
+func (p *slideshowPlayer) Next() (NowPlaying, error) {
+	return p.do(func() error {
+		p.advance("next")
+		return nil
+	})
+}
+
+// Previous goes back through the photos already shown, it stays on the
+// first one it remembers
+func (p *slideshowPlayer) Previous() (NowPlaying, error) {
+	return p.do(func() error {
+		if p.position > 0 {
+			p.position = p.position - 1
+			p.current("previous")
+		}
+		return nil
+	})
+}
+
+// Pause keeps the photo on screen until playback is resumed or moved on
+func (p *slideshowPlayer) Pause() (NowPlaying, error) {
+	return p.do(func() error {
+		p.setPaused(true)
+		return nil
+	})
+}
+
+func (p *slideshowPlayer) Resume() (NowPlaying, error) {
+	return p.do(func() error {
+		p.setPaused(false)
+		return nil
+	})
+}
+
+// Show puts the named photo on screen now
+func (p *slideshowPlayer) Show(name string) (NowPlaying, error) {
+	return p.do(func() error {
+		if !p.has(name) {
+			return ErrNotInSlideshow
+		}
+		p.jump(name, "show")
+		return nil
+	})
+}
+
+// LastShown is when the photo was last on screen, zero if it never was
+func (p *slideshowPlayer) LastShown(name string) time.Time {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.shown[name]
+}
+
+func (p *slideshowPlayer) Stop() {
+	close(p.done)
+	<-p.stopped
+}
+
+// readJSON loads file into value, a missing file leaves value alone
+func readJSON(file string, value interface{}) error {
+	if file == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// writeJSON saves value to file, writing then renaming so readers never
+// see half of it
+func writeJSON(file string, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,185 @@
+package player
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fixture struct {
+	dir  string
+	show string
+	bus  events.EventBus
+}
+
+func newFixture(t *testing.T, photos ...string) fixture {
+	f := fixture{
+		dir:  t.TempDir(),
+		show: t.TempDir(),
+		bus:  events.NewEventBus(100),
+	}
+	for _, name := range photos {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(f.show, name), []byte("photo"), 0644))
+	}
+	return f
+}
+
+func (f fixture) player(t *testing.T) Player {
+	p, err := NewPlayer(filepath.Join(f.dir, "player.json"), filepath.Join(f.dir, "now.json"),
+		filepath.Join(f.dir, "shown.json"), f.show, nil, f.bus)
+	require.Nil(t, err)
+	return p
+}
+
+func (f fixture) ordered(t *testing.T, p Player) {
+	settings := DefaultSettings
+	settings.Shuffle = false
+	require.Nil(t, p.SetSettings(settings))
+}
+
+func TestSettingsArePersistedAndAnnounced(t *testing.T) {
+	f := newFixture(t)
+	sub := f.bus.Subscribe(0)
+	defer sub.Close()
+
+	p := f.player(t)
+	assert.Equal(t, DefaultSettings, p.Settings())
+
+	settings := DefaultSettings
+	settings.Interval = "30s"
+	settings.Transition = Slide
+	settings.Clock = true
+	require.Nil(t, p.SetSettings(settings))
+	p.Stop()
+
+	types := []string{}
+	for len(sub.Events()) > 0 {
+		types = append(types, (<-sub.Events()).Type)
+	}
+	assert.Contains(t, types, events.PlayerChanged)
+
+	reloaded := f.player(t)
+	defer reloaded.Stop()
+	assert.Equal(t, settings, reloaded.Settings())
+}
+
+func TestSettingsValidate(t *testing.T) {
+	assert.Nil(t, DefaultSettings.Validate())
+
+	for _, change := range []func(*Settings){
+		func(s *Settings) { s.Interval = "soon" },
+		func(s *Settings) { s.Interval = "500ms" },
+		func(s *Settings) { s.Transition = "wipe" },
+		func(s *Settings) { s.Fit = "stretch" },
+	} {
+		s := DefaultSettings
+		change(&s)
+		assert.NotNil(t, s.Validate(), "%+v", s)
+	}
+}
+
+func TestNextPreviousAndShow(t *testing.T) {
+	f := newFixture(t, "a.jpg", "b.jpg", "c.jpg")
+	p := f.player(t)
+	defer p.Stop()
+	f.ordered(t, p)
+
+	first := p.Now().Name
+	require.NotEmpty(t, first)
+	assert.Equal(t, 3, p.Now().Count)
+
+	second, err := p.Next()
+	require.Nil(t, err)
+	third, err := p.Next()
+	require.Nil(t, err)
+	assert.NotEqual(t, second.Name, third.Name)
+
+	back, err := p.Previous()
+	require.Nil(t, err)
+	assert.Equal(t, second.Name, back.Name)
+	forward, err := p.Next()
+	require.Nil(t, err)
+	assert.Equal(t, third.Name, forward.Name, "next retraces what previous went back over")
+
+	shown, err := p.Show("a.jpg")
+	require.Nil(t, err)
+	assert.Equal(t, "a.jpg", shown.Name)
+	assert.Equal(t, "show", shown.Reason)
+	assert.Equal(t, PhotoURL+"a.jpg", shown.URL)
+	assert.False(t, p.LastShown("a.jpg").IsZero())
+
+	_, err = p.Show("missing.jpg")
+	assert.Equal(t, ErrNotInSlideshow, err)
+}
+
+func TestPauseStopsTheTimerAndIsRemembered(t *testing.T) {
+	f := newFixture(t, "a.jpg", "b.jpg")
+	p := f.player(t)
+	require.NotNil(t, p.Now().Until)
+
+	paused, err := p.Pause()
+	require.Nil(t, err)
+	assert.True(t, paused.Paused)
+	assert.Nil(t, paused.Until)
+	p.Stop()
+
+	// the state file lets playback carry on where it was after a restart
+	restarted := f.player(t)
+	defer restarted.Stop()
+	assert.Equal(t, paused.Name, restarted.Now().Name)
+	assert.True(t, restarted.Now().Paused)
+
+	resumed, err := restarted.Resume()
+	require.Nil(t, err)
+	assert.False(t, resumed.Paused)
+	assert.NotNil(t, resumed.Until)
+}
+
+func TestFollowsTheSlideshowDirectory(t *testing.T) {
+	f := newFixture(t)
+	p := f.player(t)
+	defer p.Stop()
+	assert.Equal(t, "", p.Now().Name)
+
+	// a new upload goes straight on screen
+	require.Nil(t, ioutil.WriteFile(filepath.Join(f.show, "new.jpg"), []byte("photo"), 0644))
+	f.bus.Publish(events.PhotoStaged, "new.jpg", nil)
+	assert.Eventually(t, func() bool { return p.Now().Name == "new.jpg" }, time.Second, 10*time.Millisecond)
+
+	// taking the photo on screen out of the slideshow moves on
+	require.Nil(t, ioutil.WriteFile(filepath.Join(f.show, "other.jpg"), []byte("photo"), 0644))
+	require.Nil(t, os.Remove(filepath.Join(f.show, "new.jpg")))
+	f.bus.Publish(events.SlideshowChanged, "new.jpg", nil)
+	assert.Eventually(t, func() bool { return p.Now().Name == "other.jpg" }, time.Second, 10*time.Millisecond)
+}
+
+func TestStartingShowsOnePhotoAndForgetsRemovedOnes(t *testing.T) {
+	f := newFixture(t, "a.jpg", "b.jpg")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(f.dir, "player.json"), []byte(`{"interval": "10s", "shuffle": false}`), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(f.dir, "shown.json"), []byte(`{"gone.jpg": "2020-01-02T03:04:05Z"}`), 0644))
+	sub := f.bus.Subscribe(0)
+	defer sub.Close()
+
+	p := f.player(t)
+	assert.Equal(t, "a.jpg", p.Now().Name)
+	p.Stop()
+
+	changes := 0
+	for len(sub.Events()) > 0 {
+		if (<-sub.Events()).Type == events.PlaybackChanged {
+			changes = changes + 1
+		}
+	}
+	assert.Equal(t, 1, changes)
+
+	shown, err := ioutil.ReadFile(filepath.Join(f.dir, "shown.json"))
+	require.Nil(t, err)
+	assert.Contains(t, string(shown), "a.jpg")
+	assert.NotContains(t, string(shown), "gone.jpg")
+}
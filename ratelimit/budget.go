@@ -0,0 +1,153 @@
+package ratelimit
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default is the budget for routes that don't have their own
+const Default = "*"
+
+// Rate is an Amount allowed each Per, all of it can be used at once
+type Rate struct {
+	Amount float64
+	Per    time.Duration
+}
+
+// Limiter makes a limiter that keeps to the rate, nil for no limit
+func (r Rate) Limiter() Limiter {
+	if r.Amount <= 0 || r.Per <= 0 {
+		return nil
+	}
+	return NewLimiter(r.Amount/r.Per.Minutes(), r.Amount)
+}
+
+// Budget is how many requests and how many bytes a client can send to a
+// route, a zero Rate has no limit
+type Budget struct {
+	Requests Rate
+	Bytes    Rate
+}
+
+// Budgets are kept by route name, Default covers the rest
+type Budgets map[string]Budget
+
+var ratePattern = regexp.MustCompile(`^(?i)(\d+(?:\.\d+)?)(b|kb|mb|gb)?/(s|sec|m|min|h|hour)$`)
+
+var units = map[string]float64{
+	"":   1,
+	"b":  1,
+	"kb": 1024,
+	"mb": 1024 * 1024,
+	"gb": 1024 * 1024 * 1024,
+}
+
+var periods = map[string]time.Duration{
+	"s":    time.Second,
+	"sec":  time.Second,
+	"m":    time.Minute,
+	"min":  time.Minute,
+	"h":    time.Hour,
+	"hour": time.Hour,
+}
+
+// ParseBudgets reads budgets such as
+//
+//	AddPhotos=30/min 500MB/min; Login=10/min; *=600/min
+//
+// a rate with a size limits bytes and one without limits requests, a route
+// with 0/min has no limit
+func ParseBudgets(spec string) (Budgets, error) {
+	budgets := make(Budgets)
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		route := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || route == "" {
+			return nil, fmt.Errorf("rate limit %q must be route=rate", entry)
+		}
+
+		budget := Budget{}
+		for _, field := range strings.Fields(parts[1]) {
+			m := ratePattern.FindStringSubmatch(field)
+			if m == nil {
+				return nil, fmt.Errorf("rate %q for %s must be like 30/min or 500MB/hour", field, route)
+			}
+			amount, _ := strconv.ParseFloat(m[1], 64)
+			rate := Rate{Amount: amount * units[strings.ToLower(m[2])], Per: periods[strings.ToLower(m[3])]}
+			if m[2] == "" {
+				budget.Requests = rate
+			} else {
+				budget.Bytes = rate
+			}
+		}
+		budgets[route] = budget
+	}
+	return budgets, nil
+}
+
+// Merge returns the budgets with those in other replacing them route by
+// route
+func (b Budgets) Merge(other Budgets) Budgets {
+	result := make(Budgets)
+	for route, budget := range b {
+		result[route] = budget
+	}
+	for route, budget := range other {
+		result[route] = budget
+	}
+	return result
+}
+
+// String writes the budgets back in the form ParseBudgets reads
+func (b Budgets) String() string {
+	routes := make([]string, 0, len(b))
+	for route := range b {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	entries := []string{}
+	for _, route := range routes {
+		rates := []string{}
+		if r := b[route].Requests; r.Amount > 0 {
+			rates = append(rates, formatRate(r, ""))
+		}
+		if r := b[route].Bytes; r.Amount > 0 {
+			rates = append(rates, formatRate(r, "B"))
+		}
+		if len(rates) == 0 {
+			rates = append(rates, "0/min")
+		}
+		entries = append(entries, route+"="+strings.Join(rates, " "))
+	}
+	return strings.Join(entries, "; ")
+}
+
+func formatRate(r Rate, unit string) string {
+	amount := r.Amount
+	if unit != "" {
+		for _, u := range []string{"GB", "MB", "KB"} {
+			size := units[strings.ToLower(u)]
+			if amount >= size && amount == float64(int64(amount/size))*size {
+				amount, unit = amount/size, u
+				break
+			}
+		}
+	}
+	per := "min"
+	switch r.Per {
+	case time.Second:
+		per = "s"
+	case time.Hour:
+		per = "hour"
+	}
+	return strconv.FormatFloat(amount, 'f', -1, 64) + unit + "/" + per
+}
@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// how often buckets that have filled up again are forgotten
+const sweepInterval = time.Minute
+
+// Limiter keeps a token bucket for each key, such as a user or address
+// Take spends n tokens from the key's bucket, when there aren't enough it
+// spends none and says how long until there will be
+type Limiter interface {
+	Take(key string, n float64) (bool, time.Duration)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type bucketLimiter struct {
+	lock    sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*bucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+// NewLimiter refills each bucket at perMinute tokens a minute up to burst,
+// buckets start full
+func NewLimiter(perMinute, burst float64) Limiter {
+	return newLimiter(perMinute, burst, time.Now)
+}
+
+func newLimiter(perMinute, burst float64, now func() time.Time) *bucketLimiter {
+	return &bucketLimiter{
+		rate:    perMinute / 60,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+		swept:   now(),
+		now:     now,
+	}
+}
+
+// Take lets a request larger than the whole bucket through once the bucket
+// is full, leaving it in debt, otherwise it could never be made
+func (l *bucketLimiter) Take(key string, n float64) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+
+	if b.tokens >= n || b.tokens >= l.burst {
+		b.tokens -= n
+		return true, 0
+	}
+	need := math.Min(n, l.burst) - b.tokens
+	return false, time.Duration(math.Ceil(need/l.rate*1000)) * time.Millisecond
+}
+
+// sweep forgets buckets that are full again, the lock must be held
+func (l *bucketLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < sweepInterval {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
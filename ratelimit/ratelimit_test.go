@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func TestBucketsRefillOverTime(t *testing.T) {
+	c := &clock{now: time.Now()}
+	l := newLimiter(60, 3, c.Now)
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Take("nana", 1)
+		assert.True(t, ok)
+	}
+	ok, wait := l.Take("nana", 1)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	// each key has its own bucket
+	ok, _ = l.Take("sam", 1)
+	assert.True(t, ok)
+
+	c.now = c.now.Add(time.Second)
+	ok, _ = l.Take("nana", 1)
+	assert.True(t, ok)
+	ok, _ = l.Take("nana", 1)
+	assert.False(t, ok)
+}
+
+func TestLargeRequestsWaitForAFullBucket(t *testing.T) {
+	c := &clock{now: time.Now()}
+	l := newLimiter(60, 10, c.Now)
+
+	ok, _ := l.Take("nana", 25)
+	assert.True(t, ok)
+
+	// it is in debt until the 25 are paid back
+	ok, wait := l.Take("nana", 1)
+	assert.False(t, ok)
+	assert.Equal(t, 16*time.Second, wait)
+
+	c.now = c.now.Add(25 * time.Second)
+	ok, _ = l.Take("nana", 25)
+	assert.True(t, ok)
+}
+
+func TestFullBucketsAreForgotten(t *testing.T) {
+	c := &clock{now: time.Now()}
+	l := newLimiter(60, 2, c.Now)
+
+	l.Take("nana", 1)
+	c.now = c.now.Add(2 * sweepInterval)
+	l.Take("sam", 1)
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestParseBudgets(t *testing.T) {
+	budgets, err := ParseBudgets(" AddPhotos=30/min 500MB/min; Login=10/m;AppendUpload=2GB/hour ; *=600/min; Open=0/min")
+	assert.Nil(t, err)
+	assert.Equal(t, Budget{Requests: Rate{30, time.Minute}, Bytes: Rate{500 * 1024 * 1024, time.Minute}}, budgets["AddPhotos"])
+	assert.Equal(t, Budget{Requests: Rate{10, time.Minute}}, budgets["Login"])
+	assert.Equal(t, Budget{Bytes: Rate{2 * 1024 * 1024 * 1024, time.Hour}}, budgets["AppendUpload"])
+	assert.Nil(t, budgets["Open"].Requests.Limiter())
+	assert.Equal(t, "*=600/min; AddPhotos=30/min 500MB/min; AppendUpload=2GB/hour; Login=10/min; Open=0/min", budgets.String())
+
+	merged := budgets.Merge(Budgets{"Login": {Requests: Rate{5, time.Minute}}})
+	assert.Equal(t, float64(5), merged["Login"].Requests.Amount)
+	assert.Equal(t, float64(10), budgets["Login"].Requests.Amount)
+
+	for _, bad := range []string{"AddPhotos", "=30/min", "AddPhotos=30", "AddPhotos=lots/min", "AddPhotos=30/day"} {
+		_, err := ParseBudgets(bad)
+		assert.Error(t, err, bad)
+	}
+}
@@ -11,12 +11,102 @@ type Route struct {
 // Routes are the main setup for our Router
 type Routes []Route
 
+// reading stays open so kiosk browsers keep working without
+// signing in, member and admin routes need a user once anyone has an
+// account or AUTH_REQUIRED is on and every route is held to its budget in
+// RATE_LIMITS by name
 var routes = Routes{
 	// meta services
 	Route{"Healthcheck", "GET", "/healthcheck", HealthcheckHandler},
+	Route{"Events", "GET", "/events", EventsHandler},
+
+	//=== Users ===
+	Route{"Login", "POST", "/login", LoginHandler},
+	Route{"Logout", "POST", "/logout", LogoutHandler},
+	Route{"Me", "GET", "/me", account(MeHandler)},
+	Route{"ListTokens", "GET", "/tokens", account(ListTokensHandler)},
+	Route{"CreateToken", "POST", "/tokens", account(CreateTokenHandler)},
+	Route{"DeleteToken", "DELETE", "/tokens/{id}", account(DeleteTokenHandler)},
+	Route{"ListUsers", "GET", "/users", accountAdmin(ListUsersHandler)},
+	Route{"AddUser", "POST", "/users", accountAdmin(AddUserHandler)},
+	Route{"DeleteUser", "DELETE", "/users/{name}", accountAdmin(DeleteUserHandler)},
+	Route{"SetPassword", "PUT", "/users/{name}/password", account(SetPasswordHandler)},
 
 	//=== Add Photos ===
-	Route{"AddPhotos", "POST", "/photos", AddPhotosHandler},
+	Route{"AddPhotos", "POST", "/photos", memberOrGuest(idempotent(AddPhotosHandler))},
+	Route{"ImportPhotos", "POST", "/photos/import", member(idempotent(ImportPhotosHandler))},
+	Route{"RetryPhotos", "POST", "/photos/retry", admin(RetryPhotosHandler)},
+
+	//=== Guest Invites ===
+	Route{"ListInvites", "GET", "/invites", admin(ListInvitesHandler)},
+	Route{"CreateInvite", "POST", "/invites", admin(CreateInviteHandler)},
+	Route{"GetInvite", "GET", "/invites/{id}", admin(GetInviteHandler)},
+	Route{"RevokeInvite", "DELETE", "/invites/{id}", admin(RevokeInviteHandler)},
+	Route{"InviteQR", "GET", "/invites/{id}/qr.png", admin(InviteQRHandler)},
+	Route{"GuestPage", "GET", "/guest/{token}", GuestPageHandler},
+
+	//=== Resumable Uploads (tus) ===
+	Route{"UploadOptions", "OPTIONS", "/uploads", UploadOptionsHandler},
+	Route{"CreateUpload", "POST", "/uploads", member(CreateUploadHandler)},
+	Route{"UploadStatus", "HEAD", "/uploads/{id}", member(UploadStatusHandler)},
+	Route{"AppendUpload", "PATCH", "/uploads/{id}", member(AppendUploadHandler)},
+	Route{"DeleteUpload", "DELETE", "/uploads/{id}", member(DeleteUploadHandler)},
+
+	//=== Catalog ===
+	Route{"ListPhotos", "GET", "/photos", ListPhotosHandler},
+	Route{"GetPhoto", "GET", "/photos/{name}", GetPhotoHandler},
+	Route{"UpdatePhoto", "PATCH", "/photos/{name}", member(UpdatePhotoHandler)},
+	Route{"DeletePhoto", "DELETE", "/photos/{name}", admin(DeletePhotoHandler)},
+	Route{"SetPhotoTags", "PUT", "/photos/{name}/tags", member(SetPhotoTagsHandler)},
+	Route{"ListAlbums", "GET", "/albums", ListAlbumsHandler},
+	Route{"AddAlbum", "POST", "/albums", member(AddAlbumHandler)},
+	Route{"GetAlbum", "GET", "/albums/{id}", GetAlbumHandler},
+	Route{"UpdateAlbum", "PATCH", "/albums/{id}", member(UpdateAlbumHandler)},
+	Route{"DeleteAlbum", "DELETE", "/albums/{id}", admin(DeleteAlbumHandler)},
+
+	//=== Slideshow ===
+	Route{"Slideshow", "GET", "/slideshow", SlideshowHandler},
+	Route{"SlideshowPhoto", "GET", "/slideshow/photos/{name}", SlideshowPhotoHandler},
+	Route{"NowPlaying", "GET", "/slideshow/now", NowPlayingHandler},
+	Route{"Next", "POST", "/slideshow/next", member(NextHandler)},
+	Route{"Previous", "POST", "/slideshow/previous", member(PreviousHandler)},
+	Route{"Pause", "POST", "/slideshow/pause", member(PauseHandler)},
+	Route{"Resume", "POST", "/slideshow/resume", member(ResumeHandler)},
+	Route{"Show", "POST", "/slideshow/show/{name}", member(ShowHandler)},
+	Route{"SlideshowEvictions", "GET", "/slideshow/evictions", EvictionsHandler},
+	Route{"GetSelection", "GET", "/selection", GetSelectionHandler},
+	Route{"SetSelection", "PUT", "/selection", admin(SetSelectionHandler)},
+	Route{"ApplySelection", "POST", "/selection/apply", member(ApplySelectionHandler)},
+
+	//=== Frames ===
+	Route{"ListFrames", "GET", "/frames", ListFramesHandler},
+	Route{"GetFrame", "GET", "/frames/{name}", GetFrameHandler},
+	Route{"GetFrameSelection", "GET", "/frames/{name}/selection", GetFrameSelectionHandler},
+	Route{"SetFrameSelection", "PUT", "/frames/{name}/selection", admin(SetFrameSelectionHandler)},
+	Route{"ApplyFrameSelection", "POST", "/frames/{name}/selection/apply", member(ApplyFrameSelectionHandler)},
+	Route{"FrameEvictions", "GET", "/frames/{name}/evictions", FrameEvictionsHandler},
+	// frame clients sign in with a token from photopi-api user token
+	Route{"FrameManifest", "GET", "/frames/{name}/manifest", member(FrameManifestHandler)},
+	Route{"FramePhoto", "GET", "/frames/{name}/photos/{photo}", member(FramePhotoHandler)},
+
+	//=== Web Player ===
+	Route{"GetPlayer", "GET", "/player", GetPlayerHandler},
+	Route{"SetPlayer", "PUT", "/player", admin(SetPlayerHandler)},
+
+	//=== Schedules and Display ===
+	Route{"GetSchedule", "GET", "/schedules", GetScheduleHandler},
+	Route{"SetSchedule", "PUT", "/schedules", admin(SetScheduleHandler)},
+	Route{"GetDisplay", "GET", "/display", GetDisplayHandler},
+	Route{"BlankDisplay", "POST", "/display/blank", member(BlankDisplayHandler)},
+	Route{"WakeDisplay", "POST", "/display/wake", member(WakeDisplayHandler)},
+
+	//=== Webhooks ===
+	Route{"ListWebhooks", "GET", "/webhooks", admin(ListWebhooksHandler)},
+	Route{"AddWebhook", "POST", "/webhooks", admin(AddWebhookHandler)},
+	Route{"GetWebhook", "GET", "/webhooks/{id}", admin(GetWebhookHandler)},
+	Route{"DeleteWebhook", "DELETE", "/webhooks/{id}", admin(DeleteWebhookHandler)},
+	Route{"WebhookDeliveries", "GET", "/webhooks/{id}/deliveries", admin(WebhookDeliveriesHandler)},
+	Route{"TestWebhook", "POST", "/webhooks/{id}/test", admin(TestWebhookHandler)},
 
 	//=== Front End ===
 	// is added in server.go to avoid bad interaction with gorilla mux
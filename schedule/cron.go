@@ -0,0 +1,151 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a parsed five field cron expression
+// minute hour day-of-month month day-of-week
+type Cron struct {
+	minutes  []bool
+	hours    []bool
+	days     []bool
+	months   []bool
+	weekdays []bool
+	anyDay   bool
+	anyWeek  bool
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var dayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// ParseCron parses expressions like "30 22 * * mon-fri" or "*/15 6-9 * * *"
+func ParseCron(expr string) (Cron, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return Cron{}, fmt.Errorf("cron %q needs 5 fields, minute hour day month weekday", expr)
+	}
+
+	var err error
+	c := Cron{
+		anyDay:  fields[2] == "*",
+		anyWeek: fields[4] == "*",
+	}
+	if c.minutes, err = parseField(fields[0], 0, 59, nil); err != nil {
+		return c, fmt.Errorf("cron %q minute: %s", expr, err.Error())
+	}
+	if c.hours, err = parseField(fields[1], 0, 23, nil); err != nil {
+		return c, fmt.Errorf("cron %q hour: %s", expr, err.Error())
+	}
+	if c.days, err = parseField(fields[2], 1, 31, nil); err != nil {
+		return c, fmt.Errorf("cron %q day of month: %s", expr, err.Error())
+	}
+	if c.months, err = parseField(fields[3], 1, 12, monthNames); err != nil {
+		return c, fmt.Errorf("cron %q month: %s", expr, err.Error())
+	}
+	// 7 is also sunday
+	if c.weekdays, err = parseField(fields[4], 0, 7, dayNames); err != nil {
+		return c, fmt.Errorf("cron %q day of week: %s", expr, err.Error())
+	}
+	c.weekdays[0] = c.weekdays[0] || c.weekdays[7]
+
+	return c, nil
+}
+
+// parseField handles *, lists, ranges and steps for one field
+func parseField(field string, min, max int, names map[string]int) ([]bool, error) {
+	result := make([]bool, max+1)
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("bad step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = parseValue(bounds[0], names); err != nil {
+				return nil, err
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = parseValue(bounds[1], names); err != nil {
+					return nil, err
+				}
+			} else if step > 1 {
+				// "5/10" means from 5 to the end every 10
+				high = max
+			}
+		}
+
+		if low < min || high > max || low > high {
+			return nil, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := low; v <= high; v = v + step {
+			result[v] = true
+		}
+	}
+
+	return result, nil
+}
+
+func parseValue(value string, names map[string]int) (int, error) {
+	if n, ok := names[strings.ToLower(value)]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", value)
+	}
+	return n, nil
+}
+
+// Matches is true when t falls in a minute the expression fires on
+func (c Cron) Matches(t time.Time) bool {
+	if !c.minutes[t.Minute()] || !c.hours[t.Hour()] || !c.months[int(t.Month())] {
+		return false
+	}
+
+	// like cron, a restricted day of month and day of week match either one
+	day := c.days[t.Day()]
+	week := c.weekdays[int(t.Weekday())]
+	switch {
+	case c.anyDay && c.anyWeek:
+		return true
+	case c.anyDay:
+		return week
+	case c.anyWeek:
+		return day
+	}
+	return day || week
+}
+
+// Previous finds the last time at or before t the expression fired,
+// looking back as far as limit
+func (c Cron) Previous(t time.Time, limit time.Duration) (time.Time, bool) {
+	check := t.Truncate(time.Minute)
+	stop := t.Add(-limit)
+	for !check.Before(stop) {
+		if c.Matches(check) {
+			return check, true
+		}
+		check = check.Add(-time.Minute)
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,78 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func at(day, hour, minute int) time.Time {
+	// June 2024, the 3rd is a monday
+	return time.Date(2024, time.June, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{"* * * * *", "*/15 6-9 * * *", "0 22 * * mon-fri", "5,35 7 1 jan,jul 0", "0 0 * * 7"} {
+		_, err := ParseCron(expr)
+		assert.Nil(t, err, expr)
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "*/0 * * * *", "5-1 * * * *", "* * * * funday"} {
+		_, err := ParseCron(expr)
+		assert.NotNil(t, err, expr)
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	weeknights, err := ParseCron("30 22 * * mon-fri")
+	require.Nil(t, err)
+	assert.True(t, weeknights.Matches(at(3, 22, 30)))
+	assert.False(t, weeknights.Matches(at(3, 22, 31)))
+	assert.False(t, weeknights.Matches(at(8, 22, 30)))
+
+	sundays, err := ParseCron("0 9 * * 7")
+	require.Nil(t, err)
+	assert.True(t, sundays.Matches(at(9, 9, 0)))
+
+	// a restricted day of month and day of week match either one
+	either, err := ParseCron("0 12 1 * fri")
+	require.Nil(t, err)
+	assert.True(t, either.Matches(at(1, 12, 0)))
+	assert.True(t, either.Matches(at(7, 12, 0)))
+	assert.False(t, either.Matches(at(8, 12, 0)))
+}
+
+func TestCronPrevious(t *testing.T) {
+	morning, err := ParseCron("0 7 * * *")
+	require.Nil(t, err)
+
+	prev, ok := morning.Previous(at(3, 6, 59), 48*time.Hour)
+	require.True(t, ok)
+	assert.Equal(t, at(2, 7, 0), prev)
+
+	_, ok = morning.Previous(at(3, 6, 59), time.Hour)
+	assert.False(t, ok)
+}
+
+func TestConfigCompileUsesTimezones(t *testing.T) {
+	config := Config{
+		Timezone: "America/New_York",
+		Entries: []Entry{
+			{Name: "night", Cron: "0 22 * * *", Action: BlankScreen},
+			{Name: "morning", Cron: "0 7 * * *", Timezone: "Europe/London", Action: WakeScreen},
+		},
+	}
+	entries, err := config.compile()
+	require.Nil(t, err)
+	assert.Equal(t, "America/New_York", entries[0].location.String())
+	assert.Equal(t, "Europe/London", entries[1].location.String())
+
+	// 02:00 UTC is 22:00 the night before in New York
+	assert.True(t, entries[0].cron.Matches(at(4, 2, 0).In(entries[0].location)))
+
+	bad := Config{Entries: []Entry{{Name: "x", Cron: "* * * * *", Action: SwitchPlaylist}}}
+	_, err = bad.compile()
+	assert.NotNil(t, err)
+}
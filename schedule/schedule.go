@@ -0,0 +1,343 @@
+package schedule
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/events"
+	"github.com/blreynolds4/photopi-api/selection"
+)
+
+// schedule entry actions
+const (
+	SwitchPlaylist = "playlist"
+	BlankScreen    = "blank"
+	WakeScreen     = "wake"
+)
+
+// how far back to look for the entries that decide the state at start up
+const lookBack = 8 * 24 * time.Hour
+
+// Entry does its action every time its cron expression fires
+type Entry struct {
+	Name     string `json:"name"`
+	Cron     string `json:"cron"`
+	Timezone string `json:"timezone,omitempty"`
+	Action   string `json:"action"`
+	Playlist string `json:"playlist,omitempty"`
+}
+
+// Config is the list of schedule entries, Timezone is used by entries
+// that don't name their own (default is the server's local time)
+type Config struct {
+	Timezone string  `json:"timezone,omitempty"`
+	Entries  []Entry `json:"entries"`
+}
+
+// State is what the display should be doing, it is written to the state
+// file for the display process to read
+type State struct {
+	Blank    bool      `json:"blank"`
+	Playlist string    `json:"playlist"`
+	Reason   string    `json:"reason"`
+	Since    time.Time `json:"since"`
+}
+
+type compiledEntry struct {
+	Entry
+	cron     Cron
+	location *time.Location
+}
+
+func (c Config) compile() ([]compiledEntry, error) {
+	result := []compiledEntry{}
+	for _, e := range c.Entries {
+		if e.Name == "" {
+			return nil, fmt.Errorf("schedule entries need a name")
+		}
+
+		cron, err := ParseCron(e.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s: %s", e.Name, err.Error())
+		}
+
+		zone := e.Timezone
+		if zone == "" {
+			zone = c.Timezone
+		}
+		location := time.Local
+		if zone != "" {
+			location, err = time.LoadLocation(zone)
+			if err != nil {
+				return nil, fmt.Errorf("schedule %s: unknown timezone %s", e.Name, zone)
+			}
+		}
+
+		switch e.Action {
+		case SwitchPlaylist:
+			if e.Playlist == "" {
+				return nil, fmt.Errorf("schedule %s: playlist action needs a playlist", e.Name)
+			}
+		case BlankScreen, WakeScreen:
+		default:
+			return nil, fmt.Errorf("schedule %s: unknown action %q", e.Name, e.Action)
+		}
+
+		result = append(result, compiledEntry{Entry: e, cron: cron, location: location})
+	}
+	return result, nil
+}
+
+// Scheduler switches playlists and blanks the display as its entries fire
+type Scheduler interface {
+	Config() Config
+	SetConfig(config Config) error
+	State() State
+	Blank(reason string) State
+	Wake(reason string) State
+	Stop()
+}
+
+type cronScheduler struct {
+	lock      sync.Mutex
+	file      string
+	stateFile string
+	config    Config
+	entries   []compiledEntry
+	state     State
+	selector  selection.Selector
+	events    events.Publisher
+	done      chan bool
+}
+
+// NewScheduler loads the schedule from file, works out what state the
+// display should be in now and then follows the schedule every minute
+func NewScheduler(file, stateFile string, selector selection.Selector, publisher events.Publisher) (Scheduler, error) {
+	s := cronScheduler{
+		file:      file,
+		stateFile: stateFile,
+		selector:  selector,
+		events:    publisher,
+		done:      make(chan bool),
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.config); err != nil {
+			return nil, fmt.Errorf("reading schedule %s: %s", file, err.Error())
+		}
+	}
+	if s.entries, err = s.config.compile(); err != nil {
+		return nil, err
+	}
+
+	s.state = State{
+		Playlist: selector.Config().Active,
+		Reason:   "start",
+		Since:    time.Now(),
+	}
+	s.catchUp(time.Now())
+
+	go s.run()
+
+	return &s, nil
+}
+
+// catchUp applies the most recent playlist and blank/wake entries that
+// fired before now, so a restart lands in the scheduled state
+func (s *cronScheduler) catchUp(now time.Time) {
+	var playlist, screen *compiledEntry
+	var playlistAt, screenAt time.Time
+
+	s.lock.Lock()
+	entries := s.entries
+	s.lock.Unlock()
+
+	for i := range entries {
+		e := &entries[i]
+		at, ok := e.cron.Previous(now.In(e.location), lookBack)
+		if !ok {
+			continue
+		}
+		if e.Action == SwitchPlaylist {
+			if at.After(playlistAt) {
+				playlist, playlistAt = e, at
+			}
+		} else if at.After(screenAt) {
+			screen, screenAt = e, at
+		}
+	}
+
+	if playlist != nil {
+		s.fire(*playlist, playlistAt)
+	}
+	if screen != nil {
+		s.fire(*screen, screenAt)
+	} else {
+		s.save()
+	}
+}
+
+func (s *cronScheduler) run() {
+	for {
+		// wake at the start of the next minute
+		now := time.Now()
+		timer := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case t := <-timer.C:
+			s.tick(t)
+		}
+	}
+}
+
+func (s *cronScheduler) tick(t time.Time) {
+	s.lock.Lock()
+	entries := s.entries
+	s.lock.Unlock()
+
+	for _, e := range entries {
+		if e.cron.Matches(t.In(e.location)) {
+			s.fire(e, t)
+		}
+	}
+}
+
+// fire does an entry's action
+func (s *cronScheduler) fire(e compiledEntry, at time.Time) {
+	reason := "schedule " + e.Name
+	switch e.Action {
+	case SwitchPlaylist:
+		if err := s.selector.Activate(e.Playlist); err != nil {
+			fmt.Println("Schedule", e.Name, "unable to switch to playlist", e.Playlist, "because", err.Error())
+			return
+		}
+		s.update(func(state *State) {
+			state.Playlist = e.Playlist
+		}, reason, at)
+	case BlankScreen:
+		s.update(func(state *State) {
+			state.Blank = true
+		}, reason, at)
+	case WakeScreen:
+		s.update(func(state *State) {
+			state.Blank = false
+		}, reason, at)
+	}
+}
+
+func (s *cronScheduler) update(change func(*State), reason string, at time.Time) State {
+	s.lock.Lock()
+	change(&s.state)
+	s.state.Reason = reason
+	s.state.Since = at
+	state := s.state
+	s.lock.Unlock()
+
+	fmt.Println("Display is now", describe(state), "because of", reason)
+	s.save()
+	s.events.Publish(events.DisplayChanged, "", state)
+	return state
+}
+
+func describe(state State) string {
+	if state.Blank {
+		return "blank"
+	}
+	return "showing " + state.Playlist
+}
+
+// save writes the state file for the display process
+func (s *cronScheduler) save() {
+	if s.stateFile == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(s.State(), "", "  ")
+	if err == nil {
+		// write then rename so the display never reads half a file
+		tmp := s.stateFile + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, s.stateFile)
+		}
+	}
+	if err != nil {
+		fmt.Println("Unable to write display state", s.stateFile, "because", err.Error())
+	}
+}
+
+func (s *cronScheduler) Config() Config {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.config
+}
+
+// SetConfig validates and saves the schedule, it takes effect right away
+func (s *cronScheduler) SetConfig(config Config) error {
+	entries, err := config.compile()
+	if err != nil {
+		return err
+	}
+	playlists := s.selector.Config()
+	for _, e := range entries {
+		if e.Action == SwitchPlaylist {
+			if _, ok := playlists.Playlist(e.Playlist); !ok {
+				return fmt.Errorf("schedule %s: playlist %s is not defined", e.Name, e.Playlist)
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.file, data, 0644); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.config = config
+	s.entries = entries
+	s.lock.Unlock()
+
+	s.catchUp(time.Now())
+	return nil
+}
+
+// State is the display state, the playlist always reflects the one
+// the selector has active even when it was changed through its own api
+func (s *cronScheduler) State() State {
+	active := s.selector.Config().Active
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state.Playlist = active
+	return s.state
+}
+
+// Blank turns the display off until it is woken or the schedule says otherwise
+func (s *cronScheduler) Blank(reason string) State {
+	return s.update(func(state *State) {
+		state.Blank = true
+	}, reason, time.Now())
+}
+
+// Wake turns the display on until it is blanked or the schedule says otherwise
+func (s *cronScheduler) Wake(reason string) State {
+	return s.update(func(state *State) {
+		state.Blank = false
+	}, reason, time.Now())
+}
+
+func (s *cronScheduler) Stop() {
+	close(s.done)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/unrolled/secure"
+	"github.com/urfave/negroni"
+)
+
+// the cookie a signed in page reads and sends back in csrfHeader
+const csrfCookie = "photopi_csrf"
+const csrfHeader = "X-CSRF-Token"
+
+// headers cross origin pages can send and read, the tus and checksum ones
+// included
+const corsAllowHeaders = "Authorization, Content-Type, Content-MD5, X-Checksum-SHA256, Idempotency-Key, " +
+	csrfHeader + ", " + inviteHeader + ", Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata, Upload-Checksum"
+const corsExposeHeaders = "Location, Photo-Location, Retry-After, Idempotent-Replayed, " +
+	"Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Upload-Metadata"
+
+type schemeKey struct{}
+
+// forwardedScheme keeps the scheme X-Forwarded-Proto says the client used,
+// only for requests that came through one of the trusted proxies as anyone
+// else could set it
+func forwardedScheme(web webSettings) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		forwarded := strings.ToLower(strings.TrimSpace(strings.Split(req.Header.Get("X-Forwarded-Proto"), ",")[0]))
+		if (forwarded == "https" || forwarded == "http") && trustedProxy(web.trustedProxies, clientIP(req)) {
+			req = req.WithContext(context.WithValue(req.Context(), schemeKey{}, forwarded))
+		}
+		next(w, req)
+	}
+}
+
+// trustedProxy is true when the address is in one of the networks
+func trustedProxy(networks []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	for _, network := range networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// securityHeaders checks the Host is one of ALLOWED_HOSTS and adds the
+// CSP, nosniff, frame and referrer headers to every response, hosts
+// aren't checked when running locally
+func securityHeaders(ctx AppContext, web webSettings) negroni.HandlerFunc {
+	allowed := []string{}
+	for _, host := range web.allowedHosts {
+		allowed = append(allowed, hostPattern(host))
+	}
+	middleware := secure.New(secure.Options{
+		IsDevelopment:           ctx.Env == local,
+		AllowedHosts:            allowed,
+		AllowedHostsAreRegex:    true,
+		ContentSecurityPolicy:   web.contentSecurityPolicy,
+		ContentTypeNosniff:      true,
+		CustomFrameOptionsValue: web.frameOptions,
+		ReferrerPolicy:          "same-origin",
+	})
+	middleware.SetBadHostHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx.Render.JSON(w, http.StatusBadRequest, Status{Status: "error", Message: "Unknown host " + req.Host})
+	}))
+	return middleware.HandlerFuncWithNext
+}
+
+// hostPattern matches the host on any port, the Host header carries the
+// port the client used
+func hostPattern(host string) string {
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = "[" + host + "]"
+	}
+	return `(?i)^` + regexp.QuoteMeta(host) + `(:[0-9]+)?$`
+}
+
+// allowOrigins lets pages from CORS_ORIGINS, such as the UI's dev server,
+// call the API with the browser's cookies, preflight requests are answered
+// here
+func allowOrigins(web webSettings) negroni.HandlerFunc {
+	methods := strings.Join(web.corsMethods, ", ")
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		origin := req.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !contains(web.corsOrigins, origin) {
+			next(w, req)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		if req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, req)
+	}
+}
+
+// checkCSRF turns down changes sent from other sites, a page from
+// anywhere else than this server or CORS_ORIGINS can't make them, and when
+// the browser signed in with its cookie it must also send the CSRF cookie
+// back in X-CSRF-Token, which other sites can't read
+// forms can't send headers so they are let in when the browser says they
+// came from one of this server's pages
+// bearer tokens and invite links aren't sent by the browser on its own so
+// they don't need it
+func checkCSRF(ctx AppContext, web webSettings, router *mux.Router) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		switch req.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next(w, req)
+			return
+		}
+
+		if origin := req.Header.Get("Origin"); origin != "" && !sameOrigin(origin, req) && !contains(web.corsOrigins, origin) {
+			ctx.Render.JSON(w, http.StatusForbidden, Status{Status: "error", Message: "Requests from " + origin + " are not allowed"})
+			return
+		}
+
+		id, ok := req.Context().Value(identityKey{}).(identity)
+		if !ok || !id.cookie || routeName(router, req) == "Login" {
+			next(w, req)
+			return
+		}
+		cookie, err := req.Cookie(csrfCookie)
+		sent := req.Header.Get(csrfHeader)
+		if sent == "" && isForm(req) && fromThisServer(req) {
+			next(w, req)
+			return
+		}
+		if err != nil || sent == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(sent)) != 1 {
+			ctx.Render.JSON(w, http.StatusForbidden, Status{Status: "error", Message: "Send the " + csrfCookie + " cookie in " + csrfHeader + ", or sign in again"})
+			return
+		}
+		next(w, req)
+	}
+}
+
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// isForm is true for the bodies an HTML form sends
+func isForm(req *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return mediaType == "multipart/form-data" || mediaType == "application/x-www-form-urlencoded"
+}
+
+// fromThisServer is true when the browser says the request came from one
+// of this server's pages, in Origin or else Referer
+func fromThisServer(req *http.Request) bool {
+	if origin := req.Header.Get("Origin"); origin != "" {
+		return sameOrigin(origin, req)
+	}
+	referer := req.Header.Get("Referer")
+	return referer != "" && sameOrigin(referer, req)
+}
+
+// sameOrigin is true for a page served by this server, over the scheme the
+// request came in on
+func sameOrigin(origin string, req *http.Request) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Scheme, requestScheme(req)) && strings.EqualFold(u.Host, req.Host)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
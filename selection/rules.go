@@ -0,0 +1,240 @@
+package selection
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/catalog"
+)
+
+// rule types
+const (
+	OnThisDay   = "on-this-day"
+	Recent      = "recent"
+	Favourites  = "favourites"
+	Album       = "album"
+	RandomYears = "random-years"
+)
+
+// how far back a recent rule looks when it doesn't say
+const defaultRecentDays = 30
+
+// how much more likely a favourite is to be picked at random
+const favouriteWeight = 3.0
+
+// Rule picks up to Count photos of one kind, a zero count takes every match
+// Days is the window for recent photos or the slack either side of the date
+// for on this day, Weights favour years in a random-years rule (default 1)
+type Rule struct {
+	Type    string             `json:"type"`
+	Count   int                `json:"count"`
+	Days    int                `json:"days,omitempty"`
+	Album   string             `json:"album,omitempty"`
+	Weights map[string]float64 `json:"weights,omitempty"`
+}
+
+// Playlist is a named list of rules, evaluated in order
+type Playlist struct {
+	Name  string `json:"name"`
+	Rules []Rule `json:"rules"`
+}
+
+// Validate checks the rule can be evaluated
+func (r Rule) Validate() error {
+	if r.Count < 0 || r.Days < 0 {
+		return fmt.Errorf("%s rule count and days can't be negative", r.Type)
+	}
+
+	switch r.Type {
+	case OnThisDay, Recent, Favourites:
+	case Album:
+		if r.Album == "" {
+			return fmt.Errorf("album rule needs an album")
+		}
+	case RandomYears:
+		if r.Count == 0 {
+			return fmt.Errorf("random-years rule needs a count")
+		}
+		for year, weight := range r.Weights {
+			if _, err := strconv.Atoi(year); err != nil {
+				return fmt.Errorf("random-years weight %q is not a year", year)
+			}
+			if weight < 0 {
+				return fmt.Errorf("random-years weight for %s can't be negative", year)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown rule type %q", r.Type)
+	}
+	return nil
+}
+
+// Select evaluates the playlist's rules in order against the photos, each
+// rule adds photos not already picked by an earlier one, hidden photos are
+// never selected and favourites are more likely to be picked at random
+func Select(playlist Playlist, photos []catalog.Photo, now time.Time, rng *rand.Rand) []string {
+	picked := make(map[string]bool)
+	result := []string{}
+
+	for _, rule := range playlist.Rules {
+		candidates := []catalog.Photo{}
+		for _, p := range photos {
+			if !p.Hidden && !picked[p.Name] && rule.matches(p, now) {
+				candidates = append(candidates, p)
+			}
+		}
+
+		var chosen []catalog.Photo
+		if rule.Type == RandomYears {
+			chosen = rule.pickAcrossYears(candidates, rng)
+		} else {
+			chosen = pickRandom(candidates, rule.Count, rng)
+		}
+
+		for _, p := range chosen {
+			picked[p.Name] = true
+			result = append(result, p.Name)
+		}
+	}
+
+	return result
+}
+
+func (r Rule) matches(p catalog.Photo, now time.Time) bool {
+	switch r.Type {
+	case OnThisDay:
+		// the nearest anniversary can be in last or next year when the
+		// window crosses new year
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		for year := now.Year() - 1; year <= now.Year()+1; year++ {
+			if year <= p.Taken.Year() {
+				continue
+			}
+			days := int(anniversary(p.Taken, year, now.Location()).Sub(today).Hours() / 24)
+			if days < 0 {
+				days = -days
+			}
+			if days <= r.Days {
+				return true
+			}
+		}
+		return false
+	case Recent:
+		days := r.Days
+		if days == 0 {
+			days = defaultRecentDays
+		}
+		return p.Added.After(now.AddDate(0, 0, -days))
+	case Favourites:
+		return p.Favourite
+	case Album:
+		return p.InAlbum(r.Album)
+	case RandomYears:
+		return true
+	}
+	return false
+}
+
+// anniversary is the day in year the photo was taken on, photos from the
+// 29th of February have theirs on the 28th in other years
+func anniversary(taken time.Time, year int, loc *time.Location) time.Time {
+	day := taken.Day()
+	if taken.Month() == time.February && day == 29 && time.Date(year, time.February, 29, 0, 0, 0, 0, loc).Month() != time.February {
+		day = 28
+	}
+	return time.Date(year, taken.Month(), day, 0, 0, 0, 0, loc)
+}
+
+// pickRandom returns count photos chosen at random, or all of them for a zero count
+func pickRandom(photos []catalog.Photo, count int, rng *rand.Rand) []catalog.Photo {
+	if count == 0 || count >= len(photos) {
+		return photos
+	}
+
+	pool := append([]catalog.Photo{}, photos...)
+	result := []catalog.Photo{}
+	for len(result) < count {
+		i := pickOne(pool, rng)
+		result = append(result, pool[i])
+		pool = append(pool[:i], pool[i+1:]...)
+	}
+	return result
+}
+
+// pickOne returns the index of a photo chosen at random, favourites weighted higher
+func pickOne(photos []catalog.Photo, rng *rand.Rand) int {
+	total := 0.0
+	for _, p := range photos {
+		total = total + photoWeight(p)
+	}
+
+	roll := rng.Float64() * total
+	for i, p := range photos {
+		roll = roll - photoWeight(p)
+		if roll < 0 {
+			return i
+		}
+	}
+	return len(photos) - 1
+}
+
+func photoWeight(p catalog.Photo) float64 {
+	if p.Favourite {
+		return favouriteWeight
+	}
+	return 1
+}
+
+// pickAcrossYears chooses a year by weight and then a photo from it, so a
+// year with a few photos shows up as often as one with thousands
+func (r Rule) pickAcrossYears(photos []catalog.Photo, rng *rand.Rand) []catalog.Photo {
+	byYear := make(map[int][]catalog.Photo)
+	for _, p := range photos {
+		byYear[p.Taken.Year()] = append(byYear[p.Taken.Year()], p)
+	}
+
+	years := []int{}
+	for year := range byYear {
+		years = append(years, year)
+	}
+	sort.Ints(years)
+
+	result := []catalog.Photo{}
+	for len(result) < r.Count {
+		total := 0.0
+		for _, year := range years {
+			if len(byYear[year]) > 0 {
+				total = total + r.weight(year)
+			}
+		}
+		if total == 0 {
+			break
+		}
+
+		roll := rng.Float64() * total
+		for _, year := range years {
+			pool := byYear[year]
+			if len(pool) == 0 {
+				continue
+			}
+			roll = roll - r.weight(year)
+			if roll < 0 {
+				i := pickOne(pool, rng)
+				result = append(result, pool[i])
+				byYear[year] = append(pool[:i], pool[i+1:]...)
+				break
+			}
+		}
+	}
+	return result
+}
+
+func (r Rule) weight(year int) float64 {
+	if weight, ok := r.Weights[strconv.Itoa(year)]; ok {
+		return weight
+	}
+	return 1
+}
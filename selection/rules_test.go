@@ -0,0 +1,137 @@
+package selection
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/catalog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var now = time.Date(2024, time.June, 15, 12, 0, 0, 0, time.UTC)
+
+func photo(name string, taken time.Time) catalog.Photo {
+	return catalog.Photo{Name: name, Taken: taken, Added: taken}
+}
+
+func TestOnThisDayAndRecent(t *testing.T) {
+	photos := []catalog.Photo{
+		photo("2019-06-15.jpg", time.Date(2019, time.June, 15, 8, 0, 0, 0, time.UTC)),
+		photo("2020-06-17.jpg", time.Date(2020, time.June, 17, 8, 0, 0, 0, time.UTC)),
+		photo("2021-01-01.jpg", time.Date(2021, time.January, 1, 8, 0, 0, 0, time.UTC)),
+		photo("2024-06-01.jpg", time.Date(2024, time.June, 1, 8, 0, 0, 0, time.UTC)),
+	}
+	rng := rand.New(rand.NewSource(1))
+
+	exact := Playlist{Rules: []Rule{{Type: OnThisDay}}}
+	assert.Equal(t, []string{"2019-06-15.jpg"}, Select(exact, photos, now, rng))
+
+	window := Playlist{Rules: []Rule{{Type: OnThisDay, Days: 3}, {Type: Recent}}}
+	assert.Equal(t, []string{"2019-06-15.jpg", "2020-06-17.jpg", "2024-06-01.jpg"}, Select(window, photos, now, rng))
+}
+
+func TestOnThisDayAcrossNewYear(t *testing.T) {
+	photos := []catalog.Photo{
+		photo("2019-12-31.jpg", time.Date(2019, time.December, 31, 8, 0, 0, 0, time.UTC)),
+		photo("2020-01-03.jpg", time.Date(2020, time.January, 3, 8, 0, 0, 0, time.UTC)),
+		photo("2023-12-31.jpg", time.Date(2023, time.December, 31, 8, 0, 0, 0, time.UTC)),
+	}
+	rng := rand.New(rand.NewSource(1))
+	window := Playlist{Rules: []Rule{{Type: OnThisDay, Days: 3}}}
+
+	// last new year's eve is too recent to be an anniversary
+	january := time.Date(2024, time.January, 2, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, []string{"2019-12-31.jpg", "2020-01-03.jpg"}, Select(window, photos, january, rng))
+
+	december := time.Date(2024, time.December, 31, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, []string{"2019-12-31.jpg", "2020-01-03.jpg", "2023-12-31.jpg"}, Select(window, photos, december, rng))
+}
+
+func TestOnThisDayLeapDay(t *testing.T) {
+	photos := []catalog.Photo{photo("2020-02-29.jpg", time.Date(2020, time.February, 29, 8, 0, 0, 0, time.UTC))}
+	exact := Playlist{Rules: []Rule{{Type: OnThisDay}}}
+	rng := rand.New(rand.NewSource(1))
+
+	assert.Equal(t, []string{"2020-02-29.jpg"}, Select(exact, photos, time.Date(2023, time.February, 28, 12, 0, 0, 0, time.UTC), rng))
+	assert.Empty(t, Select(exact, photos, time.Date(2023, time.March, 1, 12, 0, 0, 0, time.UTC), rng))
+	assert.Equal(t, []string{"2020-02-29.jpg"}, Select(exact, photos, time.Date(2024, time.February, 29, 12, 0, 0, 0, time.UTC), rng))
+}
+
+func TestRulesDoNotRepeatPhotos(t *testing.T) {
+	fav := photo("fav.jpg", now.AddDate(0, 0, -1))
+	fav.Favourite = true
+	fav.Albums = []string{"kids"}
+	kid := photo("kid.jpg", now.AddDate(-2, 0, 0))
+	kid.Albums = []string{"kids"}
+	photos := []catalog.Photo{fav, kid}
+
+	playlist := Playlist{Rules: []Rule{{Type: Favourites}, {Type: Album, Album: "kids"}, {Type: Recent}}}
+	assert.Equal(t, []string{"fav.jpg", "kid.jpg"}, Select(playlist, photos, now, rand.New(rand.NewSource(1))))
+}
+
+func TestRandomYearsBalancesYears(t *testing.T) {
+	photos := []catalog.Photo{photo("2010.jpg", time.Date(2010, time.May, 1, 0, 0, 0, 0, time.UTC))}
+	for i := 0; i < 50; i++ {
+		photos = append(photos, photo(time.Duration(i).String()+".jpg", time.Date(2023, time.May, 1, 0, 0, i, 0, time.UTC)))
+	}
+
+	playlist := Playlist{Rules: []Rule{{Type: RandomYears, Count: 6}}}
+	picked := Select(playlist, photos, now, rand.New(rand.NewSource(7)))
+	require.Equal(t, 6, len(picked))
+
+	// equal year weights give the lone 2010 photo the same
+	// chance each pick as all fifty from 2023 together
+	assert.Contains(t, picked, "2010.jpg")
+
+	// a zero weight leaves a year out
+	skip := Playlist{Rules: []Rule{{Type: RandomYears, Count: 6, Weights: map[string]float64{"2010": 0}}}}
+	assert.NotContains(t, Select(skip, photos, now, rand.New(rand.NewSource(7))), "2010.jpg")
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := Config{
+		Active:    "home",
+		Playlists: []Playlist{{Name: "home", Rules: []Rule{{Type: Recent, Days: 7}}}},
+	}
+	assert.Nil(t, valid.Validate())
+
+	missing := valid
+	missing.Active = "bedroom"
+	assert.NotNil(t, missing.Validate())
+
+	badRule := Config{Playlists: []Playlist{{Name: "x", Rules: []Rule{{Type: Album}}}}}
+	assert.NotNil(t, badRule.Validate())
+
+	badInterval := Config{Interval: "5s"}
+	assert.NotNil(t, badInterval.Validate())
+}
+
+func TestHiddenNeverSelectedAndFavouritesWeighted(t *testing.T) {
+	hidden := photo("hidden.jpg", now.AddDate(0, 0, -1))
+	hidden.Hidden = true
+	hidden.Favourite = true
+	fav := photo("fav.jpg", now.AddDate(-1, 0, 0))
+	fav.Favourite = true
+	photos := []catalog.Photo{hidden, fav}
+	for i := 0; i < 9; i++ {
+		photos = append(photos, photo(fmt.Sprintf("plain-%d.jpg", i), now.AddDate(-1, 0, 0)))
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	picks := 0
+	for i := 0; i < 1000; i++ {
+		chosen := Select(Playlist{Rules: []Rule{{Type: RandomYears, Count: 1}}}, photos, now, rng)
+		require.Len(t, chosen, 1)
+		assert.NotEqual(t, "hidden.jpg", chosen[0])
+		if chosen[0] == "fav.jpg" {
+			picks++
+		}
+	}
+	// a favourite counts as three photos, 3 in 12
+	assert.InDelta(t, 250, picks, 60)
+
+	assert.NotContains(t, Select(Playlist{Rules: []Rule{{Type: Favourites}}}, photos, now, rng), "hidden.jpg")
+}
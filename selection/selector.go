@@ -0,0 +1,262 @@
+package selection
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/catalog"
+	"github.com/blreynolds4/photopi-api/stager"
+)
+
+// how often the active playlist is re-evaluated when the config doesn't say
+const defaultInterval = time.Hour
+
+// Config holds the playlists and which one builds the slideshow
+// with no active playlist every upload goes into the slideshow as before
+type Config struct {
+	Active    string     `json:"active"`
+	Interval  string     `json:"interval,omitempty"`
+	Playlists []Playlist `json:"playlists"`
+}
+
+// Result is the outcome of evaluating the active playlist
+type Result struct {
+	Playlist string    `json:"playlist"`
+	Photos   []string  `json:"photos"`
+	Time     time.Time `json:"time"`
+}
+
+// Playlist finds a playlist by name
+func (c Config) Playlist(name string) (Playlist, bool) {
+	for _, p := range c.Playlists {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Playlist{}, false
+}
+
+// interval parses how often to re-evaluate
+func (c Config) interval() (time.Duration, error) {
+	if c.Interval == "" {
+		return defaultInterval, nil
+	}
+	d, err := time.ParseDuration(c.Interval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid interval %q: %s", c.Interval, err.Error())
+	}
+	if d < time.Minute {
+		return 0, fmt.Errorf("interval %s is shorter than a minute", c.Interval)
+	}
+	return d, nil
+}
+
+// Validate checks every playlist and that the active one exists
+func (c Config) Validate() error {
+	if _, err := c.interval(); err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	for _, p := range c.Playlists {
+		if p.Name == "" {
+			return fmt.Errorf("playlists need a name")
+		}
+		if names[p.Name] {
+			return fmt.Errorf("playlist %s is defined twice", p.Name)
+		}
+		names[p.Name] = true
+
+		for _, r := range p.Rules {
+			if err := r.Validate(); err != nil {
+				return fmt.Errorf("playlist %s: %s", p.Name, err.Error())
+			}
+		}
+	}
+
+	if c.Active != "" && !names[c.Active] {
+		return fmt.Errorf("active playlist %s is not defined", c.Active)
+	}
+	return nil
+}
+
+// Selector re-evaluates the active playlist on a schedule and syncs the
+// slideshow directory to the photos it picks
+type Selector interface {
+	Config() Config
+	SetConfig(config Config) error
+	Activate(playlist string) error
+	Apply() (Result, error)
+	Last() Result
+	Stop()
+}
+
+type catalogSelector struct {
+	lock    sync.Mutex
+	file    string
+	config  Config
+	last    Result
+	catalog catalog.Catalog
+	stager  stager.PhotoStager
+	rng     *rand.Rand
+	changed chan bool
+	done    chan bool
+}
+
+// NewSelector loads the selection config from file and starts re-evaluating
+// the active playlist against the catalog
+func NewSelector(file string, cat catalog.Catalog, stage stager.PhotoStager) (Selector, error) {
+	s := catalogSelector{
+		file:    file,
+		catalog: cat,
+		stager:  stage,
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		changed: make(chan bool, 1),
+		done:    make(chan bool),
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.config); err != nil {
+			return nil, fmt.Errorf("reading selection config %s: %s", file, err.Error())
+		}
+		if err := s.config.Validate(); err != nil {
+			return nil, fmt.Errorf("selection config %s: %s", file, err.Error())
+		}
+	}
+
+	go s.run()
+
+	return &s, nil
+}
+
+func (s *catalogSelector) run() {
+	for {
+		s.evaluate()
+
+		interval, _ := s.Config().interval()
+		timer := time.NewTimer(interval)
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-s.changed:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (s *catalogSelector) evaluate() {
+	if _, err := s.Apply(); err != nil {
+		fmt.Println("Unable to apply slideshow selection because", err.Error())
+	}
+}
+
+func (s *catalogSelector) Config() Config {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.config
+}
+
+// SetConfig validates and saves the config, the slideshow is rebuilt right away
+func (s *catalogSelector) SetConfig(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.file, data, 0644); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.config = config
+	s.lock.Unlock()
+
+	select {
+	case s.changed <- true:
+	default:
+		// a re-evaluation is already pending
+	}
+	return nil
+}
+
+// Activate makes the named playlist the active one and rebuilds the slideshow
+func (s *catalogSelector) Activate(playlist string) error {
+	config := s.Config()
+	if config.Active == playlist {
+		return nil
+	}
+	config.Active = playlist
+	return s.SetConfig(config)
+}
+
+// Apply evaluates the active playlist now and syncs the slideshow to it
+func (s *catalogSelector) Apply() (Result, error) {
+	config := s.Config()
+	result := Result{
+		Playlist: config.Active,
+		Photos:   []string{},
+		Time:     time.Now(),
+	}
+	if config.Active == "" {
+		return result, nil
+	}
+
+	playlist, _ := config.Playlist(config.Active)
+	playlist = s.resolveAlbums(playlist)
+	s.lock.Lock()
+	result.Photos = Select(playlist, s.catalog.List(), result.Time, s.rng)
+	s.lock.Unlock()
+
+	err := s.stager.Sync(result.Photos, fmt.Sprintf("not selected by playlist %s", playlist.Name))
+	if err != nil {
+		return result, err
+	}
+	fmt.Println("Playlist", playlist.Name, "selected", len(result.Photos), "photos")
+
+	s.lock.Lock()
+	s.last = result
+	s.lock.Unlock()
+	return result, nil
+}
+
+// resolveAlbums lets album rules name an album as well as give its id
+func (s *catalogSelector) resolveAlbums(playlist Playlist) Playlist {
+	rules := make([]Rule, len(playlist.Rules))
+	for i, r := range playlist.Rules {
+		if r.Type == Album {
+			if album, err := s.catalog.FindAlbum(r.Album); err == nil {
+				r.Album = album.ID
+			} else {
+				fmt.Println("Playlist", playlist.Name, "has no album", r.Album)
+			}
+		}
+		rules[i] = r
+	}
+	playlist.Rules = rules
+	return playlist
+}
+
+// Last is the most recent selection applied to the slideshow
+func (s *catalogSelector) Last() Result {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.last
+}
+
+func (s *catalogSelector) Stop() {
+	close(s.done)
+}
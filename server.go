@@ -1,15 +1,20 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
+	"net"
 	"net/http"
+	"strings"
 
+	"github.com/blreynolds4/photopi-api/certs"
 	"github.com/gorilla/mux"
 	"github.com/urfave/negroni"
 )
 
 // StartServer Wraps the mux Router and uses the Negroni Middleware
-func StartServer(ctx AppContext) {
+// when s.tls has a port it is also served over HTTPS
+func StartServer(ctx AppContext, s settings) {
 	router := mux.NewRouter().StrictSlash(true)
 	for _, route := range routes {
 		var handler http.Handler
@@ -25,27 +30,91 @@ func StartServer(ctx AppContext) {
 	router.PathPrefix("/ui/").Handler(
 		http.StripPrefix("/ui/", http.FileServer(http.Dir(ctx.UIPath))))
 
-	// security
-	// var isDevelopment = false
-	// if ctx.Env == local {
-	// 	isDevelopment = true
-	// }
-	// secureMiddleware := secure.New(secure.Options{
-	// 	IsDevelopment:      isDevelopment,                                // This will cause the AllowedHosts, SSLRedirect, and STSSeconds/STSIncludeSubdomains options to be ignored during development. When deploying to production, be sure to set this to false.
-	// 	AllowedHosts:       []string{"localhost:8080", "localhost:8081"}, // AllowedHosts is a list of fully qualified domain names that are allowed (CORS)
-	// 	ContentTypeNosniff: false,                                        // If ContentTypeNosniff is true, adds the X-Content-Type-Options header with the value `nosniff`. Default is false.
-	// 	BrowserXssFilter:   false,                                        // If BrowserXssFilter is true, adds the X-XSS-Protection header with the value `1; mode=block`. Default is false.
-	// })
+	// the web player a kiosk browser opens to show the slideshow
+	frame := http.StripPrefix("/frame/", http.FileServer(http.Dir(ctx.FramePath)))
+	router.PathPrefix("/frame").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/frame" {
+			http.Redirect(w, req, "/frame/", http.StatusMovedPermanently)
+			return
+		}
+		frame.ServeHTTP(w, req)
+	})
 
 	// start now
 	n := negroni.New()
-	n.Use(negroni.NewLogger())
-	// n.Use(negroni.HandlerFunc(secureMiddleware.HandlerFuncWithNext))
+	n.Use(logRequests(negroni.NewLogger()))
+	n.Use(forwardedScheme(s.web))
+	n.Use(securityHeaders(ctx, s.web))
+	n.Use(allowOrigins(s.web))
+	n.Use(authenticate(ctx))
+	n.Use(checkCSRF(ctx, s.web, router))
+	n.Use(rateLimit(ctx, router))
 	n.UseHandler(router)
 	log.Println("===> Starting app (v" + ctx.Version + ") on port " + ctx.Port + " in " + ctx.Env + " mode.")
-	if ctx.Env == local {
-		n.Run("localhost:" + ctx.Port)
-	} else {
-		n.Run(":" + ctx.Port)
+	host := s.bind
+	if host == "" && ctx.Env == local {
+		host = "localhost"
 	}
+	if s.tls.port == "" {
+		n.Run(net.JoinHostPort(host, ctx.Port))
+		return
+	}
+
+	certFile, keyFile, err := certs.Files(s.tls.certs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the plain port keeps serving, or sends everyone over to HTTPS
+	var plain http.Handler = n
+	if s.tls.redirect {
+		plain = redirectToTLS(s.tls.port)
+	}
+	go func() {
+		log.Fatal(http.ListenAndServe(net.JoinHostPort(host, ctx.Port), plain))
+	}()
+
+	log.Println("===> Serving HTTPS on port " + s.tls.port + " with " + certFile)
+	server := &http.Server{
+		Addr:      net.JoinHostPort(host, s.tls.port),
+		Handler:   n,
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+	log.Fatal(server.ListenAndServeTLS(certFile, keyFile))
+}
+
+// logRequests logs each request with logger, leaving the token out of
+// invite links
+func logRequests(logger *negroni.Logger) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		logged := req
+		if strings.HasPrefix(req.URL.Path, "/guest/") {
+			u := *req.URL
+			u.Path = "/guest/..."
+			logged = req.WithContext(req.Context())
+			logged.URL = &u
+			logged.RequestURI = u.Path
+		}
+		logger.ServeHTTP(w, logged, func(w http.ResponseWriter, _ *http.Request) {
+			next(w, req)
+		})
+	}
+}
+
+// redirectToTLS sends requests to the same host and path on the HTTPS port,
+// 308 so uploads are sent again as they were
+func redirectToTLS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			host = name
+		}
+		host = strings.Trim(host, "[]")
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
 }
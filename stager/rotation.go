@@ -0,0 +1,279 @@
+package stager
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/events"
+	"github.com/blreynolds4/photopi-api/naming"
+)
+
+// rotation policies for choosing which photos leave the slideshow
+const (
+	OldestFirst        = "oldest"
+	LeastRecentlyShown = "least-shown"
+	RandomEviction     = "random"
+)
+
+// Pinner reports photos that should never be rotated out of the slideshow
+type Pinner interface {
+	Pinned(name string) bool
+}
+
+// Hider reports photos that must never be in the slideshow
+type Hider interface {
+	Hidden(name string) bool
+}
+
+// ShowHistory reports when a photo was last on screen
+// a zero time means it has never been shown
+type ShowHistory interface {
+	LastShown(name string) time.Time
+}
+
+// Capacity limits the slideshow directory, a zero max means no limit
+// evicted photos are moved to ArchiveDir and recorded in EvictionLog
+// photos Hidden reports are kept in the archive instead of being shown
+type Capacity struct {
+	MaxCount    int
+	MaxBytes    int64
+	Policy      string
+	KeepPinned  bool
+	ArchiveDir  string
+	EvictionLog string
+	Pins        Pinner
+	Hidden      Hider
+	History     ShowHistory
+}
+
+// Eviction records a photo rotated out of the slideshow, Archive is where
+// it went which has a new name when one by its name was already archived
+type Eviction struct {
+	Photo   string    `json:"photo"`
+	Archive string    `json:"archive"`
+	Policy  string    `json:"policy"`
+	Reason  string    `json:"reason"`
+	Time    time.Time `json:"time"`
+}
+
+// RenamedFrom is the photo's name in the slideshow when it was archived
+// under another one
+func (e Eviction) RenamedFrom() string {
+	if filepath.Base(e.Archive) == e.Photo {
+		return ""
+	}
+	return e.Photo
+}
+
+// limited is true when the capacity has something to enforce
+func (c Capacity) limited() bool {
+	return c.MaxCount > 0 || c.MaxBytes > 0
+}
+
+// ValidPolicy checks the policy name, empty means oldest first
+func ValidPolicy(policy string) bool {
+	switch policy {
+	case "", OldestFirst, LeastRecentlyShown, RandomEviction:
+		return true
+	}
+	return false
+}
+
+type stagedPhoto struct {
+	name     string
+	size     int64
+	modified time.Time
+}
+
+// listPhotos returns the photos in dir, skipping directories and dot files
+func listPhotos(dir string) ([]stagedPhoto, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	photos := []stagedPhoto{}
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		photos = append(photos, stagedPhoto{
+			name:     info.Name(),
+			size:     info.Size(),
+			modified: info.ModTime(),
+		})
+	}
+	return photos, nil
+}
+
+// enforceCapacity archives photos until the slideshow fits its limits
+// keep is never evicted, it is the photo that was just staged
+func (d *directoryStager) enforceCapacity(keep string) {
+	if !d.capacity.limited() {
+		return
+	}
+
+	photos, err := listPhotos(d.stageDir)
+	if err != nil {
+		fmt.Println("Unable to list slideshow", d.stageDir, "because", err.Error())
+		return
+	}
+
+	count := len(photos)
+	var total int64
+	for _, p := range photos {
+		total = total + p.size
+	}
+
+	candidates := []stagedPhoto{}
+	for _, p := range photos {
+		if p.name == keep {
+			continue
+		}
+		if d.capacity.KeepPinned && d.capacity.Pins != nil && d.capacity.Pins.Pinned(p.name) {
+			continue
+		}
+		candidates = append(candidates, p)
+	}
+	d.orderForEviction(candidates)
+
+	for _, p := range candidates {
+		reason := ""
+		if d.capacity.MaxCount > 0 && count > d.capacity.MaxCount {
+			reason = fmt.Sprintf("count %d over max %d", count, d.capacity.MaxCount)
+		} else if d.capacity.MaxBytes > 0 && total > d.capacity.MaxBytes {
+			reason = fmt.Sprintf("size %d over max %d bytes", total, d.capacity.MaxBytes)
+		}
+		if reason == "" {
+			break
+		}
+
+		if err := d.evict(p.name, reason); err != nil {
+			fmt.Println("Failed to evict", p.name, "because", err.Error())
+			continue
+		}
+		count = count - 1
+		total = total - p.size
+	}
+}
+
+// orderForEviction sorts photos so the first one is evicted first
+func (d *directoryStager) orderForEviction(photos []stagedPhoto) {
+	switch d.capacity.Policy {
+	case RandomEviction:
+		rand.Shuffle(len(photos), func(i, j int) {
+			photos[i], photos[j] = photos[j], photos[i]
+		})
+	case LeastRecentlyShown:
+		shown := func(p stagedPhoto) time.Time {
+			if d.capacity.History != nil {
+				if t := d.capacity.History.LastShown(p.name); !t.IsZero() {
+					return t
+				}
+			}
+			// never shown (or no history), fall back to when it arrived
+			return p.modified
+		}
+		sort.SliceStable(photos, func(i, j int) bool {
+			return shown(photos[i]).Before(shown(photos[j]))
+		})
+	default:
+		sort.SliceStable(photos, func(i, j int) bool {
+			return photos[i].modified.Before(photos[j].modified)
+		})
+	}
+}
+
+// evict moves a photo from the slideshow into the archive and records it,
+// it keeps its name so it can be restored unless another photo has it in
+// the archive, then it is renamed and the event is published under the
+// new name
+func (d *directoryStager) evict(name, reason string) error {
+	ext := filepath.Ext(name)
+	destination := naming.UniqueFileName(d.capacity.ArchiveDir, strings.TrimSuffix(name, ext), ext)
+	if err := os.Rename(filepath.Join(d.stageDir, name), destination); err != nil {
+		return err
+	}
+	archived := filepath.Base(destination)
+
+	policy := d.capacity.Policy
+	if policy == "" {
+		policy = OldestFirst
+	}
+	eviction := Eviction{
+		Photo:   name,
+		Archive: destination,
+		Policy:  policy,
+		Reason:  reason,
+		Time:    time.Now(),
+	}
+	fmt.Println("Evicted", name, "to", destination, "because", reason)
+
+	if d.capacity.EvictionLog != "" {
+		if err := appendEviction(d.capacity.EvictionLog, eviction); err != nil {
+			fmt.Println("Unable to record eviction of", name, "because", err.Error())
+		}
+	}
+
+	d.events.Publish(events.PhotoArchived, archived, eviction)
+	d.events.Publish(events.SlideshowChanged, name, map[string]string{"removed": name})
+	return nil
+}
+
+func appendEviction(file string, eviction Eviction) error {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := json.Marshal(eviction)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// ReadEvictions returns up to limit of the most recent evictions in the log, newest first
+func ReadEvictions(file string, limit int) ([]Eviction, error) {
+	result := []Eviction{}
+
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := Eviction{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		result = append(result, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// newest first
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
@@ -0,0 +1,202 @@
+package stager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type pinSet map[string]bool
+
+func (p pinSet) Pinned(name string) bool {
+	return p[name]
+}
+
+// writePhotos creates photos in dir, each one a minute newer than the last
+func writePhotos(t *testing.T, dir string, names ...string) {
+	start := time.Now().Add(-time.Hour)
+	for i, name := range names {
+		file := filepath.Join(dir, name)
+		require.Nil(t, ioutil.WriteFile(file, []byte("photo"), 0644))
+		modified := start.Add(time.Duration(i) * time.Minute)
+		require.Nil(t, os.Chtimes(file, modified, modified))
+	}
+}
+
+func remaining(t *testing.T, dir string) []string {
+	photos, err := listPhotos(dir)
+	require.Nil(t, err)
+	names := []string{}
+	for _, p := range photos {
+		names = append(names, p.name)
+	}
+	return names
+}
+
+func TestEnforceCapacityEvictsOldestUnpinned(t *testing.T) {
+	show := t.TempDir()
+	archive := t.TempDir()
+	log := filepath.Join(t.TempDir(), "evictions.jsonl")
+	writePhotos(t, show, "a.jpg", "b.jpg", "c.jpg", "d.jpg", "e.jpg")
+
+	bus := events.NewEventBus(10)
+	d := directoryStager{
+		stageDir: show,
+		events:   bus,
+		capacity: Capacity{
+			MaxCount:    3,
+			KeepPinned:  true,
+			Pins:        pinSet{"a.jpg": true},
+			ArchiveDir:  archive,
+			EvictionLog: log,
+		},
+	}
+	d.enforceCapacity("")
+
+	assert.Equal(t, []string{"a.jpg", "d.jpg", "e.jpg"}, remaining(t, show))
+	assert.Equal(t, []string{"b.jpg", "c.jpg"}, remaining(t, archive))
+
+	evictions, err := ReadEvictions(log, 10)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(evictions))
+	assert.Equal(t, "c.jpg", evictions[0].Photo)
+	assert.Equal(t, OldestFirst, evictions[0].Policy)
+}
+
+type history map[string]time.Time
+
+func (h history) LastShown(name string) time.Time {
+	return h[name]
+}
+
+func TestEnforceCapacityLeastRecentlyShown(t *testing.T) {
+	show := t.TempDir()
+	archive := t.TempDir()
+	writePhotos(t, show, "a.jpg", "b.jpg", "c.jpg")
+
+	d := directoryStager{
+		stageDir: show,
+		events:   events.NewEventBus(10),
+		capacity: Capacity{
+			MaxBytes:   10,
+			Policy:     LeastRecentlyShown,
+			ArchiveDir: archive,
+			History: history{
+				"a.jpg": time.Now(),
+				"b.jpg": time.Now().Add(-time.Minute),
+				"c.jpg": time.Now().Add(-2 * time.Minute),
+			},
+		},
+	}
+
+	// the just staged photo is never evicted
+	d.enforceCapacity("c.jpg")
+
+	assert.Equal(t, []string{"a.jpg", "c.jpg"}, remaining(t, show))
+	assert.Equal(t, []string{"b.jpg"}, remaining(t, archive))
+}
+
+type hideSet map[string]bool
+
+func (h hideSet) Hidden(name string) bool {
+	return h[name]
+}
+
+func TestHiddenPhotosStayInTheArchive(t *testing.T) {
+	inbox := t.TempDir()
+	show := t.TempDir()
+	archive := t.TempDir()
+	writePhotos(t, inbox, "secret.jpg", "public.jpg")
+	hidden := hideSet{"secret.jpg": true}
+
+	s := NewDirectoryStager(show, 5, events.NewEventBus(10), Capacity{ArchiveDir: archive, Hidden: hidden})
+	defer s.Stop()
+
+	s.StagePhoto(filepath.Join(inbox, "secret.jpg"))
+	s.StagePhoto(filepath.Join(inbox, "public.jpg"))
+	// requests run after anything already queued for staging
+	require.Nil(t, s.Sync([]string{"public.jpg", "secret.jpg"}, "test"))
+	assert.Equal(t, []string{"public.jpg"}, remaining(t, show))
+	assert.Equal(t, []string{"secret.jpg"}, remaining(t, archive))
+
+	// hiding a photo that is showing pulls it out straight away
+	hidden["public.jpg"] = true
+	require.Nil(t, s.Unstage("public.jpg", "hidden"))
+	assert.Empty(t, remaining(t, show))
+	assert.NotNil(t, s.Restore("public.jpg"))
+
+	delete(hidden, "public.jpg")
+	require.Nil(t, s.Restore("public.jpg"))
+	assert.Equal(t, []string{"public.jpg"}, remaining(t, show))
+}
+
+func TestEvictedPhotosKeepTheirNames(t *testing.T) {
+	show := t.TempDir()
+	archive := t.TempDir()
+	writePhotos(t, show, "a.jpg", "b.jpg")
+
+	s := NewDirectoryStager(show, 5, events.NewEventBus(10), Capacity{ArchiveDir: archive})
+	defer s.Stop()
+
+	// nothing selected leaves the slideshow alone
+	require.Nil(t, s.Sync([]string{}, "test"))
+	assert.Equal(t, []string{"a.jpg", "b.jpg"}, remaining(t, show))
+
+	require.Nil(t, s.Sync([]string{"b.jpg"}, "test"))
+	assert.Equal(t, []string{"b.jpg"}, remaining(t, show))
+	assert.Equal(t, []string{"a.jpg"}, remaining(t, archive))
+
+	require.Nil(t, s.Restore("a.jpg"))
+	assert.Equal(t, []string{"a.jpg", "b.jpg"}, remaining(t, show))
+}
+
+func TestEvictionsNeverOverwriteTheArchive(t *testing.T) {
+	show := t.TempDir()
+	archive := t.TempDir()
+	log := filepath.Join(t.TempDir(), "evictions.log")
+	writePhotos(t, show, "a.jpg")
+	writePhotos(t, archive, "a.jpg")
+	bus := events.NewEventBus(10)
+	feed := bus.Subscribe(0)
+	defer feed.Close()
+
+	s := NewDirectoryStager(show, 5, bus, Capacity{ArchiveDir: archive, EvictionLog: log})
+	defer s.Stop()
+
+	require.Nil(t, s.Unstage("a.jpg", "test"))
+	assert.Equal(t, []string{"a.jpg", "a_1.jpg"}, remaining(t, archive))
+
+	e := <-feed.Events()
+	assert.Equal(t, events.PhotoArchived, e.Type)
+	assert.Equal(t, "a_1.jpg", e.Photo)
+	assert.Equal(t, "a.jpg", e.Data.(Eviction).RenamedFrom())
+
+	evictions, err := ReadEvictions(log, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(evictions))
+	assert.Equal(t, filepath.Join(archive, "a_1.jpg"), evictions[0].Archive)
+}
+
+func TestStagedNamesAreUnusedInTheArchive(t *testing.T) {
+	inbox := t.TempDir()
+	show := t.TempDir()
+	archive := t.TempDir()
+	writePhotos(t, inbox, "a.jpg", "secret.jpg")
+	writePhotos(t, archive, "a.jpg")
+	writePhotos(t, show, "secret.jpg")
+
+	s := NewDirectoryStager(show, 5, events.NewEventBus(10), Capacity{ArchiveDir: archive, Hidden: hideSet{"secret.jpg": true}})
+	defer s.Stop()
+
+	s.StagePhoto(filepath.Join(inbox, "a.jpg"))
+	s.StagePhoto(filepath.Join(inbox, "secret.jpg"))
+	require.Nil(t, s.Sync([]string{}, "test"))
+	assert.Equal(t, []string{"a_1.jpg", "secret.jpg"}, remaining(t, show))
+	assert.Equal(t, []string{"a.jpg", "secret_1.jpg"}, remaining(t, archive))
+}
@@ -1,51 +1,77 @@
 package stager
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/blreynolds4/photopi-api/events"
 	"github.com/blreynolds4/photopi-api/naming"
 )
 
+// ErrStopped is returned for requests made after the stager stopped
+var ErrStopped = errors.New("stager is stopped")
+
 // Stager is a service that moves a file
 // from the provided path to the slide show dir
 type PhotoStager interface {
 	StagePhoto(source string) error
+	Sync(names []string, reason string) error
+	Unstage(name, reason string) error
+	Restore(name string) error
 	Stop()
 }
 
+// request is work done on the staging goroutine
+type request struct {
+	run  func() error
+	done chan error
+}
+
 type directoryStager struct {
 	stageDir  string
 	stageChan chan string
+	requests  chan request
+	stopped   chan bool
+	events    events.Publisher
+	capacity  Capacity
 }
 
-func NewDirectoryStager(stageDir string, bufferSize int) PhotoStager {
+// NewDirectoryStager moves photos into stageDir, rotating the oldest out to
+// the capacity's archive when the directory is over its limits
+func NewDirectoryStager(stageDir string, bufferSize int, publisher events.Publisher, capacity Capacity) PhotoStager {
 	stager := directoryStager{
 		stageDir:  stageDir,
 		stageChan: make(chan string, bufferSize),
+		requests:  make(chan request),
+		stopped:   make(chan bool),
+		events:    publisher,
+		capacity:  capacity,
 	}
 
 	go func() {
+		defer close(stager.stopped)
+
+		// bring an existing slideshow within its limits before staging more
+		stager.enforceCapacity("")
+
+		// staging and every other change to the slideshow happen here
+		// so they never race
 		for {
-			// more will be true if the
-			source, more := <-stager.stageChan
-			if more {
-				ext := filepath.Ext(source)
-				filename := filepath.Base(source)
-				// remove the extension
-				filename = strings.ReplaceAll(filename, ext, "")
-				destination := naming.UniqueFileName(stager.stageDir, filename, ext)
-				err := os.Rename(source, destination)
-				if err != nil {
-					// requeue the file for staging
-					fmt.Println("Failed to move ", source, "because", err.Error())
-					// failed staging will get requeued by another process
-					// doing it here is likely to create an infinite loop until
-					// the error is corrected
+			select {
+			case source, more := <-stager.stageChan:
+				if !more {
+					return
+				}
+				stager.stage(source)
+			case req := <-stager.requests:
+				// finish staging what is already queued so requests see it
+				for len(stager.stageChan) > 0 {
+					stager.stage(<-stager.stageChan)
 				}
-				fmt.Println("Staged", destination)
+				req.done <- req.run()
 			}
 		}
 	}()
@@ -53,11 +79,169 @@ func NewDirectoryStager(stageDir string, bufferSize int) PhotoStager {
 	return &stager
 }
 
+func (d *directoryStager) stage(source string) {
+	ext := filepath.Ext(source)
+	filename := filepath.Base(source)
+	// remove the extension
+	filename = strings.ReplaceAll(filename, ext, "")
+
+	// hidden photos are kept but go straight to the archive, either way the
+	// name is unused in both so it never collides as it moves between them
+	dir, other := d.stageDir, d.capacity.ArchiveDir
+	if d.hidden(filepath.Base(source)) {
+		dir, other = d.capacity.ArchiveDir, d.stageDir
+	}
+	others := []string{}
+	if other != "" {
+		others = append(others, other)
+	}
+	destination := naming.UniqueFileNameIn(dir, others, filename, ext)
+	err := os.Rename(source, destination)
+	if err != nil {
+		// requeue the file for staging
+		fmt.Println("Failed to move ", source, "because", err.Error())
+		// failed staging will get requeued by another process
+		// doing it here is likely to create an infinite loop until
+		// the error is corrected
+		d.events.Publish(events.PhotoFailed, filepath.Base(source), map[string]string{
+			"stage": "stage",
+			"error": err.Error(),
+		})
+		return
+	}
+	fmt.Println("Staged", destination)
+	name := filepath.Base(destination)
+	d.events.Publish(events.PhotoStaged, name, map[string]string{"source": filepath.Base(source)})
+	if dir != d.stageDir {
+		return
+	}
+	d.events.Publish(events.SlideshowChanged, name, map[string]string{"added": name})
+
+	d.enforceCapacity(name)
+}
+
+// sync moves photos between the archive and the slideshow so the slideshow
+// holds the named photos, pinned photos stay when the capacity keeps them
+// and no names at all leaves the slideshow as it is
+func (d *directoryStager) sync(names []string, reason string) error {
+	if len(names) == 0 {
+		d.enforceCapacity("")
+		return nil
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	photos, err := listPhotos(d.stageDir)
+	if err != nil {
+		return err
+	}
+
+	showing := make(map[string]bool)
+	for _, p := range photos {
+		showing[p.name] = true
+		if wanted[p.name] {
+			continue
+		}
+		if d.capacity.KeepPinned && d.capacity.Pins != nil && d.capacity.Pins.Pinned(p.name) {
+			continue
+		}
+		if err := d.evict(p.name, reason); err != nil {
+			fmt.Println("Failed to remove", p.name, "from the slideshow because", err.Error())
+		}
+	}
+
+	for _, name := range names {
+		if showing[name] {
+			continue
+		}
+		if err := d.restore(name); err != nil {
+			fmt.Println("Unable to add", name, "to the slideshow because", err.Error())
+		}
+	}
+
+	d.enforceCapacity("")
+	return nil
+}
+
+// restore moves a photo from the archive back into the slideshow
+func (d *directoryStager) restore(name string) error {
+	if d.hidden(name) {
+		return fmt.Errorf("%s is hidden", name)
+	}
+	err := os.Rename(filepath.Join(d.capacity.ArchiveDir, name), filepath.Join(d.stageDir, name))
+	if err != nil {
+		return err
+	}
+	fmt.Println("Restored", name, "to the slideshow")
+	d.events.Publish(events.SlideshowChanged, name, map[string]string{"added": name})
+	return nil
+}
+
+func (d *directoryStager) hidden(name string) bool {
+	return d.capacity.Hidden != nil && d.capacity.Hidden.Hidden(name)
+}
+
+// do runs the request on the staging goroutine and waits for it
+func (d *directoryStager) do(run func() error) error {
+	req := request{
+		run:  run,
+		done: make(chan error, 1),
+	}
+
+	select {
+	case d.requests <- req:
+		return <-req.done
+	case <-d.stopped:
+		return ErrStopped
+	}
+}
+
 func (d *directoryStager) StagePhoto(source string) error {
 	d.stageChan <- source
 	return nil
 }
 
+// Sync makes the slideshow hold the named photos, anything else is moved to
+// the archive and recorded as an eviction with the reason given, an empty
+// selection puts no limit on the slideshow
+func (d *directoryStager) Sync(names []string, reason string) error {
+	return d.do(func() error {
+		return d.sync(names, reason)
+	})
+}
+
+// Unstage takes a photo out of the slideshow now, it is archived and
+// recorded as an eviction with the reason given
+func (d *directoryStager) Unstage(name, reason string) error {
+	return d.do(func() error {
+		if _, err := os.Stat(filepath.Join(d.stageDir, name)); os.IsNotExist(err) {
+			// not in the slideshow, nothing to do
+			return nil
+		}
+		return d.evict(name, reason)
+	})
+}
+
+// Restore puts an archived photo back in the slideshow
+func (d *directoryStager) Restore(name string) error {
+	return d.do(func() error {
+		if _, err := os.Stat(filepath.Join(d.stageDir, name)); err == nil {
+			// already showing
+			return nil
+		}
+		if err := d.restore(name); err != nil {
+			return err
+		}
+		d.enforceCapacity(name)
+		return nil
+	})
+}
+
+// Stop stages the photos already queued before returning
 func (d *directoryStager) Stop() {
 	close(d.stageChan)
+	<-d.stopped
 }
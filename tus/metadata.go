@@ -0,0 +1,53 @@
+package tus
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ParseMetadata reads an Upload-Metadata header, comma separated keys each
+// with an optional base64 value
+func ParseMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		key := parts[0]
+		if key == "" {
+			return nil, fmt.Errorf("metadata keys can't be blank")
+		}
+		value := ""
+		if len(parts) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("metadata %s is not base64", key)
+			}
+			value = string(decoded)
+		}
+		metadata[key] = value
+	}
+	return metadata, nil
+}
+
+// FormatMetadata writes metadata as an Upload-Metadata header
+func FormatMetadata(metadata map[string]string) string {
+	keys := []string{}
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		if metadata[key] == "" {
+			pairs = append(pairs, key)
+			continue
+		}
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(metadata[key])))
+	}
+	return strings.Join(pairs, ",")
+}
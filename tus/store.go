@@ -0,0 +1,366 @@
+package tus
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version is the tus protocol version served
+const Version = "1.0.0"
+
+// how long an unfinished upload is kept before it is cleaned up
+const maxAge = 7 * 24 * time.Hour
+
+// how long a finished upload is remembered, so a client that missed the
+// last response can find out it finished instead of sending it again
+const finishedAge = 24 * time.Hour
+
+var (
+	// ErrNotFound is returned for an upload that doesn't exist
+	ErrNotFound = errors.New("upload not found")
+	// ErrOffset is returned when a chunk doesn't start where the upload ends
+	ErrOffset = errors.New("upload offset does not match")
+	// ErrBusy is returned while another chunk is being written
+	ErrBusy = errors.New("upload is busy")
+	// ErrTooLong is returned for a chunk that goes past the upload length
+	ErrTooLong = errors.New("chunk is longer than the upload")
+	// ErrChecksum is returned when a chunk doesn't match its checksum
+	ErrChecksum = errors.New("checksum mismatch")
+	// ErrAlgorithm is returned for a checksum algorithm that isn't supported
+	ErrAlgorithm = errors.New("unsupported checksum algorithm")
+	// ErrFinished is returned for an upload already handed on
+	ErrFinished = errors.New("upload is finished")
+)
+
+// Algorithms are the checksum algorithms chunks can be checked with
+var Algorithms = []string{"sha1", "md5", "sha256"}
+
+var validID = regexp.MustCompile(`^[a-f0-9]{32}$`)
+
+// Upload is an upload in progress, Offset is how much has arrived, once
+// Finished it has all arrived and Photos are where what it added went
+type Upload struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Offset   int64             `json:"-"`
+	Metadata map[string]string `json:"metadata"`
+	Created  time.Time         `json:"created"`
+	Finished *time.Time        `json:"finished,omitempty"`
+	Photos   []string          `json:"photos,omitempty"`
+}
+
+// Complete is true once every byte has arrived
+func (u Upload) Complete() bool {
+	return u.Offset == u.Length
+}
+
+// Store keeps partial uploads on disk until they are complete
+// Append writes a chunk at offset, checked against checksum when it isn't
+// blank, Open reads a complete upload, Finish drops its data but remembers
+// the photos it added for a day and Remove deletes it
+type Store interface {
+	Create(length int64, metadata map[string]string) (Upload, error)
+	Get(id string) (Upload, error)
+	Append(id string, offset int64, chunk io.Reader, checksum string) (Upload, error)
+	Open(id string) (*os.File, error)
+	Finish(id string, photos []string) (Upload, error)
+	Remove(id string) error
+}
+
+type dirStore struct {
+	dir  string
+	lock sync.Mutex
+	busy map[string]bool
+}
+
+// NewStore keeps uploads in dir, uploads left unfinished for a week and
+// finished ones older than a day are removed
+func NewStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0744); err != nil {
+		return nil, err
+	}
+	s := dirStore{
+		dir:  dir,
+		busy: make(map[string]bool),
+	}
+	s.clean(time.Now().Add(-maxAge), time.Now().Add(-finishedAge))
+	return &s, nil
+}
+
+func (s *dirStore) dataFile(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+func (s *dirStore) infoFile(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// Create starts an upload of length bytes
+func (s *dirStore) Create(length int64, metadata map[string]string) (Upload, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return Upload{}, err
+	}
+	upload := Upload{
+		ID:       hex.EncodeToString(b),
+		Length:   length,
+		Metadata: metadata,
+		Created:  time.Now(),
+	}
+
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return Upload{}, err
+	}
+	if err := ioutil.WriteFile(s.dataFile(upload.ID), nil, 0644); err != nil {
+		return Upload{}, err
+	}
+	if err := ioutil.WriteFile(s.infoFile(upload.ID), data, 0644); err != nil {
+		os.Remove(s.dataFile(upload.ID))
+		return Upload{}, err
+	}
+	return upload, nil
+}
+
+// Get returns the upload, its offset is how much of it is on disk
+func (s *dirStore) Get(id string) (Upload, error) {
+	if !validID.MatchString(id) {
+		return Upload{}, ErrNotFound
+	}
+	data, err := ioutil.ReadFile(s.infoFile(id))
+	if os.IsNotExist(err) {
+		return Upload{}, ErrNotFound
+	}
+	if err != nil {
+		return Upload{}, err
+	}
+	upload := Upload{}
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return Upload{}, err
+	}
+	if upload.Finished != nil {
+		if time.Since(*upload.Finished) > finishedAge {
+			return Upload{}, ErrNotFound
+		}
+		upload.Offset = upload.Length
+		return upload, nil
+	}
+
+	info, err := os.Stat(s.dataFile(id))
+	if os.IsNotExist(err) {
+		return Upload{}, ErrNotFound
+	}
+	if err != nil {
+		return Upload{}, err
+	}
+	upload.Offset = info.Size()
+	return upload, nil
+}
+
+// Append writes the chunk to the end of the upload, whatever arrives before
+// a dropped connection is kept unless the chunk has a checksum, then the
+// whole chunk must arrive and match
+func (s *dirStore) Append(id string, offset int64, chunk io.Reader, checksum string) (Upload, error) {
+	var sum hash.Hash
+	var expected []byte
+	if checksum != "" {
+		var err error
+		if sum, expected, err = parseChecksum(checksum); err != nil {
+			return Upload{}, err
+		}
+	}
+
+	if !s.claim(id) {
+		return Upload{}, ErrBusy
+	}
+	defer s.release(id)
+
+	upload, err := s.Get(id)
+	if err != nil {
+		return upload, err
+	}
+	if upload.Finished != nil {
+		return upload, ErrFinished
+	}
+	if offset != upload.Offset {
+		return upload, ErrOffset
+	}
+
+	f, err := os.OpenFile(s.dataFile(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return upload, err
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	if sum != nil {
+		w = io.MultiWriter(f, sum)
+	}
+	remaining := upload.Length - upload.Offset
+	written, err := io.Copy(w, io.LimitReader(chunk, remaining))
+	if err == nil && written == remaining {
+		// anything more than the upload needs is an error
+		var extra [1]byte
+		if n, _ := chunk.Read(extra[:]); n > 0 {
+			err = ErrTooLong
+		}
+	}
+	if err == nil && sum != nil && string(sum.Sum(nil)) != string(expected) {
+		err = ErrChecksum
+	}
+	if err != nil && (sum != nil || err == ErrTooLong) {
+		// the chunk is sent again in full
+		if terr := f.Truncate(upload.Offset); terr != nil {
+			fmt.Println("Unable to truncate upload", id, "because", terr.Error())
+		}
+		return upload, err
+	}
+
+	upload.Offset += written
+	return upload, err
+}
+
+// parseChecksum reads an Upload-Checksum header, the algorithm name and a
+// base64 digest
+func parseChecksum(checksum string) (hash.Hash, []byte, error) {
+	parts := strings.SplitN(strings.TrimSpace(checksum), " ", 2)
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("checksum must be an algorithm and a digest")
+	}
+	expected, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("checksum digest is not base64")
+	}
+	switch parts[0] {
+	case "sha1":
+		return sha1.New(), expected, nil
+	case "md5":
+		return md5.New(), expected, nil
+	case "sha256":
+		return sha256.New(), expected, nil
+	}
+	return nil, nil, ErrAlgorithm
+}
+
+// Open reads the upload's data
+func (s *dirStore) Open(id string) (*os.File, error) {
+	upload, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if upload.Finished != nil {
+		return nil, ErrFinished
+	}
+	return os.Open(s.dataFile(id))
+}
+
+// Finish records that a complete upload was handed on and what it added,
+// its data is no longer needed
+func (s *dirStore) Finish(id string, photos []string) (Upload, error) {
+	if !s.claim(id) {
+		return Upload{}, ErrBusy
+	}
+	defer s.release(id)
+
+	upload, err := s.Get(id)
+	if err != nil {
+		return upload, err
+	}
+	if upload.Finished != nil {
+		return upload, ErrFinished
+	}
+	if !upload.Complete() {
+		return upload, ErrOffset
+	}
+
+	now := time.Now()
+	upload.Finished = &now
+	upload.Photos = photos
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return upload, err
+	}
+	if err := ioutil.WriteFile(s.infoFile(id), data, 0644); err != nil {
+		return upload, err
+	}
+	if err := os.Remove(s.dataFile(id)); err != nil {
+		fmt.Println("Unable to remove finished upload", id, "because", err.Error())
+	}
+	return upload, nil
+}
+
+// Remove deletes the upload, finished or not
+func (s *dirStore) Remove(id string) error {
+	if _, err := s.Get(id); err != nil {
+		return err
+	}
+	if !s.claim(id) {
+		return ErrBusy
+	}
+	defer s.release(id)
+
+	if err := os.Remove(s.dataFile(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(s.infoFile(id))
+}
+
+func (s *dirStore) claim(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.busy[id] {
+		return false
+	}
+	s.busy[id] = true
+	return true
+}
+
+func (s *dirStore) release(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.busy, id)
+}
+
+// clean removes uploads last written before cutoff and finished ones,
+// which only have their info file, recorded before finishedCutoff
+func (s *dirStore) clean(cutoff, finishedCutoff time.Time) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		fmt.Println("Unable to clean uploads in", s.dir, "because", err.Error())
+		return
+	}
+	written := make(map[string]bool)
+	for _, info := range infos {
+		written[info.Name()] = true
+	}
+	for _, info := range infos {
+		if id := strings.TrimSuffix(info.Name(), ".json"); id != info.Name() && validID.MatchString(id) && !written[id] {
+			if info.ModTime().Before(finishedCutoff) {
+				os.Remove(s.infoFile(id))
+			}
+			continue
+		}
+		if !validID.MatchString(info.Name()) || info.ModTime().After(cutoff) {
+			continue
+		}
+		fmt.Println("Removing abandoned upload", info.Name())
+		os.Remove(s.infoFile(info.Name()))
+		os.Remove(s.dataFile(info.Name()))
+	}
+}
@@ -0,0 +1,99 @@
+package tus
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func checksum(data string) string {
+	sum := sha1.Sum([]byte(data))
+	return "sha1 " + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// dropped gives some data and then fails like a lost connection
+type dropped struct {
+	data string
+}
+
+func (d *dropped) Read(p []byte) (int, error) {
+	if d.data == "" {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, d.data)
+	d.data = d.data[n:]
+	return n, nil
+}
+
+func TestUploadsResumeWhereTheyStopped(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	require.Nil(t, err)
+
+	upload, err := store.Create(10, map[string]string{"filename": "beach.jpg"})
+	require.Nil(t, err)
+	assert.Equal(t, int64(0), upload.Offset)
+
+	// a dropped connection keeps what arrived
+	upload, err = store.Append(upload.ID, 0, &dropped{data: "0123"}, "")
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(4), upload.Offset)
+
+	_, err = store.Append(upload.ID, 0, strings.NewReader("0123"), "")
+	assert.Equal(t, ErrOffset, err)
+
+	// a chunk with a checksum is all or nothing
+	_, err = store.Append(upload.ID, 4, strings.NewReader("456789"), checksum("something else"))
+	assert.Equal(t, ErrChecksum, err)
+	upload, err = store.Get(upload.ID)
+	require.Nil(t, err)
+	assert.Equal(t, int64(4), upload.Offset)
+
+	_, err = store.Append(upload.ID, 4, strings.NewReader("456789!"), "")
+	assert.Equal(t, ErrTooLong, err)
+
+	upload, err = store.Append(upload.ID, 4, strings.NewReader("456789"), checksum("456789"))
+	require.Nil(t, err)
+	assert.True(t, upload.Complete())
+	assert.Equal(t, "beach.jpg", upload.Metadata["filename"])
+
+	f, err := store.Open(upload.ID)
+	require.Nil(t, err)
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	require.Nil(t, err)
+	assert.Equal(t, "0123456789", string(data))
+
+	// once handed on only the record of what it added is kept
+	_, err = store.Finish(upload.ID, []string{"/photos/beach.jpg"})
+	require.Nil(t, err)
+	upload, err = store.Get(upload.ID)
+	require.Nil(t, err)
+	assert.True(t, upload.Complete())
+	assert.Equal(t, []string{"/photos/beach.jpg"}, upload.Photos)
+	_, err = store.Append(upload.ID, 4, strings.NewReader("456789"), "")
+	assert.Equal(t, ErrFinished, err)
+	_, err = store.Open(upload.ID)
+	assert.Equal(t, ErrFinished, err)
+
+	require.Nil(t, store.Remove(upload.ID))
+	_, err = store.Get(upload.ID)
+	assert.Equal(t, ErrNotFound, err)
+	_, err = store.Get("../../etc/passwd")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestMetadataRoundTrips(t *testing.T) {
+	metadata, err := ParseMetadata("filename YmVhY2guanBn,tags aG9saWRheSxzdW4=,is_confidential")
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{"filename": "beach.jpg", "tags": "holiday,sun", "is_confidential": ""}, metadata)
+	assert.Equal(t, "filename YmVhY2guanBn,is_confidential,tags aG9saWRheSxzdW4=", FormatMetadata(metadata))
+
+	_, err = ParseMetadata("filename not-base64!")
+	assert.NotNil(t, err)
+}
@@ -5,4 +5,8 @@ export default axios.create({
   headers: {
     "Content-type": "application/json",
   },
+  // the API checks signed in browsers send back its CSRF cookie
+  withCredentials: true,
+  xsrfCookieName: "photopi_csrf",
+  xsrfHeaderName: "X-CSRF-Token",
 });
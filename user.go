@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/blreynolds4/photopi-api/users"
+)
+
+const userUsage = `Usage: photopi-api user <command>
+
+  add [-admin] <name>       add a user, the password is read from stdin
+  password <name>           change a user's password, read from stdin
+  remove <name>             remove a user and their tokens
+  list                      list the users
+  token [-name n] <name>    issue an API token for scripts and frames
+`
+
+// runUser manages who can sign in, it works on the same users file as the
+// server, which picks the changes up while running
+func runUser(args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, userUsage)
+		os.Exit(2)
+	}
+
+	s := loadSettings()
+	store, err := users.NewStore(filepath.Join(s.dataPath, "users.json"))
+	if err != nil {
+		fmt.Println("Unable to read users because", err.Error())
+		os.Exit(1)
+	}
+
+	flags := flag.NewFlagSet("user "+args[0], flag.ExitOnError)
+	isAdmin := flags.Bool("admin", false, "make the user an admin")
+	tokenName := flags.String("name", "", "what the token is for")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), userUsage)
+	}
+	flags.Parse(args[1:])
+	name := flags.Arg(0)
+	if args[0] != "list" && flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "add":
+		role := users.Member
+		if *isAdmin {
+			role = users.Admin
+		}
+		user, err := store.Add(name, readPassword(name), role)
+		exitOn(err)
+		fmt.Println("Added", user.Role, user.Name)
+	case "password":
+		exitOn(store.SetPassword(name, readPassword(name)))
+		fmt.Println("Changed the password for", users.Name(name))
+	case "remove":
+		exitOn(store.Delete(name))
+		fmt.Println("Removed", users.Name(name))
+	case "list":
+		for _, user := range store.List() {
+			fmt.Printf("%-20s %-8s %s\n", user.Name, user.Role, user.Created.Format("2006-01-02"))
+		}
+	case "token":
+		secret, _, err := store.IssueToken(name, *tokenName, 0, false)
+		exitOn(err)
+		fmt.Println(secret)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+}
+
+// readPassword reads a line from stdin, so it can be piped in
+func readPassword(name string) string {
+	fmt.Fprintf(os.Stderr, "Password for %s: ", users.Name(name))
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Println("Unable to read the password because", err.Error())
+		os.Exit(1)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+func exitOn(err error) {
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,456 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// roles, admins can do everything members can
+const (
+	Member = "member"
+	Admin  = "admin"
+)
+
+// shortest password accepted
+const minPassword = 8
+
+// tokens start with this so they are easy to spot in logs and scripts
+const tokenPrefix = "ppt_"
+
+// ErrNotFound is returned when there is no user with the name
+var ErrNotFound = errors.New("user not found")
+
+// ErrExists is returned when adding a user whose name is taken
+var ErrExists = errors.New("there is already a user with that name")
+
+// ErrBadLogin is returned for a wrong name or password, which one isn't said
+var ErrBadLogin = errors.New("wrong name or password")
+
+// ErrBadToken is returned for tokens that are unknown, revoked or expired
+var ErrBadToken = errors.New("token is not valid")
+
+// ErrTokenNotFound is returned when there is no token with the id
+var ErrTokenNotFound = errors.New("token not found")
+
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9._@-]{0,63}$`)
+
+// User is someone who can sign in, photos they add are attributed to Name
+type User struct {
+	Name    string    `json:"name"`
+	Role    string    `json:"role"`
+	Created time.Time `json:"created"`
+}
+
+// Can is true when the user has the role or one above it
+func (u User) Can(role string) bool {
+	return u.Role == Admin || u.Role == role
+}
+
+// Token lets a script or a signed in browser act as a user, only a hash of
+// the secret is kept, sessions are the tokens login hands out
+type Token struct {
+	ID      string     `json:"id"`
+	User    string     `json:"user"`
+	Name    string     `json:"name"`
+	Session bool       `json:"session,omitempty"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Store keeps the users and their tokens
+// Login checks a name and password and Authenticate a token's secret,
+// tokens are issued with an optional lifetime, 0 means they never expire
+type Store interface {
+	Add(name, password, role string) (User, error)
+	Get(name string) (User, error)
+	List() []User
+	Delete(name string) error
+	SetPassword(name, password string) error
+	Login(name, password string) (User, error)
+
+	IssueToken(user, name string, ttl time.Duration, session bool) (string, Token, error)
+	Authenticate(secret string) (User, Token, error)
+	Tokens(user string) []Token
+	Revoke(id string) error
+}
+
+// account is a user as saved, with their password hash
+type account struct {
+	User
+	Password string `json:"password"`
+}
+
+// savedToken is a token as saved, with the hash of its secret
+type savedToken struct {
+	Token
+	Hash string `json:"hash"`
+}
+
+type usersFile struct {
+	Users  []account    `json:"users"`
+	Tokens []savedToken `json:"tokens"`
+}
+
+type fileStore struct {
+	lock     sync.Mutex
+	file     string
+	modified time.Time
+	users    map[string]account
+	tokens   map[string]savedToken // by hash
+}
+
+// NewStore keeps users in file, changes made to it by another process,
+// such as the user command, are picked up
+func NewStore(file string) (Store, error) {
+	s := fileStore{file: file}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Name trims and lowercases a user name
+func Name(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+func (s *fileStore) Add(name, password, role string) (User, error) {
+	name = Name(name)
+	if !validName.MatchString(name) {
+		return User{}, fmt.Errorf("user names are letters, numbers and . _ @ -, up to 64 long")
+	}
+	if role != Member && role != Admin {
+		return User{}, fmt.Errorf("unknown role %q", role)
+	}
+	if err := checkNewPassword(password); err != nil {
+		return User{}, err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.refresh()
+
+	if _, ok := s.users[name]; ok {
+		return User{}, ErrExists
+	}
+	a := account{User: User{Name: name, Role: role, Created: time.Now()}, Password: hash}
+	s.users[name] = a
+	return a.User, s.save()
+}
+
+func (s *fileStore) Get(name string) (User, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.refresh()
+
+	a, ok := s.users[Name(name)]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return a.User, nil
+}
+
+func (s *fileStore) List() []User {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.refresh()
+
+	result := make([]User, 0, len(s.users))
+	for _, a := range s.users {
+		result = append(result, a.User)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// Delete removes the user and revokes their tokens, the last admin can't
+// be removed
+func (s *fileStore) Delete(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.refresh()
+
+	name = Name(name)
+	a, ok := s.users[name]
+	if !ok {
+		return ErrNotFound
+	}
+	if a.Role == Admin && s.admins() == 1 {
+		return fmt.Errorf("%s is the only admin", name)
+	}
+	delete(s.users, name)
+	for hash, t := range s.tokens {
+		if t.User == name {
+			delete(s.tokens, hash)
+		}
+	}
+	return s.save()
+}
+
+// SetPassword changes the password and signs the user out everywhere,
+// their API tokens keep working
+func (s *fileStore) SetPassword(name, password string) error {
+	if err := checkNewPassword(password); err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.refresh()
+
+	name = Name(name)
+	a, ok := s.users[name]
+	if !ok {
+		return ErrNotFound
+	}
+	a.Password = hash
+	s.users[name] = a
+	for h, t := range s.tokens {
+		if t.User == name && t.Session {
+			delete(s.tokens, h)
+		}
+	}
+	return s.save()
+}
+
+func (s *fileStore) Login(name, password string) (User, error) {
+	s.lock.Lock()
+	s.refresh()
+	a, ok := s.users[Name(name)]
+	s.lock.Unlock()
+
+	// hashing is slow, so it is done outside the lock, and for unknown
+	// names too so they take as long to turn down
+	if !ok {
+		unknownOnce.Do(func() {
+			unknownUser, _ = hashPassword("not a password")
+		})
+		checkPassword(unknownUser, password)
+		return User{}, ErrBadLogin
+	}
+	if !checkPassword(a.Password, password) {
+		return User{}, ErrBadLogin
+	}
+	return a.User, nil
+}
+
+// unknownUser is checked against when a name isn't found
+var unknownUser string
+var unknownOnce sync.Once
+
+// IssueToken creates a token for the user and returns its secret, which
+// can't be seen again
+func (s *fileStore) IssueToken(user, name string, ttl time.Duration, session bool) (string, Token, error) {
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", Token{}, err
+	}
+	secret := tokenPrefix + hex.EncodeToString(random)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.refresh()
+
+	user = Name(user)
+	if _, ok := s.users[user]; !ok {
+		return "", Token{}, ErrNotFound
+	}
+	t := Token{
+		ID:      newID(),
+		User:    user,
+		Name:    strings.TrimSpace(name),
+		Session: session,
+		Created: time.Now(),
+	}
+	if ttl > 0 {
+		expires := t.Created.Add(ttl)
+		t.Expires = &expires
+	}
+	s.tokens[hashToken(secret)] = savedToken{Token: t, Hash: hashToken(secret)}
+	return secret, t, s.save()
+}
+
+func (s *fileStore) Authenticate(secret string) (User, Token, error) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return User{}, Token{}, ErrBadToken
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.refresh()
+
+	t, ok := s.tokens[hashToken(secret)]
+	if !ok || t.expired(time.Now()) {
+		return User{}, Token{}, ErrBadToken
+	}
+	a, ok := s.users[t.User]
+	if !ok {
+		return User{}, Token{}, ErrBadToken
+	}
+	return a.User, t.Token, nil
+}
+
+// Tokens lists the user's unexpired tokens, newest first
+func (s *fileStore) Tokens(user string) []Token {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.refresh()
+
+	user = Name(user)
+	now := time.Now()
+	result := []Token{}
+	for _, t := range s.tokens {
+		if t.User == user && !t.expired(now) {
+			result = append(result, t.Token)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Created.After(result[j].Created)
+	})
+	return result
+}
+
+func (s *fileStore) Revoke(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.refresh()
+
+	for hash, t := range s.tokens {
+		if t.ID == id {
+			delete(s.tokens, hash)
+			return s.save()
+		}
+	}
+	return ErrTokenNotFound
+}
+
+func (t Token) expired(now time.Time) bool {
+	return t.Expires != nil && now.After(*t.Expires)
+}
+
+// admins counts the admins, the lock must be held
+func (s *fileStore) admins() int {
+	count := 0
+	for _, a := range s.users {
+		if a.Role == Admin {
+			count++
+		}
+	}
+	return count
+}
+
+// refresh reloads the file if something else changed it, the lock must be
+// held
+func (s *fileStore) refresh() {
+	info, err := os.Stat(s.file)
+	if err != nil || info.ModTime().Equal(s.modified) {
+		return
+	}
+	if err := s.load(); err != nil {
+		fmt.Println("Unable to reload users because", err.Error())
+	}
+}
+
+// load reads the file, a missing file is no users
+func (s *fileStore) load() error {
+	users := make(map[string]account)
+	tokens := make(map[string]savedToken)
+
+	data, err := ioutil.ReadFile(s.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		saved := usersFile{}
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return fmt.Errorf("reading users %s: %s", s.file, err.Error())
+		}
+		for _, a := range saved.Users {
+			users[a.Name] = a
+		}
+		for _, t := range saved.Tokens {
+			tokens[t.Hash] = t
+		}
+		if info, err := os.Stat(s.file); err == nil {
+			s.modified = info.ModTime()
+		}
+	}
+	s.users = users
+	s.tokens = tokens
+	return nil
+}
+
+// save writes the users out, dropping expired tokens, the lock must be held
+func (s *fileStore) save() error {
+	saved := usersFile{
+		Users:  make([]account, 0, len(s.users)),
+		Tokens: make([]savedToken, 0, len(s.tokens)),
+	}
+	for _, a := range s.users {
+		saved.Users = append(saved.Users, a)
+	}
+	sort.Slice(saved.Users, func(i, j int) bool {
+		return saved.Users[i].Name < saved.Users[j].Name
+	})
+	now := time.Now()
+	for hash, t := range s.tokens {
+		if t.expired(now) {
+			delete(s.tokens, hash)
+			continue
+		}
+		saved.Tokens = append(saved.Tokens, t)
+	}
+	sort.Slice(saved.Tokens, func(i, j int) bool {
+		return saved.Tokens[i].Created.Before(saved.Tokens[j].Created)
+	})
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// only this user can read the password hashes
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.file); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.file); err == nil {
+		s.modified = info.ModTime()
+	}
+	return nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,102 @@
+package users
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPBKDF2MatchesTheStandard(t *testing.T) {
+	// RFC 7914 section 11
+	key := pbkdf2([]byte("passwd"), []byte("salt"), 1, 64)
+	assert.Equal(t, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"+
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783", hex.EncodeToString(key))
+
+	key = pbkdf2([]byte("password"), []byte("salt"), 2, 32)
+	assert.Equal(t, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43", hex.EncodeToString(key))
+}
+
+func TestUsersLogInWithTheirPassword(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.json")
+	store, err := NewStore(file)
+	require.Nil(t, err)
+
+	_, err = store.Add("Nana", "short", Member)
+	assert.Error(t, err)
+	nana, err := store.Add(" Nana ", "correct horse", Member)
+	require.Nil(t, err)
+	assert.Equal(t, "nana", nana.Name)
+	_, err = store.Add("nana", "correct horse", Member)
+	assert.Equal(t, ErrExists, err)
+
+	user, err := store.Login("NANA", "correct horse")
+	require.Nil(t, err)
+	assert.Equal(t, nana, user)
+	_, err = store.Login("nana", "wrong horse")
+	assert.Equal(t, ErrBadLogin, err)
+	_, err = store.Login("grandpa", "correct horse")
+	assert.Equal(t, ErrBadLogin, err)
+
+	// passwords are never saved as given
+	data, err := ioutil.ReadFile(file)
+	require.Nil(t, err)
+	assert.NotContains(t, string(data), "correct horse")
+
+	// the file is read again when another process changes it
+	other, err := NewStore(file)
+	require.Nil(t, err)
+	_, err = other.Add("sam", "battery staple", Admin)
+	require.Nil(t, err)
+	assert.Len(t, store.List(), 2)
+}
+
+func TestTokensActAsTheirUser(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "users.json"))
+	require.Nil(t, err)
+	_, err = store.Add("sam", "battery staple", Admin)
+	require.Nil(t, err)
+	_, err = store.Add("nana", "correct horse", Member)
+	require.Nil(t, err)
+
+	secret, token, err := store.IssueToken("nana", "phone", 0, false)
+	require.Nil(t, err)
+	user, found, err := store.Authenticate(secret)
+	require.Nil(t, err)
+	assert.Equal(t, "nana", user.Name)
+	assert.Equal(t, token, found)
+	_, _, err = store.Authenticate(secret + "x")
+	assert.Equal(t, ErrBadToken, err)
+
+	// sessions expire and end when the password changes
+	session, _, err := store.IssueToken("nana", "browser", time.Hour, true)
+	require.Nil(t, err)
+	expired, _, err := store.IssueToken("nana", "old", time.Millisecond, true)
+	require.Nil(t, err)
+	time.Sleep(2 * time.Millisecond)
+	_, _, err = store.Authenticate(expired)
+	assert.Equal(t, ErrBadToken, err)
+	assert.Len(t, store.Tokens("nana"), 2)
+
+	require.Nil(t, store.SetPassword("nana", "new password"))
+	_, _, err = store.Authenticate(session)
+	assert.Equal(t, ErrBadToken, err)
+	_, _, err = store.Authenticate(secret)
+	assert.Nil(t, err)
+
+	require.Nil(t, store.Revoke(token.ID))
+	_, _, err = store.Authenticate(secret)
+	assert.Equal(t, ErrBadToken, err)
+
+	// removing a user ends their tokens, but the last admin stays
+	secret, _, err = store.IssueToken("nana", "phone", 0, false)
+	require.Nil(t, err)
+	require.Nil(t, store.Delete("nana"))
+	_, _, err = store.Authenticate(secret)
+	assert.Equal(t, ErrBadToken, err)
+	assert.Error(t, store.Delete("sam"))
+}
@@ -0,0 +1,448 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/events"
+)
+
+// headers sent with every delivery
+const (
+	SignatureHeader = "X-PhotoPi-Signature"
+	EventHeader     = "X-PhotoPi-Event"
+	DeliveryHeader  = "X-PhotoPi-Delivery"
+)
+
+// TestEvent is the event type sent by a test-fire
+const TestEvent = "webhook.test"
+
+// how many deliveries are kept in the log
+const deliveryLogSize = 200
+
+// ErrNotFound is returned for an unknown subscription id
+var ErrNotFound = errors.New("webhook not found")
+
+// LifecycleEvents are the event types a webhook can subscribe to
+var LifecycleEvents = []string{
+	events.PhotoReceived,
+	events.PhotoBackedUp,
+	events.PhotoStaged,
+	events.PhotoFailed,
+}
+
+// Subscription is a url that gets a signed POST for the events it wants
+// an empty event list means every lifecycle event
+type Subscription struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Secret  string    `json:"secret,omitempty"`
+	Events  []string  `json:"events"`
+	Active  bool      `json:"active"`
+	Created time.Time `json:"created"`
+}
+
+// Payload is the signed JSON body posted to a subscriber
+type Payload struct {
+	Delivery string      `json:"delivery"`
+	Event    string      `json:"event"`
+	Photo    string      `json:"photo,omitempty"`
+	Time     time.Time   `json:"time"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+// Delivery records the outcome of sending one event to one subscription
+type Delivery struct {
+	ID           string    `json:"id"`
+	Subscription string    `json:"subscription"`
+	Event        string    `json:"event"`
+	Photo        string    `json:"photo,omitempty"`
+	Attempts     int       `json:"attempts"`
+	StatusCode   int       `json:"statusCode,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Delivered    bool      `json:"delivered"`
+	Time         time.Time `json:"time"`
+}
+
+// Options tune how deliveries are sent, Drain is how long Stop waits for
+// deliveries in flight
+type Options struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	Timeout     time.Duration
+	Drain       time.Duration
+}
+
+// DefaultOptions are used by the service unless overridden
+var DefaultOptions = Options{
+	MaxAttempts: 5,
+	Backoff:     2 * time.Second,
+	Timeout:     10 * time.Second,
+	Drain:       15 * time.Second,
+}
+
+// Webhooks manages subscriptions and delivers pipeline events to them
+type Webhooks interface {
+	List() []Subscription
+	Get(id string) (Subscription, error)
+	Add(sub Subscription) (Subscription, error)
+	Delete(id string) error
+	Deliveries(id string) []Delivery
+	TestFire(id string) (Delivery, error)
+	Stop()
+}
+
+type webhookService struct {
+	lock       sync.Mutex
+	file       string
+	subs       map[string]Subscription
+	deliveries []Delivery
+	client     *http.Client
+	options    Options
+	done       chan bool
+	running    sync.WaitGroup
+}
+
+// NewWebhooks loads the subscriptions saved in file and starts delivering
+// events from the bus to them
+func NewWebhooks(file string, bus events.EventBus, options Options) (Webhooks, error) {
+	service := webhookService{
+		file:    file,
+		subs:    make(map[string]Subscription),
+		client:  &http.Client{Timeout: options.Timeout},
+		options: options,
+		done:    make(chan bool),
+	}
+
+	if err := service.load(); err != nil {
+		return nil, err
+	}
+
+	// subscribe before returning so no event published after this is missed
+	service.running.Add(1)
+	go service.listen(bus, bus.Subscribe(0))
+
+	return &service, nil
+}
+
+// Sign returns the signature header value for body using secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *webhookService) listen(bus events.EventBus, sub events.Subscription) {
+	defer s.running.Done()
+	var lastID uint64
+	for {
+		stopped := s.forward(sub, &lastID)
+		sub.Close()
+		if stopped {
+			return
+		}
+
+		sub = bus.Subscribe(lastID)
+		for _, e := range sub.Replay() {
+			lastID = e.ID
+			s.dispatch(e)
+		}
+	}
+}
+
+// forward dispatches events until the service stops (returns true) or the
+// bus drops the subscription for falling behind (returns false)
+func (s *webhookService) forward(sub events.Subscription, lastID *uint64) bool {
+	for {
+		select {
+		case <-s.done:
+			return true
+		case e, more := <-sub.Events():
+			if !more {
+				return false
+			}
+			*lastID = e.ID
+			s.dispatch(e)
+		}
+	}
+}
+
+func (s *webhookService) dispatch(e events.Event) {
+	for _, sub := range s.List() {
+		if sub.Active && sub.wants(e.Type) {
+			s.running.Add(1)
+			go func(sub Subscription, payload Payload) {
+				defer s.running.Done()
+				s.deliver(sub, payload, s.options.MaxAttempts)
+			}(sub, Payload{
+				Delivery: newID(),
+				Event:    e.Type,
+				Photo:    e.Photo,
+				Time:     e.Time,
+				Data:     e.Data,
+			})
+		}
+	}
+}
+
+func (sub Subscription) wants(eventType string) bool {
+	if len(sub.Events) == 0 {
+		return isLifecycleEvent(eventType)
+	}
+
+	for _, t := range sub.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func isLifecycleEvent(eventType string) bool {
+	for _, t := range LifecycleEvents {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver posts the payload, retrying with a growing backoff until it is
+// accepted, the attempts run out or the service stops, and logs the result
+func (s *webhookService) deliver(sub Subscription, payload Payload, attempts int) Delivery {
+	result := Delivery{
+		ID:           payload.Delivery,
+		Subscription: sub.ID,
+		Event:        payload.Event,
+		Photo:        payload.Photo,
+		Time:         time.Now(),
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		result.Error = err.Error()
+		s.record(result)
+		return result
+	}
+
+	wait := s.options.Backoff
+	for result.Attempts < attempts {
+		if result.Attempts > 0 {
+			select {
+			case <-s.done:
+				result.Error = "stopped before retrying, " + result.Error
+				result.Time = time.Now()
+				s.record(result)
+				return result
+			case <-time.After(wait):
+			}
+			wait = wait * 2
+		}
+		result.Attempts = result.Attempts + 1
+
+		status, err := s.post(sub, payload, body)
+		result.StatusCode = status
+		if err == nil {
+			result.Error = ""
+			result.Delivered = true
+			break
+		}
+		result.Error = err.Error()
+		fmt.Println("Webhook", sub.ID, "delivery", payload.Delivery, "attempt", result.Attempts, "failed:", err.Error())
+	}
+
+	result.Time = time.Now()
+	s.record(result)
+	return result
+}
+
+func (s *webhookService) post(sub Subscription, payload Payload, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, payload.Event)
+	req.Header.Set(DeliveryHeader, payload.Delivery)
+	req.Header.Set(SignatureHeader, Sign(sub.Secret, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (s *webhookService) record(d Delivery) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.deliveries = append(s.deliveries, d)
+	if len(s.deliveries) > deliveryLogSize {
+		s.deliveries = s.deliveries[len(s.deliveries)-deliveryLogSize:]
+	}
+}
+
+func (s *webhookService) List() []Subscription {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := make([]Subscription, 0, len(s.subs))
+	for _, sub := range s.subs {
+		result = append(result, sub)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Created.Before(result[j].Created)
+	})
+	return result
+}
+
+func (s *webhookService) Get(id string) (Subscription, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sub, ok := s.subs[id]
+	if !ok {
+		return sub, ErrNotFound
+	}
+	return sub, nil
+}
+
+func (s *webhookService) Add(sub Subscription) (Subscription, error) {
+	u, err := url.Parse(sub.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return sub, fmt.Errorf("webhook url must be an absolute http(s) url: %q", sub.URL)
+	}
+	for _, t := range sub.Events {
+		if !isLifecycleEvent(t) {
+			return sub, fmt.Errorf("unknown webhook event %q", t)
+		}
+	}
+
+	if sub.Secret == "" {
+		sub.Secret = newID() + newID()
+	}
+	sub.ID = newID()
+	sub.Created = time.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.subs[sub.ID] = sub
+	return sub, s.save()
+}
+
+func (s *webhookService) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.subs[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.subs, id)
+	return s.save()
+}
+
+func (s *webhookService) Deliveries(id string) []Delivery {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := []Delivery{}
+	for i := len(s.deliveries) - 1; i >= 0; i-- {
+		if id == "" || s.deliveries[i].Subscription == id {
+			result = append(result, s.deliveries[i])
+		}
+	}
+	return result
+}
+
+// TestFire sends a test event to the subscription and waits for the result,
+// it only makes a single attempt so the caller sees failures right away
+func (s *webhookService) TestFire(id string) (Delivery, error) {
+	sub, err := s.Get(id)
+	if err != nil {
+		return Delivery{}, err
+	}
+
+	return s.deliver(sub, Payload{
+		Delivery: newID(),
+		Event:    TestEvent,
+		Time:     time.Now(),
+		Data:     map[string]string{"message": "test delivery from photopi-api"},
+	}, 1), nil
+}
+
+// Stop ends deliveries and waits up to the Drain option for the ones in
+// flight, retries still waiting on their backoff give up
+func (s *webhookService) Stop() {
+	close(s.done)
+
+	finished := make(chan bool)
+	go func() {
+		s.running.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(s.options.Drain):
+		fmt.Println("Webhook deliveries still in flight after", s.options.Drain)
+	}
+}
+
+func (s *webhookService) load() error {
+	data, err := ioutil.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	subs := []Subscription{}
+	if err := json.Unmarshal(data, &subs); err != nil {
+		return fmt.Errorf("reading webhooks from %s: %s", s.file, err.Error())
+	}
+	for _, sub := range subs {
+		s.subs[sub.ID] = sub
+	}
+	return nil
+}
+
+// save writes the subscriptions out, the lock must be held
+func (s *webhookService) save() error {
+	subs := make([]Subscription, 0, len(s.subs))
+	for _, sub := range s.subs {
+		subs = append(subs, sub)
+	}
+
+	data, err := json.MarshalIndent(subs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.file, data, 0600)
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,174 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blreynolds4/photopi-api/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testOptions = Options{
+	MaxAttempts: 3,
+	Backoff:     time.Millisecond,
+	Timeout:     time.Second,
+	Drain:       time.Second,
+}
+
+// receiver is an httptest server that records the signed payloads it gets
+type receiver struct {
+	lock     sync.Mutex
+	server   *httptest.Server
+	payloads []Payload
+	failures int
+}
+
+func newReceiver(t *testing.T, secret string, failures int) *receiver {
+	r := &receiver{failures: failures}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		assert.Equal(t, Sign(secret, body), req.Header.Get(SignatureHeader))
+
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if r.failures > 0 {
+			r.failures = r.failures - 1
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		// the handler runs on the server's goroutine, so assert rather than require
+		p := Payload{}
+		if !assert.Nil(t, json.Unmarshal(body, &p)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.payloads = append(r.payloads, p)
+	}))
+	return r
+}
+
+func (r *receiver) received() []Payload {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Payload{}, r.payloads...)
+}
+
+func newTestWebhooks(t *testing.T, bus events.EventBus) Webhooks {
+	hooks, err := NewWebhooks(filepath.Join(t.TempDir(), "webhooks.json"), bus, testOptions)
+	require.Nil(t, err)
+	return hooks
+}
+
+func TestDeliversSubscribedEvents(t *testing.T) {
+	bus := events.NewEventBus(10)
+	hooks := newTestWebhooks(t, bus)
+	defer hooks.Stop()
+
+	r := newReceiver(t, "s3cret", 0)
+	defer r.server.Close()
+
+	sub, err := hooks.Add(Subscription{URL: r.server.URL, Secret: "s3cret", Events: []string{events.PhotoStaged}, Active: true})
+	require.Nil(t, err)
+
+	bus.Publish(events.PhotoReceived, "a.jpg", nil)
+	bus.Publish(events.PhotoStaged, "a.jpg", nil)
+
+	require.Eventually(t, func() bool { return len(hooks.Deliveries(sub.ID)) == 1 }, time.Second, time.Millisecond)
+	got := r.received()
+	require.Equal(t, 1, len(got))
+	assert.Equal(t, events.PhotoStaged, got[0].Event)
+	assert.Equal(t, "a.jpg", got[0].Photo)
+}
+
+func TestRetriesUntilDelivered(t *testing.T) {
+	bus := events.NewEventBus(10)
+	hooks := newTestWebhooks(t, bus)
+	defer hooks.Stop()
+
+	r := newReceiver(t, "retry", 2)
+	defer r.server.Close()
+
+	sub, err := hooks.Add(Subscription{URL: r.server.URL, Secret: "retry", Active: true})
+	require.Nil(t, err)
+
+	bus.Publish(events.PhotoBackedUp, "b.jpg", nil)
+
+	require.Eventually(t, func() bool { return len(hooks.Deliveries(sub.ID)) == 1 }, time.Second, time.Millisecond)
+	d := hooks.Deliveries(sub.ID)[0]
+	assert.True(t, d.Delivered)
+	assert.Equal(t, 3, d.Attempts)
+	assert.Equal(t, events.PhotoBackedUp, r.received()[0].Event)
+}
+
+func TestStopWaitsForDeliveriesInFlight(t *testing.T) {
+	bus := events.NewEventBus(10)
+	hooks := newTestWebhooks(t, bus)
+
+	arrived := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(arrived)
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer server.Close()
+	sub, err := hooks.Add(Subscription{URL: server.URL, Secret: "slow", Active: true})
+	require.Nil(t, err)
+
+	bus.Publish(events.PhotoStaged, "c.jpg", nil)
+	<-arrived
+	hooks.Stop()
+
+	deliveries := hooks.Deliveries(sub.ID)
+	require.Equal(t, 1, len(deliveries))
+	assert.True(t, deliveries[0].Delivered)
+}
+
+func TestTestFireMakesOneAttempt(t *testing.T) {
+	hooks := newTestWebhooks(t, events.NewEventBus(10))
+	defer hooks.Stop()
+
+	r := newReceiver(t, "down", 10)
+	defer r.server.Close()
+
+	sub, err := hooks.Add(Subscription{URL: r.server.URL, Secret: "down", Active: true})
+	require.Nil(t, err)
+
+	d, err := hooks.TestFire(sub.ID)
+	require.Nil(t, err)
+	assert.False(t, d.Delivered)
+	assert.Equal(t, 1, d.Attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, d.StatusCode)
+	assert.Equal(t, 1, len(hooks.Deliveries(sub.ID)))
+
+	_, err = hooks.TestFire("missing")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestSubscriptionsArePersisted(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "webhooks.json")
+	hooks, err := NewWebhooks(file, events.NewEventBus(1), testOptions)
+	require.Nil(t, err)
+	sub, err := hooks.Add(Subscription{URL: "http://example.com/hook", Active: true})
+	require.Nil(t, err)
+	assert.NotEmpty(t, sub.Secret)
+	hooks.Stop()
+
+	reloaded, err := NewWebhooks(file, events.NewEventBus(1), testOptions)
+	require.Nil(t, err)
+	defer reloaded.Stop()
+	got, err := reloaded.Get(sub.ID)
+	require.Nil(t, err)
+	assert.Equal(t, sub.URL, got.URL)
+	assert.Equal(t, sub.Secret, got.Secret)
+
+	_, err = reloaded.Add(Subscription{URL: "ftp://example.com"})
+	assert.NotNil(t, err)
+	_, err = reloaded.Add(Subscription{URL: "http://example.com", Events: []string{"nope"}})
+	assert.NotNil(t, err)
+}